@@ -0,0 +1,487 @@
+package lotusdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// backupMetaName is the file holding the manifest of the latest backup, see DB.Backup.
+	backupMetaName = "BACKUP"
+	// backupTempDirName is the directory of the checkpoint which the backup is taken from.
+	backupTempDirName = "BACKUP.temp"
+	// restoreMetaName is the file holding the id of the last backup restored to the directory, see Restore.
+	restoreMetaName = "RESTORE"
+
+	backupMagic   = "LOTUSBAK"
+	backupVersion = 1
+	// backupBlockSize is the size of the blocks compared between backups, only the changed blocks are written.
+	backupBlockSize = 1 << 20
+	// backupEndOfBlocks is written as the file index after the last block.
+	backupEndOfBlocks = math.MaxUint32
+	// backupMaxFiles and backupMaxPathSize bound the file list read from a backup before it is verified,
+	// so a corrupted backup can not allocate too much memory, see Restore.
+	backupMaxFiles    = 1 << 20
+	backupMaxPathSize = 4096
+)
+
+// BackupID identifies a backup written by DB.Backup, which the next incremental backup is based on.
+// The zero BackupID means no backup, a backup based on it is a full backup.
+type BackupID uint64
+
+// backupFile is a file in a backup.
+type backupFile struct {
+	path    string // path relative to the database directory, separated by slash.
+	dir     bool
+	size    int64
+	modTime int64
+	// hashes are the hashes of the blocks of the file, to find the changed blocks in the next backup.
+	hashes []uint64
+}
+
+// backupManifest is the manifest of the latest backup, stored in the database directory.
+type backupManifest struct {
+	id    BackupID
+	files map[string]*backupFile
+}
+
+// loadBackupManifest loads the manifest of the latest backup, an empty one is returned if there is no backup.
+// ErrBackupMetaCorrupted is returned if the manifest is truncated or corrupted.
+func loadBackupManifest(path string) (*backupManifest, error) {
+	manifest := &backupManifest{files: make(map[string]*backupFile)}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return manifest, nil
+		}
+		return nil, err
+	}
+	// read returns the next n bytes of the manifest, nil if there are not enough bytes.
+	read := func(n int) []byte {
+		if n < 0 || n > len(buf) {
+			return nil
+		}
+		next := buf[:n]
+		buf = buf[n:]
+		return next
+	}
+	header := read(12)
+	if header == nil {
+		return nil, ErrBackupMetaCorrupted
+	}
+	manifest.id = BackupID(binary.LittleEndian.Uint64(header))
+	count := binary.LittleEndian.Uint32(header[8:])
+	for i := 0; i < int(count); i++ {
+		size := read(4)
+		if size == nil {
+			return nil, ErrBackupMetaCorrupted
+		}
+		path := read(int(binary.LittleEndian.Uint32(size)))
+		meta := read(20)
+		if path == nil || meta == nil {
+			return nil, ErrBackupMetaCorrupted
+		}
+		file := &backupFile{
+			path:    string(path),
+			size:    int64(binary.LittleEndian.Uint64(meta)),
+			modTime: int64(binary.LittleEndian.Uint64(meta[8:])),
+		}
+		blocks := int(binary.LittleEndian.Uint32(meta[16:]))
+		hashes := read(blocks * 8)
+		if hashes == nil {
+			return nil, ErrBackupMetaCorrupted
+		}
+		file.hashes = make([]uint64, blocks)
+		for j := range file.hashes {
+			file.hashes[j] = binary.LittleEndian.Uint64(hashes[j*8:])
+		}
+		manifest.files[file.path] = file
+	}
+	if len(buf) > 0 {
+		return nil, ErrBackupMetaCorrupted
+	}
+	return manifest, nil
+}
+
+func (m *backupManifest) encode() []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(m.id))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(m.files)))
+	for _, file := range m.files {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(file.path)))
+		buf = append(buf, file.path...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(file.size))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(file.modTime))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(file.hashes)))
+		for _, hash := range file.hashes {
+			buf = binary.LittleEndian.AppendUint64(buf, hash)
+		}
+	}
+	return buf
+}
+
+// Backup writes a backup of the database to w, and returns its BackupID.
+//
+// If since is zero, it is a full backup which contains all the files of the database.
+// Otherwise, it is an incremental backup based on the backup since, which must be the latest one,
+// or ErrBackupNotFound is returned. It only contains the blocks changed after the backup since,
+// e.g. the new value log segments, the changed pages of the index and the wal of memtables.
+// The full backup and the incremental backups after it can be restored by Restore in order.
+//
+// The backup is taken from a checkpoint created in the database directory, see DB.Checkpoint,
+// so it is consistent, and the value log segments are hard linked instead of copied.
+// The files are compared block by block with the hashes of the latest backup kept in the database directory,
+// and the sealed files with the same size and modification time are unchanged without being read.
+// The backup is a stream of the file list, the changed blocks and a checksum, which is self-describing.
+// It returns ErrDatabaseReadOnly in read only mode, because the checkpoint and manifest are in the database directory.
+func (db *DB) Backup(w io.Writer, since BackupID) (BackupID, error) {
+	if db.options.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+	// the backups are based on the manifest of the latest one.
+	db.backupLock.Lock()
+	defer db.backupLock.Unlock()
+
+	metaPath := filepath.Join(db.options.DirPath, backupMetaName)
+	latest, err := loadBackupManifest(metaPath)
+	// a full backup does not need the manifest of the latest backup, the corrupted one is replaced by it.
+	// The ids of the new backups start from the current time, so the incremental backups
+	// based on the lost manifest can not be restored after them, see Restore.
+	if errors.Is(err, ErrBackupMetaCorrupted) && since == 0 {
+		latest = &backupManifest{id: BackupID(time.Now().UnixNano()), files: make(map[string]*backupFile)}
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	previous := &backupManifest{files: make(map[string]*backupFile)}
+	if since != 0 {
+		if since != latest.id {
+			return 0, ErrBackupNotFound
+		}
+		previous = latest
+	}
+
+	tempDir := filepath.Join(db.options.DirPath, backupTempDirName)
+	if err = os.RemoveAll(tempDir); err != nil {
+		return 0, err
+	}
+	if err = db.Checkpoint(tempDir); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	files, err := listBackupFiles(tempDir)
+	if err != nil {
+		return 0, err
+	}
+	current := &backupManifest{id: latest.id + 1, files: make(map[string]*backupFile)}
+
+	// the header: magic, version, id, since and the file list.
+	checksum := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, checksum))
+	header := append([]byte(backupMagic), backupVersion)
+	header = binary.LittleEndian.AppendUint64(header, uint64(current.id))
+	header = binary.LittleEndian.AppendUint64(header, uint64(since))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(files)))
+	for _, file := range files {
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(file.path)))
+		header = append(header, file.path...)
+		if file.dir {
+			header = append(header, 1)
+		} else {
+			header = append(header, 0)
+		}
+		header = binary.LittleEndian.AppendUint64(header, uint64(file.size))
+	}
+	if _, err = bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	// the changed blocks of the files.
+	buf := make([]byte, backupBlockSize)
+	for i, file := range files {
+		if file.dir {
+			continue
+		}
+		if err = writeBackupBlocks(bw, uint32(i), tempDir, file, previous.files[file.path], buf); err != nil {
+			return 0, err
+		}
+		current.files[file.path] = file
+	}
+	end := binary.LittleEndian.AppendUint32(nil, backupEndOfBlocks)
+	if _, err = bw.Write(end); err != nil {
+		return 0, err
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(binary.LittleEndian.AppendUint32(nil, checksum.Sum32())); err != nil {
+		return 0, err
+	}
+
+	// the backup is written, the next one can be based on it.
+	if err = writeMetaFile(metaPath, current.encode()); err != nil {
+		return 0, err
+	}
+	return current.id, nil
+}
+
+// listBackupFiles lists the files and directories in dir, the parents are listed before the children.
+func listBackupFiles(dir string) ([]*backupFile, error) {
+	var files []*backupFile
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		file := &backupFile{path: filepath.ToSlash(rel), dir: entry.IsDir()}
+		if !file.dir {
+			info, errInfo := entry.Info()
+			if errInfo != nil {
+				return errInfo
+			}
+			file.size, file.modTime = info.Size(), info.ModTime().UnixNano()
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// writeBackupBlocks writes the blocks of the file which are changed after the previous backup.
+// Each block is written as the file index, the offset, the length and the data.
+func writeBackupBlocks(w io.Writer, index uint32, dir string, file, previous *backupFile, buf []byte) error {
+	if previous != nil && previous.size == file.size && previous.modTime == file.modTime {
+		file.hashes = previous.hashes
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, 16)
+	for offset := int64(0); offset < file.size; offset += backupBlockSize {
+		block := buf[:min(backupBlockSize, file.size-offset)]
+		if _, err = io.ReadFull(f, block); err != nil {
+			return err
+		}
+		hash := xxhash.Sum64(block)
+		n := len(file.hashes)
+		file.hashes = append(file.hashes, hash)
+		if previous != nil && n < len(previous.hashes) && previous.hashes[n] == hash {
+			continue
+		}
+		binary.LittleEndian.PutUint32(header[0:4], index)
+		binary.LittleEndian.PutUint64(header[4:12], uint64(offset))
+		binary.LittleEndian.PutUint32(header[12:16], uint32(len(block)))
+		if _, err = w.Write(header); err != nil {
+			return err
+		}
+		if _, err = w.Write(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore restores a backup written by DB.Backup to the database directory dir.
+//
+// A full backup must be restored to a new or empty directory, or ErrRestoreDirNotEmpty is returned.
+// The incremental backups after it are restored to the same directory in order, ErrBackupChainBroken is returned
+// if the backup is not based on the last one restored to the directory.
+// The directory can be opened by Open after any backup is restored,
+// but no more incremental backups can be restored to it then, because the files are changed by the database.
+//
+// The files are changed in place, if Restore fails, e.g. the backup is truncated or corrupted,
+// the directory must be restored again from the full backup.
+func Restore(r io.Reader, dir string) error {
+	checksum := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, checksum)
+	read := func(size int) ([]byte, error) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, ErrInvalidBackup
+			}
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	header, err := read(len(backupMagic) + 21)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(backupMagic)]) != backupMagic || header[len(backupMagic)] != backupVersion {
+		return ErrInvalidBackup
+	}
+	header = header[len(backupMagic)+1:]
+	id := binary.LittleEndian.Uint64(header[0:8])
+	since := binary.LittleEndian.Uint64(header[8:16])
+	count := binary.LittleEndian.Uint32(header[16:20])
+	if count > backupMaxFiles {
+		return ErrInvalidBackup
+	}
+	files := make([]*backupFile, count)
+	listed := make(map[string]*backupFile, len(files))
+	for i := range files {
+		buf, errRead := read(4)
+		if errRead != nil {
+			return errRead
+		}
+		pathSize := binary.LittleEndian.Uint32(buf)
+		if pathSize > backupMaxPathSize {
+			return ErrInvalidBackup
+		}
+		if buf, errRead = read(int(pathSize) + 9); errRead != nil {
+			return errRead
+		}
+		file := &backupFile{path: string(buf[:len(buf)-9]), dir: buf[len(buf)-9] == 1}
+		file.size = int64(binary.LittleEndian.Uint64(buf[len(buf)-8:]))
+		if !filepath.IsLocal(filepath.FromSlash(file.path)) || file.size < 0 {
+			return ErrInvalidBackup
+		}
+		files[i] = file
+		listed[file.path] = file
+	}
+
+	// the backup must be based on the last one restored to the directory.
+	metaPath := filepath.Join(dir, restoreMetaName)
+	if since == 0 {
+		entries, errRead := os.ReadDir(dir)
+		if errRead != nil && !os.IsNotExist(errRead) {
+			return errRead
+		}
+		if len(entries) > 0 {
+			return ErrRestoreDirNotEmpty
+		}
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	} else {
+		buf, errRead := os.ReadFile(metaPath)
+		if errRead != nil && !os.IsNotExist(errRead) {
+			return errRead
+		}
+		if len(buf) != 8 || binary.LittleEndian.Uint64(buf) != since {
+			return ErrBackupChainBroken
+		}
+	}
+
+	// remove the files not in the backup, and truncate the others to their sizes.
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir || path == metaPath {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if file := listed[filepath.ToSlash(rel)]; file != nil && file.dir == entry.IsDir() {
+			return nil
+		}
+		if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.path))
+		if file.dir {
+			if err = os.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+		f, errOpen := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, defaultFileMode)
+		if errOpen != nil {
+			return errOpen
+		}
+		err = f.Truncate(file.size)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// write the changed blocks.
+	var current *os.File
+	var currentIndex uint32
+	closeCurrent := func() error {
+		if current == nil {
+			return nil
+		}
+		err := current.Sync()
+		if errClose := current.Close(); err == nil {
+			err = errClose
+		}
+		current = nil
+		return err
+	}
+	defer closeCurrent()
+	for {
+		buf, errRead := read(4)
+		if errRead != nil {
+			return errRead
+		}
+		index := binary.LittleEndian.Uint32(buf)
+		if index == backupEndOfBlocks {
+			break
+		}
+		if buf, errRead = read(12); errRead != nil {
+			return errRead
+		}
+		offset := int64(binary.LittleEndian.Uint64(buf[0:8]))
+		size := int64(binary.LittleEndian.Uint32(buf[8:12]))
+		if int(index) >= len(files) || files[index].dir || size > backupBlockSize ||
+			offset < 0 || offset+size > files[index].size {
+			return ErrInvalidBackup
+		}
+		block, errRead := read(int(size))
+		if errRead != nil {
+			return errRead
+		}
+		if current == nil || currentIndex != index {
+			if err = closeCurrent(); err != nil {
+				return err
+			}
+			path := filepath.Join(dir, filepath.FromSlash(files[index].path))
+			if current, err = os.OpenFile(path, os.O_WRONLY, defaultFileMode); err != nil {
+				return err
+			}
+			currentIndex = index
+		}
+		if _, err = current.WriteAt(block, offset); err != nil {
+			return err
+		}
+	}
+	if err = closeCurrent(); err != nil {
+		return err
+	}
+
+	// the checksum is not included in itself.
+	sum := checksum.Sum32()
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(br, buf); err != nil || binary.LittleEndian.Uint32(buf) != sum {
+		return ErrInvalidBackup
+	}
+	return writeMetaFile(metaPath, binary.LittleEndian.AppendUint64(nil, id))
+}
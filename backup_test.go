@@ -0,0 +1,165 @@
+package lotusdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBBackup(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-backup")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("key %d", i))
+			}
+			value := func(i, version int) []byte {
+				return []byte(fmt.Sprintf("value %d-%d", i, version))
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put(key(i), value(i, 0)))
+			}
+			db.flushMemtable(db.activeMem)
+			for i := 100; i < 150; i++ {
+				require.NoError(t, db.Put(key(i), value(i, 0)))
+			}
+
+			full := new(bytes.Buffer)
+			fullID, err := db.Backup(full, 0)
+			require.NoError(t, err)
+
+			// the changes are in the incremental backup, and nothing is changed in the next one.
+			for i := 0; i < 10; i++ {
+				require.NoError(t, db.Put(key(i), value(i, 1)))
+			}
+			require.NoError(t, db.Delete(key(10)))
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Compact())
+			require.NoError(t, db.Put(key(150), value(150, 0)))
+			incremental := new(bytes.Buffer)
+			incrementalID, err := db.Backup(incremental, fullID)
+			require.NoError(t, err)
+			unchanged := new(bytes.Buffer)
+			unchangedID, err := db.Backup(unchanged, incrementalID)
+			require.NoError(t, err)
+			assert.Less(t, unchanged.Len(), 4096)
+			_, err = db.Backup(new(bytes.Buffer), incrementalID)
+			require.ErrorIs(t, err, ErrBackupNotFound)
+
+			dir := filepath.Join(os.TempDir(), "db-test-backup-restore")
+			_ = os.RemoveAll(dir)
+			defer os.RemoveAll(dir)
+			require.ErrorIs(t, Restore(bytes.NewReader(incremental.Bytes()), dir), ErrBackupChainBroken)
+			require.NoError(t, Restore(bytes.NewReader(full.Bytes()), dir))
+			require.ErrorIs(t, Restore(bytes.NewReader(full.Bytes()), dir), ErrRestoreDirNotEmpty)
+			require.ErrorIs(t, Restore(bytes.NewReader(unchanged.Bytes()), dir), ErrBackupChainBroken)
+			truncated := incremental.Bytes()[:incremental.Len()-1]
+			require.ErrorIs(t, Restore(bytes.NewReader(truncated), dir), ErrInvalidBackup)
+			// the directory must be restored again from the full backup after a failure.
+			require.NoError(t, os.RemoveAll(dir))
+			require.NoError(t, Restore(bytes.NewReader(full.Bytes()), dir))
+			require.NoError(t, Restore(bytes.NewReader(incremental.Bytes()), dir))
+			require.NoError(t, Restore(bytes.NewReader(unchanged.Bytes()), dir))
+
+			restoredOptions := options
+			restoredOptions.DirPath = dir
+			restored, err := Open(restoredOptions)
+			require.NoError(t, err)
+			for i := 0; i <= 150; i++ {
+				v, errGet := restored.Get(key(i))
+				switch {
+				case i == 10:
+					require.ErrorIs(t, errGet, ErrKeyNotFound)
+				case i < 10:
+					require.NoError(t, errGet)
+					assert.Equal(t, value(i, 1), v)
+				default:
+					require.NoError(t, errGet)
+					assert.Equal(t, value(i, 0), v)
+				}
+			}
+			report, err := restored.Verify(context.Background(), VerifyOptions{})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			require.NoError(t, restored.Close())
+
+			// no more incremental backups can be restored once the directory is opened.
+			next := new(bytes.Buffer)
+			_, err = db.Backup(next, unchangedID)
+			require.NoError(t, err)
+			require.ErrorIs(t, Restore(bytes.NewReader(next.Bytes()), dir), ErrBackupChainBroken)
+		})
+	}
+}
+
+func TestDBBackupMetaCorrupted(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-backup-meta")
+	require.NoError(t, err)
+	options.DirPath = path
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+	}
+	full := new(bytes.Buffer)
+	fullID, err := db.Backup(full, 0)
+	require.NoError(t, err)
+
+	metaPath := filepath.Join(path, backupMetaName)
+	meta, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	for _, corrupted := range [][]byte{meta[:4], meta[:13], meta[:len(meta)-1], append(meta, 0)} {
+		require.NoError(t, os.WriteFile(metaPath, corrupted, defaultFileMode))
+		_, err = loadBackupManifest(metaPath)
+		require.ErrorIs(t, err, ErrBackupMetaCorrupted)
+		_, err = db.Backup(new(bytes.Buffer), fullID)
+		require.ErrorIs(t, err, ErrBackupMetaCorrupted)
+	}
+
+	// a full backup replaces the corrupted manifest, and the next incremental backup is based on it.
+	newFullID, err := db.Backup(new(bytes.Buffer), 0)
+	require.NoError(t, err)
+	assert.NotEqual(t, fullID+1, newFullID)
+	_, err = db.Backup(new(bytes.Buffer), newFullID)
+	require.NoError(t, err)
+}
+
+func TestRestoreCorruptedHeader(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "db-test-restore-corrupted")
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	header := func(count uint32) []byte {
+		buf := append([]byte(backupMagic), backupVersion)
+		buf = binary.LittleEndian.AppendUint64(buf, 1)
+		buf = binary.LittleEndian.AppendUint64(buf, 0)
+		return binary.LittleEndian.AppendUint32(buf, count)
+	}
+	// the file count and the path size are checked before allocating for them
+	require.ErrorIs(t, Restore(bytes.NewReader(header(math.MaxUint32)), dir), ErrInvalidBackup)
+	stream := binary.LittleEndian.AppendUint32(header(1), math.MaxUint32)
+	require.ErrorIs(t, Restore(bytes.NewReader(stream), dir), ErrInvalidBackup)
+	stream = binary.LittleEndian.AppendUint32(header(1), backupMaxPathSize)
+	require.ErrorIs(t, Restore(bytes.NewReader(stream), dir), ErrInvalidBackup)
+	_, err := os.Stat(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -1,8 +1,12 @@
 package lotusdb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/rosedblabs/diskhash"
@@ -18,14 +22,32 @@ import (
 // Batch is not a transaction, it does not guarantee isolation.
 // But it can guarantee atomicity, consistency and durability(if the Sync options is true).
 //
-// You must call Commit method to commit the batch, otherwise the DB will be locked.
+// You must call Commit or Discard method to finish the batch, otherwise the DB will be locked.
+//
+// Savepoints can be set by SetSavepoint, and RollbackToSavepoint will undo
+// all the writes in the batch after the latest savepoint.
 type Batch struct {
 	db            *DB
-	pendingWrites map[string]*LogRecord
+	pendingWrites map[string]*LogRecord // keyed by the family key of the records
 	options       BatchOptions
 	mu            sync.RWMutex
 	committed     bool
+	discarded     bool
+	released      bool // released is true if the DB lock held by the batch is released.
 	batchID       *snowflake.Node
+	snapshot      *Snapshot // snapshot to read from, nil means reading the latest data.
+	savepoints    []int     // savepoints are the lengths of undoLog when they are set.
+	undoLog       []undoEntry
+	rangeDeletes  []*LogRecord // range tombstones, see DeleteRange.
+}
+
+// undoEntry records the pending write of a key before it is overwritten,
+// a nil record means the key was not in pendingWrites.
+// If rangeDelete is true, it records a range tombstone added to the batch.
+type undoEntry struct {
+	key         string
+	record      *LogRecord
+	rangeDelete bool
 }
 
 // NewBatch creates a new Batch instance.
@@ -75,6 +97,12 @@ func (b *Batch) reset() {
 	b.db = nil
 	b.pendingWrites = nil
 	b.committed = false
+	b.discarded = false
+	b.released = false
+	b.snapshot = nil
+	b.savepoints = nil
+	b.undoLog = nil
+	b.rangeDeletes = nil
 }
 
 func (b *Batch) lock() {
@@ -94,9 +122,27 @@ func (b *Batch) unlock() {
 }
 
 // Put adds a key-value pair to the batch for writing.
+// The key will expire after the TTL in batch options, if it is set.
 func (b *Batch) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	return b.PutWithTTL(key, value, b.options.TTL)
+}
+
+// PutWithTTL adds a key-value pair with the specified ttl to the batch for writing.
+// The key will be invisible after the ttl, zero ttl means the key never expires.
+func (b *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return b.put(b.db.defaultFamily, key, value, ttl)
+}
+
+// PutCF adds a key-value pair of the column family to the batch for writing.
+// The key will expire after the TTL in batch options, if it is set.
+func (b *Batch) PutCF(cf *ColumnFamily, key []byte, value []byte) error {
+	return b.put(cf, key, value, b.options.TTL)
+}
+
+// put adds a key-value pair of the column family to the batch for writing.
+func (b *Batch) put(cf *ColumnFamily, key []byte, value []byte, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
 	}
 	if b.db.closed {
 		return ErrDBClosed
@@ -105,85 +151,146 @@ func (b *Batch) Put(key []byte, value []byte) error {
 		return ErrReadOnlyBatch
 	}
 
-	b.mu.Lock()
 	// write to pendingWrites
-	b.pendingWrites[string(key)] = &LogRecord{
-		Key:   key,
-		Value: value,
-		Type:  LogRecordNormal,
-	}
-	b.mu.Unlock()
-
-	return nil
+	return b.write(&LogRecord{
+		Key:          key,
+		Value:        value,
+		Type:         LogRecordNormal,
+		Expire:       expireAt(ttl),
+		ColumnFamily: cf.id,
+	})
 }
 
 // Get retrieves the value associated with a given key from the batch.
 func (b *Batch) Get(key []byte) ([]byte, error) {
+	return b.get(b.db.defaultFamily, key)
+}
+
+// GetCF retrieves the value associated with a given key of the column family from the batch.
+func (b *Batch) GetCF(cf *ColumnFamily, key []byte) ([]byte, error) {
+	return b.get(cf, key)
+}
+
+// get retrieves the value of the key in the column family.
+func (b *Batch) get(cf *ColumnFamily, key []byte) ([]byte, error) {
+	return b.getCtx(context.Background(), cf, key)
+}
+
+// getCtx retrieves the value of the key in the column family,
+// ctx is checked before reading the index and value log.
+//
+//nolint:gocognit
+func (b *Batch) getCtx(ctx context.Context, cf *ColumnFamily, key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
 	if b.db.closed {
 		return nil, ErrDBClosed
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// the merge operands from the newest to the oldest,
+	// they will be folded onto the value found in the older data.
+	var operands [][]byte
+	fkey := familyKey(cf.id, key)
 
 	// get from pendingWrites
 	if b.pendingWrites != nil {
 		b.mu.RLock()
-		if record := b.pendingWrites[string(key)]; record != nil {
-			if record.Type == LogRecordDeleted {
+		if record := b.pendingWrites[string(fkey)]; record != nil {
+			if record.Type == LogRecordDeleted || isExpired(record.Expire, time.Now().UnixNano()) {
 				b.mu.RUnlock()
 				return nil, ErrKeyNotFound
 			}
+			if record.Type != LogRecordMerge {
+				b.mu.RUnlock()
+				return record.Value, nil
+			}
+			operands = appendMergeOperands(operands, record.Value)
+		} else if b.isRangeDeleted(cf, key) {
 			b.mu.RUnlock()
-			return record.Value, nil
+			return nil, ErrKeyNotFound
 		}
 		b.mu.RUnlock()
 	}
 
 	// get from memtables
-	tables := b.db.getMemTables()
+	tables, readSeq, err := b.readView()
+	if err != nil {
+		return nil, err
+	}
 	for _, table := range tables {
-		deleted, value := table.get(key)
+		deleted, value, tableOperands := table.lookup(fkey, readSeq)
+		operands = append(operands, tableOperands...)
 		if deleted {
-			return nil, ErrKeyNotFound
+			return b.db.resolveValue(key, nil, operands)
 		}
 		if len(value) != 0 {
-			return value, nil
+			return b.db.resolveValue(key, value, operands)
 		}
 	}
 
 	// get from index
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 	var value []byte
 	var matchKey func(diskhash.Slot) (bool, error)
-	if b.db.options.IndexType == Hash {
-		matchKey = MatchKeyFunc(b.db, key, nil, &value)
+	if cf.options.IndexType == Hash {
+		matchKey = matchKeyFunc(cf.vlog, key, nil, &value)
 	}
 
-	position, err := b.db.index.Get(key, matchKey)
+	position, err := cf.index.Get(key, matchKey)
 	if err != nil {
 		return nil, err
 	}
 
-	if b.db.options.IndexType == Hash {
-		if value == nil {
-			return nil, ErrKeyNotFound
+	// the index entry is overwritten after the snapshot is created, read the kept one.
+	if b.snapshot != nil {
+		if keptPos, ok := b.snapshot.keptPosition(fkey); ok {
+			if keptPos == nil || isExpired(keptPos.expire, time.Now().UnixNano()) {
+				return b.db.resolveValue(key, nil, operands)
+			}
+			record, errRead := cf.vlog.read(keptPos)
+			if errRead != nil {
+				return nil, errRead
+			}
+			return b.db.resolveValue(key, record.value, operands)
 		}
-		return value, nil
 	}
-	if position == nil {
-		return nil, ErrKeyNotFound
+
+	if cf.options.IndexType == Hash {
+		return b.db.resolveValue(key, value, operands)
+	}
+	if position == nil || isExpired(position.expire, time.Now().UnixNano()) {
+		return b.db.resolveValue(key, nil, operands)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
 	}
-	record, err := b.db.vlog.read(position)
+	record, err := cf.vlog.read(position)
 	if err != nil {
 		return nil, err
 	}
-	return record.value, nil
+	return b.db.resolveValue(key, record.value, operands)
 }
 
 // Delete marks a key for deletion in the batch.
 func (b *Batch) Delete(key []byte) error {
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
+	return b.delete(b.db.defaultFamily, key)
+}
+
+// DeleteCF marks a key of the column family for deletion in the batch.
+func (b *Batch) DeleteCF(cf *ColumnFamily, key []byte) error {
+	return b.delete(cf, key)
+}
+
+// delete marks a key of the column family for deletion.
+func (b *Batch) delete(cf *ColumnFamily, key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
 	}
 	if b.db.closed {
 		return ErrDBClosed
@@ -192,61 +299,311 @@ func (b *Batch) Delete(key []byte) error {
 		return ErrReadOnlyBatch
 	}
 
+	return b.write(&LogRecord{
+		Key:          key,
+		Type:         LogRecordDeleted,
+		ColumnFamily: cf.id,
+	})
+}
+
+// Merge adds a merge operand of the key to the batch for writing, see DB.Merge.
+// The operand will expire after the TTL in batch options, if it is set,
+// see ColumnFamily.MergeWithOptions for the expiration time of the merged value.
+func (b *Batch) Merge(key []byte, operand []byte) error {
+	return b.merge(b.db.defaultFamily, key, operand)
+}
+
+// MergeCF adds a merge operand of the key of the column family to the batch for writing.
+func (b *Batch) MergeCF(cf *ColumnFamily, key []byte, operand []byte) error {
+	return b.merge(cf, key, operand)
+}
+
+// merge adds a merge operand of the key of the column family.
+func (b *Batch) merge(cf *ColumnFamily, key []byte, operand []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+	if b.db.options.MergeOperator == nil {
+		return ErrMergeOperatorNotSet
+	}
+
 	b.mu.Lock()
-	b.pendingWrites[string(key)] = &LogRecord{
-		Key:  key,
-		Type: LogRecordDeleted,
+	defer b.mu.Unlock()
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	record := &LogRecord{
+		Key:          key,
+		Value:        encodeMergeOperands([][]byte{operand}),
+		Type:         LogRecordMerge,
+		Expire:       expireAt(b.options.TTL),
+		ColumnFamily: cf.id,
+	}
+	// a batch holds a single record for each key, combine it with the pending one.
+	if pending := b.pendingWrites[string(familyKey(cf.id, key))]; pending != nil {
+		var err error
+		if record, err = b.db.combineMerge(pending, record); err != nil {
+			return err
+		}
+	}
+	b.addPendingWrite(record)
+	return nil
+}
+
+// DeleteRange marks all the keys in [start, end) for deletion in the batch,
+// a nil end means all the keys not less than start, see DB.DeleteRange.
+// The keys written to the batch after DeleteRange are not deleted.
+func (b *Batch) DeleteRange(start, end []byte) error {
+	return b.deleteRange(b.db.defaultFamily, start, end)
+}
+
+// DeleteRangeCF marks all the keys of the column family in [start, end) for deletion in the batch.
+func (b *Batch) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	return b.deleteRange(cf, start, end)
+}
+
+// deleteRange marks all the keys of the column family in [start, end) for deletion.
+func (b *Batch) deleteRange(cf *ColumnFamily, start, end []byte) error {
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+	if cf.options.IndexType == Hash {
+		return ErrRangeDeleteUnsupportedTypeHASH
+	}
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return nil
 	}
-	b.mu.Unlock()
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	// the pending writes in the range are deleted
+	for key, record := range b.pendingWrites {
+		if record.ColumnFamily != cf.id || !keyInRange(record.Key, start, end) {
+			continue
+		}
+		if len(b.savepoints) > 0 {
+			b.undoLog = append(b.undoLog, undoEntry{key: key, record: record})
+		}
+		delete(b.pendingWrites, key)
+	}
+	if len(b.savepoints) > 0 {
+		b.undoLog = append(b.undoLog, undoEntry{rangeDelete: true})
+	}
+	if start == nil {
+		start = []byte{}
+	}
+	b.rangeDeletes = append(b.rangeDeletes, &LogRecord{
+		Key:          start,
+		Value:        end,
+		Type:         LogRecordRangeDeleted,
+		ColumnFamily: cf.id,
+	})
+	return nil
+}
+
+// isRangeDeleted checks whether the key of the column family is deleted
+// by the range tombstones in the batch, must be called with b.mu held.
+func (b *Batch) isRangeDeleted(cf *ColumnFamily, key []byte) bool {
+	for _, record := range b.rangeDeletes {
+		if record.ColumnFamily != cf.id {
+			continue
+		}
+		end := record.Value
+		if len(end) == 0 {
+			end = nil
+		}
+		if keyInRange(key, record.Key, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// write adds the record to pendingWrites.
+func (b *Batch) write(record *LogRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	b.addPendingWrite(record)
+	return nil
+}
+
+// addPendingWrite adds the record to pendingWrites, must be called with b.mu held.
+// The overwritten one is recorded in undoLog if there is any savepoint.
+func (b *Batch) addPendingWrite(record *LogRecord) {
+	key := string(familyKey(record.ColumnFamily, record.Key))
+	if len(b.savepoints) > 0 {
+		b.undoLog = append(b.undoLog, undoEntry{
+			key:    key,
+			record: b.pendingWrites[key],
+		})
+	}
+	b.pendingWrites[key] = record
+}
+
+// SetSavepoint marks the current state of the batch,
+// which can be restored by RollbackToSavepoint.
+// Savepoints can be nested, RollbackToSavepoint restores the latest one.
+func (b *Batch) SetSavepoint() error {
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	b.savepoints = append(b.savepoints, len(b.undoLog))
+	return nil
+}
+
+// RollbackToSavepoint undoes all the writes after the latest savepoint, and removes the savepoint.
+// It will return ErrNoSavepoint if there is no savepoint in the batch.
+func (b *Batch) RollbackToSavepoint() error {
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discarded {
+		return ErrBatchDiscarded
+	}
+	if len(b.savepoints) == 0 {
+		return ErrNoSavepoint
+	}
+	savepoint := b.savepoints[len(b.savepoints)-1]
+	b.savepoints = b.savepoints[:len(b.savepoints)-1]
+
+	// undo the writes in reverse order
+	for i := len(b.undoLog) - 1; i >= savepoint; i-- {
+		entry := b.undoLog[i]
+		if entry.rangeDelete {
+			b.rangeDeletes = b.rangeDeletes[:len(b.rangeDeletes)-1]
+		} else if entry.record == nil {
+			delete(b.pendingWrites, entry.key)
+		} else {
+			b.pendingWrites[entry.key] = entry.record
+		}
+	}
+	b.undoLog = b.undoLog[:savepoint]
 	return nil
 }
 
+// Discard drops all the pending writes and releases the DB lock held by the batch.
+// It is safe to call Discard after Commit, it does nothing in this case.
+func (b *Batch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released {
+		return
+	}
+	b.discarded = true
+	b.released = true
+	b.pendingWrites = nil
+	b.savepoints = nil
+	b.undoLog = nil
+	b.rangeDeletes = nil
+	b.unlock()
+}
+
 // Exist checks if the key exists in the database.
 func (b *Batch) Exist(key []byte) (bool, error) {
+	return b.exist(b.db.defaultFamily, key)
+}
+
+// ExistCF checks if the key exists in the column family.
+func (b *Batch) ExistCF(cf *ColumnFamily, key []byte) (bool, error) {
+	return b.exist(cf, key)
+}
+
+// exist checks if the key exists in the column family.
+func (b *Batch) exist(cf *ColumnFamily, key []byte) (bool, error) {
 	if len(key) == 0 {
 		return false, ErrKeyIsEmpty
 	}
 	if b.db.closed {
 		return false, ErrDBClosed
 	}
+	fkey := familyKey(cf.id, key)
 
 	// check if the key exists in pendingWrites
 	if b.pendingWrites != nil {
 		b.mu.RLock()
-		if record := b.pendingWrites[string(key)]; record != nil {
+		if record := b.pendingWrites[string(fkey)]; record != nil {
 			b.mu.RUnlock()
-			return record.Type != LogRecordDeleted, nil
+			return record.Type != LogRecordDeleted && !isExpired(record.Expire, time.Now().UnixNano()), nil
+		}
+		if b.isRangeDeleted(cf, key) {
+			b.mu.RUnlock()
+			return false, nil
 		}
 		b.mu.RUnlock()
 	}
 
-	// get from memtables
-	tables := b.db.getMemTables()
+	// get from memtables, a key with merge operands always exists.
+	tables, readSeq, err := b.readView()
+	if err != nil {
+		return false, err
+	}
 	for _, table := range tables {
-		deleted, value := table.get(key)
+		deleted, value, operands := table.lookup(fkey, readSeq)
+		if len(operands) != 0 || len(value) != 0 {
+			return true, nil
+		}
 		if deleted {
 			return false, nil
 		}
-		if len(value) != 0 {
-			return true, nil
-		}
 	}
 
 	// check if the key exists in index
 	var value []byte
-	var matchKeyFunc func(diskhash.Slot) (bool, error)
-	if b.db.options.IndexType == Hash {
-		matchKeyFunc = MatchKeyFunc(b.db, key, nil, &value)
+	var matchKey func(diskhash.Slot) (bool, error)
+	if cf.options.IndexType == Hash {
+		matchKey = matchKeyFunc(cf.vlog, key, nil, &value)
 	}
-	pos, err := b.db.index.Get(key, matchKeyFunc)
+	pos, err := cf.index.Get(key, matchKey)
 	if err != nil {
 		return false, err
 	}
-	if b.db.options.IndexType == Hash {
+
+	// the index entry is overwritten after the snapshot is created, check the kept one.
+	if b.snapshot != nil {
+		if keptPos, ok := b.snapshot.keptPosition(fkey); ok {
+			return keptPos != nil && !isExpired(keptPos.expire, time.Now().UnixNano()), nil
+		}
+	}
+	if cf.options.IndexType == Hash {
 		return value != nil, nil
 	}
-	return pos != nil, nil
+	return pos != nil && !isExpired(pos.expire, time.Now().UnixNano()), nil
+}
+
+// readView returns the memtables and the sequence number visible to the batch.
+// If the batch reads from a snapshot, it returns the memtables pinned by the snapshot.
+func (b *Batch) readView() ([]*memtable, uint64, error) {
+	if b.snapshot == nil {
+		return b.db.getMemTables(), math.MaxUint64, nil
+	}
+	b.snapshot.mu.RLock()
+	defer b.snapshot.mu.RUnlock()
+	if b.snapshot.released() {
+		return nil, 0, ErrSnapshotReleased
+	}
+	return b.snapshot.memtables, b.snapshot.seq, nil
 }
 
 // Commit commits the batch, if the batch is readonly or empty, it will return directly.
@@ -255,14 +612,35 @@ func (b *Batch) Exist(key []byte) (bool, error) {
 // then write a record to indicate the end of the batch to guarantee atomicity.
 // Finally, it will write the index.
 func (b *Batch) Commit() error {
+	return b.CommitCtx(context.Background())
+}
+
+// CommitCtx commits the batch like Commit, but gives up if ctx is done before the batch is written,
+// including waiting for the memtable space, the error of ctx is returned in this case.
+// The batch can not be committed again after CommitCtx returns, whether it succeeds or not.
+func (b *Batch) CommitCtx(ctx context.Context) error {
+	b.mu.Lock()
+	if b.discarded {
+		b.mu.Unlock()
+		return ErrBatchDiscarded
+	}
+	if b.released {
+		b.mu.Unlock()
+		return ErrBatchCommitted
+	}
+	b.released = true
+	b.mu.Unlock()
 	defer b.unlock()
 	if b.db.closed {
 		return ErrDBClosed
 	}
 
-	if b.options.ReadOnly || len(b.pendingWrites) == 0 {
+	if b.options.ReadOnly || (len(b.pendingWrites) == 0 && len(b.rangeDeletes) == 0) {
 		return nil
 	}
+	if b.db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -273,16 +651,23 @@ func (b *Batch) Commit() error {
 	}
 
 	// wait for memtable space
-	if err := b.db.waitMemtableSpace(); err != nil {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.db.waitMemtableSpace(ctx); err != nil {
 		return err
 	}
 	batchID := b.batchID.Generate()
+	// every committed batch gets a new sequence number, which is the version of its keys
+	seq := b.db.seq + 1
 	// call memtable put batch
-	err := b.db.activeMem.putBatch(b.pendingWrites, batchID, b.options.WriteOptions)
+	err := b.db.activeMem.putBatch(b.pendingWrites, batchID, seq, b.options.WriteOptions, b.rangeDeletes...)
 	if err != nil {
 		return err
 	}
 
+	b.db.seq = seq
+	b.db.oracle.recordCommit(b.pendingWrites, b.rangeDeletes, seq)
 	b.committed = true
 	return nil
 }
@@ -0,0 +1,140 @@
+package lotusdb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchDiscard(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-batch-discard")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1")))
+	batch.Discard()
+	// discard twice is safe
+	batch.Discard()
+	require.ErrorIs(t, batch.Put([]byte("key 2"), []byte("value 2")), ErrBatchDiscarded)
+	require.ErrorIs(t, batch.Commit(), ErrBatchDiscarded)
+
+	// the db lock is released
+	_, err = db.Get([]byte("key 1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Put([]byte("key 2"), []byte("value 2")))
+
+	// discard after commit does nothing
+	batch = db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 3"), []byte("value 3")))
+	require.NoError(t, batch.Commit())
+	batch.Discard()
+	require.ErrorIs(t, batch.Commit(), ErrBatchCommitted)
+	value, err := db.Get([]byte("key 3"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 3"), value)
+
+	// discard a readonly batch
+	batch = db.NewBatch(BatchOptions{ReadOnly: true})
+	value, err = batch.Get([]byte("key 2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 2"), value)
+	batch.Discard()
+	require.NoError(t, db.Put([]byte("key 4"), []byte("value 4")))
+}
+
+func TestBatchSavepoint(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-batch-savepoint")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.ErrorIs(t, batch.RollbackToSavepoint(), ErrNoSavepoint)
+
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1")))
+	require.NoError(t, batch.SetSavepoint())
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1 new")))
+	require.NoError(t, batch.Put([]byte("key 2"), []byte("value 2")))
+
+	require.NoError(t, batch.SetSavepoint())
+	require.NoError(t, batch.Delete([]byte("key 2")))
+	require.NoError(t, batch.Put([]byte("key 3"), []byte("value 3")))
+
+	// rollback to the second savepoint
+	require.NoError(t, batch.RollbackToSavepoint())
+	value, err := batch.Get([]byte("key 2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 2"), value)
+	_, err = batch.Get([]byte("key 3"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// rollback to the first savepoint
+	require.NoError(t, batch.RollbackToSavepoint())
+	value, err = batch.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1"), value)
+	_, err = batch.Get([]byte("key 2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.ErrorIs(t, batch.RollbackToSavepoint(), ErrNoSavepoint)
+
+	require.NoError(t, batch.Put([]byte("key 4"), []byte("value 4")))
+	require.NoError(t, batch.Commit())
+
+	expected := map[string][]byte{
+		"key 1": []byte("value 1"),
+		"key 2": nil,
+		"key 3": nil,
+		"key 4": []byte("value 4"),
+	}
+	for key, expectedValue := range expected {
+		value, err = db.Get([]byte(key))
+		if expectedValue == nil {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, expectedValue, value)
+	}
+}
+
+func TestBatchCommitCtx(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-batch-commit-ctx")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1")))
+	require.ErrorIs(t, batch.CommitCtx(ctx), context.Canceled)
+	require.ErrorIs(t, batch.Commit(), ErrBatchCommitted)
+
+	// the batch is not written, and the db lock is released
+	_, err = db.Get([]byte("key 1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	batch = db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1")))
+	require.NoError(t, batch.CommitCtx(context.Background()))
+	value, err := db.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1"), value)
+}
@@ -3,10 +3,12 @@ package lotusdb
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lotusdblabs/bbolt"
@@ -18,6 +20,8 @@ import (
 const (
 	defaultFileMode        os.FileMode = 0600
 	defaultInitialMmapSize int         = 1024
+	indexExpireSize        int         = 8
+	bptreeLockTimeout                  = 100 * time.Millisecond
 )
 
 // bucket name for bolt db to store index data.
@@ -44,11 +48,20 @@ func openBTreeIndex(options indexOptions, _ ...diskhash.MatchKeyFunc) (*BPTree,
 				NoSync:          true,
 				InitialMmapSize: defaultInitialMmapSize,
 				FreelistType:    bbolt.FreelistMapType,
+				// the copy of the index is opened with a shared lock in read only mode, see Open,
+				// it fails instead of waiting if the lock is held by another process.
+				ReadOnly: options.readOnly,
+				Timeout:  bptreeLockTimeout,
 			},
 		)
 		if err != nil {
 			return nil, err
 		}
+		// the bucket has been created by the writable one in read only mode
+		if options.readOnly {
+			trees[i] = tree
+			continue
+		}
 
 		// begin a writable transaction to create the bucket if not exists
 		tx, err := tree.Begin(true)
@@ -80,13 +93,11 @@ func (bt *BPTree) Get(key []byte, _ ...diskhash.MatchKeyFunc) (*KeyPosition, err
 		bucket := tx.Bucket(indexBucketName)
 		value := bucket.Get(key)
 		if len(value) != 0 {
-			keyPos = new(KeyPosition)
-			keyPos.key, keyPos.partition = key, uint32(p)
-			err := keyPos.uid.UnmarshalBinary(value[:len(keyPos.uid)])
+			var err error
+			keyPos, err = bt.decodeValue(key, uint32(p), value)
 			if err != nil {
 				return err
 			}
-			keyPos.position = wal.DecodeChunkPosition(value[len(keyPos.uid):])
 		}
 		return nil
 	}); err != nil {
@@ -96,6 +107,31 @@ func (bt *BPTree) Get(key []byte, _ ...diskhash.MatchKeyFunc) (*KeyPosition, err
 	return keyPos, nil
 }
 
+// getBatch gets the positions of the keys in the partition within a single read transaction,
+// a nil position means the key does not exist.
+func (bt *BPTree) getBatch(partition int, keys [][]byte) ([]*KeyPosition, error) {
+	positions := make([]*KeyPosition, len(keys))
+	err := bt.trees[partition].View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, key := range keys {
+			value := bucket.Get(key)
+			if len(value) == 0 {
+				continue
+			}
+			keyPos, err := bt.decodeValue(key, uint32(partition), value)
+			if err != nil {
+				return err
+			}
+			positions[i] = keyPos
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
 // PutBatch puts the specified key positions into the index.
 //
 //nolint:gocognit
@@ -132,24 +168,26 @@ func (bt *BPTree) PutBatch(positions []*KeyPosition, _ ...diskhash.MatchKeyFunc)
 					case <-ctx.Done():
 						return ctx.Err()
 					default:
-						uidBytes, _ := record.uid.MarshalBinary()
-						encPos := record.position.Encode()
-						//nolint:gocritic // Need to combine uidbytes with encPos and place them in bptree
-						valueBytes := append(uidBytes, encPos...)
-						if err, oldValue := bucket.Put(record.key, valueBytes); err != nil {
+						value, err := bt.options.encryptor.encryptIndexValue(record.key, encodeIndexValue(record))
+						if err != nil {
+							return err
+						}
+						// Put returns the value of the next key as the old value if the key does not exist,
+						// so the old value is got before putting.
+						var oldKeyPos *KeyPosition
+						if oldValue := bucket.Get(record.key); oldValue != nil {
+							if oldKeyPos, err = bt.decodeValue(record.key, record.partition, oldValue); err != nil {
+								return err
+							}
+						}
+						if err, _ = bucket.Put(record.key, value); err != nil {
 							if errors.Is(err, bbolt.ErrKeyRequired) {
 								return ErrKeyIsEmpty
 							}
 							return err
-						} else if oldValue != nil {
-							keyPos := new(KeyPosition)
-							keyPos.key, keyPos.partition = record.key, record.partition
-							err = keyPos.uid.UnmarshalBinary(oldValue[:len(keyPos.uid)])
-							if err != nil {
-								return err
-							}
-							keyPos.position = wal.DecodeChunkPosition(oldValue[len(keyPos.uid):])
-							partitionDeprecatedKeyPosition = append(partitionDeprecatedKeyPosition, keyPos)
+						}
+						if oldKeyPos != nil {
+							partitionDeprecatedKeyPosition = append(partitionDeprecatedKeyPosition, oldKeyPos)
 						}
 					}
 				}
@@ -222,13 +260,10 @@ func (bt *BPTree) DeleteBatch(keys [][]byte, _ ...diskhash.MatchKeyFunc) ([]*Key
 						if err, oldValue := bucket.Delete(key); err != nil {
 							return err
 						} else if oldValue != nil {
-							keyPos := new(KeyPosition)
-							keyPos.key, keyPos.partition = key, uint32(partition)
-							err = keyPos.uid.UnmarshalBinary(oldValue[:len(keyPos.uid)])
+							keyPos, err := bt.decodeValue(key, uint32(partition), oldValue)
 							if err != nil {
 								return err
 							}
-							keyPos.position = wal.DecodeChunkPosition(oldValue[len(keyPos.uid):])
 							partitionDeprecatedKeyPosition = append(partitionDeprecatedKeyPosition, keyPos)
 						}
 					}
@@ -259,6 +294,117 @@ func (bt *BPTree) DeleteBatch(keys [][]byte, _ ...diskhash.MatchKeyFunc) ([]*Key
 	return deprecatedKeyPosition, nil
 }
 
+// rangeKeys returns at most limit keys in [start, end) of the partition,
+// a nil end means there is no upper limit.
+// The key to read the rest of the range from is returned too, nil if there are no more keys.
+func (bt *BPTree) rangeKeys(partition int, start, end []byte, limit int) ([][]byte, []byte, error) {
+	var keys [][]byte
+	var next []byte
+	err := bt.trees[partition].View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(indexBucketName).Cursor()
+		for key, _ := cursor.Seek(start); key != nil; key, _ = cursor.Next() {
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+			// the key is only valid in the transaction
+			if len(keys) == limit {
+				next = bytes.Clone(key)
+				break
+			}
+			keys = append(keys, bytes.Clone(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, next, nil
+}
+
+const (
+	// indexValueMarker follows the uid in the index value to mark the layout with flags,
+	// the values written before it is added are followed by the chunk position directly,
+	// which starts with the segment id, and the segment id is never 0.
+	indexValueMarker byte = 0
+	// indexValueExpireFlag is set in the flags of the index value if it has an expiration time.
+	indexValueExpireFlag byte = 1 << 0
+)
+
+// +-------------+-------------+-------------+-------------+-------------+
+// |     uid     |    marker   |    flags    |    expire   |   position  |
+// +-------------+-------------+-------------+-------------+-------------+
+//
+//	16 bytes      1 byte        1 byte        8 bytes       varint
+//
+// The expire is only encoded if it is not 0, which is marked by indexValueExpireFlag in the flags.
+// The values written before the marker is added only hold the uid and position, see indexValuePosition.
+func encodeIndexValue(keyPos *KeyPosition) []byte {
+	uidBytes, _ := keyPos.uid.MarshalBinary()
+	encPos := keyPos.position.Encode()
+	buf := make([]byte, len(uidBytes)+2, len(uidBytes)+2+indexExpireSize+len(encPos))
+	copy(buf, uidBytes)
+	buf[len(uidBytes)] = indexValueMarker
+	if keyPos.expire != 0 {
+		buf[len(uidBytes)+1] |= indexValueExpireFlag
+		buf = binary.LittleEndian.AppendUint64(buf, keyPos.expire)
+	}
+	return append(buf, encPos...)
+}
+
+// decodeIndexValue decodes the value stored in bptree to the key position.
+func decodeIndexValue(key []byte, partition uint32, value []byte) (*KeyPosition, error) {
+	keyPos := &KeyPosition{key: key, partition: partition}
+	expire, encPos, err := indexValuePosition(value)
+	if err != nil {
+		return nil, err
+	}
+	if err = keyPos.uid.UnmarshalBinary(value[:len(keyPos.uid)]); err != nil {
+		return nil, err
+	}
+	keyPos.expire = expire
+	keyPos.position = wal.DecodeChunkPosition(encPos)
+	return keyPos, nil
+}
+
+// indexValuePosition returns the expiration time and the encoded chunk position in the plain index value,
+// the expire is 0 if the value is written before the marker is added.
+// ErrChunkPositionCorrupted is returned if the value is too short.
+func indexValuePosition(value []byte) (uint64, []byte, error) {
+	var uid uuid.UUID
+	if len(value) <= len(uid) {
+		return 0, nil, ErrChunkPositionCorrupted
+	}
+	index := len(uid)
+	var expire uint64
+	if value[index] == indexValueMarker {
+		if len(value) < index+2 {
+			return 0, nil, ErrChunkPositionCorrupted
+		}
+		flags := value[index+1]
+		index += 2
+		if flags&indexValueExpireFlag != 0 {
+			if len(value) < index+indexExpireSize {
+				return 0, nil, ErrChunkPositionCorrupted
+			}
+			expire = binary.LittleEndian.Uint64(value[index:])
+			index += indexExpireSize
+		}
+	}
+	if len(value) <= index {
+		return 0, nil, ErrChunkPositionCorrupted
+	}
+	return expire, value[index:], nil
+}
+
+// decodeValue decrypts the value stored in bptree if it is encrypted, and decodes it to the key position.
+func (bt *BPTree) decodeValue(key []byte, partition uint32, value []byte) (*KeyPosition, error) {
+	value, err := bt.options.encryptor.decryptIndexValue(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndexValue(key, partition, value)
+}
+
 // Close releases all boltdb database resources.
 // It will block waiting for any open transactions to finish
 // before closing the database and returning.
@@ -283,100 +429,209 @@ func (bt *BPTree) Sync() error {
 	return nil
 }
 
+// bptreeIteratorPageSize is the number of index entries read in a read transaction by the bptree iterator.
+const bptreeIteratorPageSize = 256
+
 // bptreeIterator implement baseIterator.
+// It seeks the cursor to the bounds directly, see IteratorOptions.
+//
+// The index entries are read in pages, and every page is read in a short read transaction,
+// because the index can not be remapped to grow while any read transaction is open.
+// The entries overwritten after the iterator is created are overridden by the ones kept by the snapshot,
+// so the iterator still reads a consistent view, see snapshotOverride.
 type bptreeIterator struct {
-	key     []byte
-	value   []byte
-	tx      *bbolt.Tx
-	cursor  *bbolt.Cursor
+	tree    *bbolt.DB
 	options IteratorOptions
+	lower   []byte // inclusive lower bound, nil means no limit
+	upper   []byte // exclusive upper bound, nil means no limit
+
+	page []bptreeEntry // the entries of the current page in the iterating direction
+	cur  int           // the current entry in page
+	end  []byte        // the last key read from index by the current page, nil if there are no more pages
+	err  error         // the error to read a page, the iterator is exhausted then
+
+	override  *snapshotOverride // override the entries by the snapshot, nil if the entries are read as is
+	encryptor *encryptor        // decrypt the values, nil if the encryption is disabled
+}
+
+// bptreeEntry is an index entry read by the bptree iterator,
+// keyPos is set instead of value if the entry is overridden by the snapshot.
+type bptreeEntry struct {
+	key    []byte
+	value  []byte
+	keyPos *KeyPosition
 }
 
 // create a boltdb based btree iterator.
-func newBptreeIterator(tx *bbolt.Tx, options IteratorOptions) *bptreeIterator {
+func newBptreeIterator(tree *bbolt.DB, options IteratorOptions, encryptor *encryptor,
+	override *snapshotOverride) *bptreeIterator {
+	lower, upper := iterateBounds(options)
 	return &bptreeIterator{
-		cursor:  tx.Bucket(indexBucketName).Cursor(),
-		options: options,
-		tx:      tx,
+		tree:      tree,
+		options:   options,
+		lower:     lower,
+		upper:     upper,
+		override:  override,
+		encryptor: encryptor,
 	}
 }
 
 // Rewind seek the first key in the iterator.
 func (bi *bptreeIterator) Rewind() {
-	if bi.options.Reverse {
-		bi.key, bi.value = bi.cursor.Last()
-		if len(bi.options.Prefix) == 0 {
+	bi.load(nil, true)
+}
+
+// Seek move the iterator to the key which is
+// greater(less when reverse is true) than or equal to the specified key.
+func (bi *bptreeIterator) Seek(key []byte) {
+	bi.load(key, true)
+}
+
+// Next moves the iterator to the next key.
+func (bi *bptreeIterator) Next() {
+	bi.cur++
+	if bi.cur >= len(bi.page) && bi.end != nil {
+		bi.load(bi.end, false)
+	}
+}
+
+// load reads the page of entries from the start key, a nil start means the first key in the bounds.
+// The page is skipped if all its entries are deleted by the snapshot.
+func (bi *bptreeIterator) load(start []byte, inclusive bool) {
+	bi.page, bi.cur, bi.end = nil, 0, nil
+	for {
+		tx, err := bi.tree.Begin(false)
+		if err != nil {
+			bi.err = err
 			return
 		}
-		for bi.key != nil && !bytes.HasPrefix(bi.key, bi.options.Prefix) {
-			bi.key, bi.value = bi.cursor.Prev()
+		page, end := bi.read(tx.Bucket(indexBucketName).Cursor(), start, inclusive)
+		// the entries kept before the transaction are all loaded, see snapshotOverride.refresh.
+		if bi.override != nil {
+			page = bi.override.merge(page, start, inclusive, end, bi.compare)
 		}
-	} else {
-		bi.key, bi.value = bi.cursor.First()
-		if len(bi.options.Prefix) == 0 {
+		if err = tx.Rollback(); err != nil {
+			bi.err = err
 			return
 		}
-		for bi.key != nil && !bytes.HasPrefix(bi.key, bi.options.Prefix) {
-			bi.key, bi.value = bi.cursor.Next()
+		bi.page, bi.end = page, end
+		if len(page) > 0 || end == nil {
+			return
 		}
+		start, inclusive = end, false
 	}
 }
 
-// Seek move the iterator to the key which is
-// greater(less when reverse is true) than or equal to the specified key.
-func (bi *bptreeIterator) Seek(key []byte) {
-	bi.key, bi.value = bi.cursor.Seek(key)
-	if !bytes.Equal(bi.key, key) && bi.options.Reverse {
-		bi.key, bi.value = bi.cursor.Prev()
-	}
-	if len(bi.options.Prefix) == 0 {
-		return
-	}
-	if !bytes.HasPrefix(bi.Key(), bi.options.Prefix) {
-		bi.Next()
+// read reads a page of entries from the cursor, the entries are copied because the transaction is closed after reading.
+// The last key is returned if the page is full, which is the start of the next page.
+func (bi *bptreeIterator) read(cursor *bbolt.Cursor, start []byte, inclusive bool) ([]bptreeEntry, []byte) {
+	key, value := bi.seek(cursor, start, inclusive)
+	page := make([]bptreeEntry, 0, bptreeIteratorPageSize)
+	for key != nil && keyInRange(key, bi.lower, bi.upper) {
+		page = append(page, bptreeEntry{
+			key:   append([]byte(nil), key...),
+			value: append([]byte(nil), value...),
+		})
+		if len(page) == bptreeIteratorPageSize {
+			return page, page[len(page)-1].key
+		}
+		if bi.options.Reverse {
+			key, value = cursor.Prev()
+		} else {
+			key, value = cursor.Next()
+		}
 	}
+	return page, nil
 }
 
-// Next moves the iterator to the next key.
-func (bi *bptreeIterator) Next() {
-	if bi.options.Reverse {
-		bi.key, bi.value = bi.cursor.Prev()
-		if len(bi.options.Prefix) == 0 {
-			return
+// seek moves the cursor to the start key, or the key after it if inclusive is false.
+func (bi *bptreeIterator) seek(cursor *bbolt.Cursor, start []byte, inclusive bool) ([]byte, []byte) {
+	if !bi.options.Reverse {
+		if start == nil || bytes.Compare(start, bi.lower) < 0 {
+			start, inclusive = bi.lower, true
 		}
-		// prefix scan
-		for bi.key != nil && !bytes.HasPrefix(bi.key, bi.options.Prefix) {
-			bi.key, bi.value = bi.cursor.Prev()
+		if start == nil {
+			return cursor.First()
 		}
-	} else {
-		bi.key, bi.value = bi.cursor.Next()
-		if len(bi.options.Prefix) == 0 {
-			return
+		key, value := cursor.Seek(start)
+		if !inclusive && bytes.Equal(key, start) {
+			key, value = cursor.Next()
 		}
-		// prefix scan
-		for bi.key != nil && !bytes.HasPrefix(bi.key, bi.options.Prefix) {
-			bi.key, bi.value = bi.cursor.Next()
+		return key, value
+	}
+
+	if start == nil || (bi.upper != nil && bytes.Compare(start, bi.upper) >= 0) {
+		return bi.seekBefore(cursor, bi.upper)
+	}
+	if inclusive {
+		key, value := cursor.Seek(start)
+		if bytes.Equal(key, start) {
+			return key, value
 		}
 	}
+	return bi.seekBefore(cursor, start)
+}
+
+// seekBefore moves the cursor to the last key less than the specified key,
+// a nil key means the last key.
+func (bi *bptreeIterator) seekBefore(cursor *bbolt.Cursor, key []byte) ([]byte, []byte) {
+	if key == nil {
+		return cursor.Last()
+	}
+	if k, _ := cursor.Seek(key); k == nil {
+		return cursor.Last()
+	}
+	return cursor.Prev()
+}
+
+// compare compares the keys in the iterating direction.
+func (bi *bptreeIterator) compare(a, b []byte) int {
+	if bi.options.Reverse {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
 }
 
 // Key get the current key.
 func (bi *bptreeIterator) Key() []byte {
-	return bi.key
+	return bi.page[bi.cur].key
 }
 
-// Value get the current value.
+// Value get the current value, which is the encoded chunk position if the value is not encrypted.
 func (bi *bptreeIterator) Value() any {
-	var uid uuid.UUID
-	return bi.value[len(uid):]
+	entry := bi.page[bi.cur]
+	if entry.keyPos != nil {
+		return entry.keyPos.position.Encode()
+	}
+	_, encPos, _ := indexValuePosition(entry.value)
+	return encPos
+}
+
+// position get the chunk position and the expiration time of the current key.
+// ErrChunkPositionCorrupted is returned if the index entry can not be decoded.
+func (bi *bptreeIterator) position() (*wal.ChunkPosition, uint64, error) {
+	entry := bi.page[bi.cur]
+	if entry.keyPos != nil {
+		return entry.keyPos.position, entry.keyPos.expire, nil
+	}
+	value, err := bi.encryptor.decryptIndexValue(entry.key, entry.value)
+	if err != nil {
+		return nil, 0, err
+	}
+	expire, encPos, err := indexValuePosition(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return wal.DecodeChunkPosition(encPos), expire, nil
 }
 
 // Valid returns whether the iterator is exhausted.
 func (bi *bptreeIterator) Valid() bool {
-	return bi.key != nil
+	return bi.cur < len(bi.page)
 }
 
 // Close the iterator.
 func (bi *bptreeIterator) Close() error {
-	return bi.tx.Rollback()
+	bi.page = nil
+	return nil
 }
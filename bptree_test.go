@@ -469,13 +469,11 @@ func Test_bptreeIterator(t *testing.T) {
 	require.NoError(t, err)
 
 	tree := bt.trees[0]
-	tx, err := tree.Begin(true)
-	require.NoError(t, err)
 	iteratorOptions := IteratorOptions{
 		Reverse: false,
 	}
 
-	itr := newBptreeIterator(tx, iteratorOptions)
+	itr := newBptreeIterator(tree, iteratorOptions, nil, nil)
 	require.NoError(t, err)
 	var prev []byte
 	itr.Rewind()
@@ -489,14 +487,12 @@ func Test_bptreeIterator(t *testing.T) {
 	err = itr.Close()
 	require.NoError(t, err)
 
-	tx, err = tree.Begin(true)
-	require.NoError(t, err)
 	iteratorOptions = IteratorOptions{
 		Reverse: true,
 	}
 	prev = nil
 
-	itr = newBptreeIterator(tx, iteratorOptions)
+	itr = newBptreeIterator(tree, iteratorOptions, nil, nil)
 	require.NoError(t, err)
 	itr.Rewind()
 	for itr.Valid() {
@@ -517,14 +513,12 @@ func Test_bptreeIterator(t *testing.T) {
 	err = itr.Close()
 	require.NoError(t, err)
 
-	tx, err = tree.Begin(true)
-	require.NoError(t, err)
 	iteratorOptions = IteratorOptions{
 		Reverse: false,
 	}
 	prev = nil
 
-	itr = newBptreeIterator(tx, iteratorOptions)
+	itr = newBptreeIterator(tree, iteratorOptions, nil, nil)
 	require.NoError(t, err)
 	itr.Rewind()
 	for itr.Valid() {
@@ -549,28 +543,24 @@ func Test_bptreeIterator(t *testing.T) {
 	_, err = bt.PutBatch(keyPositions2)
 	require.NoError(t, err)
 
-	tx, err = tree.Begin(true)
-	require.NoError(t, err)
 	iteratorOptions = IteratorOptions{
 		Reverse: false,
 		Prefix:  []byte("not valid"),
 	}
 
-	itr = newBptreeIterator(tx, iteratorOptions)
+	itr = newBptreeIterator(tree, iteratorOptions, nil, nil)
 	require.NoError(t, err)
 	itr.Rewind()
 	assert.False(t, itr.Valid())
 	err = itr.Close()
 	require.NoError(t, err)
 
-	tx, err = tree.Begin(true)
-	require.NoError(t, err)
 	iteratorOptions = IteratorOptions{
 		Reverse: false,
 		Prefix:  []byte("abc"),
 	}
 
-	itr = newBptreeIterator(tx, iteratorOptions)
+	itr = newBptreeIterator(tree, iteratorOptions, nil, nil)
 	require.NoError(t, err)
 	itr.Rewind()
 	assert.True(t, itr.Valid())
@@ -0,0 +1,564 @@
+package lotusdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	// the archived wal file name format is .CHG.%020d,
+	// %020d is the max commit sequence number of the changes in the wal,
+	// it is zero padded so the name of an archived wal is never a prefix of another one.
+	changeLogFileExt = ".CHG.%020d"
+	changeMetaName   = "CHANGEMETA"
+)
+
+// ChangeBatch is a batch committed to the database, yielded by ChangeIterator in commit order.
+type ChangeBatch struct {
+	// Seq is the commit sequence number of the batch.
+	// It is the cursor of the batch, pass it to DB.Changes to resume after the batch.
+	Seq uint64
+	// Records are the log records written by the batch, see LogRecordType for the record types.
+	Records []*LogRecord
+}
+
+// changeFeed retains the wal of the flushed memtables for the change consumers.
+//
+// When a memtable is flushed, its wal is archived instead of deleted if a registered consumer
+// or an open ChangeIterator has not reached the changes in it yet.
+// An archived wal is deleted once all of them are past its changes.
+type changeFeed struct {
+	mu           sync.Mutex
+	dirPath      string
+	flushedSeq   uint64                       // the max commit sequence number of the flushed memtables
+	discardedSeq uint64                       // the changes not greater than it may be discarded
+	consumers    map[string]uint64            // registered consumers and their acknowledged cursors
+	iterators    map[*ChangeIterator]struct{} // open iterators, they pin the changes after their cursors
+	archived     []uint64                     // max sequence numbers of the archived wal, in ascending order
+	readOnly     bool                         // the archived wal are not deleted in read only mode
+}
+
+// openChangeFeed loads the change meta and finds the archived wal in the directory.
+func openChangeFeed(dirPath string, readOnly bool) (*changeFeed, error) {
+	feed := &changeFeed{
+		dirPath:   dirPath,
+		consumers: make(map[string]uint64),
+		iterators: make(map[*ChangeIterator]struct{}),
+		readOnly:  readOnly,
+	}
+	if err := feed.loadMeta(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var prefix int
+		var maxSeq uint64
+		if _, err = fmt.Sscanf(entry.Name(), "%d.CHG.%d", &prefix, &maxSeq); err != nil {
+			continue
+		}
+		// the wal is discarded but not deleted before the database was closed.
+		if maxSeq <= feed.discardedSeq {
+			if readOnly {
+				continue
+			}
+			if err = os.Remove(filepath.Join(dirPath, entry.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		feed.archived = append(feed.archived, maxSeq)
+	}
+	sort.Slice(feed.archived, func(i, j int) bool { return feed.archived[i] < feed.archived[j] })
+	return feed, nil
+}
+
+// +-------------+---------------+----------------+--------------+-------------+----------+-----
+// | flushed seq | discarded seq | consumer count |   name size  |     name    |  cursor  | ...
+// +-------------+---------------+----------------+--------------+-------------+----------+-----
+//
+//	8 bytes         8 bytes          4 bytes         4 bytes        n bytes     8 bytes
+func (feed *changeFeed) loadMeta() error {
+	buf, err := os.ReadFile(filepath.Join(feed.dirPath, changeMetaName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	//nolint:gomnd // size of the fixed header
+	if len(buf) < 20 {
+		return ErrChangeMetaCorrupted
+	}
+	feed.flushedSeq = binary.LittleEndian.Uint64(buf[0:8])
+	feed.discardedSeq = binary.LittleEndian.Uint64(buf[8:16])
+	count := binary.LittleEndian.Uint32(buf[16:20])
+	index := 20
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < index+4 {
+			return ErrChangeMetaCorrupted
+		}
+		size := int(binary.LittleEndian.Uint32(buf[index:]))
+		index += 4
+		if len(buf) < index+size+8 {
+			return ErrChangeMetaCorrupted
+		}
+		name := string(buf[index : index+size])
+		index += size
+		feed.consumers[name] = binary.LittleEndian.Uint64(buf[index:])
+		index += 8
+	}
+	return nil
+}
+
+// storeMeta persists the change meta.
+func (feed *changeFeed) storeMeta() error {
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint64(buf[0:8], feed.flushedSeq)
+	binary.LittleEndian.PutUint64(buf[8:16], feed.discardedSeq)
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(len(feed.consumers)))
+	for name, cursor := range feed.consumers {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+		buf = binary.LittleEndian.AppendUint64(buf, cursor)
+	}
+
+	return writeMetaFile(filepath.Join(feed.dirPath, changeMetaName), buf)
+}
+
+// minCursor returns the min cursor of the consumers and the open iterators,
+// math.MaxUint64 is returned if there is none, which means no change is needed.
+// It must be called with feed.mu held.
+func (feed *changeFeed) minCursor() uint64 {
+	cursor := uint64(math.MaxUint64)
+	for _, ack := range feed.consumers {
+		cursor = min(cursor, ack)
+	}
+	for iter := range feed.iterators {
+		cursor = min(cursor, iter.cursor)
+	}
+	return cursor
+}
+
+// retire is called when the memtable is flushed, it archives the wal of the memtable
+// if the changes in it are still needed, otherwise the wal is deleted.
+// It must be called with db.mu held, so no ChangeIterator is reading the wal.
+func (feed *changeFeed) retire(table *memtable) error {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	table.mu.RLock()
+	maxSeq := table.maxSeq
+	table.mu.RUnlock()
+	feed.flushedSeq = max(feed.flushedSeq, maxSeq)
+
+	if maxSeq > feed.minCursor() {
+		if err := feed.storeMeta(); err != nil {
+			return err
+		}
+		if err := table.wal.Close(); err != nil {
+			return err
+		}
+		if err := table.wal.RenameFileExt(fmt.Sprintf(changeLogFileExt, maxSeq)); err != nil {
+			return err
+		}
+		feed.archived = append(feed.archived, maxSeq)
+		sort.Slice(feed.archived, func(i, j int) bool { return feed.archived[i] < feed.archived[j] })
+		return nil
+	}
+
+	feed.discardedSeq = max(feed.discardedSeq, maxSeq)
+	if err := feed.storeMeta(); err != nil {
+		return err
+	}
+	return table.deleteWAl()
+}
+
+// gc deletes the archived wal whose changes are not needed anymore, nothing is deleted in read only mode.
+// It must be called with feed.mu held.
+func (feed *changeFeed) gc() error {
+	if feed.readOnly {
+		return nil
+	}
+	cursor := feed.minCursor()
+	var deleted int
+	for _, maxSeq := range feed.archived {
+		if maxSeq > cursor {
+			break
+		}
+		// update the meta first, the wal left by a failed deletion is removed when opening.
+		feed.discardedSeq = max(feed.discardedSeq, maxSeq)
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	if err := feed.storeMeta(); err != nil {
+		return err
+	}
+	for _, maxSeq := range feed.archived[:deleted] {
+		if err := removeChangeLog(feed.dirPath, maxSeq); err != nil {
+			return err
+		}
+	}
+	feed.archived = feed.archived[deleted:]
+	return nil
+}
+
+// removeChangeLog removes the segment files of the archived wal.
+func removeChangeLog(dirPath string, maxSeq uint64) error {
+	files, err := filepath.Glob(filepath.Join(dirPath, "*"+fmt.Sprintf(changeLogFileExt, maxSeq)))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterChangeConsumer registers a durable change consumer with the given name,
+// the wal is retained until the consumer acknowledges the changes in it, see AckChanges.
+//
+// It returns the acknowledged cursor of the consumer, pass it to Changes to resume.
+// A new consumer starts from the current commit sequence number,
+// which means it will receive the changes committed after the registration.
+func (db *DB) RegisterChangeConsumer(name string) (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.changes.mu.Lock()
+	defer db.changes.mu.Unlock()
+	if cursor, ok := db.changes.consumers[name]; ok {
+		return cursor, nil
+	}
+	db.changes.consumers[name] = db.seq
+	if err := db.changes.storeMeta(); err != nil {
+		delete(db.changes.consumers, name)
+		return 0, err
+	}
+	return db.seq, nil
+}
+
+// AckChanges acknowledges that the consumer has processed all the changes not greater than cursor,
+// the archived wal only holding these changes will be deleted if no other consumer needs them.
+// It will return ErrChangeConsumerNotFound if the consumer is not registered.
+func (db *DB) AckChanges(name string, cursor uint64) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	db.changes.mu.Lock()
+	defer db.changes.mu.Unlock()
+	ack, ok := db.changes.consumers[name]
+	if !ok {
+		return ErrChangeConsumerNotFound
+	}
+	if cursor <= ack {
+		return nil
+	}
+	db.changes.consumers[name] = cursor
+	if err := db.changes.storeMeta(); err != nil {
+		return err
+	}
+	return db.changes.gc()
+}
+
+// UnregisterChangeConsumer removes the change consumer, the wal retained for it will be deleted.
+// It will return ErrChangeConsumerNotFound if the consumer is not registered.
+func (db *DB) UnregisterChangeConsumer(name string) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	db.changes.mu.Lock()
+	defer db.changes.mu.Unlock()
+	if _, ok := db.changes.consumers[name]; !ok {
+		return ErrChangeConsumerNotFound
+	}
+	delete(db.changes.consumers, name)
+	if err := db.changes.storeMeta(); err != nil {
+		return err
+	}
+	return db.changes.gc()
+}
+
+// Changes returns an iterator over the batches committed after cursor, in commit order.
+// Pass 0 to read all the retained changes, or the Seq of the last processed ChangeBatch to resume.
+//
+// The changes are read from the wal, so the batches written with DisableWal are not included.
+// The changes after cursor are retained while the iterator is open,
+// but it will return ErrChangesDiscarded if some of them have been discarded already,
+// register a consumer to retain the changes across restarts, see RegisterChangeConsumer.
+// It returns ErrDatabaseReadOnly in read only mode, because the wal is archived or deleted by the writable process.
+func (db *DB) Changes(cursor uint64) (*ChangeIterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+
+	db.changes.mu.Lock()
+	defer db.changes.mu.Unlock()
+	if cursor == 0 {
+		cursor = db.changes.discardedSeq
+	}
+	if cursor < db.changes.discardedSeq {
+		return nil, ErrChangesDiscarded
+	}
+
+	iter := &ChangeIterator{db: db, cursor: cursor, pending: make(map[uint64][]*LogRecord)}
+	for _, maxSeq := range db.changes.archived {
+		if maxSeq > cursor {
+			iter.sources = append(iter.sources, changeSource{maxSeq: maxSeq})
+		}
+	}
+	// the memtables from the oldest to the newest
+	tables := db.getMemTables()
+	for i := len(tables) - 1; i >= 0; i-- {
+		iter.sources = append(iter.sources, changeSource{table: tables[i]})
+	}
+	iter.lastTableID = db.activeMem.options.tableID
+	db.changes.iterators[iter] = struct{}{}
+	return iter, nil
+}
+
+// changeSource is a wal holding the changes, it is either an archived wal or the wal of a memtable.
+type changeSource struct {
+	table  *memtable // the memtable, nil if the wal is archived
+	maxSeq uint64    // the max commit sequence number of the archived wal
+}
+
+// ChangeIterator iterates the committed batches in commit order, see DB.Changes.
+// It is not thread-safe, and must be closed after use.
+type ChangeIterator struct {
+	db          *DB
+	cursor      uint64 // the sequence number of the last yielded batch, protected by changeFeed.mu
+	sources     []changeSource
+	lastTableID uint32 // the id of the newest memtable in sources
+	archive     *wal.WAL
+	reader      *wal.Reader
+	live        bool // whether the reader reads the wal of a memtable in use
+	chunks      int  // number of chunks read from the current source, it is the position of the reader
+	pending     map[uint64][]*LogRecord
+	closed      bool
+}
+
+// Next returns the next committed batch.
+// It returns io.EOF if there is no more committed batch for now,
+// Next can be called again later to get the batches committed after that.
+func (it *ChangeIterator) Next() (*ChangeBatch, error) {
+	if it.closed {
+		return nil, ErrChangeIteratorClosed
+	}
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	if it.db.closed {
+		return nil, ErrDBClosed
+	}
+
+	for {
+		if len(it.sources) == 0 && !it.addNewMemtables() {
+			return nil, io.EOF
+		}
+		batch, err := it.nextInSource()
+		if err == nil {
+			return batch, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		// the active memtable will get more changes, the reader continues from here next time.
+		if it.sources[0].table == it.db.activeMem {
+			return nil, io.EOF
+		}
+		it.closeSource()
+		it.chunks = 0
+		it.sources = it.sources[1:]
+	}
+}
+
+// addNewMemtables adds the memtables created after the last source.
+func (it *ChangeIterator) addNewMemtables() bool {
+	tables := it.db.getMemTables()
+	for i := len(tables) - 1; i >= 0; i-- {
+		if tables[i].options.tableID > it.lastTableID {
+			it.sources = append(it.sources, changeSource{table: tables[i]})
+		}
+	}
+	it.lastTableID = it.db.activeMem.options.tableID
+	return len(it.sources) > 0
+}
+
+// isLiveTable checks whether the memtable is still in use, its wal is retired after flushing.
+func (it *ChangeIterator) isLiveTable(table *memtable) bool {
+	for _, t := range it.db.getMemTables() {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// nextInSource returns the next committed batch in the current source.
+func (it *ChangeIterator) nextInSource() (*ChangeBatch, error) {
+	source := it.sources[0]
+	// the memtable is flushed since the last read, its wal is archived now.
+	if it.live && !it.isLiveTable(source.table) {
+		it.closeSource()
+	}
+	if it.reader == nil {
+		if err := it.openSource(source); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		// the reader can not read the chunks written after it returns io.EOF,
+		// so it stops at the end of the wal of a memtable in use, and is kept for the new chunks.
+		if it.live && it.chunks >= it.writtenChunks(source.table) {
+			return nil, io.EOF
+		}
+		chunk, _, err := it.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		it.chunks++
+		if chunk, err = it.db.encryptor.decryptLogRecord(chunk); err != nil {
+			return nil, err
+		}
+		record := decodeLogRecord(chunk)
+		if record.Type != LogRecordBatchFinished {
+			it.pending[record.BatchID] = append(it.pending[record.BatchID], record)
+			continue
+		}
+
+		batchID, err := snowflake.ParseBytes(record.Key)
+		if err != nil {
+			return nil, err
+		}
+		records := it.pending[uint64(batchID)]
+		delete(it.pending, uint64(batchID))
+		seq, _ := binary.Uvarint(record.Value)
+		if seq <= it.cursor {
+			continue
+		}
+		it.db.changes.mu.Lock()
+		it.cursor = seq
+		it.db.changes.mu.Unlock()
+		return &ChangeBatch{Seq: seq, Records: records}, nil
+	}
+}
+
+// writtenChunks returns the number of chunks written to the wal of the memtable.
+func (it *ChangeIterator) writtenChunks(table *memtable) int {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.chunks
+}
+
+// openSource opens the reader of the source.
+// The wal of a memtable is archived after it is flushed, so the archived one is opened
+// and the chunks read from the memtable before are skipped.
+func (it *ChangeIterator) openSource(source changeSource) error {
+	maxSeq := source.maxSeq
+	if source.table != nil {
+		if it.isLiveTable(source.table) {
+			it.reader = source.table.wal.NewReader()
+			it.live = true
+			return nil
+		}
+		source.table.mu.RLock()
+		maxSeq = source.table.maxSeq
+		source.table.mu.RUnlock()
+	}
+
+	ext := fmt.Sprintf(changeLogFileExt, maxSeq)
+	if _, err := os.Stat(wal.SegmentFileName(it.db.options.DirPath, ext, 1)); err != nil {
+		if os.IsNotExist(err) {
+			// the wal of a flushed memtable is deleted if the changes in it are not needed.
+			if maxSeq <= it.cursor {
+				it.reader = emptyChangeReader()
+				return nil
+			}
+			return ErrChangesDiscarded
+		}
+		return err
+	}
+	archive, err := wal.Open(wal.Options{
+		DirPath:        it.db.options.DirPath,
+		SegmentSize:    math.MaxInt,
+		SegmentFileExt: ext,
+	})
+	if err != nil {
+		return err
+	}
+	it.archive = archive
+	it.reader = archive.NewReader()
+	return it.skipChunks()
+}
+
+// emptyChangeReader returns a reader without any chunk.
+func emptyChangeReader() *wal.Reader {
+	return &wal.Reader{}
+}
+
+// skipChunks skips the chunks read from the current source before it is archived.
+func (it *ChangeIterator) skipChunks() error {
+	for i := 0; i < it.chunks; i++ {
+		if _, _, err := it.reader.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSource closes the reader of the current source.
+func (it *ChangeIterator) closeSource() {
+	if it.archive != nil {
+		_ = it.archive.Close()
+		it.archive = nil
+	}
+	it.reader = nil
+	it.live = false
+}
+
+// Close the iterator, the changes pinned by it will be released.
+func (it *ChangeIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.closeSource()
+	it.sources = nil
+
+	it.db.changes.mu.Lock()
+	defer it.db.changes.mu.Unlock()
+	delete(it.db.changes.iterators, it)
+	return it.db.changes.gc()
+}
@@ -0,0 +1,189 @@
+package lotusdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readChanges reads all the batches from the iterator until io.EOF.
+func readChanges(t *testing.T, iter *ChangeIterator) []*ChangeBatch {
+	var batches []*ChangeBatch
+	for {
+		batch, err := iter.Next()
+		if err == io.EOF {
+			return batches
+		}
+		require.NoError(t, err)
+		batches = append(batches, batch)
+	}
+}
+
+func TestDBChanges(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-changes")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("key 0"), []byte("value 0")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("value 1")))
+	require.NoError(t, batch.Put([]byte("key 2"), []byte("value 2")))
+	require.NoError(t, batch.Commit())
+	require.NoError(t, db.Delete([]byte("key 0")))
+
+	iter, err := db.Changes(0)
+	require.NoError(t, err)
+	batches := readChanges(t, iter)
+	require.Len(t, batches, 3)
+	assert.Equal(t, uint64(1), batches[0].Seq)
+	assert.Equal(t, []byte("key 0"), batches[0].Records[0].Key)
+	assert.Equal(t, LogRecordNormal, batches[0].Records[0].Type)
+	assert.Len(t, batches[1].Records, 2)
+	assert.Equal(t, LogRecordDeleted, batches[2].Records[0].Type)
+
+	// the iterator continues with the new changes, across the flushed memtables
+	require.NoError(t, db.Put([]byte("key 3"), []byte("value 3")))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Put([]byte("key 4"), []byte("value 4")))
+	batches = readChanges(t, iter)
+	require.Len(t, batches, 2)
+	assert.Equal(t, []byte("key 3"), batches[0].Records[0].Key)
+	assert.Equal(t, []byte("key 4"), batches[1].Records[0].Key)
+	require.NoError(t, iter.Close())
+	_, err = iter.Next()
+	require.ErrorIs(t, err, ErrChangeIteratorClosed)
+
+	// the archived wal is deleted after the iterator is closed
+	db.flushMemtable(db.activeMem)
+	_, err = db.Changes(1)
+	require.ErrorIs(t, err, ErrChangesDiscarded)
+	files, err := filepath.Glob(filepath.Join(path, "*.CHG.*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	// 0 means the retained changes
+	require.NoError(t, db.Put([]byte("key 5"), []byte("value 5")))
+	iter, err = db.Changes(0)
+	require.NoError(t, err)
+	batches = readChanges(t, iter)
+	require.Len(t, batches, 1)
+	assert.Equal(t, []byte("key 5"), batches[0].Records[0].Key)
+
+	// the reader of the active memtable continues with the new changes
+	reader := iter.reader
+	for i := 6; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+		batches = readChanges(t, iter)
+		require.Len(t, batches, 1)
+		assert.Equal(t, []byte(fmt.Sprintf("key %d", i)), batches[0].Records[0].Key)
+	}
+	assert.Same(t, reader, iter.reader)
+	require.NoError(t, iter.Close())
+
+	iter, err = db.Changes(db.seq)
+	require.NoError(t, err)
+	assert.Empty(t, readChanges(t, iter))
+	require.NoError(t, iter.Close())
+}
+
+func TestDBChangeConsumer(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-change-consumer")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("before"), []byte("value")))
+	cursor, err := db.RegisterChangeConsumer("search")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), cursor)
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			db.flushMemtable(db.activeMem)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+	}
+	db.flushMemtable(db.activeMem)
+
+	// the changes are retained across restarts until they are acknowledged
+	require.NoError(t, db.Close())
+	db, err = Open(options)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), db.seq)
+	cursor, err = db.RegisterChangeConsumer("search")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), cursor)
+
+	iter, err := db.Changes(cursor)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		batch, errNext := iter.Next()
+		require.NoError(t, errNext)
+		assert.Equal(t, []byte(fmt.Sprintf("key %d", i)), batch.Records[0].Key)
+		cursor = batch.Seq
+	}
+	require.NoError(t, iter.Close())
+	require.NoError(t, db.AckChanges("search", cursor))
+
+	// resume from the acknowledged cursor
+	iter, err = db.Changes(cursor)
+	require.NoError(t, err)
+	batches := readChanges(t, iter)
+	require.Len(t, batches, 7)
+	assert.Equal(t, []byte("key 3"), batches[0].Records[0].Key)
+	require.NoError(t, iter.Close())
+
+	// the first archived wal is deleted after all its changes are acknowledged
+	require.NoError(t, db.AckChanges("search", 6))
+	_, err = db.Changes(cursor)
+	require.ErrorIs(t, err, ErrChangesDiscarded)
+	files, err := filepath.Glob(filepath.Join(path, "*.CHG.*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	require.NoError(t, db.UnregisterChangeConsumer("search"))
+	require.ErrorIs(t, db.AckChanges("search", 11), ErrChangeConsumerNotFound)
+	files, err = filepath.Glob(filepath.Join(path, "*.CHG.*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDBChangesMerge(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-changes-merge")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Merge([]byte("key"), []byte("a")))
+	require.NoError(t, batch.Merge([]byte("key"), []byte("b")))
+	require.NoError(t, batch.Commit())
+	require.NoError(t, db.DeleteRange([]byte("a"), []byte("b")))
+
+	iter, err := db.Changes(0)
+	require.NoError(t, err)
+	defer iter.Close()
+	batches := readChanges(t, iter)
+	require.Len(t, batches, 2)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, batches[0].Records[0].MergeOperands())
+	assert.Equal(t, LogRecordRangeDeleted, batches[1].Records[0].Type)
+	assert.Equal(t, []byte("b"), batches[1].Records[0].Value)
+}
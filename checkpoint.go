@@ -0,0 +1,312 @@
+package lotusdb
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lotusdblabs/bbolt"
+	"github.com/rosedblabs/wal"
+)
+
+// Checkpoint creates a consistent copy of the database in dir, which can be opened by Open as a standalone database.
+// The dir must not exist, it is created by Checkpoint.
+//
+// The checkpoint contains all the batches committed before it is created, except the ones written with DisableWal
+// and not flushed yet, because the memtables are restored from the wal when opening the checkpoint.
+// The sealed value log segments and archived wal are hard linked into dir if it is in the same file system,
+// the other files are copied, including the active value log segments, the index and the wal of memtables.
+//
+// The flush is paused while the files are captured, and the writes are only paused for a moment
+// to capture the sizes of the wal, the reads are not paused. The wal, the active value log segments
+// and the bptree index are copied after the flush is resumed, up to the captured view,
+// and the value log segments compacted meanwhile are not removed until the checkpoint is finished.
+// The hash index is copied with the flush paused, because it can not be read in a consistent view like the bptree,
+// and the hash iterators can not be created meanwhile.
+//
+// It returns ErrDatabaseReadOnly in read only mode, because the files may be changed by the writable process.
+func (db *DB) Checkpoint(dir string) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return ErrCheckpointDirExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// the value log segments compacted meanwhile can not be removed until the checkpoint is finished.
+	db.pinValueLogs()
+	defer db.unpinValueLogs()
+
+	cp, err := db.captureCheckpoint(dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+	if err = cp.finish(); err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// checkpoint holds the files to be copied after the flush is resumed.
+type checkpoint struct {
+	// bptree read transactions and their destination paths, the bptree index is copied in the read transactions.
+	txs   []*bbolt.Tx
+	paths []string
+	// the active value log segments and the wal of memtables, and their sizes when the checkpoint is captured,
+	// the records appended after that are not referenced by the captured index, nor committed before it.
+	segments []checkpointSegment
+}
+
+// checkpointSegment is a file to be copied up to the size, it is opened when the checkpoint is captured,
+// so it can still be copied if it is removed by the flush after that, e.g. the wal of a flushed memtable.
+type checkpointSegment struct {
+	src  *os.File
+	dst  string
+	size int64
+}
+
+// captureCheckpoint captures a consistent view of the database with the flush paused,
+// and copies or links the files which can be changed by the flush or the writes.
+func (db *DB) captureCheckpoint(dir string) (*checkpoint, error) {
+	// the hash iterators can not load the hash index while it is reopened, see HashTable.copyTo.
+	db.scanLock.Lock()
+	defer db.scanLock.Unlock()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	// the sizes of the wal are captured with the writes paused, so they end at the last committed batch.
+	// The wal created after that only holds the batches committed after the checkpoint, which are skipped.
+	db.mu.RLock()
+	closed := db.closed
+	walSizes, err := db.walSizes()
+	db.mu.RUnlock()
+	if closed {
+		return nil, ErrDBClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{}
+	bptreeFiles := make(map[string]bool)
+	hashIndexDirs := make(map[string]bool)
+	activeSegments := make(map[string]bool)
+	deprecatedMetas := make(map[string]*ColumnFamily)
+	for _, cf := range db.getFamilies() {
+		deprecatedMetas[filepath.Join(cf.dirPath, deprecatedMetaName)] = cf
+		if index, ok := cf.index.(*BPTree); ok {
+			for i, tree := range index.trees {
+				tx, err := tree.Begin(false)
+				if err != nil {
+					cp.rollback()
+					return nil, err
+				}
+				path := filepath.Join(cf.dirPath, fmt.Sprintf(indexFileExt, i))
+				rel, _ := filepath.Rel(db.options.DirPath, path)
+				cp.txs = append(cp.txs, tx)
+				cp.paths = append(cp.paths, filepath.Join(dir, rel))
+				bptreeFiles[path] = true
+			}
+		}
+		if index, ok := cf.index.(*HashTable); ok {
+			rel, _ := filepath.Rel(db.options.DirPath, cf.dirPath)
+			if err := os.MkdirAll(filepath.Join(dir, rel), os.ModePerm); err != nil {
+				cp.rollback()
+				return nil, err
+			}
+			if err := index.copyTo(filepath.Join(dir, rel)); err != nil {
+				cp.rollback()
+				return nil, err
+			}
+			for i := range index.tables {
+				hashIndexDirs[filepath.Join(cf.dirPath, fmt.Sprintf(indexFileExt, i))] = true
+			}
+		}
+		for i, walFile := range cf.vlog.walFiles {
+			path := wal.SegmentFileName(cf.dirPath, fmt.Sprintf(valueLogFileExt, i), walFile.ActiveSegmentID())
+			activeSegments[path] = true
+		}
+	}
+
+	err = filepath.WalkDir(db.options.DirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(db.options.DirPath, path)
+		dst := filepath.Join(dir, rel)
+		switch {
+		case hashIndexDirs[path]:
+			return filepath.SkipDir
+		case entry.Name() == backupTempDirName:
+			// the checkpoint of a backup in progress
+			return filepath.SkipDir
+		case entry.IsDir():
+			return os.MkdirAll(dst, os.ModePerm)
+		case entry.Name() == fileLockName || entry.Name() == indexLockName || entry.Name() == indexGenerationName ||
+			entry.Name() == backupMetaName || entry.Name() == restoreMetaName || bptreeFiles[path]:
+			return nil
+		case activeSegments[path]:
+			info, errInfo := entry.Info()
+			if errInfo != nil {
+				return errInfo
+			}
+			return cp.addSegment(path, dst, info.Size())
+		case isWalFile(entry.Name()):
+			size, ok := walSizes[path]
+			if !ok {
+				return nil
+			}
+			return cp.addSegment(path, dst, size)
+		case deprecatedMetas[path] != nil:
+			// the deprecated meta is only stored when closing, so the current numbers are stored.
+			cf := deprecatedMetas[path]
+			if errCreate := os.WriteFile(dst, nil, defaultFileMode); errCreate != nil {
+				return errCreate
+			}
+			return storeDeprecatedEntryMeta(dst, cf.vlog.deprecatedNumber, cf.vlog.totalNumber)
+		case isSealedFile(entry.Name()):
+			return linkFile(path, dst)
+		default:
+			return copyFile(path, dst, -1)
+		}
+	})
+	if err != nil {
+		cp.rollback()
+		return nil, err
+	}
+	return cp, nil
+}
+
+// walSizes returns the sizes of the wal files of memtables, must be called with db.mu held.
+func (db *DB) walSizes() (map[string]int64, error) {
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, entry := range entries {
+		if !isWalFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		sizes[filepath.Join(db.options.DirPath, entry.Name())] = info.Size()
+	}
+	return sizes, nil
+}
+
+// isWalFile reports whether the file is a wal segment of a memtable.
+func isWalFile(name string) bool {
+	var id, tableID int
+	_, err := fmt.Sscanf(name, "%d"+walFileExt, &id, &tableID)
+	return err == nil && name == fmt.Sprintf("%09d"+walFileExt, id, tableID)
+}
+
+// addSegment opens the file to be copied up to the size by finish.
+func (cp *checkpoint) addSegment(src, dst string, size int64) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	cp.segments = append(cp.segments, checkpointSegment{src: file, dst: dst, size: size})
+	return nil
+}
+
+// finish copies the bptree index, the active value log segments and the wal captured.
+func (cp *checkpoint) finish() error {
+	defer cp.rollback()
+	for i, tx := range cp.txs {
+		if err := tx.CopyFile(cp.paths[i], defaultFileMode); err != nil {
+			return err
+		}
+	}
+	for _, segment := range cp.segments {
+		if err := copyReader(segment.src, segment.dst, segment.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback closes the bptree read transactions and the files to be copied.
+func (cp *checkpoint) rollback() {
+	for _, tx := range cp.txs {
+		_ = tx.Rollback()
+	}
+	cp.txs = nil
+	for _, segment := range cp.segments {
+		_ = segment.src.Close()
+	}
+	cp.segments = nil
+}
+
+// isSealedFile reports whether the file will never be changed, it is a value log segment
+// other than the active one or an archived wal, which can be hard linked.
+func isSealedFile(name string) bool {
+	var id, partition int
+	if _, err := fmt.Sscanf(name, "%d"+valueLogFileExt, &id, &partition); err == nil {
+		return true
+	}
+	// the archived wal is named like .CHG.%020d, see changeLogFileExt.
+	return strings.Contains(name, ".CHG.")
+}
+
+// linkFile hard links the file to dst, it is copied if hard link is not supported.
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, -1)
+}
+
+// copyDir copies all the files in the directory to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), os.ModePerm)
+		}
+		return copyFile(path, filepath.Join(dst, rel), -1)
+	})
+}
+
+// copyFile copies the first size bytes of the file to dst, the whole file is copied if size is negative.
+func copyFile(src, dst string, size int64) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	return copyReader(srcFile, dst, size)
+}
+
+// copyReader copies the first size bytes read from src to dst, all of them are copied if size is negative.
+func copyReader(srcFile io.Reader, dst string, size int64) error {
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		_, err = io.Copy(dstFile, srcFile)
+	} else {
+		_, err = io.CopyN(dstFile, srcFile, size)
+	}
+	if err == nil {
+		err = dstFile.Sync()
+	}
+	if errClose := dstFile.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
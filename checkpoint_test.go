@@ -0,0 +1,193 @@
+package lotusdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBCheckpoint(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-checkpoint")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			cfOptions := DefaultColumnFamilyOptions
+			cfOptions.IndexType = indexType
+			family, err := db.CreateColumnFamily("users", cfOptions)
+			require.NoError(t, err)
+
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("key %d", i))
+			}
+			value := func(i, version int) []byte {
+				return []byte(fmt.Sprintf("value %d-%d", i, version))
+			}
+			// the flushed ones are in index and value log, the others are in wal.
+			for i := 0; i < 200; i++ {
+				require.NoError(t, db.Put(key(i), value(i, 0)))
+				require.NoError(t, family.Put(key(i), value(i, 0)))
+				if i == 99 {
+					db.flushMemtable(db.activeMem)
+				}
+			}
+			require.NoError(t, db.Put(key(0), value(0, 1)))
+
+			dir := filepath.Join(os.TempDir(), "db-test-checkpoint-dir")
+			_ = os.RemoveAll(dir)
+			defer os.RemoveAll(dir)
+			require.NoError(t, db.Checkpoint(dir))
+			require.ErrorIs(t, db.Checkpoint(dir), ErrCheckpointDirExists)
+
+			// the changes after the checkpoint is created are invisible to it
+			require.NoError(t, db.Put(key(1), value(1, 1)))
+			require.NoError(t, db.Put(key(200), value(200, 0)))
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Compact())
+
+			checkpointOptions := options
+			checkpointOptions.DirPath = dir
+			checkpointDB, err := Open(checkpointOptions)
+			require.NoError(t, err)
+			checkpointFamily, err := checkpointDB.ColumnFamily("users")
+			require.NoError(t, err)
+			for i := 0; i < 200; i++ {
+				version := 0
+				if i == 0 {
+					version = 1
+				}
+				v, errGet := checkpointDB.Get(key(i))
+				require.NoError(t, errGet)
+				assert.Equal(t, value(i, version), v)
+				v, errGet = checkpointFamily.Get(key(i))
+				require.NoError(t, errGet)
+				assert.Equal(t, value(i, 0), v)
+			}
+			_, err = checkpointDB.Get(key(200))
+			require.ErrorIs(t, err, ErrKeyNotFound)
+
+			// the checkpoint is a standalone database
+			require.NoError(t, checkpointDB.Put(key(2), value(2, 1)))
+			checkpointDB.flushMemtable(checkpointDB.activeMem)
+			require.NoError(t, checkpointDB.Compact())
+			report, err := checkpointDB.Verify(context.Background(), VerifyOptions{CheckOrphans: true})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			require.NoError(t, checkpointDB.Close())
+
+			v, err := db.Get(key(2))
+			require.NoError(t, err)
+			assert.Equal(t, value(2, 0), v)
+			v, err = db.Get(key(1))
+			require.NoError(t, err)
+			assert.Equal(t, value(1, 1), v)
+
+			require.NoError(t, db.Close())
+			closedDir := filepath.Join(os.TempDir(), "db-test-checkpoint-closed")
+			require.ErrorIs(t, db.Checkpoint(closedDir), ErrDBClosed)
+			_, err = os.Stat(closedDir)
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDBCheckpointConcurrent(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-checkpoint-concurrent")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+			}
+			db.flushMemtable(db.activeMem)
+			for i := 100; i < 200; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+			}
+
+			// the reads and writes go on while the checkpoint is created.
+			done := make(chan struct{})
+			errs := make(chan error, 2)
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						errs <- nil
+						return
+					default:
+					}
+					if errPut := db.Put([]byte(fmt.Sprintf("new key %d", i)), []byte("value")); errPut != nil {
+						errs <- errPut
+						return
+					}
+				}
+			}()
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						errs <- nil
+						return
+					default:
+					}
+					if _, errGet := db.Get([]byte(fmt.Sprintf("key %d", i%200))); errGet != nil {
+						errs <- errGet
+						return
+					}
+				}
+			}()
+
+			dir := filepath.Join(os.TempDir(), "db-test-checkpoint-concurrent-dir")
+			_ = os.RemoveAll(dir)
+			defer os.RemoveAll(dir)
+			require.NoError(t, db.Checkpoint(dir))
+			close(done)
+			require.NoError(t, <-errs)
+			require.NoError(t, <-errs)
+
+			checkpointOptions := options
+			checkpointOptions.DirPath = dir
+			checkpointDB, err := Open(checkpointOptions)
+			require.NoError(t, err)
+			defer checkpointDB.Close()
+			for i := 0; i < 200; i++ {
+				value, errGet := checkpointDB.Get([]byte(fmt.Sprintf("key %d", i)))
+				require.NoError(t, errGet)
+				assert.Equal(t, []byte("value"), value)
+			}
+			// the writes are committed in order, so the ones in the checkpoint have no gaps.
+			var written int
+			for ; ; written++ {
+				if _, errGet := checkpointDB.Get([]byte(fmt.Sprintf("new key %d", written))); errGet != nil {
+					require.ErrorIs(t, errGet, ErrKeyNotFound)
+					break
+				}
+			}
+			iter, err := checkpointDB.NewIterator(IteratorOptions{Prefix: []byte("new key ")})
+			require.NoError(t, err)
+			count := 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				count++
+			}
+			require.NoError(t, iter.Close())
+			assert.Equal(t, written, count)
+		})
+	}
+}
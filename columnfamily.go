@@ -0,0 +1,444 @@
+package lotusdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// DefaultColumnFamilyName is the name of the default column family,
+	// the methods of DB and Batch without a column family operate on it.
+	DefaultColumnFamilyName = "default"
+	defaultColumnFamilyID   = 0
+	columnFamilyMetaName    = "CFMETA"
+	// the directory of a column family is CF.%d, %d is the id of the column family.
+	// The index and value log of the default column family are in the database directory.
+	columnFamilyDirName = "CF.%d"
+	familyKeySize       = 4
+)
+
+// ColumnFamily is a logically separate keyspace of the database,
+// it has its own index and value log, which can be configured by ColumnFamilyOptions.
+//
+// All the column families share the memtables and the wal,
+// so a batch writing to several column families is still atomic.
+// A key in a column family never conflicts with the same key in another one.
+type ColumnFamily struct {
+	db      *DB
+	id      uint32
+	name    string
+	dirPath string
+	options ColumnFamilyOptions
+	index   Index
+	vlog    *valueLog
+}
+
+// familyKey returns the key of the column family in memtables,
+// which is prefixed by the id of the column family.
+func familyKey(id uint32, key []byte) []byte {
+	buf := make([]byte, familyKeySize+len(key))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[familyKeySize:], key)
+	return buf
+}
+
+// splitFamilyKey splits the key in memtables into the id of the column family and the key.
+func splitFamilyKey(key []byte) (uint32, []byte) {
+	return binary.BigEndian.Uint32(key), key[familyKeySize:]
+}
+
+// openColumnFamily opens the index and value log of the column family in dirPath.
+//
+// In read only mode, nothing is written to dirPath. The index is changed in place by the writable process,
+// so it is copied to indexDir and the copy is opened, and the value log is opened as views.
+// It must be called with the index lock file locked, see Open.
+func openColumnFamily(options Options, id uint32, name string,
+	cfOptions ColumnFamilyOptions, dirPath, indexDir string) (*ColumnFamily, error) {
+	var deprecatedNumber, totalEntryNumber uint32
+	if options.ReadOnly {
+		// nothing is compacted in read only mode, so the deprecated meta is not needed.
+		if err := copyIndex(cfOptions.IndexType, cfOptions.PartitionNum, dirPath, indexDir); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		// create deprecatedMeta file if not exist, read deprecatedNumber
+		var err error
+		deprecatedMetaPath := filepath.Join(dirPath, deprecatedMetaName)
+		deprecatedNumber, totalEntryNumber, err = loadDeprecatedEntryMeta(deprecatedMetaPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// open index
+	encryptor := newEncryptor(options.KeyProvider)
+	index, err := openIndex(indexOptions{
+		indexType:       cfOptions.IndexType,
+		dirPath:         indexDir,
+		partitionNum:    cfOptions.PartitionNum,
+		keyHashFunction: options.KeyHashFunction,
+		encryptor:       encryptor,
+		readOnly:        options.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// open value log
+	vlog, err := openValueLog(valueLogOptions{
+		dirPath:               dirPath,
+		segmentSize:           cfOptions.ValueLogFileSize,
+		partitionNum:          uint32(cfOptions.PartitionNum),
+		hashKeyFunction:       options.KeyHashFunction,
+		compactBatchCapacity:  options.CompactBatchCapacity,
+		deprecatedtableNumber: deprecatedNumber,
+		totalNumber:           totalEntryNumber,
+		compression:           options.Compression,
+		compressionMinSize:    options.CompressionMinSize,
+		encryptor:             encryptor,
+		readOnly:              options.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ColumnFamily{
+		id:      id,
+		name:    name,
+		dirPath: dirPath,
+		options: cfOptions,
+		index:   index,
+		vlog:    vlog,
+	}, nil
+}
+
+// columnFamilyMeta is a column family recorded in the column family meta.
+type columnFamilyMeta struct {
+	id      uint32
+	name    string
+	options ColumnFamilyOptions
+}
+
+// openAllColumnFamilies opens the column families recorded in the column family meta,
+// except the default one, the copies of their indexes are in indexDir in read only mode.
+func openAllColumnFamilies(options Options, indexDir string) ([]*ColumnFamily, error) {
+	metas, err := loadColumnFamilyMeta(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var families []*ColumnFamily
+	for _, meta := range metas {
+		name := fmt.Sprintf(columnFamilyDirName, meta.id)
+		family, errOpen := openColumnFamily(options, meta.id, meta.name, meta.options,
+			filepath.Join(options.DirPath, name), filepath.Join(indexDir, name))
+		if errOpen != nil {
+			return nil, errOpen
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// loadColumnFamilyMeta reads the column families recorded in the column family meta in dirPath,
+// see storeColumnFamilies for the format.
+func loadColumnFamilyMeta(dirPath string) ([]columnFamilyMeta, error) {
+	buf, err := os.ReadFile(filepath.Join(dirPath, columnFamilyMetaName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metas []columnFamilyMeta
+	for index := 0; index < len(buf); {
+		// id, name size, index type, partition num and value log file size
+		//nolint:gomnd // size of the fixed fields
+		if len(buf) < index+21 {
+			return nil, ErrColumnFamilyMetaCorrupted
+		}
+		id := binary.LittleEndian.Uint32(buf[index:])
+		size := int(binary.LittleEndian.Uint32(buf[index+4:]))
+		index += 8
+		//nolint:gomnd // size of the fixed fields
+		if len(buf) < index+size+13 {
+			return nil, ErrColumnFamilyMetaCorrupted
+		}
+		name := string(buf[index : index+size])
+		index += size
+		cfOptions := ColumnFamilyOptions{
+			IndexType:        IndexType(buf[index]),
+			PartitionNum:     int(binary.LittleEndian.Uint32(buf[index+1:])),
+			ValueLogFileSize: int64(binary.LittleEndian.Uint64(buf[index+5:])),
+		}
+		index += 13
+		metas = append(metas, columnFamilyMeta{id: id, name: name, options: cfOptions})
+	}
+	return metas, nil
+}
+
+// storeColumnFamilies persists the column families except the default one.
+//
+// +-------------+-------------+-------------+-------------+---------------+----------------------+-----
+// |     id      |  name size  |     name    |  index type | partition num | value log file size  | ...
+// +-------------+-------------+-------------+-------------+---------------+----------------------+-----
+//
+//	4 bytes       4 bytes        n bytes      1 byte         4 bytes            8 bytes
+//
+// must be called with db.familyLock held.
+func (db *DB) storeColumnFamilies() error {
+	var buf []byte
+	for _, family := range sortFamilies(db.families) {
+		if family.id == defaultColumnFamilyID {
+			continue
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, family.id)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(family.name)))
+		buf = append(buf, family.name...)
+		buf = append(buf, byte(family.options.IndexType))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(family.options.PartitionNum))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(family.options.ValueLogFileSize))
+	}
+	return writeMetaFile(filepath.Join(db.options.DirPath, columnFamilyMetaName), buf)
+}
+
+// CreateColumnFamily creates a column family with the given name and options.
+// It will return ErrColumnFamilyExists if the column family already exists,
+// use DB.ColumnFamily to get it, the column families are reopened with the database.
+func (db *DB) CreateColumnFamily(name string, options ColumnFamilyOptions) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, ErrColumnFamilyNameIsEmpty
+	}
+	if options.PartitionNum <= 0 {
+		options.PartitionNum = DefaultColumnFamilyOptions.PartitionNum
+	}
+	if options.ValueLogFileSize <= 0 {
+		options.ValueLogFileSize = DefaultColumnFamilyOptions.ValueLogFileSize
+	}
+	// assure ValueLogFileSize >= MemtableSize
+	if options.ValueLogFileSize < int64(db.options.MemtableSize) {
+		options.ValueLogFileSize = int64(db.options.MemtableSize)
+	}
+
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+	if _, ok := db.families[name]; ok {
+		return nil, ErrColumnFamilyExists
+	}
+
+	var id uint32
+	for _, family := range db.families {
+		id = max(id, family.id)
+	}
+	id++
+	dirPath := filepath.Join(db.options.DirPath, fmt.Sprintf(columnFamilyDirName, id))
+	family, err := openColumnFamily(db.options, id, name, options, dirPath, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	family.db = db
+	db.families[name] = family
+	if err = db.storeColumnFamilies(); err != nil {
+		delete(db.families, name)
+		_ = family.close()
+		return nil, err
+	}
+	return family, nil
+}
+
+// ColumnFamily returns the column family with the given name,
+// DefaultColumnFamilyName can be used to get the default column family.
+// It will return ErrColumnFamilyNotFound if the column family does not exist.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+	family, ok := db.families[name]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return family, nil
+}
+
+// familyByID returns the column family with the given id, nil is returned if not found.
+func (db *DB) familyByID(id uint32) *ColumnFamily {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+	for _, family := range db.families {
+		if family.id == id {
+			return family
+		}
+	}
+	return nil
+}
+
+// getFamilies returns all the column families sorted by id, the default one is the first.
+func (db *DB) getFamilies() []*ColumnFamily {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+	return sortFamilies(db.families)
+}
+
+// sortFamilies returns the column families sorted by id.
+func sortFamilies(familyMap map[string]*ColumnFamily) []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(familyMap))
+	for _, family := range familyMap {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+	return families
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// ID returns the id of the column family, it is the ColumnFamily of the log records in the change feed.
+func (cf *ColumnFamily) ID() uint32 {
+	return cf.id
+}
+
+// Put put with defaultWriteOptions.
+func (cf *ColumnFamily) Put(key []byte, value []byte) error {
+	return cf.PutWithOptions(key, value, DefaultWriteOptions)
+}
+
+// PutWithOptions a key-value pair into the column family, see DB.PutWithOptions.
+func (cf *ColumnFamily) PutWithOptions(key []byte, value []byte, options WriteOptions) error {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.options.WriteOptions = options
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, options.Sync, options.DisableWal, db).withPendingWrites()
+	if err := batch.PutCF(cf, key, value); err != nil {
+		batch.Discard()
+		return err
+	}
+	return batch.Commit()
+}
+
+// Get get with defaultReadOptions.
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.GetWithOptions(key, DefaultReadOptions)
+}
+
+// GetWithOptions the value of the specified key from the column family, see DB.GetWithOptions.
+func (cf *ColumnFamily) GetWithOptions(key []byte, options ReadOptions) ([]byte, error) {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.init(true, false, true, db)
+	batch.snapshot = options.Snapshot
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return batch.GetCF(cf, key)
+}
+
+// Delete delete with defaultWriteOptions.
+func (cf *ColumnFamily) Delete(key []byte) error {
+	return cf.DeleteWithOptions(key, DefaultWriteOptions)
+}
+
+// DeleteWithOptions the specified key from the column family, see DB.DeleteWithOptions.
+func (cf *ColumnFamily) DeleteWithOptions(key []byte, options WriteOptions) error {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.options.WriteOptions = options
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, options.Sync, options.DisableWal, db).withPendingWrites()
+	if err := batch.DeleteCF(cf, key); err != nil {
+		batch.Discard()
+		return err
+	}
+	return batch.Commit()
+}
+
+// Exist exist with defaultReadOptions.
+func (cf *ColumnFamily) Exist(key []byte) (bool, error) {
+	return cf.ExistWithOptions(key, DefaultReadOptions)
+}
+
+// ExistWithOptions checks if the specified key exists in the column family, see DB.ExistWithOptions.
+func (cf *ColumnFamily) ExistWithOptions(key []byte, options ReadOptions) (bool, error) {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.init(true, false, true, db)
+	batch.snapshot = options.Snapshot
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return batch.ExistCF(cf, key)
+}
+
+// NewIterator returns a new iterator of the column family, see DB.NewIterator.
+func (cf *ColumnFamily) NewIterator(options IteratorOptions) (*Iterator, error) {
+	return cf.db.newIterator(context.Background(), cf, options, -1)
+}
+
+// NewIteratorCtx returns a new iterator of the column family, see DB.NewIteratorCtx.
+func (cf *ColumnFamily) NewIteratorCtx(ctx context.Context, options IteratorOptions) (*Iterator, error) {
+	return cf.db.newIterator(ctx, cf, options, -1)
+}
+
+// sync the index and value log of the column family.
+func (cf *ColumnFamily) sync() error {
+	if err := cf.index.Sync(); err != nil {
+		return err
+	}
+	return cf.vlog.sync()
+}
+
+// close the index and value log of the column family,
+// and persist the deprecated number and total entry number, which are not changed in read only mode.
+func (cf *ColumnFamily) close() error {
+	if err := cf.index.Close(); err != nil {
+		return err
+	}
+	if !cf.db.options.ReadOnly {
+		deprecatedMetaPath := filepath.Join(cf.dirPath, deprecatedMetaName)
+		err := storeDeprecatedEntryMeta(deprecatedMetaPath, cf.vlog.deprecatedNumber, cf.vlog.totalNumber)
+		if err != nil {
+			return err
+		}
+	}
+	return cf.vlog.close()
+}
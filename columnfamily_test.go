@@ -0,0 +1,284 @@
+package lotusdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBColumnFamily(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-column-family")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	_, err = db.CreateColumnFamily("", DefaultColumnFamilyOptions)
+	require.ErrorIs(t, err, ErrColumnFamilyNameIsEmpty)
+	_, err = db.CreateColumnFamily(DefaultColumnFamilyName, DefaultColumnFamilyOptions)
+	require.ErrorIs(t, err, ErrColumnFamilyExists)
+	_, err = db.ColumnFamily("users")
+	require.ErrorIs(t, err, ErrColumnFamilyNotFound)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	assert.Equal(t, "users", users.Name())
+	assert.Equal(t, uint32(1), users.ID())
+	_, err = db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.ErrorIs(t, err, ErrColumnFamilyExists)
+
+	// the same key in different column families
+	require.NoError(t, db.Put([]byte("key"), []byte("default value")))
+	require.NoError(t, users.Put([]byte("key"), []byte("users value")))
+	require.NoError(t, users.Put([]byte("deleted"), []byte("value")))
+	require.NoError(t, users.Delete([]byte("deleted")))
+
+	check := func(t *testing.T) {
+		value, errGet := db.Get([]byte("key"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("default value"), value)
+		value, errGet = users.Get([]byte("key"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("users value"), value)
+
+		_, errGet = users.Get([]byte("deleted"))
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		exist, errExist := users.Exist([]byte("deleted"))
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+		exist, errExist = db.Exist([]byte("deleted"))
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+	}
+
+	t.Run("read from memtable", check)
+	db.flushMemtable(db.activeMem)
+	t.Run("read after flush", check)
+
+	// the column families are reopened with the database
+	require.NoError(t, db.Close())
+	db, err = Open(options)
+	require.NoError(t, err)
+	users, err = db.ColumnFamily("users")
+	require.NoError(t, err)
+	t.Run("read after reopen", check)
+
+	defaultFamily, err := db.ColumnFamily(DefaultColumnFamilyName)
+	require.NoError(t, err)
+	value, err := defaultFamily.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("default value"), value)
+}
+
+func TestDBColumnFamilyWriteOptions(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-column-family-write-options")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+
+	var syncs int
+	defer func(sync func(*wal.WAL) error) { syncWal = sync }(syncWal)
+	syncWal = func(w *wal.WAL) error {
+		syncs++
+		return w.Sync()
+	}
+	require.NoError(t, users.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, 0, syncs)
+	require.NoError(t, users.PutWithOptions([]byte("sync"), []byte("value"), WriteOptions{Sync: true}))
+	assert.Equal(t, 1, syncs)
+	require.NoError(t, users.DeleteWithOptions([]byte("key"), WriteOptions{Sync: true}))
+	assert.Equal(t, 2, syncs)
+
+	// the writes without wal are lost after reopening, since the memtable is not flushed
+	require.NoError(t, users.PutWithOptions([]byte("no wal"), []byte("value"), WriteOptions{DisableWal: true}))
+	require.NoError(t, users.DeleteWithOptions([]byte("sync"), WriteOptions{DisableWal: true}))
+	require.NoError(t, db.Close())
+	db, err = Open(options)
+	require.NoError(t, err)
+	users, err = db.ColumnFamily("users")
+	require.NoError(t, err)
+	value, err := users.Get([]byte("sync"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	_, err = users.Get([]byte("no wal"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = users.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestDBColumnFamilyBatch(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-column-family-batch")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	orders, err := db.CreateColumnFamily("orders", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+
+	// a batch writing to several column families is atomic
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key"), []byte("default")))
+	require.NoError(t, batch.PutCF(users, []byte("key"), []byte("users")))
+	require.NoError(t, batch.PutCF(orders, []byte("key"), []byte("orders")))
+	value, err := batch.GetCF(users, []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+	require.NoError(t, batch.DeleteCF(orders, []byte("key")))
+	exist, err := batch.ExistCF(orders, []byte("key"))
+	require.NoError(t, err)
+	assert.False(t, exist)
+	require.NoError(t, batch.Commit())
+
+	// the range deletion only deletes the keys in the default column family
+	require.NoError(t, db.DropPrefix(nil))
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	value, err = users.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+
+	db.flushMemtable(db.activeMem)
+	value, err = users.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+	_, err = orders.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestDBColumnFamilyIterator(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-column-family-iterator")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	orders, err := db.CreateColumnFamily("orders", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	// key 0 ~ key 4 are in index, key 5 ~ key 9 are in memtable
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			db.flushMemtable(db.activeMem)
+		}
+		key := []byte(fmt.Sprintf("key %d", i))
+		require.NoError(t, db.Put(key, []byte("default")))
+		require.NoError(t, users.Put(key, []byte("users")))
+		require.NoError(t, orders.Put(key, []byte("orders")))
+	}
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	require.NoError(t, users.Delete([]byte("key 1")))
+	require.NoError(t, users.Delete([]byte("key 7")))
+	db.flushMemtable(db.activeMem)
+
+	for _, reverse := range []bool{false, true} {
+		iter, errIter := users.NewIterator(IteratorOptions{Reverse: reverse})
+		require.NoError(t, errIter)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.NotEqual(t, []byte("key 1"), iter.Key())
+			assert.NotEqual(t, []byte("key 7"), iter.Key())
+			assert.Equal(t, []byte("users"), iter.Value())
+			count++
+		}
+		assert.Equal(t, 8, count)
+		require.NoError(t, iter.Close())
+
+		// the snapshot is taken before the deletions
+		iter, errIter = users.NewIterator(IteratorOptions{Reverse: reverse, Snapshot: snapshot})
+		require.NoError(t, errIter)
+		count = 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, []byte("users"), iter.Value())
+			count++
+		}
+		assert.Equal(t, 10, count)
+		require.NoError(t, iter.Close())
+	}
+
+	iter, err := orders.NewIterator(IteratorOptions{Prefix: []byte("key 5")})
+	require.NoError(t, err)
+	iter.Rewind()
+	require.True(t, iter.Valid())
+	assert.Equal(t, []byte("key 5"), iter.Key())
+	assert.Equal(t, []byte("orders"), iter.Value())
+	iter.Next()
+	assert.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+}
+
+func TestDBColumnFamilyHash(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-column-family-hash")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	cfOptions := DefaultColumnFamilyOptions
+	cfOptions.IndexType = Hash
+	cfOptions.PartitionNum = 2
+	sessions, err := db.CreateColumnFamily("sessions", cfOptions)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sessions.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+	}
+	require.NoError(t, sessions.Delete([]byte("key 0")))
+	db.flushMemtable(db.activeMem)
+
+	iter, err := sessions.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 9, count)
+	require.NoError(t, iter.Close())
+	for i := 0; i < 10; i++ {
+		exist, errExist := sessions.Exist([]byte(fmt.Sprintf("key %d", i)))
+		require.NoError(t, errExist)
+		assert.Equal(t, i != 0, exist)
+	}
+
+	// the value log of the column family is compacted
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sessions.Put([]byte(fmt.Sprintf("key %d", i)), []byte("new value")))
+	}
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Compact())
+	for i := 0; i < 10; i++ {
+		value, errGet := sessions.Get([]byte(fmt.Sprintf("key %d", i)))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("new value"), value)
+	}
+
+	// the default column family is not affected by the options of the column family
+	iter, err = db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	require.NoError(t, iter.Close())
+}
@@ -0,0 +1,70 @@
+package lotusdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression algorithm of the values in value log, see Options.Compression.
+type Compression uint8
+
+const (
+	// NoCompression stores the values as is.
+	NoCompression Compression = iota
+	// Snappy compresses the values with snappy, which is fast with a moderate compression ratio.
+	Snappy
+	// ZSTD compresses the values with zstd, which has a higher compression ratio than snappy.
+	ZSTD
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, they are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressValue compresses the value with the compression algorithm.
+// The value is returned as is with NoCompression if the compressed one is not smaller.
+func compressValue(value []byte, compression Compression) ([]byte, Compression) {
+	var compressed []byte
+	switch compression {
+	case Snappy:
+		compressed = snappy.Encode(nil, value)
+	case ZSTD:
+		encoder, _ := zstdCodec()
+		compressed = encoder.EncodeAll(value, nil)
+	default:
+		return value, NoCompression
+	}
+	if len(compressed) >= len(value) {
+		return value, NoCompression
+	}
+	return compressed, compression
+}
+
+// decompressValue decompresses the value compressed by the compression algorithm.
+func decompressValue(value []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return value, nil
+	case Snappy:
+		return snappy.Decode(nil, value)
+	case ZSTD:
+		_, decoder := zstdCodec()
+		return decoder.DecodeAll(value, nil)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompression, compression)
+	}
+}
@@ -0,0 +1,127 @@
+package lotusdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/lotusdblabs/lotusdb/v2/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressValue(t *testing.T) {
+	compressible := bytes.Repeat([]byte(`{"name":"lotusdb","type":"kv"}`), 100)
+	incompressible := util.RandomValue(10)
+	for _, compression := range []Compression{NoCompression, Snappy, ZSTD} {
+		compressed, actual := compressValue(compressible, compression)
+		assert.Equal(t, compression, actual)
+		if compression != NoCompression {
+			assert.Less(t, len(compressed), len(compressible))
+		}
+		value, err := decompressValue(compressed, actual)
+		require.NoError(t, err)
+		assert.Equal(t, compressible, value)
+
+		// the value is stored as is if it can not be compressed
+		compressed, actual = compressValue(incompressible, compression)
+		assert.Equal(t, NoCompression, actual)
+		assert.Equal(t, incompressible, compressed)
+
+		record := &ValueLogRecord{uid: uuid.New(), key: []byte("key"), value: compressible, expire: 10}
+		decoded, err := decodeValueLogRecord(encodeValueLogRecord(record, compression))
+		require.NoError(t, err)
+		assert.Equal(t, record, decoded)
+	}
+
+	_, err := decompressValue(compressible, ZSTD+1)
+	require.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+// valueLogCompressions returns the number of records compressed by every compression algorithm in value log.
+func valueLogCompressions(t *testing.T, vlog *valueLog) map[Compression]int {
+	compressions := make(map[Compression]int)
+	for _, walFile := range vlog.walFiles {
+		reader := walFile.NewReader()
+		for {
+			chunk, _, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			compressions[Compression(binary.LittleEndian.Uint32(chunk[16:])>>valueLogRecordCompressionShift)]++
+		}
+	}
+	return compressions
+}
+
+func TestDBCompression(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-compression")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.Compression = Snappy
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"name":"lotusdb"}`, i)), 10)
+	}
+	check := func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			v, errGet := db.Get([]byte(fmt.Sprintf("key %d", i)))
+			require.NoError(t, errGet)
+			assert.Equal(t, value(i), v)
+		}
+		// the small values are not compressed
+		v, errGet := db.Get([]byte("small"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("small value"), v)
+	}
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), value(i)))
+	}
+	require.NoError(t, db.Put([]byte("small"), []byte("small value")))
+	db.flushMemtable(db.activeMem)
+	assert.Equal(t, map[Compression]int{Snappy: 100, NoCompression: 1}, valueLogCompressions(t, db.vlog))
+
+	// reopen with another compression algorithm, the mixed records are readable.
+	require.NoError(t, db.Close())
+	options.Compression = ZSTD
+	db, err = Open(options)
+	require.NoError(t, err)
+	for i := 100; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), value(i)))
+	}
+	db.flushMemtable(db.activeMem)
+	assert.Equal(t, map[Compression]int{Snappy: 100, ZSTD: 100, NoCompression: 1}, valueLogCompressions(t, db.vlog))
+	t.Run("mixed", check)
+
+	// the values are recompressed in compaction
+	require.NoError(t, db.Compact())
+	assert.Equal(t, map[Compression]int{ZSTD: 200, NoCompression: 1}, valueLogCompressions(t, db.vlog))
+	t.Run("compacted", check)
+
+	require.NoError(t, db.Close())
+	options.Compression = NoCompression
+	db, err = Open(options)
+	require.NoError(t, err)
+	t.Run("reopen", check)
+	require.NoError(t, db.Compact())
+	assert.Equal(t, map[Compression]int{NoCompression: 201}, valueLogCompressions(t, db.vlog))
+	t.Run("decompressed", check)
+
+	options.Compression = ZSTD + 1
+	_, err = Open(options)
+	require.ErrorIs(t, err, ErrUnknownCompression)
+}
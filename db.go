@@ -1,12 +1,15 @@
 package lotusdb
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -34,7 +37,7 @@ const (
 //
 // DB is thread-safe, and can be used by multiple goroutines.
 // But you can not open multiple DBs with the same directory path at the same time.
-// ErrDatabaseIsUsing will be returned if you do so.
+// ErrDatabaseIsUsing will be returned if you do so, but it can be opened in read only mode, see Options.ReadOnly.
 //
 // LotusDB is the most advanced key-value database written in Go.
 // It combines the advantages of LSM tree and B+ tree, read and write are both very fast.
@@ -45,6 +48,9 @@ type DB struct {
 	index            Index                // index is multi-partition indexes to store key and chunk position.
 	vlog             *valueLog            // vlog is the value log.
 	fileLock         *flock.Flock         // fileLock to prevent multiple processes from using the same database directory.
+	indexLock        *flock.Flock         // indexLock is locked while the index is changed, see lockIndex.
+	indexDir         string               // indexDir is the copy of the indexes in read only mode, see Open.
+	indexGeneration  uint64               // indexGeneration is increased whenever the index is changed, see unlockIndex.
 	flushChan        chan *memtable       // flushChan is used to notify the flush goroutine to flush memtable to disk.
 	flushLock        sync.Mutex           // flushLock is to prevent flush running while compaction doesn't occur.
 	compactChan      chan deprecatedState // compactChan is used to notify the shard need to compact.
@@ -54,7 +60,24 @@ type DB struct {
 	closeflushChan   chan struct{} // used to elegantly close flush listening coroutines.
 	closeCompactChan chan struct{} // used to elegantly close autoCompact listening coroutines.
 	options          Options
-	batchPool        sync.Pool // batchPool is a pool of batch, to reduce the cost of memory allocation.
+	batchPool        sync.Pool              // batchPool is a pool of batch, to reduce the cost of memory allocation.
+	seq              uint64                 // seq is the commit sequence number of the latest batch.
+	snapshots        map[*Snapshot]struct{} // snapshots are the open snapshots.
+	snapshotLock     sync.Mutex             // snapshotLock protects snapshots.
+	iterators        map[*Iterator]struct{} // iterators are the open iterators, which are invalidated by Close.
+	oracle           *txnOracle             // oracle tracks the committed keys for transaction conflict detection.
+	changes          *changeFeed            // changes retains the wal for the change consumers, see DB.Changes.
+	defaultFamily    *ColumnFamily          // defaultFamily holds the index and value log of the default column family.
+	families         map[string]*ColumnFamily
+	familyLock       sync.RWMutex  // familyLock protects families.
+	iterLock         sync.Mutex    // iterLock protects openIterators and iterators.
+	openIterators    int           // openIterators is the number of open iterators and checkpoints, see pinValueLogs.
+	scanLock         sync.RWMutex  // scanLock is read locked while loading the hash index, see newIterator.
+	encryptor        *encryptor    // encryptor decrypts the wal read by the change iterators, nil if not encrypted.
+	backupLock       sync.Mutex    // backupLock serializes the backups, which are based on the latest one.
+	primaryDir       string        // primaryDir is the directory of the primary, empty if not a secondary.
+	catchUpLock      sync.Mutex    // catchUpLock serializes the catch-ups with the primary, see TryCatchUpWithPrimary.
+	retired          []retiredView // retired are replaced by the catch-ups with the primary, see closeRetired.
 }
 
 // Open a database with the specified options.
@@ -65,66 +88,87 @@ type DB struct {
 //
 // It will first open the wal to rebuild the memtable, then open the index and value log.
 // Return the DB object if succeeded, otherwise return the error.
+//
+// In read only mode, the database must have been created by a writable Open, and it can be opened
+// while the writable process is running, nothing is written to the database directory.
+// The wal is read to rebuild the memtables without flushing them, and the value log files are opened read only.
+// The index is changed in place by the writable process, so it is copied to a temporary directory
+// with the index lock file locked shared, which pauses the flush and compaction of the writable process
+// while copying, the copy is opened and it is removed when closing.
+// The database is read as it is when opened, the batches committed after that are not read.
 func Open(options Options) (*DB, error) {
+	return open(options, "")
+}
+
+// open opens the database like Open, the copy of the indexes is created in indexDir in read only mode,
+// a temporary directory is created for it if indexDir is empty, see OpenAsSecondary.
+func open(options Options, indexDir string) (*DB, error) {
 	// check whether all options are valid
 	if err := validateOptions(&options); err != nil {
 		return nil, err
 	}
 
-	// create data directory if not exist
-	if _, err := os.Stat(options.DirPath); err != nil {
-		if err = os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+	var err error
+	var fileLock *flock.Flock
+	if options.ReadOnly {
+		// the database must exist, nothing is created in read only mode
+		if _, err = os.Stat(filepath.Join(options.DirPath, fileLockName)); err != nil {
 			return nil, err
 		}
-	}
-
-	// create file lock, prevent multiple processes from using the same database directory
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
-	if err != nil {
-		return nil, err
-	}
-	if !hold {
-		return nil, ErrDatabaseIsUsing
-	}
+	} else {
+		if _, err = os.Stat(options.DirPath); err != nil {
+			// create data directory if not exist
+			if err = os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
 
-	// create deprecatedMeta file if not exist, read deprecatedNumber
-	deprecatedMetaPath := filepath.Join(options.DirPath, deprecatedMetaName)
-	deprecatedNumber, totalEntryNumber, err := loadDeprecatedEntryMeta(deprecatedMetaPath)
-	if err != nil {
-		return nil, err
-	}
+		// create file lock, prevent multiple processes from using the same database directory,
+		// the read only processes do not lock it.
+		fileLock = flock.New(filepath.Join(options.DirPath, fileLockName))
+		var hold bool
+		if hold, err = fileLock.TryLock(); err != nil {
+			return nil, err
+		}
+		if !hold {
+			return nil, ErrDatabaseIsUsing
+		}
+		// release the file lock if failed to open, e.g. the wal can not be decrypted,
+		// so the database can be opened again with the right options.
+		defer func() {
+			if err != nil {
+				_ = fileLock.Unlock()
+			}
+		}()
 
-	// open all memtables
-	memtables, err := openAllMemtables(options)
-	if err != nil {
-		return nil, err
+		// no more incremental backups can be restored once the database is opened, see Restore.
+		if err = os.Remove(filepath.Join(options.DirPath, restoreMetaName)); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// open index
-	index, err := openIndex(indexOptions{
-		indexType:       options.IndexType,
-		dirPath:         options.DirPath,
-		partitionNum:    options.PartitionNum,
-		keyHashFunction: options.KeyHashFunction,
-	})
-	if err != nil {
-		return nil, err
+	// the index lock file is locked while the index and value logs are changed or captured, see DB.lockIndex.
+	indexLock := flock.New(filepath.Join(options.DirPath, indexLockName))
+	if !options.ReadOnly {
+		indexDir = options.DirPath
+	} else if indexDir == "" {
+		if indexDir, err = os.MkdirTemp("", "lotusdb-readonly"); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				_ = os.RemoveAll(indexDir)
+			}
+		}()
 	}
-
-	// open value log
-	vlog, err := openValueLog(valueLogOptions{
-		dirPath:               options.DirPath,
-		segmentSize:           options.ValueLogFileSize,
-		partitionNum:          uint32(options.PartitionNum),
-		hashKeyFunction:       options.KeyHashFunction,
-		compactBatchCapacity:  options.CompactBatchCapacity,
-		deprecatedtableNumber: deprecatedNumber,
-		totalNumber:           totalEntryNumber,
-	})
+	files, err := openDatabaseFiles(options, indexLock, indexDir)
 	if err != nil {
 		return nil, err
 	}
+	memtables, defaultFamily := files.memtables, files.families[0]
 
 	// init diskIO
 	diskIO := new(DiskIO)
@@ -137,9 +181,10 @@ func Open(options Options) (*DB, error) {
 	db := &DB{
 		activeMem:        memtables[len(memtables)-1],
 		immuMems:         memtables[:len(memtables)-1],
-		index:            index,
-		vlog:             vlog,
+		index:            defaultFamily.index,
+		vlog:             defaultFamily.vlog,
 		fileLock:         fileLock,
+		indexLock:        indexLock,
 		flushChan:        make(chan *memtable, options.MemtableNums-1),
 		closeflushChan:   make(chan struct{}),
 		closeCompactChan: make(chan struct{}),
@@ -147,10 +192,27 @@ func Open(options Options) (*DB, error) {
 		diskIO:           diskIO,
 		options:          options,
 		batchPool:        sync.Pool{New: makeBatch},
-	}
-
-	// if there are some immutable memtables when opening the database, flush them to disk
-	if len(db.immuMems) > 0 {
+		snapshots:        make(map[*Snapshot]struct{}),
+		iterators:        make(map[*Iterator]struct{}),
+		oracle:           newTxnOracle(),
+		changes:          files.changes,
+		indexGeneration:  files.generation,
+		defaultFamily:    defaultFamily,
+		families:         make(map[string]*ColumnFamily),
+		encryptor:        newEncryptor(options.KeyProvider),
+	}
+	if options.ReadOnly {
+		db.indexDir = indexDir
+	}
+	for _, family := range files.families {
+		family.db = db
+		db.families[family.name] = family
+	}
+	db.seq = lastSeq(files.changes, memtables)
+
+	// if there are some immutable memtables when opening the database, flush them to disk,
+	// they are kept in memory in read only mode.
+	if len(db.immuMems) > 0 && !options.ReadOnly {
 		for _, table := range db.immuMems {
 			db.flushMemtable(table)
 		}
@@ -175,9 +237,112 @@ func Open(options Options) (*DB, error) {
 	return db, nil
 }
 
+// databaseFiles are the memtables, the change feed and the column families opened by openDatabaseFiles.
+type databaseFiles struct {
+	memtables  []*memtable
+	changes    *changeFeed
+	families   []*ColumnFamily // the default column family is the first one
+	generation uint64          // the index generation when the index is captured, see DB.indexGeneration
+}
+
+// openDatabaseFiles opens the memtables, the change feed and the column families of the database,
+// the default column family is the first one, and the copies of the indexes are in indexDir in read only mode.
+// The index lock file is locked while the column families are opened, so the index and value logs
+// are captured consistently with the memtables in read only mode, see removeFlushedMemtables.
+func openDatabaseFiles(options Options, indexLock *flock.Flock, indexDir string) (*databaseFiles, error) {
+	// open all memtables, they are read before the index is copied in read only mode,
+	// so the ones flushed meanwhile can be found, see removeFlushedMemtables.
+	memtables, err := openAllMemtables(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ReadOnly {
+		// the lock file is created by the writable process, no one changes the index if it does not exist.
+		if _, err = os.Stat(indexLock.Path()); err == nil {
+			err = indexLock.RLock()
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = indexLock.Lock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var families []*ColumnFamily
+	fail := func(err error) (*databaseFiles, error) {
+		for _, family := range families {
+			_ = family.index.Close()
+			_ = family.vlog.close()
+		}
+		_ = indexLock.Unlock()
+		return nil, err
+	}
+
+	// the writable process changes the index from a new generation, see DB.indexGeneration.
+	generation, err := loadIndexGeneration(options.DirPath)
+	if err != nil {
+		return fail(err)
+	}
+	if !options.ReadOnly {
+		generation++
+		if err = storeIndexGeneration(options.DirPath, generation); err != nil {
+			return fail(err)
+		}
+	}
+
+	// load the change meta and the archived wal
+	changes, err := openChangeFeed(options.DirPath, options.ReadOnly)
+	if err != nil {
+		return fail(err)
+	}
+
+	// open the default column family, its index and value log are in the database directory
+	defaultFamily, err := openColumnFamily(options, defaultColumnFamilyID, DefaultColumnFamilyName,
+		ColumnFamilyOptions{
+			IndexType:        options.IndexType,
+			PartitionNum:     options.PartitionNum,
+			ValueLogFileSize: options.ValueLogFileSize,
+		}, options.DirPath, indexDir)
+	if err != nil {
+		return fail(err)
+	}
+	families = append(families, defaultFamily)
+
+	// open the other column families
+	others, err := openAllColumnFamilies(options, indexDir)
+	families = append(families, others...)
+	if err != nil {
+		return fail(err)
+	}
+
+	if options.ReadOnly {
+		if memtables, err = removeFlushedMemtables(memtables); err != nil {
+			return fail(err)
+		}
+	}
+	if err = indexLock.Unlock(); err != nil {
+		return fail(err)
+	}
+	return &databaseFiles{memtables: memtables, changes: changes, families: families, generation: generation}, nil
+}
+
+// lastSeq returns the commit sequence number of the latest batch in the memtables and the flushed ones.
+func lastSeq(changes *changeFeed, memtables []*memtable) uint64 {
+	seq := changes.flushedSeq
+	for _, table := range memtables {
+		if table.maxSeq > seq {
+			seq = table.maxSeq
+		}
+	}
+	return seq
+}
+
 // Close the database, close all data files and release file lock.
 // Set the closed flag to true.
 // The DB instance cannot be used after closing.
+// The iterators which are still open are invalid after closing, but they should still be closed.
 func (db *DB) Close() error {
 	close(db.flushChan)
 	<-db.closeflushChan
@@ -185,8 +350,12 @@ func (db *DB) Close() error {
 		close(db.compactChan)
 		<-db.closeCompactChan
 	}
+	// wait for the hash index being loaded by the iterators.
+	db.scanLock.Lock()
+	defer db.scanLock.Unlock()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	db.invalidateIterators()
 
 	// close all memtables
 	for _, table := range db.immuMems {
@@ -197,28 +366,39 @@ func (db *DB) Close() error {
 	if err := db.activeMem.close(); err != nil {
 		return err
 	}
-	// close index
-	if err := db.index.Close(); err != nil {
-		return err
-	}
 
 	db.flushLock.Lock()
-	// persist deprecated number and total entry number
-	deprecatedMetaPath := filepath.Join(db.options.DirPath, deprecatedMetaName)
-	err := storeDeprecatedEntryMeta(deprecatedMetaPath, db.vlog.deprecatedNumber, db.vlog.totalNumber)
-	if err != nil {
-		return err
-	}
 	defer db.flushLock.Unlock()
-
-	// close value log
-	if err = db.vlog.close(); err != nil {
-		return err
+	// close index and value log of all column families,
+	// persist deprecated number and total entry number,
+	// the segments rewritten by compaction are removed even if the invalid iterators are not closed yet.
+	if !db.options.ReadOnly {
+		if err := db.indexLock.Lock(); err != nil {
+			return err
+		}
+		defer func() { _ = db.indexLock.Unlock() }()
+	}
+	for _, family := range db.getFamilies() {
+		if err := family.close(); err != nil {
+			return err
+		}
 	}
-	// release file lock
-	if err = db.fileLock.Unlock(); err != nil {
+	// the ones replaced by the catch-ups of a secondary, the iterators reading them are invalid now.
+	if err := db.closeRetired(); err != nil {
 		return err
 	}
+	if db.options.ReadOnly {
+		// remove the copy of the indexes
+		if err := os.RemoveAll(db.indexDir); err != nil {
+			return err
+		}
+	}
+	// release file lock, it is not locked in read only mode, except the secondary directory, see OpenAsSecondary.
+	if db.fileLock != nil {
+		if err := db.fileLock.Unlock(); err != nil {
+			return err
+		}
+	}
 
 	db.closed = true
 	return nil
@@ -238,13 +418,11 @@ func (db *DB) Sync() error {
 	if err := db.activeMem.sync(); err != nil {
 		return err
 	}
-	// sync index
-	if err := db.index.Sync(); err != nil {
-		return err
-	}
-	// sync value log
-	if err := db.vlog.sync(); err != nil {
-		return err
+	// sync index and value log of all column families
+	for _, family := range db.getFamilies() {
+		if err := family.sync(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -255,10 +433,24 @@ func (db *DB) Put(key []byte, value []byte) error {
 	return db.PutWithOptions(key, value, DefaultWriteOptions)
 }
 
+// PutWithTTL put a key-value pair with the specified ttl, using defaultWriteOptions.
+// The key will be invisible after the ttl, and will be removed from the value log in compaction.
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	options := DefaultWriteOptions
+	options.TTL = ttl
+	return db.PutWithOptions(key, value, options)
+}
+
 // PutWithOptions a key-value pair into the database.
 // Actually, it will open a new batch and commit it.
 // You can think the batch has only one Put operation.
 func (db *DB) PutWithOptions(key []byte, value []byte, options WriteOptions) error {
+	return db.PutCtx(context.Background(), key, value, options)
+}
+
+// PutCtx puts a key-value pair into the database like PutWithOptions,
+// but gives up if ctx is done before the key is written, see Batch.CommitCtx.
+func (db *DB) PutCtx(ctx context.Context, key []byte, value []byte, options WriteOptions) error {
 	batch, ok := db.batchPool.Get().(*Batch)
 	if !ok {
 		panic("batchPoll.Get failed")
@@ -273,27 +465,39 @@ func (db *DB) PutWithOptions(key []byte, value []byte, options WriteOptions) err
 	// and the WAL file will be synced to disk according to the DB options.
 	batch.init(false, false, false, db).withPendingWrites()
 	if err := batch.Put(key, value); err != nil {
-		batch.unlock()
+		batch.Discard()
 		return err
 	}
-	return batch.Commit()
+	return batch.CommitCtx(ctx)
+}
+
+// Get get with defaultReadOptions.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.GetWithOptions(key, DefaultReadOptions)
 }
 
-// Get the value of the specified key from the database.
+// GetWithOptions the value of the specified key from the database.
 // Actually, it will open a new batch and commit it.
 // You can think the batch has only one Get operation.
-func (db *DB) Get(key []byte) ([]byte, error) {
+func (db *DB) GetWithOptions(key []byte, options ReadOptions) ([]byte, error) {
+	return db.GetCtx(context.Background(), key, options)
+}
+
+// GetCtx gets the value of the specified key from the database like GetWithOptions,
+// but gives up if ctx is done before reading the index or value log, the error of ctx is returned.
+func (db *DB) GetCtx(ctx context.Context, key []byte, options ReadOptions) ([]byte, error) {
 	batch, ok := db.batchPool.Get().(*Batch)
 	if !ok {
 		panic("batchPoll.Get failed")
 	}
 	batch.init(true, false, true, db)
+	batch.snapshot = options.Snapshot
 	defer func() {
 		_ = batch.Commit()
 		batch.reset()
 		db.batchPool.Put(batch)
 	}()
-	return batch.Get(key)
+	return batch.getCtx(ctx, db.defaultFamily, key)
 }
 
 // Delete delete with defaultWriteOptions.
@@ -319,21 +523,27 @@ func (db *DB) DeleteWithOptions(key []byte, options WriteOptions) error {
 	// and the WAL file will be synced to disk according to the DB options.
 	batch.init(false, false, false, db).withPendingWrites()
 	if err := batch.Delete(key); err != nil {
-		batch.unlock()
+		batch.Discard()
 		return err
 	}
 	return batch.Commit()
 }
 
-// Exist checks if the specified key exists in the database.
+// Exist exist with defaultReadOptions.
+func (db *DB) Exist(key []byte) (bool, error) {
+	return db.ExistWithOptions(key, DefaultReadOptions)
+}
+
+// ExistWithOptions checks if the specified key exists in the database.
 // Actually, it will open a new batch and commit it.
 // You can think the batch has only one Exist operation.
-func (db *DB) Exist(key []byte) (bool, error) {
+func (db *DB) ExistWithOptions(key []byte, options ReadOptions) (bool, error) {
 	batch, ok := db.batchPool.Get().(*Batch)
 	if !ok {
 		panic("batchPoll.Get failed")
 	}
 	batch.init(true, false, true, db)
+	batch.snapshot = options.Snapshot
 	defer func() {
 		_ = batch.Commit()
 		batch.reset()
@@ -342,6 +552,116 @@ func (db *DB) Exist(key []byte) (bool, error) {
 	return batch.Exist(key)
 }
 
+// CompareAndSwap compare and swap with defaultWriteOptions.
+func (db *DB) CompareAndSwap(key, oldValue, newValue []byte) (bool, error) {
+	return db.CompareAndSwapWithOptions(key, oldValue, newValue, DefaultWriteOptions)
+}
+
+// CompareAndSwapWithOptions sets the value of the key to newValue
+// only if the current value equals to oldValue, a nil oldValue means the key does not exist.
+// It returns whether the value is swapped.
+func (db *DB) CompareAndSwapWithOptions(key, oldValue, newValue []byte, options WriteOptions) (bool, error) {
+	var swapped bool
+	err := db.readModifyWrite(key, options, func(batch *Batch, value []byte, exist bool) error {
+		if exist != (oldValue != nil) || !bytes.Equal(value, oldValue) {
+			return nil
+		}
+		swapped = true
+		return batch.Put(key, newValue)
+	})
+	return swapped, err
+}
+
+// PutIfAbsent put if absent with defaultWriteOptions.
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	return db.PutIfAbsentWithOptions(key, value, DefaultWriteOptions)
+}
+
+// PutIfAbsentWithOptions puts the key-value pair only if the key does not exist.
+// It returns whether the key-value pair is put.
+func (db *DB) PutIfAbsentWithOptions(key, value []byte, options WriteOptions) (bool, error) {
+	var put bool
+	err := db.readModifyWrite(key, options, func(batch *Batch, _ []byte, exist bool) error {
+		if exist {
+			return nil
+		}
+		put = true
+		return batch.Put(key, value)
+	})
+	return put, err
+}
+
+// GetAndDelete get and delete with defaultWriteOptions.
+func (db *DB) GetAndDelete(key []byte) ([]byte, error) {
+	return db.GetAndDeleteWithOptions(key, DefaultWriteOptions)
+}
+
+// GetAndDeleteWithOptions deletes the key and returns its value before deletion.
+// It returns ErrKeyNotFound if the key does not exist.
+func (db *DB) GetAndDeleteWithOptions(key []byte, options WriteOptions) ([]byte, error) {
+	var oldValue []byte
+	err := db.readModifyWrite(key, options, func(batch *Batch, value []byte, exist bool) error {
+		if !exist {
+			return ErrKeyNotFound
+		}
+		oldValue = value
+		return batch.Delete(key)
+	})
+	return oldValue, err
+}
+
+// Update update with defaultWriteOptions.
+func (db *DB) Update(key []byte, fn func(oldValue []byte) ([]byte, error)) error {
+	return db.UpdateWithOptions(key, fn, DefaultWriteOptions)
+}
+
+// UpdateWithOptions sets the value of the key to the one returned by fn,
+// the current value is passed to fn, and it is nil if the key does not exist.
+// If fn returns a nil value, the key will be deleted.
+// If fn returns an error, nothing will be written and the error will be returned.
+//
+// No other writes can happen between the read and the write, so fn should be fast.
+func (db *DB) UpdateWithOptions(key []byte, fn func(oldValue []byte) ([]byte, error), options WriteOptions) error {
+	return db.readModifyWrite(key, options, func(batch *Batch, value []byte, _ bool) error {
+		newValue, err := fn(value)
+		if err != nil {
+			return err
+		}
+		if newValue == nil {
+			return batch.Delete(key)
+		}
+		return batch.Put(key, newValue)
+	})
+}
+
+// readModifyWrite reads the current value of the key and writes the new one in a single batch,
+// the DB lock is held by the batch, so it is atomic with respect to other writers.
+// The batch is committed if fn returns nil, otherwise it is discarded.
+func (db *DB) readModifyWrite(key []byte, options WriteOptions,
+	fn func(batch *Batch, value []byte, exist bool) error) error {
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.options.WriteOptions = options
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, options.Sync, options.DisableWal, db).withPendingWrites()
+
+	value, err := batch.Get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		batch.Discard()
+		return err
+	}
+	if err = fn(batch, value, err == nil); err != nil {
+		batch.Discard()
+		return err
+	}
+	return batch.Commit()
+}
+
 // validateOptions validates the given options.
 func validateOptions(options *Options) error {
 	if options.DirPath == "" {
@@ -359,10 +679,23 @@ func validateOptions(options *Options) error {
 	if options.ValueLogFileSize <= 0 {
 		options.ValueLogFileSize = DefaultOptions.ValueLogFileSize
 	}
+	if options.Compression > ZSTD {
+		return ErrUnknownCompression
+	}
+	if options.KeyProvider == nil && options.EncryptionKey != nil {
+		if _, err := aes.NewCipher(options.EncryptionKey); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEncryptionKey, err)
+		}
+		options.KeyProvider = NewStaticKeyProvider(0, map[uint32][]byte{0: options.EncryptionKey})
+	}
 	// assure ValueLogFileSize >= MemtableSize
 	if options.ValueLogFileSize < int64(options.MemtableSize) {
 		options.ValueLogFileSize = int64(options.MemtableSize)
 	}
+	// nothing is compacted in read only mode
+	if options.ReadOnly {
+		options.AutoCompactSupport = false
+	}
 	return nil
 }
 
@@ -384,7 +717,8 @@ func (db *DB) getMemTables() []*memtable {
 // If the active memtable is full, it will be flushed to disk by the background goroutine.
 // But if the flush speed is slower than the write speed, there may be no space in the memtable.
 // So the write operation will wait for space in the memtable, and the timeout is specified by WaitMemSpaceTimeout.
-func (db *DB) waitMemtableSpace() error {
+// The waiting is also given up if ctx is done.
+func (db *DB) waitMemtableSpace(ctx context.Context) error {
 	if !db.activeMem.isFull() {
 		return nil
 	}
@@ -404,6 +738,8 @@ func (db *DB) waitMemtableSpace() error {
 		db.activeMem = table
 	case <-timer.C:
 		return ErrWaitMemtableSpaceTimeOut
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	return nil
@@ -411,138 +747,306 @@ func (db *DB) waitMemtableSpace() error {
 
 // flushMemtable flushes the specified memtable to disk.
 // Following steps will be done:
-// 1. Iterate all records in memtable, divide them into deleted keys and log records.
+// 1. Iterate all records in memtable, divide them into deleted keys and log records
+// of each column family, the keys in index deleted by the range tombstones are also deleted keys.
 // 2. Write the log records to value log, get the positions of keys.
-// 3. Add old uuid, write all keys and positions to index.
-// 4. Add deleted uuid, and delete the deleted keys from index.
-// 5. Delete the wal.
+// 3. Keep the index entries to be overwritten for the open snapshots.
+// 4. Add old uuid, write all keys and positions to index.
+// 5. Add deleted uuid, and delete the deleted keys from index.
+// 6. Delete the wal, or archive it if the change consumers still need it.
+//
+// Step 2 to 5 are done for every column family with its own index and value log.
 //
 //nolint:funlen
 func (db *DB) flushMemtable(table *memtable) {
 	db.flushLock.Lock()
 	defer db.flushLock.Unlock()
+	db.lockIndex()
+	defer db.unlockIndex()
 
 	sklIter := table.skl.NewIterator()
-	var deletedKeys [][]byte
-	var logRecords []*ValueLogRecord
+	flushes := make(map[uint32]*familyFlush)
+	getFlush := func(id uint32) *familyFlush {
+		if flush, ok := flushes[id]; ok {
+			return flush
+		}
+		flush := &familyFlush{family: db.familyByID(id), flushedKeys: make(map[string]struct{})}
+		flushes[id] = flush
+		return flush
+	}
 
 	// iterate all records in memtable, divide them into deleted keys and log records
 	// for every log record, we generate uuid.
+	// the expired records are treated as deleted keys, because they are invisible.
+	// only the newest version of a key will be flushed, the older versions
+	// are still visible to the snapshots holding this memtable.
+	now := time.Now().UnixNano()
+	tombstones := table.rangeTombstones(math.MaxUint64)
+	for _, tombstone := range tombstones {
+		getFlush(tombstone.familyID())
+	}
+	var prevKey []byte
 	for sklIter.SeekToFirst(); sklIter.Valid(); sklIter.Next() {
-		key, valueStruct := y.ParseKey(sklIter.Key()), sklIter.Value()
-		if valueStruct.Meta == LogRecordDeleted {
-			deletedKeys = append(deletedKeys, key)
-		} else {
-			logRecord := ValueLogRecord{key: key, value: valueStruct.Value, uid: uuid.New()}
-			logRecords = append(logRecords, &logRecord)
+		fkey, valueStruct := y.ParseKey(sklIter.Key()), sklIter.Value()
+		if prevKey != nil && bytes.Equal(fkey, prevKey) {
+			continue
 		}
+		prevKey = fkey
+		id, key := splitFamilyKey(fkey)
+		flush := getFlush(id)
+		if len(tombstones) > 0 {
+			flush.flushedKeys[string(key)] = struct{}{}
+		}
+		if valueStruct.Meta == LogRecordDeleted || isExpired(valueStruct.ExpiresAt, now) ||
+			isRangeDeleted(tombstones, fkey, y.ParseTs(sklIter.Key())) {
+			flush.deletedKeys = append(flush.deletedKeys, key)
+			continue
+		}
+		value, expire := valueStruct.Value, valueStruct.ExpiresAt
+		if valueStruct.Meta == LogRecordMerge && flush.family != nil {
+			// fold the merge operands permanently, the merged value expires with the earliest part of it.
+			var err error
+			if value, expire, err = db.mergeForFlush(table, flush.family, key); err != nil {
+				log.Println("merge operands failed:", err)
+				_ = sklIter.Close()
+				return
+			}
+		}
+		logRecord := ValueLogRecord{key: key, value: value, uid: uuid.New(),
+			expire: expire}
+		flush.logRecords = append(flush.logRecords, &logRecord)
 	}
 	_ = sklIter.Close()
 	// log.Println("len del:",len(deletedKeys),len(logRecords))
 
-	// write to value log, get the positions of keys
-	keyPos, err := db.vlog.writeBatch(logRecords)
+	for id, flush := range flushes {
+		if flush.family == nil {
+			log.Println("column family not found:", id)
+			return
+		}
+		if err := db.flushFamily(flush, tombstones); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	// delete old memtable kept in memory
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// delete the wal, or archive it if the changes in it are still needed
+	err := db.changes.retire(table)
 	if err != nil {
-		log.Println("vlog writeBatch failed:", err)
+		log.Println("retire wal failed:", err)
 		return
 	}
+	if table == db.activeMem {
+		options := db.activeMem.options
+		options.tableID++
+		// open a new memtable for writing
+		table, err = openMemtable(options)
+		if err != nil {
+			panic("flush activate memtable wrong")
+		}
+		db.activeMem = table
+	} else {
+		if len(db.immuMems) == 1 {
+			db.immuMems = db.immuMems[:0]
+		} else {
+			db.immuMems = db.immuMems[1:]
+		}
+	}
+	db.sendThresholdState()
+
+	// remove the segments compacted while the iterators were reading them.
+	if err = db.removeObsoleteSegments(); err != nil {
+		log.Println("remove compacted value log segments failed:", err)
+	}
+}
+
+// deleteIndexKeys deletes the keys from index of the column family,
+// the index entries are kept for the open snapshots first.
+func (db *DB) deleteIndexKeys(cf *ColumnFamily, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := db.keepSnapshotVersions(cf, keys); err != nil {
+		return fmt.Errorf("keep snapshot versions failed: %w", err)
+	}
+	return db.removeIndexKeys(cf, keys)
+}
+
+// removeIndexKeys deletes the keys from index of the column family,
+// and adds the uuid of the deleted values into deprecatedtable.
+func (db *DB) removeIndexKeys(cf *ColumnFamily, keys [][]byte) error {
+	var deleteMatchKeys []diskhash.MatchKeyFunc
+	if cf.options.IndexType == Hash && len(keys) > 0 {
+		deleteMatchKeys = make([]diskhash.MatchKeyFunc, len(keys))
+		for i := range deleteMatchKeys {
+			deleteMatchKeys[i] = matchKeyFunc(cf.vlog, keys[i], nil, nil)
+		}
+	}
+
+	// delete the deleted keys from index
+	oldKeyPostions, err := cf.index.DeleteBatch(keys, deleteMatchKeys...)
+	if err != nil {
+		return fmt.Errorf("index DeleteBatch failed: %w", err)
+	}
+
+	// uuid into deprecatedtable
+	for _, oldKeyPostion := range oldKeyPostions {
+		cf.vlog.setDeprecated(oldKeyPostion.partition, oldKeyPostion.uid)
+	}
+	return nil
+}
+
+// familyFlush holds the records of a column family to be flushed from a memtable.
+type familyFlush struct {
+	family      *ColumnFamily
+	logRecords  []*ValueLogRecord
+	deletedKeys [][]byte
+	flushedKeys map[string]struct{} // the keys in memtable, only collected if there are range tombstones
+}
+
+// flushFamily writes the records of a column family to its value log and index.
+//
+//nolint:funlen
+func (db *DB) flushFamily(flush *familyFlush, tombstones []*rangeTombstone) error {
+	cf := flush.family
+	deletedKeys := flush.deletedKeys
+
+	// write to value log, get the positions of keys
+	keyPos, err := cf.vlog.writeBatch(flush.logRecords)
+	if err != nil {
+		return fmt.Errorf("vlog writeBatch failed: %w", err)
+	}
 
 	// sync the value log
-	if err = db.vlog.sync(); err != nil {
-		log.Println("vlog sync failed:", err)
-		return
+	if err = cf.vlog.sync(); err != nil {
+		return fmt.Errorf("vlog sync failed: %w", err)
+	}
+
+	// keep the index entries to be overwritten, they are still visible to the open snapshots.
+	keys := make([][]byte, 0, len(keyPos)+len(deletedKeys))
+	for _, pos := range keyPos {
+		keys = append(keys, pos.key)
+	}
+	if err = db.keepSnapshotVersions(cf, append(keys, deletedKeys...)); err != nil {
+		return fmt.Errorf("keep snapshot versions failed: %w", err)
 	}
 
 	// Add old key uuid into deprecatedtable, write all keys and positions to index.
+	// The hash index does not return the old positions, they are got by the match functions.
 	var putMatchKeys []diskhash.MatchKeyFunc
-	if db.options.IndexType == Hash && len(keyPos) > 0 {
+	var oldHashPositions []*KeyPosition
+	if cf.options.IndexType == Hash && len(keyPos) > 0 {
 		putMatchKeys = make([]diskhash.MatchKeyFunc, len(keyPos))
+		oldHashPositions = make([]*KeyPosition, len(keyPos))
 		for i := range putMatchKeys {
-			putMatchKeys[i] = MatchKeyFunc(db, keyPos[i].key, nil, nil)
+			putMatchKeys[i] = matchKeyFunc(cf.vlog, keyPos[i].key, &oldHashPositions[i], nil)
 		}
 	}
 
 	// Write all keys and positions to index.
-	oldKeyPostions, err := db.index.PutBatch(keyPos, putMatchKeys...)
+	oldKeyPostions, err := cf.index.PutBatch(keyPos, putMatchKeys...)
 	if err != nil {
-		log.Println("index PutBatch failed:", err)
-		return
+		return fmt.Errorf("index PutBatch failed: %w", err)
+	}
+	for _, oldKeyPostion := range oldHashPositions {
+		if oldKeyPostion != nil {
+			oldKeyPostions = append(oldKeyPostions, oldKeyPostion)
+		}
 	}
 
 	// Add old key uuid into deprecatedtable
 	for _, oldKeyPostion := range oldKeyPostions {
-		db.vlog.setDeprecated(oldKeyPostion.partition, oldKeyPostion.uid)
+		cf.vlog.setDeprecated(oldKeyPostion.partition, oldKeyPostion.uid)
 	}
 
 	// Add deleted key uuid into deprecatedtable, and delete the deleted keys from index.
-	var deleteMatchKeys []diskhash.MatchKeyFunc
-	if db.options.IndexType == Hash && len(deletedKeys) > 0 {
-		deleteMatchKeys = make([]diskhash.MatchKeyFunc, len(deletedKeys))
-		for i := range deleteMatchKeys {
-			deleteMatchKeys[i] = MatchKeyFunc(db, deletedKeys[i], nil, nil)
-		}
-	}
-
-	// delete the deleted keys from index
-	if oldKeyPostions, err = db.index.DeleteBatch(deletedKeys, deleteMatchKeys...); err != nil {
-		log.Println("index DeleteBatch failed:", err)
-		return
+	if err = db.removeIndexKeys(cf, deletedKeys); err != nil {
+		return err
 	}
 
-	// uuid into deprecatedtable
-	for _, oldKeyPostion := range oldKeyPostions {
-		db.vlog.setDeprecated(oldKeyPostion.partition, oldKeyPostion.uid)
+	// the keys in index deleted by the range tombstones are deleted from index too.
+	if len(tombstones) > 0 {
+		if err = db.deleteIndexRanges(cf, tombstones, flush.flushedKeys); err != nil {
+			return fmt.Errorf("delete range deleted keys failed: %w", err)
+		}
 	}
 
 	// sync the index
-	if err = db.index.Sync(); err != nil {
-		log.Println("index sync failed:", err)
-		return
+	if err = cf.index.Sync(); err != nil {
+		return fmt.Errorf("index sync failed: %w", err)
 	}
+	return nil
+}
 
-	// delete the wal
-	if err = table.deleteWAl(); err != nil {
-		log.Println("delete wal failed:", err)
-		return
+// mergeForFlush folds the merge operands of the key in the flushing memtable, and returns the merged value
+// with its expiration time, the older memtables are flushed already, so the base value is read from index.
+func (db *DB) mergeForFlush(table *memtable, cf *ColumnFamily, key []byte) ([]byte, uint64, error) {
+	deleted, value, operands, expire := table.lookupExpire(familyKey(cf.id, key), math.MaxUint64)
+	if !deleted && len(value) == 0 {
+		var indexExpire uint64
+		var err error
+		if value, indexExpire, err = db.getIndexValue(cf, key); err != nil {
+			return nil, 0, err
+		}
+		if value != nil {
+			expire = mergeExpire(expire, indexExpire)
+		}
 	}
+	value, err := db.foldOperands(key, value, operands)
+	return value, expire, err
+}
 
-	// delete old memtable kept in memory
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if table == db.activeMem {
-		options := db.activeMem.options
-		options.tableID++
-		// open a new memtable for writing
-		table, err = openMemtable(options)
-		if err != nil {
-			panic("flush activate memtable wrong")
-		}
-		db.activeMem = table
-	} else {
-		if len(db.immuMems) == 1 {
-			db.immuMems = db.immuMems[:0]
-		} else {
-			db.immuMems = db.immuMems[1:]
+// getIndexValue gets the latest value of the key from index and value log of the column family,
+// and its expiration time, a nil value is returned if the key does not exist or is expired.
+func (db *DB) getIndexValue(cf *ColumnFamily, key []byte) ([]byte, uint64, error) {
+	var value []byte
+	var hashTableKeyPos *KeyPosition
+	var matchKey func(diskhash.Slot) (bool, error)
+	if cf.options.IndexType == Hash {
+		matchKey = matchKeyFunc(cf.vlog, key, &hashTableKeyPos, &value)
+	}
+	position, err := cf.index.Get(key, matchKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cf.options.IndexType == Hash {
+		if value == nil {
+			return nil, 0, nil
 		}
+		return value, hashTableKeyPos.expire, nil
 	}
-	db.sendThresholdState()
+	if position == nil || isExpired(position.expire, time.Now().UnixNano()) {
+		return nil, 0, nil
+	}
+	record, err := cf.vlog.read(position)
+	if err != nil {
+		return nil, 0, err
+	}
+	return record.value, position.expire, nil
 }
 
 func (db *DB) sendThresholdState() {
 	if db.options.AutoCompactSupport {
-		// check deprecatedtable size
-		lowerThreshold := uint32((float32)(db.vlog.totalNumber) * db.options.AdvisedCompactionRate)
-		upperThreshold := uint32((float32)(db.vlog.totalNumber) * db.options.ForceCompactionRate)
+		// check deprecatedtable size of every column family, the most urgent state wins
 		thresholdState := deprecatedState{
 			thresholdState: ThresholdState(UnarriveThreshold),
 		}
-		if db.vlog.deprecatedNumber >= upperThreshold {
-			thresholdState = deprecatedState{
-				thresholdState: ThresholdState(ArriveForceThreshold),
-			}
-		} else if db.vlog.deprecatedNumber > lowerThreshold {
-			thresholdState = deprecatedState{
-				thresholdState: ThresholdState(ArriveAdvisedThreshold),
+		for _, cf := range db.getFamilies() {
+			lowerThreshold := uint32((float32)(cf.vlog.totalNumber) * db.options.AdvisedCompactionRate)
+			upperThreshold := uint32((float32)(cf.vlog.totalNumber) * db.options.ForceCompactionRate)
+			if cf.vlog.deprecatedNumber >= upperThreshold {
+				thresholdState = deprecatedState{
+					thresholdState: ThresholdState(ArriveForceThreshold),
+				}
+				break
+			} else if cf.vlog.deprecatedNumber > lowerThreshold {
+				thresholdState = deprecatedState{
+					thresholdState: ThresholdState(ArriveAdvisedThreshold),
+				}
 			}
 		}
 		select {
@@ -656,38 +1160,80 @@ func (db *DB) listenDiskIOState() {
 // Compact will iterate all values in vlog, and write the valid values to a new vlog file.
 // Then replace the old vlog file with the new one, and delete the old one.
 //
-//nolint:gocognit
+// The value logs of all column families are compacted.
+// The valid values are rewritten to the new segments of the value logs, and the old segments are removed
+// after the open iterators reading them are closed, by the next flush or compaction, or when closing.
 func (db *DB) Compact() error {
+	return db.CompactCtx(context.Background())
+}
+
+// CompactCtx compacts the value logs like Compact, but stops if ctx is done, the error of ctx is returned.
+// The value log partitions which have been compacted are kept, and a partition stops between the batches
+// of valid records it rewrites. The old segments of a stopped partition are kept, the records rewritten
+// before stopping are dropped from them by the next compaction, so it can be resumed by calling it again.
+func (db *DB) CompactCtx(ctx context.Context) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	db.scanLock.Lock()
+	defer db.scanLock.Unlock()
 	db.flushLock.Lock()
 	defer db.flushLock.Unlock()
+	db.lockIndex()
+	defer db.unlockIndex()
 
 	log.Println("[Compact data]")
-	openVlogFile := func(part int, ext string) *wal.WAL {
-		walFile, err := wal.Open(wal.Options{
-			DirPath:        db.vlog.options.dirPath,
-			SegmentSize:    db.vlog.options.segmentSize,
-			SegmentFileExt: fmt.Sprintf(ext, part),
-			Sync:           false, // we will sync manually
-			BytesPerSync:   0,     // the same as Sync
-		})
-		if err != nil {
-			_ = walFile.Delete()
-			panic(err)
+	snapshotRecords := db.snapshotRecords()
+	for _, cf := range db.getFamilies() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.compact(ctx, cf, snapshotRecords); err != nil {
+			return err
 		}
-		return walFile
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.removeObsoleteSegments()
+}
 
-	g, _ := errgroup.WithContext(context.Background())
+// compact compacts the value log of the column family, see CompactCtx.
+// The records kept by the open snapshots are rewritten even if they are overwritten, see DB.snapshotRecords.
+//
+//nolint:gocognit,funlen
+func (db *DB) compact(ctx context.Context, cf *ColumnFamily, snapshotRecords map[uuid.UUID]struct{}) error {
+	g, gctx := errgroup.WithContext(ctx)
 	var capacity int64
-	var capacityList = make([]int64, db.options.PartitionNum)
-	for i := 0; i < int(db.vlog.options.partitionNum); i++ {
+	var capacityList = make([]int64, cf.options.PartitionNum)
+	var expiredNumber uint32
+	snapshotUIDs := make([][]uuid.UUID, cf.options.PartitionNum)
+	var snapshotDeprecated uint32
+	now := time.Now().UnixNano()
+	for i := 0; i < int(cf.vlog.options.partitionNum); i++ {
 		part := i
 		g.Go(func() error {
-			newVlogFile := openVlogFile(part, tempValueLogFileExt)
+			// the valid records are rewritten to the new segments of the same wal,
+			// so the old segments can still be read by the open iterators.
+			reader, last, err := cf.vlog.compactionReader(part)
+			if err != nil {
+				return err
+			}
+			walFile := cf.vlog.walFiles[part]
 			validRecords := make([]*ValueLogRecord, 0)
-			reader := db.vlog.walFiles[part].NewReader()
+			var expiredKeys [][]byte
+			var completed bool
+			defer func() {
+				if !completed {
+					cf.vlog.interrupt(part, last)
+				}
+			}()
 			// iterate all records in wal, find the valid records
 			for {
+				// the batches rewritten are complete, the batch in progress is dropped,
+				// its records are still in the old segments, which are kept if the partition is stopped.
+				if err = gctx.Err(); err != nil {
+					return err
+				}
 				chunk, pos, err := reader.Next()
 				atomic.AddInt64(&capacity, int64(len(chunk)))
 				capacityList[part] += int64(len(chunk))
@@ -695,37 +1241,36 @@ func (db *DB) Compact() error {
 					if errors.Is(err, io.EOF) {
 						break
 					}
-					_ = newVlogFile.Delete()
 					return err
 				}
 
-				record := decodeValueLogRecord(chunk)
-				var hashTableKeyPos *KeyPosition
-				var matchKey func(diskhash.Slot) (bool, error)
-				if db.options.IndexType == Hash {
-					matchKey = MatchKeyFunc(db, record.key, &hashTableKeyPos, nil)
-				}
-				keyPos, err := db.index.Get(record.key, matchKey)
+				record, err := cf.vlog.decodeRecord(chunk)
 				if err != nil {
-					_ = newVlogFile.Delete()
 					return err
 				}
-
-				if db.options.IndexType == Hash {
-					keyPos = hashTableKeyPos
-				}
-
-				if keyPos == nil {
-					continue
+				current, err := db.isCurrentRecord(cf, record, part, pos)
+				if err != nil {
+					return err
 				}
-				if keyPos.partition == uint32(part) && reflect.DeepEqual(keyPos.position, pos) {
+				if current {
+					// the expired records will be dropped, and removed from index.
+					if isExpired(record.expire, now) {
+						expiredKeys = append(expiredKeys, record.key)
+					} else {
+						validRecords = append(validRecords, record)
+					}
+				} else if _, ok := snapshotRecords[record.uid]; ok {
+					// the record is overwritten, but still visible to some snapshots.
 					validRecords = append(validRecords, record)
+					snapshotUIDs[part] = append(snapshotUIDs[part], record.uid)
+					if cf.vlog.isDeprecated(part, record.uid) {
+						atomic.AddUint32(&snapshotDeprecated, 1)
+					}
 				}
 
-				if capacity >= int64(db.vlog.options.compactBatchCapacity) {
-					err = db.rewriteValidRecords(newVlogFile, validRecords, part)
+				if capacity >= int64(cf.vlog.options.compactBatchCapacity) {
+					err = db.rewriteValidRecords(cf, walFile, validRecords, part)
 					if err != nil {
-						_ = newVlogFile.Delete()
 						return err
 					}
 					validRecords = validRecords[:0]
@@ -735,67 +1280,106 @@ func (db *DB) Compact() error {
 			}
 
 			if len(validRecords) > 0 {
-				err := db.rewriteValidRecords(newVlogFile, validRecords, part)
+				err := db.rewriteValidRecords(cf, walFile, validRecords, part)
 				if err != nil {
-					_ = newVlogFile.Delete()
 					return err
 				}
 			}
-
-			// replace the wal with the new one.
-			_ = db.vlog.walFiles[part].Delete()
-			_ = newVlogFile.Close()
-			if err := newVlogFile.RenameFileExt(fmt.Sprintf(valueLogFileExt, part)); err != nil {
+			if err := db.removeExpiredKeys(cf, expiredKeys); err != nil {
 				return err
 			}
-			db.vlog.walFiles[part] = openVlogFile(part, valueLogFileExt)
+			atomic.AddUint32(&expiredNumber, uint32(len(expiredKeys)))
+
+			// the old segments are removed after the iterators reading them are closed.
+			cf.vlog.complete(part, last)
+			completed = true
 
 			// clean dpTable after compact
-			db.vlog.dpTables[part].clean()
+			cf.vlog.dpTables[part].clean()
 
 			return nil
 		})
 	}
-	db.vlog.cleanDeprecatedTable()
-	return g.Wait()
+	err := g.Wait()
+	cf.vlog.cleanDeprecatedTable()
+	cf.vlog.restoreDeprecated(snapshotUIDs, snapshotDeprecated)
+	cf.vlog.removeExpiredNumber(expiredNumber)
+	return err
 }
 
 // Compact will iterate all values in vlog, find old values by deprecatedtable,
 // and write the valid values to a new vlog file.
 // Then replace the old vlog file with the new one, and delete the old one.
 //
-//nolint:gocognit
+// The value logs of all column families are compacted, the old segments are removed like Compact.
 func (db *DB) CompactWithDeprecatedtable() error {
+	return db.CompactWithDeprecatedtableCtx(context.Background())
+}
+
+// CompactWithDeprecatedtableCtx compacts the value logs like CompactWithDeprecatedtable,
+// but stops if ctx is done, the error of ctx is returned, see CompactCtx.
+func (db *DB) CompactWithDeprecatedtableCtx(ctx context.Context) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	db.scanLock.Lock()
+	defer db.scanLock.Unlock()
 	db.flushLock.Lock()
 	defer db.flushLock.Unlock()
+	db.lockIndex()
+	defer db.unlockIndex()
 
 	log.Println("[CompactWithDeprecatedtable data]")
-	openVlogFile := func(part int, ext string) *wal.WAL {
-		walFile, err := wal.Open(wal.Options{
-			DirPath:        db.vlog.options.dirPath,
-			SegmentSize:    db.vlog.options.segmentSize,
-			SegmentFileExt: fmt.Sprintf(ext, part),
-			Sync:           false, // we will sync manually
-			BytesPerSync:   0,     // the same as Sync
-		})
-		if err != nil {
-			_ = walFile.Delete()
-			panic(err)
+	snapshotRecords := db.snapshotRecords()
+	for _, cf := range db.getFamilies() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.compactWithDeprecatedtable(ctx, cf, snapshotRecords); err != nil {
+			return err
 		}
-		return walFile
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.removeObsoleteSegments()
+}
 
-	g, _ := errgroup.WithContext(context.Background())
+// compactWithDeprecatedtable compacts the value log of the column family, see CompactWithDeprecatedtable.
+// The records in the segments of a stopped compaction are checked against the index instead of
+// the deprecated table, because the ones rewritten before stopping are not deprecated, see valueLog.interrupted.
+//
+//nolint:gocognit,funlen
+func (db *DB) compactWithDeprecatedtable(ctx context.Context, cf *ColumnFamily,
+	snapshotRecords map[uuid.UUID]struct{}) error {
+	g, gctx := errgroup.WithContext(ctx)
 	var capacity int64
-	var capacityList = make([]int64, db.options.PartitionNum)
-	for i := 0; i < int(db.vlog.options.partitionNum); i++ {
+	var capacityList = make([]int64, cf.options.PartitionNum)
+	var expiredNumber uint32
+	snapshotUIDs := make([][]uuid.UUID, cf.options.PartitionNum)
+	var snapshotDeprecated uint32
+	now := time.Now().UnixNano()
+	for i := 0; i < int(cf.vlog.options.partitionNum); i++ {
 		part := i
 		g.Go(func() error {
-			newVlogFile := openVlogFile(part, tempValueLogFileExt)
+			reader, last, err := cf.vlog.compactionReader(part)
+			if err != nil {
+				return err
+			}
+			walFile := cf.vlog.walFiles[part]
 			validRecords := make([]*ValueLogRecord, 0)
-			reader := db.vlog.walFiles[part].NewReader()
+			var expiredKeys [][]byte
+			interrupted := cf.vlog.interrupted[part]
+			var completed bool
+			defer func() {
+				if !completed {
+					cf.vlog.interrupt(part, last)
+				}
+			}()
 			// iterate all records in wal, find the valid records
 			for {
+				if err = gctx.Err(); err != nil {
+					return err
+				}
 				chunk, pos, err := reader.Next()
 				atomic.AddInt64(&capacity, int64(len(chunk)))
 				capacityList[part] += int64(len(chunk))
@@ -803,42 +1387,49 @@ func (db *DB) CompactWithDeprecatedtable() error {
 					if errors.Is(err, io.EOF) {
 						break
 					}
-					_ = newVlogFile.Delete()
 					return err
 				}
 
-				record := decodeValueLogRecord(chunk)
-				if !db.vlog.isDeprecated(part, record.uid) {
-					// not find old uuid in dptable, we add it to validRecords.
-					validRecords = append(validRecords, record)
+				record, err := cf.vlog.decodeRecord(chunk)
+				if err != nil {
+					return err
 				}
-				if db.options.IndexType == Hash {
-					var hashTableKeyPos *KeyPosition
-					// var matchKey func(diskhash.Slot) (bool, error)
-					matchKey := MatchKeyFunc(db, record.key, &hashTableKeyPos, nil)
-					var keyPos *KeyPosition
-					keyPos, err = db.index.Get(record.key, matchKey)
-					if err != nil {
-						_ = newVlogFile.Delete()
+				if isExpired(record.expire, now) {
+					// the expired record will be dropped, remove it from index if it is still the latest one.
+					var current bool
+					if current, err = db.isCurrentRecord(cf, record, part, pos); err != nil {
 						return err
 					}
-
-					if db.options.IndexType == Hash {
-						keyPos = hashTableKeyPos
+					if current {
+						expiredKeys = append(expiredKeys, record.key)
 					}
-
-					if keyPos == nil {
-						continue
+					continue
+				}
+				// the records of the hash index are always checked against the index,
+				// e.g. the keys deleted from the hash index are not deprecated.
+				deprecated := cf.vlog.isDeprecated(part, record.uid)
+				if !deprecated && (cf.options.IndexType == Hash || pos.SegmentId <= interrupted) {
+					var current bool
+					if current, err = db.isCurrentRecord(cf, record, part, pos); err != nil {
+						return err
 					}
-					if keyPos.partition == uint32(part) && reflect.DeepEqual(keyPos.position, pos) {
-						validRecords = append(validRecords, record)
+					deprecated = !current
+				}
+				_, kept := snapshotRecords[record.uid]
+				if !deprecated || kept {
+					// not find old uuid in dptable, or it is still visible to some snapshots,
+					// we add it to validRecords.
+					validRecords = append(validRecords, record)
+				}
+				if kept {
+					snapshotUIDs[part] = append(snapshotUIDs[part], record.uid)
+					if deprecated {
+						atomic.AddUint32(&snapshotDeprecated, 1)
 					}
 				}
-
-				if capacity >= int64(db.vlog.options.compactBatchCapacity) {
-					err = db.rewriteValidRecords(newVlogFile, validRecords, part)
+				if capacity >= int64(cf.vlog.options.compactBatchCapacity) {
+					err = db.rewriteValidRecords(cf, walFile, validRecords, part)
 					if err != nil {
-						_ = newVlogFile.Delete()
 						return err
 					}
 					validRecords = validRecords[:0]
@@ -847,54 +1438,112 @@ func (db *DB) CompactWithDeprecatedtable() error {
 				}
 			}
 			if len(validRecords) > 0 {
-				err := db.rewriteValidRecords(newVlogFile, validRecords, part)
+				err := db.rewriteValidRecords(cf, walFile, validRecords, part)
 				if err != nil {
-					_ = newVlogFile.Delete()
 					return err
 				}
 			}
-
-			// replace the wal with the new one.
-			_ = db.vlog.walFiles[part].Delete()
-			_ = newVlogFile.Close()
-			if err := newVlogFile.RenameFileExt(fmt.Sprintf(valueLogFileExt, part)); err != nil {
+			if err := db.removeExpiredKeys(cf, expiredKeys); err != nil {
 				return err
 			}
-			db.vlog.walFiles[part] = openVlogFile(part, valueLogFileExt)
+			atomic.AddUint32(&expiredNumber, uint32(len(expiredKeys)))
+
+			// the old segments are removed after the iterators reading them are closed.
+			cf.vlog.complete(part, last)
+			completed = true
 			return nil
 		})
 	}
 
 	err := g.Wait()
-	db.vlog.cleanDeprecatedTable()
+	cf.vlog.cleanDeprecatedTable()
+	cf.vlog.restoreDeprecated(snapshotUIDs, snapshotDeprecated)
+	cf.vlog.removeExpiredNumber(expiredNumber)
 	return err
 }
 
-func (db *DB) rewriteValidRecords(walFile *wal.WAL, validRecords []*ValueLogRecord, part int) error {
+// isCurrentRecord checks whether the index of the column family
+// still points to the value log record at the given position.
+func (db *DB) isCurrentRecord(cf *ColumnFamily, record *ValueLogRecord, part int, pos *wal.ChunkPosition) (bool, error) {
+	var hashTableKeyPos *KeyPosition
+	var matchKey func(diskhash.Slot) (bool, error)
+	if cf.options.IndexType == Hash {
+		matchKey = matchKeyFunc(cf.vlog, record.key, &hashTableKeyPos, nil)
+	}
+	keyPos, err := cf.index.Get(record.key, matchKey)
+	if err != nil {
+		return false, err
+	}
+
+	if cf.options.IndexType == Hash {
+		keyPos = hashTableKeyPos
+	}
+
+	if keyPos == nil {
+		return false, nil
+	}
+	return keyPos.partition == uint32(part) && reflect.DeepEqual(keyPos.position, pos), nil
+}
+
+// removeExpiredKeys deletes the expired keys from index,
+// their values are dropped from the value log by compaction.
+func (db *DB) removeExpiredKeys(cf *ColumnFamily, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	matchKeys := make([]diskhash.MatchKeyFunc, len(keys))
+	if cf.options.IndexType == Hash {
+		for i := range matchKeys {
+			matchKeys[i] = matchKeyFunc(cf.vlog, keys[i], nil, nil)
+		}
+	}
+	_, err := cf.index.DeleteBatch(keys, matchKeys...)
+	return err
+}
+
+func (db *DB) rewriteValidRecords(cf *ColumnFamily, walFile *wal.WAL, validRecords []*ValueLogRecord, part int) error {
 	for _, record := range validRecords {
-		walFile.PendingWrites(encodeValueLogRecord(record))
+		// the value is recompressed with the current compression algorithm,
+		// and reencrypted with the current encryption key.
+		buf, err := cf.vlog.encodeRecord(record)
+		if err != nil {
+			walFile.ClearPendingWrites()
+			return err
+		}
+		walFile.PendingWrites(buf)
 	}
 
 	walChunkPositions, err := walFile.WriteAll()
 	if err != nil {
 		return err
 	}
+	// the old records are removed once the index points to the new ones, so they must be persisted first.
+	if err = walFile.Sync(); err != nil {
+		return err
+	}
 
-	positions := make([]*KeyPosition, len(walChunkPositions))
+	positions := make([]*KeyPosition, 0, len(walChunkPositions))
 	for i, walChunkPosition := range walChunkPositions {
-		positions[i] = &KeyPosition{
+		keyPos := &KeyPosition{
 			key:       validRecords[i].key,
 			partition: uint32(part),
+			uid:       validRecords[i].uid,
+			expire:    validRecords[i].expire,
 			position:  walChunkPosition,
 		}
+		// the records kept by snapshots are not in index, just update their positions.
+		if db.updateSnapshotPosition(keyPos) {
+			continue
+		}
+		positions = append(positions, keyPos)
 	}
 	matchKeys := make([]diskhash.MatchKeyFunc, len(positions))
-	if db.options.IndexType == Hash {
+	if cf.options.IndexType == Hash {
 		for i := range matchKeys {
-			matchKeys[i] = MatchKeyFunc(db, positions[i].key, nil, nil)
+			matchKeys[i] = matchKeyFunc(cf.vlog, positions[i].key, nil, nil)
 		}
 	}
-	_, err = db.index.PutBatch(positions, matchKeys...)
+	_, err = cf.index.PutBatch(positions, matchKeys...)
 	return err
 }
 
@@ -946,6 +1595,27 @@ func loadDeprecatedEntryMeta(deprecatedMetaPath string) (uint32, uint32, error)
 	return deprecatedNumber, totalEntryNumber, nil
 }
 
+// writeMetaFile writes the meta file, it is written to a temporary file
+// and renamed, so the meta file is never partially written.
+func writeMetaFile(path string, buf []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
 // persist deprecated number and total entry number.
 func storeDeprecatedEntryMeta(deprecatedMetaPath string, deprecatedNumber uint32, totalNumber uint32) error {
 	file, err := os.OpenFile(deprecatedMetaPath, os.O_RDWR|os.O_TRUNC, 0666)
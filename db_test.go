@@ -2,14 +2,24 @@ package lotusdb
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/google/uuid"
+	"github.com/lotusdblabs/bbolt"
 	"github.com/lotusdblabs/lotusdb/v2/util"
 	"github.com/rosedblabs/diskhash"
+	"github.com/rosedblabs/wal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -61,6 +71,65 @@ func TestDBOpen(t *testing.T) {
 	})
 }
 
+// The directories in testdata/baseline are written before the expiration time is added to the records,
+// with 100 keys flushed to the index and value log, and the key 000 and 001 rewritten in the wal.
+func TestDBOpenBaselineFormat(t *testing.T) {
+	for name, indexType := range map[string]IndexType{"btree": BTree, "hash": Hash} {
+		t.Run(name, func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-baseline")
+			require.NoError(t, err)
+			require.NoError(t, copyDir(filepath.Join("testdata", "baseline", name), path))
+			options.DirPath = path
+			options.IndexType = indexType
+			options.PartitionNum = 2
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			check := func() {
+				v, errGet := db.Get([]byte("key 000"))
+				require.NoError(t, errGet)
+				assert.Equal(t, []byte("memtable"), v)
+				_, errGet = db.Get([]byte("key 001"))
+				require.ErrorIs(t, errGet, ErrKeyNotFound)
+				v, errGet = db.Get([]byte("key 099"))
+				require.NoError(t, errGet)
+				assert.Equal(t, []byte("flushed"), v)
+			}
+			check()
+			// the new records with the expiration time are written next to the old ones
+			ttl := time.Second
+			require.NoError(t, db.PutWithTTL([]byte("key 100"), []byte("expire"), ttl))
+			require.NoError(t, db.PutWithTTL([]byte("key 101"), []byte("expire"), ttl))
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.PutWithTTL([]byte("key 101"), []byte("expire"), ttl))
+			require.NoError(t, db.Compact())
+			require.NoError(t, db.Close())
+
+			db, err = Open(options)
+			require.NoError(t, err)
+			check()
+			v, err := db.Get([]byte("key 100"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("expire"), v)
+			time.Sleep(ttl)
+			for _, key := range []string{"key 100", "key 101"} {
+				_, err = db.Get([]byte(key))
+				require.ErrorIs(t, err, ErrKeyNotFound)
+			}
+			itr, err := db.NewIterator(IteratorOptions{})
+			require.NoError(t, err)
+			var keys int
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				keys++
+			}
+			require.NoError(t, itr.Close())
+			assert.Equal(t, 99, keys)
+		})
+	}
+}
+
 func TestDBClose(t *testing.T) {
 	options := DefaultOptions
 	path, err := os.MkdirTemp("", "db-test-close")
@@ -354,6 +423,206 @@ func TestDBExist(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDBPutWithTTL(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-put-ttl")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	ttlKey, ttlValue := []byte("key ttl"), []byte("value ttl")
+	persistKey, persistValue := []byte("key persist"), []byte("value persist")
+	ttl := 100 * time.Millisecond
+
+	iterKeys := func() [][]byte {
+		iter, errIter := db.NewIterator(IteratorOptions{})
+		require.NoError(t, errIter)
+		var keys [][]byte
+		for iter.Valid() {
+			keys = append(keys, iter.Key())
+			iter.Next()
+		}
+		require.NoError(t, iter.Close())
+		return keys
+	}
+
+	t.Run("expire in memtable", func(t *testing.T) {
+		require.NoError(t, db.PutWithTTL(ttlKey, ttlValue, ttl))
+		require.NoError(t, db.Put(persistKey, persistValue))
+
+		value, errGet := db.Get(ttlKey)
+		require.NoError(t, errGet)
+		assert.Equal(t, ttlValue, value)
+		assert.Len(t, iterKeys(), 2)
+
+		time.Sleep(ttl)
+		_, errGet = db.Get(ttlKey)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		exist, errExist := db.Exist(ttlKey)
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+		assert.Equal(t, [][]byte{persistKey}, iterKeys())
+	})
+
+	t.Run("expire in index", func(t *testing.T) {
+		batch := db.NewBatch(DefaultBatchOptions)
+		require.NoError(t, batch.PutWithTTL(ttlKey, ttlValue, ttl))
+		require.NoError(t, batch.Commit())
+		db.flushMemtable(db.activeMem)
+
+		value, errGet := db.Get(ttlKey)
+		require.NoError(t, errGet)
+		assert.Equal(t, ttlValue, value)
+
+		time.Sleep(ttl)
+		_, errGet = db.Get(ttlKey)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		exist, errExist := db.Exist(ttlKey)
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+		assert.Equal(t, [][]byte{persistKey}, iterKeys())
+	})
+
+	t.Run("drop expired in compaction", func(t *testing.T) {
+		require.NoError(t, db.Compact())
+		_, errGet := getValueFromVlog(db, ttlKey)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		value, errGet := db.Get(persistKey)
+		require.NoError(t, errGet)
+		assert.Equal(t, persistValue, value)
+
+		options := DefaultWriteOptions
+		options.TTL = ttl
+		require.NoError(t, db.PutWithOptions(ttlKey, ttlValue, options))
+		db.flushMemtable(db.activeMem)
+		time.Sleep(ttl)
+		require.NoError(t, db.CompactWithDeprecatedtable())
+		_, errGet = getValueFromVlog(db, ttlKey)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		value, errGet = db.Get(persistKey)
+		require.NoError(t, errGet)
+		assert.Equal(t, persistValue, value)
+	})
+}
+
+func TestDBReadModifyWrite(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-read-modify-write")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	key := []byte("key")
+
+	t.Run("put if absent", func(t *testing.T) {
+		put, errPut := db.PutIfAbsent(key, []byte("value 1"))
+		require.NoError(t, errPut)
+		assert.True(t, put)
+		put, errPut = db.PutIfAbsent(key, []byte("value 2"))
+		require.NoError(t, errPut)
+		assert.False(t, put)
+		value, errGet := db.Get(key)
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value 1"), value)
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		db.flushMemtable(db.activeMem)
+		swapped, errSwap := db.CompareAndSwap(key, []byte("value 2"), []byte("value 3"))
+		require.NoError(t, errSwap)
+		assert.False(t, swapped)
+		swapped, errSwap = db.CompareAndSwap(key, nil, []byte("value 3"))
+		require.NoError(t, errSwap)
+		assert.False(t, swapped)
+		swapped, errSwap = db.CompareAndSwap(key, []byte("value 1"), []byte("value 3"))
+		require.NoError(t, errSwap)
+		assert.True(t, swapped)
+		value, errGet := db.Get(key)
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value 3"), value)
+
+		swapped, errSwap = db.CompareAndSwap([]byte("key absent"), nil, []byte("value"))
+		require.NoError(t, errSwap)
+		assert.True(t, swapped)
+	})
+
+	t.Run("get and delete", func(t *testing.T) {
+		value, errGet := db.GetAndDelete(key)
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value 3"), value)
+		_, errGet = db.GetAndDelete(key)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+		_, errGet = db.Get(key)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		errUpdate := errors.New("update failed")
+		require.ErrorIs(t, db.Update(key, func([]byte) ([]byte, error) {
+			return nil, errUpdate
+		}), errUpdate)
+
+		// increase the counter concurrently
+		incr := func(old []byte) ([]byte, error) {
+			var counter int
+			if old != nil {
+				counter, _ = strconv.Atoi(string(old))
+			}
+			return []byte(strconv.Itoa(counter + 1)), nil
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					assert.NoError(t, db.Update(key, incr))
+				}
+			}()
+		}
+		wg.Wait()
+		value, errGet := db.Get(key)
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("1000"), value)
+
+		// nil value deletes the key
+		require.NoError(t, db.Update(key, func([]byte) ([]byte, error) {
+			return nil, nil
+		}))
+		_, errGet = db.Get(key)
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	})
+
+	t.Run("write options", func(t *testing.T) {
+		set := func([]byte) ([]byte, error) {
+			return []byte("value"), nil
+		}
+		require.NoError(t, db.UpdateWithOptions([]byte("sync"), set, WriteOptions{Sync: true}))
+		require.NoError(t, db.UpdateWithOptions([]byte("no wal"), set, WriteOptions{DisableWal: true}))
+		value, errGet := db.Get([]byte("no wal"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value"), value)
+
+		// the write without wal is lost after reopening, since the memtable is not flushed
+		require.NoError(t, db.Close())
+		db, err = Open(options)
+		require.NoError(t, err)
+		value, errGet = db.Get([]byte("sync"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value"), value)
+		_, errGet = db.Get([]byte("no wal"))
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	})
+}
+
 func TestDBFlushMemTables(t *testing.T) {
 	options := DefaultOptions
 	path, err := os.MkdirTemp("", "db-test-flush")
@@ -393,7 +662,7 @@ func TestDBFlushMemTables(t *testing.T) {
 	}
 	for i := 0; i < numLogs; i++ {
 		// the size of a logRecord is about 1MB (a little bigger than 1MB due to encode)
-		log := &testLog{key: util.RandomValue(2 << 18), value: util.RandomValue(2 << 18)}
+		log := &testLog{key: util.RandomValue(2 << 8), value: util.RandomValue(2 << 19)}
 		_ = db.PutWithOptions(log.key, log.value, WriteOptions{
 			Sync:       true,
 			DisableWal: false,
@@ -418,7 +687,7 @@ func TestDBFlushMemTables(t *testing.T) {
 			})
 			for i := 0; i < numLogs; i++ {
 				// the size of a logRecord is about 1MB (a little bigger than 1MB due to encode)
-				tlog := &testLog{key: util.RandomValue(2 << 18), value: util.RandomValue(2 << 18)}
+				tlog := &testLog{key: util.RandomValue(2 << 8), value: util.RandomValue(2 << 19)}
 				_ = db.PutWithOptions(tlog.key, tlog.value, WriteOptions{
 					Sync:       true,
 					DisableWal: false,
@@ -859,31 +1128,31 @@ func TestDBIterator(t *testing.T) {
 	}
 	logRecord0 := []*LogRecord{
 		// 0
-		{[]byte("k3"), nil, LogRecordDeleted, 0},
-		{[]byte("k1"), []byte("v1"), LogRecordNormal, 0},
-		{[]byte("k1"), []byte("v1_1"), LogRecordNormal, 0},
-		{[]byte("k2"), []byte("v1_1"), LogRecordNormal, 0},
-		{[]byte("abc3"), nil, LogRecordDeleted, 0},
-		{[]byte("abc1"), []byte("v1"), LogRecordNormal, 0},
-		{[]byte("abc1"), []byte("v1_1"), LogRecordNormal, 0},
-		{[]byte("abc2"), []byte("v1_1"), LogRecordNormal, 0},
+		{[]byte("k3"), nil, LogRecordDeleted, 0, 0, 0},
+		{[]byte("k1"), []byte("v1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("k1"), []byte("v1_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("k2"), []byte("v1_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc3"), nil, LogRecordDeleted, 0, 0, 0},
+		{[]byte("abc1"), []byte("v1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc1"), []byte("v1_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc2"), []byte("v1_1"), LogRecordNormal, 0, 0, 0},
 	}
 	logRecord1 := []*LogRecord{
-		{[]byte("k1"), []byte("v2_1"), LogRecordNormal, 0},
-		{[]byte("k2"), []byte("v2_1"), LogRecordNormal, 0},
-		{[]byte("k2"), []byte("v2_2"), LogRecordNormal, 0},
-		{[]byte("abc1"), []byte("v2_1"), LogRecordNormal, 0},
-		{[]byte("abc2"), []byte("v2_1"), LogRecordNormal, 0},
-		{[]byte("abc2"), []byte("v2_2"), LogRecordNormal, 0},
+		{[]byte("k1"), []byte("v2_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("k2"), []byte("v2_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("k2"), []byte("v2_2"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc1"), []byte("v2_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc2"), []byte("v2_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc2"), []byte("v2_2"), LogRecordNormal, 0, 0, 0},
 	}
 	logRecord2 := []*LogRecord{
 		// 2
-		{[]byte("k2"), nil, LogRecordDeleted, 0},
-		{[]byte("abc2"), nil, LogRecordDeleted, 0},
+		{[]byte("k2"), nil, LogRecordDeleted, 0, 0, 0},
+		{[]byte("abc2"), nil, LogRecordDeleted, 0, 0, 0},
 	}
 	logRecord3 := []*LogRecord{
-		{[]byte("k3"), []byte("v3_1"), LogRecordNormal, 0},
-		{[]byte("abc3"), []byte("v3_1"), LogRecordNormal, 0},
+		{[]byte("k3"), []byte("v3_1"), LogRecordNormal, 0, 0, 0},
+		{[]byte("abc3"), []byte("v3_1"), LogRecordNormal, 0, 0, 0},
 	}
 
 	list2Map := func(in []*LogRecord) map[string]*LogRecord {
@@ -893,14 +1162,16 @@ func TestDBIterator(t *testing.T) {
 		}
 		return out
 	}
-	err = db.immuMems[0].putBatch(list2Map(logRecord0), 0, DefaultWriteOptions)
+	err = db.immuMems[0].putBatch(list2Map(logRecord0), 0, 1, DefaultWriteOptions)
 	require.NoError(t, err)
-	err = db.immuMems[1].putBatch(list2Map(logRecord1), 1, DefaultWriteOptions)
+	err = db.immuMems[1].putBatch(list2Map(logRecord1), 1, 2, DefaultWriteOptions)
 	require.NoError(t, err)
-	err = db.immuMems[2].putBatch(list2Map(logRecord2), 2, DefaultWriteOptions)
+	err = db.immuMems[2].putBatch(list2Map(logRecord2), 2, 3, DefaultWriteOptions)
 	require.NoError(t, err)
-	err = db.activeMem.putBatch(list2Map(logRecord3), 3, DefaultWriteOptions)
+	err = db.activeMem.putBatch(list2Map(logRecord3), 3, 4, DefaultWriteOptions)
 	require.NoError(t, err)
+	// the batches are committed with seq 1 ~ 4
+	db.seq = 4
 
 	expectedKey := [][]byte{
 		[]byte("k1"),
@@ -1045,15 +1316,608 @@ func TestDBIterator(t *testing.T) {
 	}
 	err = iter.Close()
 	require.NoError(t, err)
+}
 
-	// unsupported type
-	options = DefaultOptions
+func TestDBIteratorHash(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-iter-hash")
+	require.NoError(t, err)
+	options.DirPath = path
 	options.IndexType = Hash
-	db, err = Open(options)
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// key 0 ~ key 9 are in index, key 10 ~ key 19 are in memtable
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			db.flushMemtable(db.activeMem)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %02d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	// the overwritten and deleted keys in index are not iterated
+	require.NoError(t, db.Put([]byte("key 03"), []byte("value 3 new")))
+	require.NoError(t, db.Delete([]byte("key 05")))
+	require.NoError(t, db.Delete([]byte("key 15")))
+	require.NoError(t, db.PutWithTTL([]byte("key 07"), []byte("value 7"), time.Millisecond))
+	db.flushMemtable(db.activeMem)
+	time.Sleep(time.Millisecond * 5)
+	require.NoError(t, db.Put([]byte("key 20"), []byte("value 20")))
+
+	expected := make(map[string][]byte)
+	for i := 0; i <= 20; i++ {
+		if i != 5 && i != 7 && i != 15 {
+			expected[fmt.Sprintf("key %02d", i)] = []byte(fmt.Sprintf("value %d", i))
+		}
+	}
+	expected["key 03"] = []byte("value 3 new")
+
+	for _, reverse := range []bool{false, true} {
+		iter, errIter := db.NewIterator(IteratorOptions{Reverse: reverse})
+		require.NoError(t, errIter)
+		var prev []byte
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if prev != nil {
+				assert.Equal(t, reverse, bytes.Compare(prev, iter.Key()) > 0)
+			}
+			assert.Equal(t, expected[string(iter.Key())], iter.Value())
+			prev = iter.Key()
+			count++
+		}
+		assert.Equal(t, len(expected), count)
+		require.NoError(t, iter.Close())
+	}
+
+	iter, err := db.NewIterator(IteratorOptions{Prefix: []byte("key 1")})
+	require.NoError(t, err)
+	iter.Seek([]byte("key 14"))
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"key 14", "key 16", "key 17", "key 18", "key 19"}, keys)
+	require.NoError(t, iter.Close())
+
+	// the keys overwritten and flushed while the index is loaded are still iterated.
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key %04d", i)
+		expected[key] = []byte(key)
+		require.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+	db.flushMemtable(db.activeMem)
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for i := 0; i < 5000; i += 100 {
+				key := fmt.Sprintf("key %04d", i)
+				assert.NoError(t, db.Put([]byte(key), []byte(key)))
+			}
+			db.flushMemtable(db.activeMem)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		iter, err = db.NewIterator(IteratorOptions{})
+		require.NoError(t, err)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, expected[string(iter.Key())], iter.Value())
+			count++
+		}
+		assert.Equal(t, len(expected), count)
+		require.NoError(t, iter.Close())
+	}
+	close(done)
+	<-flushed
+}
+
+func TestDBIteratorBounds(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-iter-bounds")
+		require.NoError(t, err)
+		options.DirPath = path
+		options.IndexType = indexType
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		// even keys are in index, odd keys are in memtable
+		for i := 0; i < 20; i += 2 {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %02d", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+		for i := 1; i < 20; i += 2 {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %02d", i)), []byte("value")))
+		}
+
+		// the expected keys are in [from, to) in forward mode and [rfrom, rto) in reverse mode
+		tests := []struct {
+			name       string
+			options    IteratorOptions
+			seek       []byte
+			from, to   int
+			rfrom, rto int
+		}{
+			{"lower", IteratorOptions{LowerBound: []byte("key 05")}, nil, 5, 20, 5, 20},
+			{"upper", IteratorOptions{UpperBound: []byte("key 05")}, nil, 0, 5, 0, 5},
+			{"both", IteratorOptions{LowerBound: []byte("key 03"), UpperBound: []byte("key 12")}, nil, 3, 12, 3, 12},
+			{"not exist", IteratorOptions{LowerBound: []byte("key 035"), UpperBound: []byte("key 125")}, nil, 4, 13, 4, 13},
+			{"empty", IteratorOptions{LowerBound: []byte("key 12"), UpperBound: []byte("key 03")}, nil, 0, 0, 0, 0},
+			{"prefix", IteratorOptions{LowerBound: []byte("key 05"), Prefix: []byte("key 0")}, nil, 5, 10, 5, 10},
+			{"seek", IteratorOptions{LowerBound: []byte("key 03"), UpperBound: []byte("key 12")}, []byte("key 08"), 8, 12, 3, 9},
+			{"seek before", IteratorOptions{LowerBound: []byte("key 03"), UpperBound: []byte("key 12")}, []byte("a"), 3, 12, 0, 0},
+			{"seek after", IteratorOptions{LowerBound: []byte("key 03"), UpperBound: []byte("key 12")}, []byte("z"), 0, 0, 3, 12},
+		}
+		for _, tt := range tests {
+			for _, reverse := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%d %s %v", indexType, tt.name, reverse), func(t *testing.T) {
+					tt.options.Reverse = reverse
+					iter, errIter := db.NewIterator(tt.options)
+					require.NoError(t, errIter)
+					defer iter.Close()
+
+					if tt.seek == nil {
+						iter.Rewind()
+					} else {
+						iter.Seek(tt.seek)
+					}
+					from, to := tt.from, tt.to
+					if reverse {
+						from, to = tt.rfrom, tt.rto
+					}
+					var keys []string
+					for ; iter.Valid(); iter.Next() {
+						keys = append(keys, string(iter.Key()))
+					}
+					var expected []string
+					for i := from; i < to; i++ {
+						expected = append(expected, fmt.Sprintf("key %02d", i))
+					}
+					if reverse {
+						for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+							expected[i], expected[j] = expected[j], expected[i]
+						}
+					}
+					assert.Equal(t, expected, keys)
+				})
+			}
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDBIteratorNotBlockWrites(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-iter-writes")
+		require.NoError(t, err)
+		options.DirPath = path
+		options.IndexType = indexType
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+		for i := 10; i < 20; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+		}
+
+		iter, err := db.NewIterator(IteratorOptions{})
+		require.NoError(t, err)
+
+		// the writes, reads and flushes are not blocked by the iterator, and are invisible to it.
+		require.NoError(t, db.Put([]byte("key 0"), []byte("new value")))
+		require.NoError(t, db.Put([]byte("key new"), []byte("value")))
+		require.NoError(t, db.Delete([]byte("key 15")))
+		value, err := db.Get([]byte("key 0"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new value"), value)
+		db.flushMemtable(db.activeMem)
+		require.NoError(t, db.Put([]byte("key 1"), []byte("new value")))
+
+		// compaction is not blocked by the iterator, the segments it reads are kept until it is closed.
+		require.NoError(t, db.Compact())
+		segment := wal.SegmentFileName(path, fmt.Sprintf(valueLogFileExt, 0), 1)
+		assert.FileExists(t, segment)
+
+		count := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.NotEqual(t, []byte("key new"), iter.Key())
+			assert.Equal(t, []byte("value"), iter.Value())
+			count++
+		}
+		assert.Equal(t, 20, count)
+		require.NoError(t, iter.Close())
+		require.NoError(t, iter.Close())
+		db.flushMemtable(db.activeMem)
+		assert.NoFileExists(t, segment)
+
+		iter, err = db.NewIterator(IteratorOptions{})
+		require.NoError(t, err)
+		count = 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			count++
+		}
+		assert.Equal(t, 20, count)
+		require.NoError(t, iter.Close())
+
+		require.NoError(t, db.Close())
+		_, err = db.NewIterator(IteratorOptions{})
+		require.ErrorIs(t, err, ErrDBClosed)
+		_ = os.RemoveAll(path)
+	}
+}
+
+func TestDBIteratorPages(t *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-iter-pages")
+		require.NoError(t, err)
+		options.DirPath = path
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		// the keys span several pages of every partition.
+		num := bptreeIteratorPageSize * int(options.PartitionNum) * 4
+		for i := 0; i < num; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %05d", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+
+		iter, err := db.NewIterator(IteratorOptions{Reverse: reverse})
+		require.NoError(t, err)
+		iter.Rewind()
+		require.True(t, iter.Valid())
+
+		// the index is changed before the next pages are read, the changes are invisible to the iterator.
+		for i := 0; i < num; i++ {
+			key := []byte(fmt.Sprintf("key %05d", i))
+			if i%3 == 0 {
+				require.NoError(t, db.Delete(key))
+			} else {
+				require.NoError(t, db.Put(key, []byte("new value")))
+			}
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %05d new", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+		require.NoError(t, db.Compact())
+
+		count := 0
+		var prev []byte
+		for ; iter.Valid(); iter.Next() {
+			if reverse {
+				assert.True(t, prev == nil || bytes.Compare(prev, iter.Key()) > 0)
+			} else {
+				assert.True(t, prev == nil || bytes.Compare(prev, iter.Key()) < 0)
+			}
+			prev = append(prev[:0], iter.Key()...)
+			assert.Len(t, iter.Key(), len("key 00000"))
+			assert.Equal(t, []byte("value"), iter.Value())
+			count++
+		}
+		require.NoError(t, iter.Err())
+		assert.Equal(t, num, count)
+		require.NoError(t, iter.Close())
+
+		iter, err = db.NewIterator(IteratorOptions{Reverse: reverse})
+		require.NoError(t, err)
+		count = 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			count++
+		}
+		assert.Equal(t, num-(num+2)/3+num, count)
+		require.NoError(t, iter.Close())
+		destroyDB(db)
+	}
+}
+
+func TestDBCloseWithOpenIterator(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-iter-close")
+		require.NoError(t, err)
+		options.DirPath = path
+		options.IndexType = indexType
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+		iter, err := db.NewIterator(IteratorOptions{})
+		require.NoError(t, err)
+		iter.Rewind()
+		require.True(t, iter.Valid())
+
+		// the segments read by the iterator are kept after compaction.
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("new value")))
+		}
+		db.flushMemtable(db.activeMem)
+		require.NoError(t, db.Compact())
+		segment := wal.SegmentFileName(path, fmt.Sprintf(valueLogFileExt, 0), 1)
+		assert.FileExists(t, segment)
+
+		// the iterator is invalid after Close instead of blocking it, and it is still closed by the owner.
+		require.NoError(t, db.Close())
+		assert.False(t, iter.Valid())
+		require.ErrorIs(t, iter.Err(), ErrDBClosed)
+		require.NoError(t, iter.Close())
+		assert.NoFileExists(t, segment)
+
+		db, err = Open(options)
+		require.NoError(t, err)
+		value, err := db.Get([]byte("key 0"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new value"), value)
+		destroyDB(db)
+	}
+}
+
+func TestDBIteratorErr(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-iter-err")
 	require.NoError(t, err)
-	itr, err := db.NewIterator(IteratorOptions{Reverse: false})
-	assert.Equal(t, ErrDBIteratorUnsupportedTypeHASH, err)
-	assert.Nil(t, itr)
+	options.DirPath = path
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("key 0"), []byte("value 0")))
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1")))
+	db.flushMemtable(db.activeMem)
+
+	iter, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	require.True(t, iter.Valid())
+	value, err := iter.ValueErr()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 0"), value)
+	require.NoError(t, iter.Close())
+	// the closed iterator is invalid
+	assert.False(t, iter.Valid())
+	assert.Nil(t, iter.Key())
+	_, err = iter.ValueErr()
+	require.ErrorIs(t, err, ErrIteratorClosed)
+	iter.Next()
+	iter.Rewind()
+	require.NoError(t, iter.Close())
+
+	// corrupt the index entries
+	putIndex := func(key, value []byte) {
+		index, ok := db.index.(*BPTree)
+		require.True(t, ok)
+		tree := index.trees[db.vlog.getKeyPartition(key)]
+		require.NoError(t, tree.Update(func(tx *bbolt.Tx) error {
+			errPut, _ := tx.Bucket(indexBucketName).Put(key, value)
+			return errPut
+		}))
+	}
+	putIndex([]byte("key 0"), []byte("corrupted"))
+	putIndex([]byte("key 1"), encodeIndexValue(&KeyPosition{
+		uid:      uuid.New(),
+		position: &wal.ChunkPosition{SegmentId: 100, ChunkSize: 10},
+	}))
+
+	iter, err = db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	require.True(t, iter.Valid())
+	assert.Equal(t, []byte("key 0"), iter.Key())
+	value, err = iter.ValueErr()
+	require.ErrorIs(t, err, ErrChunkPositionCorrupted)
+	assert.Nil(t, value)
+	// the iterator is invalid after the error
+	assert.False(t, iter.Valid())
+	require.ErrorIs(t, iter.Err(), ErrChunkPositionCorrupted)
+	assert.Nil(t, iter.Value())
+	require.NoError(t, iter.Close())
+
+	iter, err = db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	iter.Seek([]byte("key 1"))
+	require.True(t, iter.Valid())
+	assert.Nil(t, iter.Value())
+	require.Error(t, iter.Err())
+	assert.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+}
+
+func TestDBIteratorKeysOnly(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-iter-keys-only")
+		require.NoError(t, err)
+		options.DirPath = path
+		options.IndexType = indexType
+		options.MergeOperator = appendOperator
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		// the values cross the block boundary of value log in different offsets
+		expected := make(map[string][]byte)
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key %02d", i)
+			expected[key] = util.RandomValue((i + 1) * 7000)
+			require.NoError(t, db.Put([]byte(key), expected[key]))
+			if i == 9 {
+				db.flushMemtable(db.activeMem)
+			}
+		}
+		require.NoError(t, db.Merge([]byte("key 00"), []byte("merged")))
+		expected["key 00"] = append(append(expected["key 00"], ','), []byte("merged")...)
+
+		for _, keysOnly := range []bool{false, true} {
+			iter, errIter := db.NewIterator(IteratorOptions{KeysOnly: keysOnly})
+			require.NoError(t, errIter)
+			count := 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				size, errSize := iter.ValueSize()
+				require.NoError(t, errSize)
+				assert.Equal(t, len(expected[string(iter.Key())]), size)
+				value, errValue := iter.ValueErr()
+				if keysOnly {
+					require.ErrorIs(t, errValue, ErrIteratorKeysOnly)
+					assert.Nil(t, value)
+				} else {
+					require.NoError(t, errValue)
+					assert.Equal(t, expected[string(iter.Key())], value)
+				}
+				count++
+			}
+			require.NoError(t, iter.Err())
+			assert.Equal(t, 20, count)
+			require.NoError(t, iter.Close())
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDBCompactStopped(t *testing.T) {
+	compactions := map[string]func(db *DB, ctx context.Context) error{
+		"compact":                 (*DB).CompactCtx,
+		"compact with deprecated": (*DB).CompactWithDeprecatedtableCtx,
+	}
+	for _, indexType := range []IndexType{BTree, Hash} {
+		for name, compact := range compactions {
+			t.Run(fmt.Sprintf("%s index type %d", name, indexType), func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				// the compaction is stopped when it reaches the key, after some batches are rewritten.
+				var stopping atomic.Bool
+				options := DefaultOptions
+				path, err := os.MkdirTemp("", "db-test-compact-stopped")
+				require.NoError(t, err)
+				options.DirPath = path
+				options.IndexType = indexType
+				options.PartitionNum = 1
+				options.CompactBatchCapacity = 1 * KB
+				options.KeyHashFunction = func(key []byte) uint64 {
+					if stopping.Load() && string(key) == "key 150" {
+						cancel()
+					}
+					return xxhash.Sum64(key)
+				}
+				db, err := Open(options)
+				require.NoError(t, err)
+				defer destroyDB(db)
+
+				for i := 0; i < 200; i++ {
+					require.NoError(t, db.Put([]byte(fmt.Sprintf("key %03d", i)), []byte("value")))
+				}
+				// the index is read for the expired key by all the compactions.
+				require.NoError(t, db.PutWithTTL([]byte("key 150"), []byte("value"), time.Millisecond))
+				db.flushMemtable(db.activeMem)
+				for i := 0; i < 50; i++ {
+					require.NoError(t, db.Put([]byte(fmt.Sprintf("key %03d", i)), []byte("new value")))
+				}
+				db.flushMemtable(db.activeMem)
+
+				stopping.Store(true)
+				require.ErrorIs(t, compact(db, ctx), context.Canceled)
+				stopping.Store(false)
+				assert.NotZero(t, db.vlog.interrupted[0])
+				assert.Zero(t, db.vlog.obsolete[0])
+
+				// the stopped compaction is resumed, the records rewritten before stopping are dropped.
+				require.NoError(t, compact(db, context.Background()))
+				assert.Zero(t, db.vlog.interrupted[0])
+				report, err := db.Verify(context.Background(), VerifyOptions{CheckOrphans: true})
+				require.NoError(t, err)
+				assert.True(t, report.OK(), report.Issues)
+				assert.Equal(t, 199, report.ValueLogRecords)
+				for i := 0; i < 200; i++ {
+					value, errGet := db.Get([]byte(fmt.Sprintf("key %03d", i)))
+					if i == 150 {
+						require.ErrorIs(t, errGet, ErrKeyNotFound)
+						continue
+					}
+					require.NoError(t, errGet)
+					if i < 50 {
+						assert.Equal(t, []byte("new value"), value)
+					} else {
+						assert.Equal(t, []byte("value"), value)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDBContext(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-ctx")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MemtableSize = 1 * MB
+	options.MemtableNums = 2
+	options.WaitMemSpaceTimeout = time.Minute
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("put and get", func(t *testing.T) {
+		require.ErrorIs(t, db.PutCtx(canceled, []byte("key"), []byte("value"), DefaultWriteOptions), context.Canceled)
+		_, err = db.Get([]byte("key"))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+
+		require.NoError(t, db.PutCtx(context.Background(), []byte("key"), []byte("value"), DefaultWriteOptions))
+		value, errGet := db.GetCtx(context.Background(), []byte("key"), DefaultReadOptions)
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value"), value)
+		_, err = db.GetCtx(canceled, []byte("key"), DefaultReadOptions)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("iterator", func(t *testing.T) {
+		_, err = db.NewIteratorCtx(canceled, IteratorOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+		iter, errIter := db.NewIteratorCtx(context.Background(), IteratorOptions{})
+		require.NoError(t, errIter)
+		require.NoError(t, iter.Close())
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+		}
+		db.flushMemtable(db.activeMem)
+		require.ErrorIs(t, db.CompactCtx(canceled), context.Canceled)
+		require.NoError(t, db.CompactCtx(context.Background()))
+		for i := 0; i < 100; i++ {
+			value, errGet := db.Get([]byte(fmt.Sprintf("key %d", i)))
+			require.NoError(t, errGet)
+			assert.Equal(t, []byte("value"), value)
+		}
+	})
+
+	t.Run("wait memtable space", func(t *testing.T) {
+		// block the flush, so the memtables will be full
+		db.flushLock.Lock()
+		defer db.flushLock.Unlock()
+		ctx, cancelTimeout := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancelTimeout()
+		value := util.RandomValue(64 * KB)
+		for i := 0; ; i++ {
+			err = db.PutCtx(ctx, []byte(fmt.Sprintf("key %d", i)), value, DefaultWriteOptions)
+			if err != nil {
+				break
+			}
+		}
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
 }
 
 func TestDeprecatetableMetaPersist(t *testing.T) {
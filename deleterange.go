@@ -0,0 +1,179 @@
+package lotusdb
+
+import (
+	"bytes"
+)
+
+// rangeTombstone marks all the keys in [start, end) as deleted,
+// only the versions older than the tombstone are deleted.
+// The start and end are the keys in memtables, which are prefixed by the column family,
+// see familyKey, so a tombstone never deletes the keys of other column families.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seq   uint64 // commit sequence number of the tombstone
+}
+
+// newRangeTombstone creates a range tombstone from the log record committed with seq.
+// An empty end in the record means all the keys of the column family not less than start.
+func newRangeTombstone(record *LogRecord, seq uint64) *rangeTombstone {
+	tombstone := &rangeTombstone{start: familyKey(record.ColumnFamily, record.Key), seq: seq}
+	if len(record.Value) > 0 {
+		tombstone.end = familyKey(record.ColumnFamily, record.Value)
+	} else {
+		tombstone.end = familyKey(record.ColumnFamily+1, nil)
+	}
+	return tombstone
+}
+
+// familyID returns the id of the column family of the tombstone.
+func (rt *rangeTombstone) familyID() uint32 {
+	id, _ := splitFamilyKey(rt.start)
+	return id
+}
+
+// keyRange returns the range of the tombstone in its column family, a nil end means no upper limit.
+func (rt *rangeTombstone) keyRange() ([]byte, []byte) {
+	id, start := splitFamilyKey(rt.start)
+	endID, end := splitFamilyKey(rt.end)
+	if endID != id {
+		return start, nil
+	}
+	return start, end
+}
+
+// contains checks whether the key is in the range of the tombstone.
+func (rt *rangeTombstone) contains(key []byte) bool {
+	return keyInRange(key, rt.start, rt.end)
+}
+
+// isRangeDeleted checks whether the version of the key committed with seq is deleted by the tombstones.
+func isRangeDeleted(tombstones []*rangeTombstone, key []byte, seq uint64) bool {
+	for _, tombstone := range tombstones {
+		if tombstone.seq > seq && tombstone.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyInRange checks whether the key is in [start, end), a nil end means there is no upper limit.
+func keyInRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// prefixEnd returns the smallest key greater than all the keys with the prefix,
+// nil is returned if there is no such key, which means no upper limit.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// DeleteRange delete range with defaultWriteOptions.
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.DeleteRangeWithOptions(start, end, DefaultWriteOptions)
+}
+
+// DeleteRangeWithOptions deletes all the keys in [start, end) from the default column family,
+// see ColumnFamily.DeleteRangeWithOptions.
+func (db *DB) DeleteRangeWithOptions(start, end []byte, options WriteOptions) error {
+	return db.defaultFamily.DeleteRangeWithOptions(start, end, options)
+}
+
+// DropPrefix drop prefix with defaultWriteOptions.
+func (db *DB) DropPrefix(prefix []byte) error {
+	return db.DropPrefixWithOptions(prefix, DefaultWriteOptions)
+}
+
+// DropPrefixWithOptions deletes all the keys with the prefix from the database, see DeleteRangeWithOptions.
+func (db *DB) DropPrefixWithOptions(prefix []byte, options WriteOptions) error {
+	return db.DeleteRangeWithOptions(prefix, prefixEnd(prefix), options)
+}
+
+// DeleteRange delete range with defaultWriteOptions.
+func (cf *ColumnFamily) DeleteRange(start, end []byte) error {
+	return cf.DeleteRangeWithOptions(start, end, DefaultWriteOptions)
+}
+
+// DeleteRangeWithOptions deletes all the keys in [start, end) from the column family,
+// a nil end means deleting all the keys not less than start.
+//
+// Only a range tombstone is written, the keys are removed from index when the memtable is flushed,
+// a chunk of rangeDeleteChunkSize keys at a time, and their values are dropped from the value log in compaction.
+// It will return ErrRangeDeleteUnsupportedTypeHASH if the index type of the column family is Hash.
+func (cf *ColumnFamily) DeleteRangeWithOptions(start, end []byte, options WriteOptions) error {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.options.WriteOptions = options
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, options.Sync, options.DisableWal, db).withPendingWrites()
+	if err := batch.DeleteRangeCF(cf, start, end); err != nil {
+		batch.Discard()
+		return err
+	}
+	return batch.Commit()
+}
+
+// DropPrefix drop prefix with defaultWriteOptions.
+func (cf *ColumnFamily) DropPrefix(prefix []byte) error {
+	return cf.DropPrefixWithOptions(prefix, DefaultWriteOptions)
+}
+
+// DropPrefixWithOptions deletes all the keys with the prefix from the column family,
+// see ColumnFamily.DeleteRangeWithOptions.
+func (cf *ColumnFamily) DropPrefixWithOptions(prefix []byte, options WriteOptions) error {
+	return cf.DeleteRangeWithOptions(prefix, prefixEnd(prefix), options)
+}
+
+// rangeDeleteChunkSize is the max number of index keys deleted by a range tombstone at a time,
+// so deleting a large range never holds all the keys in it in memory, nor in a single index transaction.
+const rangeDeleteChunkSize = 4096
+
+// deleteIndexRanges deletes the keys in index of the column family deleted by the range tombstones,
+// the keys in skip are excluded, they are written after the tombstones.
+// The keys are read and deleted in chunks of rangeDeleteChunkSize keys, must be called with db.flushLock held.
+func (db *DB) deleteIndexRanges(cf *ColumnFamily, tombstones []*rangeTombstone, skip map[string]struct{}) error {
+	for _, tombstone := range tombstones {
+		if tombstone.familyID() != cf.id {
+			continue
+		}
+		index, ok := cf.index.(*BPTree)
+		if !ok {
+			return ErrRangeDeleteUnsupportedTypeHASH
+		}
+		start, end := tombstone.keyRange()
+		for partition := range index.trees {
+			// the keys deleted by the former tombstones are not read again.
+			for from := start; from != nil; {
+				rangeKeys, next, err := index.rangeKeys(partition, from, end, rangeDeleteChunkSize)
+				if err != nil {
+					return err
+				}
+				keys := rangeKeys[:0]
+				for _, key := range rangeKeys {
+					if _, ok = skip[string(key)]; !ok {
+						keys = append(keys, key)
+					}
+				}
+				if err = db.deleteIndexKeys(cf, keys); err != nil {
+					return err
+				}
+				from = next
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package lotusdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBDeleteRange(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-delete-range")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// key 0 ~ key 4 are in index, key 5 ~ key 9 are in memtable
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			db.flushMemtable(db.activeMem)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	require.NoError(t, db.DeleteRange([]byte("key 2"), []byte("key 8")))
+	// written after the range tombstone, it is not deleted
+	require.NoError(t, db.Put([]byte("key 3"), []byte("value 3 new")))
+
+	expected := map[string][]byte{
+		"key 0": []byte("value 0"),
+		"key 1": []byte("value 1"),
+		"key 3": []byte("value 3 new"),
+		"key 8": []byte("value 8"),
+		"key 9": []byte("value 9"),
+	}
+	check := func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key %d", i))
+			// the snapshot is taken before the range deletion
+			value, errGet := db.GetWithOptions(key, ReadOptions{Snapshot: snapshot})
+			require.NoError(t, errGet)
+			assert.Equal(t, []byte(fmt.Sprintf("value %d", i)), value)
+
+			value, errGet = db.Get(key)
+			exist, errExist := db.Exist(key)
+			require.NoError(t, errExist)
+			if expected[string(key)] == nil {
+				require.ErrorIs(t, errGet, ErrKeyNotFound)
+				assert.False(t, exist)
+				continue
+			}
+			require.NoError(t, errGet)
+			assert.Equal(t, expected[string(key)], value)
+			assert.True(t, exist)
+		}
+
+		for _, reverse := range []bool{false, true} {
+			iter, errIter := db.NewIterator(IteratorOptions{Reverse: reverse})
+			require.NoError(t, errIter)
+			var count int
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.Equal(t, expected[string(iter.Key())], iter.Value())
+				count++
+			}
+			assert.Equal(t, len(expected), count)
+			require.NoError(t, iter.Close())
+		}
+	}
+
+	t.Run("read from memtable", check)
+
+	deprecatedNumber := db.vlog.deprecatedNumber
+	db.flushMemtable(db.activeMem)
+	t.Run("read after flush", check)
+	// the values of key 2, key 4 and the old value of key 3 in index are deprecated
+	assert.Equal(t, deprecatedNumber+3, db.vlog.deprecatedNumber)
+
+	require.NoError(t, db.Compact())
+	t.Run("read after compaction", check)
+}
+
+func TestDBDeleteRangeReopen(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-delete-range-reopen")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte("value")))
+	}
+	require.NoError(t, db.DeleteRange([]byte("key 2"), []byte("key 8")))
+
+	require.NoError(t, db.Close())
+	db, err = Open(options)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		exist, errExist := db.Exist([]byte(fmt.Sprintf("key %d", i)))
+		require.NoError(t, errExist)
+		assert.Equal(t, i < 2 || i >= 8, exist)
+	}
+}
+
+func TestDBDropPrefix(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-drop-prefix")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("%s/%d", tenant, i)), []byte("value")))
+		}
+	}
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.DropPrefix([]byte("b/")))
+
+	iter, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.NotEqual(t, byte('b'), iter.Key()[0])
+		count++
+	}
+	assert.Equal(t, 20, count)
+	require.NoError(t, iter.Close())
+
+	require.NoError(t, db.DropPrefix(nil))
+	for _, tenant := range []string{"a", "b", "c"} {
+		exist, errExist := db.Exist([]byte(tenant + "/0"))
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+	}
+}
+
+func TestBatchDeleteRange(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-batch-delete-range")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Put([]byte("key 2"), []byte("value 2")))
+	require.NoError(t, batch.SetSavepoint())
+	require.NoError(t, batch.DeleteRange([]byte("key 1"), nil))
+	_, err = batch.Get([]byte("key 1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = batch.Get([]byte("key 2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, batch.RollbackToSavepoint())
+	value, err := batch.Get([]byte("key 2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 2"), value)
+
+	require.NoError(t, batch.DeleteRange([]byte("key 0"), []byte("key 2")))
+	require.NoError(t, batch.Commit())
+	_, err = db.Get([]byte("key 1"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	value, err = db.Get([]byte("key 2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 2"), value)
+}
+
+func TestDBDeleteRangeHash(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-delete-range-hash")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.IndexType = Hash
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.ErrorIs(t, db.DeleteRange([]byte("a"), []byte("b")), ErrRangeDeleteUnsupportedTypeHASH)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	assert.Equal(t, []byte("b"), prefixEnd([]byte{'a', 0xff, 0xff}))
+	assert.Nil(t, prefixEnd([]byte{0xff}))
+	assert.Nil(t, prefixEnd(nil))
+}
+
+func TestDBDeleteRangeChunks(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-delete-range-chunks")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// the keys in the range span several chunks of every partition.
+	num := rangeDeleteChunkSize * int(options.PartitionNum) * 3
+	for i := 0; i < num; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %06d", i)), []byte("value")))
+	}
+	require.NoError(t, db.Put([]byte("other"), []byte("value")))
+	db.flushMemtable(db.activeMem)
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	require.NoError(t, db.DropPrefix([]byte("key")))
+	require.NoError(t, db.Put([]byte("key 000001"), []byte("value new")))
+	db.flushMemtable(db.activeMem)
+
+	iter, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	require.NoError(t, iter.Close())
+	assert.Equal(t, []string{"key 000001", "other"}, keys)
+
+	// the deleted keys are kept for the snapshot.
+	value, err := db.GetWithOptions([]byte(fmt.Sprintf("key %06d", num-1)), ReadOptions{Snapshot: snapshot})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestColumnFamilyDeleteRange(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-delete-range-cf")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("key %d", i))
+		require.NoError(t, db.Put(key, []byte("value")))
+		require.NoError(t, users.Put(key, []byte("value")))
+	}
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, users.DeleteRange([]byte("key 1"), []byte("key 3")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.DeleteRangeCF(users, []byte("key 4"), nil))
+	require.NoError(t, batch.Commit())
+
+	check := func() {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("key %d", i))
+			_, errGet := db.Get(key)
+			require.NoError(t, errGet)
+			_, errGet = users.Get(key)
+			if i == 0 || i == 3 {
+				require.NoError(t, errGet)
+			} else {
+				require.ErrorIs(t, errGet, ErrKeyNotFound)
+			}
+		}
+	}
+	check()
+	db.flushMemtable(db.activeMem)
+	check()
+
+	hashFamily, err := db.CreateColumnFamily("hash", ColumnFamilyOptions{IndexType: Hash})
+	require.NoError(t, err)
+	require.ErrorIs(t, hashFamily.DropPrefix([]byte("key")), ErrRangeDeleteUnsupportedTypeHASH)
+}
@@ -0,0 +1,243 @@
+package lotusdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const (
+	// logRecordEncryptedFlag is the first byte of an encrypted log record in wal,
+	// the type of a plain log record never equals to it.
+	logRecordEncryptedFlag = 0x40
+
+	// valueLogRecordEncryptedFlag is set in the key size of an encrypted value log record.
+	valueLogRecordEncryptedFlag = 1 << 31
+
+	// encryptionKeyIDSize is the size of the key id in front of the encrypted data.
+	encryptionKeyIDSize = 4
+	// encryptionNonceSize is the nonce size of AES-GCM.
+	encryptionNonceSize = 12
+	// encryptionOverhead is the extra size of the encrypted data: key id, nonce and the tag of AES-GCM.
+	encryptionOverhead = encryptionKeyIDSize + encryptionNonceSize + 16
+
+	// maxIndexValueSize is the max size of a plain index value: uid, marker, flags, expire and chunk position,
+	// an encrypted index value is always larger than it, see encodeIndexValue.
+	maxIndexValueSize = 16 + 2 + indexExpireSize + slotValueLength
+)
+
+// KeyProvider provides the keys to encrypt the data at rest, see Options.KeyProvider.
+// The keys are identified by ids, and every encrypted record records the id of its key,
+// so the keys can be rotated: the new data is encrypted by the current key,
+// and the old data is still decrypted by its own key until it is rewritten.
+type KeyProvider interface {
+	// CurrentKeyID returns the id of the key to encrypt the new data.
+	// It is called for every write, so it should be cheap.
+	CurrentKeyID() uint32
+
+	// Key returns the key with the given id, it must be 16, 24 or 32 bytes to select
+	// AES-128, AES-192 or AES-256. The key of an id is cached after it is loaded,
+	// so an id must not be reused for another key.
+	Key(id uint32) ([]byte, error)
+}
+
+// staticKeyProvider is a KeyProvider holding all the keys in memory.
+type staticKeyProvider struct {
+	currentID uint32
+	keys      map[uint32][]byte
+}
+
+// NewStaticKeyProvider returns a KeyProvider holding the given keys in memory,
+// the key with currentID is used to encrypt the new data.
+// To rotate the key, add a new key with a new id and make it current,
+// the old keys must be kept until the data encrypted by them is rewritten in compaction.
+func NewStaticKeyProvider(currentID uint32, keys map[uint32][]byte) KeyProvider {
+	return &staticKeyProvider{currentID: currentID, keys: keys}
+}
+
+func (p *staticKeyProvider) CurrentKeyID() uint32 {
+	return p.currentID
+}
+
+func (p *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrEncryptionKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// encryptor encrypts and decrypts the data with AES-GCM by the keys of the key provider.
+// The encrypted data is formatted as:
+//
+// +-------------+-------------+-------------------+
+// |    key id   |    nonce    |  ciphertext + tag |
+// +-------------+-------------+-------------------+
+//
+//	4 bytes       12 bytes      len(plaintext) + 16
+//
+// A nil encryptor means the encryption is disabled,
+// it writes the data as is, and can not read the encrypted data.
+type encryptor struct {
+	provider KeyProvider
+	mu       sync.RWMutex
+	aeads    map[uint32]cipher.AEAD
+}
+
+// newEncryptor returns an encryptor of the key provider, nil if the provider is nil.
+func newEncryptor(provider KeyProvider) *encryptor {
+	if provider == nil {
+		return nil
+	}
+	return &encryptor{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// aead returns the cipher of the key with the id, which is created once and cached.
+func (e *encryptor) aead(id uint32) (cipher.AEAD, error) {
+	e.mu.RLock()
+	aead, ok := e.aeads[id]
+	e.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := e.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEncryptionKey, err)
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.aeads[id] = aead
+	e.mu.Unlock()
+	return aead, nil
+}
+
+// seal encrypts the plaintext by the current key, authenticates the additional data,
+// and appends the result to dst.
+func (e *encryptor) seal(dst, plaintext, additionalData []byte) ([]byte, error) {
+	id := e.provider.CurrentKeyID()
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(dst)+encryptionKeyIDSize+encryptionNonceSize,
+		len(dst)+encryptionOverhead+len(plaintext))
+	copy(buf, dst)
+	binary.LittleEndian.PutUint32(buf[len(dst):], id)
+	nonce := buf[len(dst)+encryptionKeyIDSize:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the data encrypted by seal with the same additional data.
+func (e *encryptor) open(data, additionalData []byte) ([]byte, error) {
+	if len(data) < encryptionOverhead {
+		return nil, ErrDecryptionFailed
+	}
+	aead, err := e.aead(binary.LittleEndian.Uint32(data))
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[encryptionKeyIDSize : encryptionKeyIDSize+encryptionNonceSize]
+	plaintext, err := aead.Open(nil, nonce, data[encryptionKeyIDSize+encryptionNonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// encryptLogRecord encrypts the encoded log record written to wal,
+// the encrypted one is prefixed by logRecordEncryptedFlag.
+func (e *encryptor) encryptLogRecord(buf []byte) ([]byte, error) {
+	if e == nil {
+		return buf, nil
+	}
+	return e.seal([]byte{logRecordEncryptedFlag}, buf, nil)
+}
+
+// decryptLogRecord decrypts the log record read from wal, the plain one is returned as is.
+func (e *encryptor) decryptLogRecord(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != logRecordEncryptedFlag {
+		return buf, nil
+	}
+	if e == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+	return e.open(buf[1:], nil)
+}
+
+// encryptValueLogRecord encrypts the key and value of the encoded value log record.
+// The header(uid, key size and expire) is kept in plaintext and authenticated,
+// and valueLogRecordEncryptedFlag is set in the key size.
+func (e *encryptor) encryptValueLogRecord(buf []byte) ([]byte, error) {
+	if e == nil {
+		return buf, nil
+	}
+	headerSize := valueLogRecordHeaderSize(buf)
+	header := make([]byte, headerSize)
+	copy(header, buf)
+	keySize := binary.LittleEndian.Uint32(header[16:])
+	binary.LittleEndian.PutUint32(header[16:], keySize|valueLogRecordEncryptedFlag)
+	return e.seal(header, buf[headerSize:], header)
+}
+
+// decryptValueLogRecord decrypts the value log record encrypted by encryptValueLogRecord,
+// the plain one is returned as is.
+func (e *encryptor) decryptValueLogRecord(buf []byte) ([]byte, error) {
+	if len(buf) < 16+4 {
+		return buf, nil
+	}
+	keySize := binary.LittleEndian.Uint32(buf[16:])
+	if keySize&valueLogRecordEncryptedFlag == 0 {
+		return buf, nil
+	}
+	if e == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+	headerSize := valueLogRecordHeaderSize(buf)
+	if len(buf) < headerSize {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := e.open(buf[headerSize:], buf[:headerSize])
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, headerSize+len(plaintext))
+	copy(record, buf[:headerSize])
+	binary.LittleEndian.PutUint32(record[16:], keySize&^valueLogRecordEncryptedFlag)
+	copy(record[headerSize:], plaintext)
+	return record, nil
+}
+
+// encryptIndexValue encrypts the index value of the key, the key is authenticated
+// so the value can not be moved to another key.
+func (e *encryptor) encryptIndexValue(key, value []byte) ([]byte, error) {
+	if e == nil {
+		return value, nil
+	}
+	return e.seal(nil, value, key)
+}
+
+// decryptIndexValue decrypts the index value encrypted by encryptIndexValue,
+// the plain one is returned as is.
+func (e *encryptor) decryptIndexValue(key, value []byte) ([]byte, error) {
+	if len(value) <= maxIndexValueSize {
+		return value, nil
+	}
+	if e == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+	return e.open(value, key)
+}
@@ -0,0 +1,237 @@
+package lotusdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptor(t *testing.T) {
+	key0, key1 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)
+	provider := &staticKeyProvider{currentID: 0, keys: map[uint32][]byte{0: key0, 1: key1}}
+	enc := newEncryptor(provider)
+	var plain *encryptor
+
+	logRecord := encodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value"), ColumnFamily: 1})
+	record := &ValueLogRecord{uid: uuid.New(), key: []byte("key"), value: []byte("value"), expire: 10}
+	vlogRecord := encodeValueLogRecord(record, NoCompression)
+	indexValue := encodeIndexValue(&KeyPosition{uid: record.uid, expire: 10,
+		position: &wal.ChunkPosition{SegmentId: 1, BlockNumber: 2, ChunkOffset: 3, ChunkSize: 4}})
+
+	for _, id := range []uint32{0, 1} {
+		provider.currentID = id
+		encrypted, err := enc.encryptLogRecord(logRecord)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encrypted), "value")
+		decrypted, err := enc.decryptLogRecord(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, logRecord, decrypted)
+		_, err = plain.decryptLogRecord(encrypted)
+		require.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+		encrypted, err = enc.encryptValueLogRecord(vlogRecord)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encrypted), "value")
+		_, err = decodeValueLogRecord(encrypted)
+		require.ErrorIs(t, err, ErrEncryptionKeyRequired)
+		decrypted, err = enc.decryptValueLogRecord(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, vlogRecord, decrypted)
+		// the header is authenticated
+		encrypted[0]++
+		_, err = enc.decryptValueLogRecord(encrypted)
+		require.ErrorIs(t, err, ErrDecryptionFailed)
+
+		encrypted, err = enc.encryptIndexValue([]byte("key"), indexValue)
+		require.NoError(t, err)
+		decrypted, err = enc.decryptIndexValue([]byte("key"), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, indexValue, decrypted)
+		// the value can not be moved to another key
+		_, err = enc.decryptIndexValue([]byte("another key"), encrypted)
+		require.ErrorIs(t, err, ErrDecryptionFailed)
+	}
+
+	// the plain data is returned as is
+	for _, e := range []*encryptor{enc, plain} {
+		buf, err := e.decryptLogRecord(logRecord)
+		require.NoError(t, err)
+		assert.Equal(t, logRecord, buf)
+		buf, err = e.decryptValueLogRecord(vlogRecord)
+		require.NoError(t, err)
+		assert.Equal(t, vlogRecord, buf)
+		buf, err = e.decryptIndexValue([]byte("key"), indexValue)
+		require.NoError(t, err)
+		assert.Equal(t, indexValue, buf)
+	}
+
+	provider.currentID = 2
+	_, err := enc.encryptLogRecord(logRecord)
+	require.ErrorIs(t, err, ErrEncryptionKeyNotFound)
+	provider.keys[2] = []byte("short key")
+	_, err = enc.encryptLogRecord(logRecord)
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+// filesContain reports whether any file in the directory contains the data.
+func filesContain(t *testing.T, dirPath string, data []byte) bool {
+	var found bool
+	err := filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found = found || bytes.Contains(buf, data)
+		return nil
+	})
+	require.NoError(t, err)
+	return found
+}
+
+func TestDBEncryption(t *testing.T) {
+	tests := []struct {
+		name      string
+		indexType IndexType
+	}{
+		{"BTree", BTree},
+		{"Hash", Hash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-encryption")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = tt.indexType
+			options.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer func() {
+				destroyDB(db)
+			}()
+
+			value := func(i int) []byte {
+				return []byte(fmt.Sprintf("lotusdb-secret-%d", i))
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), value(i)))
+			}
+			db.flushMemtable(db.activeMem)
+			for i := 100; i < 200; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), value(i)))
+			}
+			assert.False(t, filesContain(t, path, []byte("lotusdb-secret")))
+
+			// the wal is encrypted, it can not be replayed without the key
+			require.NoError(t, db.Close())
+			plainOptions := options
+			plainOptions.EncryptionKey = nil
+			_, err = Open(plainOptions)
+			require.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+			db, err = Open(options)
+			require.NoError(t, err)
+			for i := 0; i < 200; i++ {
+				v, errGet := db.Get([]byte(fmt.Sprintf("key %d", i)))
+				require.NoError(t, errGet)
+				assert.Equal(t, value(i), v)
+			}
+			iter, err := db.NewIterator(IteratorOptions{})
+			require.NoError(t, err)
+			var count int
+			for ; iter.Valid(); iter.Next() {
+				assert.Equal(t, []byte("lotusdb-secret"), iter.Value()[:14])
+				count++
+			}
+			require.NoError(t, iter.Err())
+			require.NoError(t, iter.Close())
+			assert.Equal(t, 200, count)
+
+			// the flushed data can not be read with a wrong key
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Close())
+			wrongOptions := options
+			wrongOptions.EncryptionKey = bytes.Repeat([]byte{2}, 32)
+			db, err = Open(wrongOptions)
+			require.NoError(t, err)
+			_, err = db.Get([]byte("key 1"))
+			require.ErrorIs(t, err, ErrDecryptionFailed)
+			require.NoError(t, db.Close())
+
+			options.EncryptionKey = []byte("short key")
+			_, err = Open(options)
+			require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+		})
+	}
+}
+
+func TestDBEncryptionKeyRotation(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-encryption-rotation")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("lotusdb-secret-%d", i))
+	}
+	check := func(t *testing.T) {
+		for i := 0; i < 300; i++ {
+			v, errGet := db.Get([]byte(fmt.Sprintf("key %d", i)))
+			require.NoError(t, errGet)
+			assert.Equal(t, value(i), v)
+		}
+	}
+	put := func(start, end int) {
+		for i := start; i < end; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), value(i)))
+		}
+		db.flushMemtable(db.activeMem)
+	}
+
+	// the data written before the encryption is enabled
+	put(0, 100)
+	assert.True(t, filesContain(t, path, []byte("lotusdb-secret")))
+	require.NoError(t, db.Close())
+
+	key0, key1 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	options.KeyProvider = NewStaticKeyProvider(0, map[uint32][]byte{0: key0})
+	db, err = Open(options)
+	require.NoError(t, err)
+	put(100, 200)
+	require.NoError(t, db.Close())
+
+	// rotate the key, the data encrypted by the old key is still readable
+	options.KeyProvider = NewStaticKeyProvider(1, map[uint32][]byte{0: key0, 1: key1})
+	db, err = Open(options)
+	require.NoError(t, err)
+	put(200, 300)
+	t.Run("mixed", check)
+
+	// all the data is encrypted by the new key in compaction
+	require.NoError(t, db.Compact())
+	assert.False(t, filesContain(t, path, []byte("lotusdb-secret")))
+	require.NoError(t, db.Close())
+
+	options.KeyProvider = NewStaticKeyProvider(1, map[uint32][]byte{1: key1})
+	db, err = Open(options)
+	require.NoError(t, err)
+	t.Run("rotated", check)
+}
@@ -3,13 +3,52 @@ package lotusdb
 import "errors"
 
 var (
-	ErrKeyIsEmpty                    = errors.New("the key is empty")
-	ErrKeyNotFound                   = errors.New("key not found in database")
-	ErrDatabaseIsUsing               = errors.New("the database directory is used by another process")
-	ErrReadOnlyBatch                 = errors.New("the batch is read only")
-	ErrBatchCommitted                = errors.New("the batch is committed")
-	ErrDBClosed                      = errors.New("the database is closed")
-	ErrDBDirectoryISEmpty            = errors.New("the database directory path can not be empty")
-	ErrWaitMemtableSpaceTimeOut      = errors.New("wait memtable space timeout, try again later")
-	ErrDBIteratorUnsupportedTypeHASH = errors.New("hash index does not support iterator")
+	ErrKeyIsEmpty                     = errors.New("the key is empty")
+	ErrKeyTooLarge                    = errors.New("the key is larger than MaxKeySize")
+	ErrKeyNotFound                    = errors.New("key not found in database")
+	ErrDatabaseIsUsing                = errors.New("the database directory is used by another process")
+	ErrDatabaseReadOnly               = errors.New("the database is opened in read only mode")
+	ErrNotSecondary                   = errors.New("the database is not opened as a secondary")
+	ErrReadOnlyBatch                  = errors.New("the batch is read only")
+	ErrBatchCommitted                 = errors.New("the batch is committed")
+	ErrBatchDiscarded                 = errors.New("the batch is discarded")
+	ErrNoSavepoint                    = errors.New("there is no savepoint in the batch")
+	ErrDBClosed                       = errors.New("the database is closed")
+	ErrDBDirectoryISEmpty             = errors.New("the database directory path can not be empty")
+	ErrWaitMemtableSpaceTimeOut       = errors.New("wait memtable space timeout, try again later")
+	ErrRangeDeleteUnsupportedTypeHASH = errors.New("hash index does not support range deletion")
+	ErrSnapshotReleased               = errors.New("the snapshot is released")
+	ErrTxnConflict                    = errors.New("transaction conflict, the keys read by the transaction are modified")
+	ErrTxnFinished                    = errors.New("the transaction is committed or discarded")
+	ErrMergeOperatorNotSet            = errors.New("the merge operator is not set in options")
+	ErrColumnFamilyExists             = errors.New("the column family already exists")
+	ErrColumnFamilyNotFound           = errors.New("the column family is not found")
+	ErrColumnFamilyNameIsEmpty        = errors.New("the column family name is empty")
+	ErrColumnFamilyMetaCorrupted      = errors.New("the column family meta file is corrupted")
+	ErrChangesDiscarded               = errors.New("the changes after the cursor are discarded")
+	ErrChangeConsumerNotFound         = errors.New("the change consumer is not registered")
+	ErrChangeIteratorClosed           = errors.New("the change iterator is closed")
+	ErrChangeMetaCorrupted            = errors.New("the change meta file is corrupted")
+	ErrIteratorClosed                 = errors.New("the iterator is closed")
+	ErrIteratorOutOfOrder             = errors.New("the iterator is out of order, a newer version is behind")
+	ErrChunkPositionCorrupted         = errors.New("the chunk position in index is corrupted")
+	ErrIteratorKeysOnly               = errors.New("the iterator only iterates keys, the values are not read")
+	ErrUnknownCompression             = errors.New("unknown compression algorithm")
+	ErrInvalidEncryptionKey           = errors.New("the encryption key must be 16, 24 or 32 bytes")
+	ErrEncryptionKeyNotFound          = errors.New("the encryption key is not found")
+	ErrEncryptionKeyRequired          = errors.New("the data is encrypted, but the encryption key is not set")
+	ErrDecryptionFailed               = errors.New("failed to decrypt, the key is wrong or the data is corrupted")
+	ErrCheckpointDirExists            = errors.New("the checkpoint directory already exists")
+	ErrBackupNotFound                 = errors.New("the backup is not the latest one, take a full backup instead")
+	ErrBackupMetaCorrupted            = errors.New("the backup meta file is corrupted, take a full backup instead")
+	ErrInvalidBackup                  = errors.New("the backup is invalid or corrupted")
+	ErrRestoreDirNotEmpty             = errors.New("the full backup must be restored to an empty directory")
+	ErrBackupChainBroken              = errors.New("the backup is not based on the last one restored to the directory")
+	ErrInvalidExport                  = errors.New("the export stream is invalid or corrupted")
+	ErrIngestNotSorted                = errors.New("the keys to ingest are not in ascending order")
 )
+
+// ErrDBIteratorUnsupportedTypeHASH was returned by NewIterator for the hash index.
+//
+// Deprecated: the hash index supports iterator now, it is never returned.
+var ErrDBIteratorUnsupportedTypeHASH = errors.New("hash index does not support iterator")
@@ -40,6 +40,10 @@ func main() {
 		fmt.Println(string(iter.Key()), string(iter.Value()))
 		iter.Next()
 	}
+	// check the error when the iteration is stopped
+	if err = iter.Err(); err != nil {
+		panic(err)
+	}
 	err = iter.Close()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,259 @@
+package lotusdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	exportMagic   = "LOTUSEXP"
+	exportVersion = 1
+	// exportFrameSize is the size of the records buffered in a frame before it is written.
+	exportFrameSize = 1 << 20
+)
+
+// Export writes the keys of the default column family to w in a portable format,
+// which can be imported by Import to a database with different options, see ColumnFamily.Export.
+func (db *DB) Export(w io.Writer, options ExportOptions) error {
+	return db.export(db.defaultFamily, w, options)
+}
+
+// Export writes the keys of the column family to w in a portable format,
+// which does not depend on the PartitionNum, IndexType and KeyHashFunction of the database.
+//
+// The keys are exported from a snapshot, so the export is consistent while the writes go on.
+// The partitions are exported concurrently, so the records are not sorted in the stream.
+// The deleted and expired keys are not exported, and the keys can be filtered by
+// the prefix and bounds in options, like IteratorOptions.
+//
+// The stream starts with the magic "LOTUSEXP" and the version byte 1, followed by the frames.
+// A frame is the length and the crc32 (IEEE) of its payload, both are little endian uint32,
+// and the payload is a sequence of records, each one is
+//
+//	+-------------+--------------+-------------+---------+---------+
+//	|  key size   |  value size  |   expire    |   key   |  value  |
+//	+-------------+--------------+-------------+---------+---------+
+//	  uvarint        uvarint        uvarint
+//
+// The expire is the expiration time in unix nano, 0 means the key never expires.
+// The stream ends with an empty frame, so a truncated stream can be detected.
+func (cf *ColumnFamily) Export(w io.Writer, options ExportOptions) error {
+	return cf.db.export(cf, w, options)
+}
+
+func (db *DB) export(cf *ColumnFamily, w io.Writer, options ExportOptions) error {
+	// all the partitions are exported from the same snapshot.
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	if _, err := w.Write(append([]byte(exportMagic), exportVersion)); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	writeFrame := func(payload []byte) error {
+		header := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+		header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(payload))
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		return err
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+	iterOptions := IteratorOptions{
+		Prefix:     options.Prefix,
+		LowerBound: options.LowerBound,
+		UpperBound: options.UpperBound,
+		Snapshot:   snapshot,
+	}
+	for i := 0; i < cf.options.PartitionNum; i++ {
+		part := i
+		g.Go(func() error {
+			return db.exportPartition(ctx, cf, part, iterOptions, writeFrame)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return writeFrame(nil)
+}
+
+// exportPartition writes the keys in the partition as frames by writeFrame.
+func (db *DB) exportPartition(ctx context.Context, cf *ColumnFamily, part int, options IteratorOptions,
+	writeFrame func(payload []byte) error) error {
+	itr, err := db.newIterator(ctx, cf, options, part)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	var payload []byte
+	now := time.Now().UnixNano()
+	for ; itr.Valid(); itr.Next() {
+		// stop if another partition fails
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		expire, errExpire := itr.expire()
+		if errExpire != nil {
+			return errExpire
+		}
+		if isExpired(expire, now) {
+			continue
+		}
+		value, errValue := itr.ValueErr()
+		if errValue != nil {
+			return errValue
+		}
+		key := itr.Key()
+		payload = binary.AppendUvarint(payload, uint64(len(key)))
+		payload = binary.AppendUvarint(payload, uint64(len(value)))
+		payload = binary.AppendUvarint(payload, expire)
+		payload = append(payload, key...)
+		payload = append(payload, value...)
+		if len(payload) >= exportFrameSize {
+			if err = writeFrame(payload); err != nil {
+				return err
+			}
+			payload = payload[:0]
+		}
+	}
+	if err = itr.Err(); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		return writeFrame(payload)
+	}
+	return nil
+}
+
+// Import writes the keys exported by Export to the default column family, see ColumnFamily.Import.
+func (db *DB) Import(r io.Reader, options ImportOptions) error {
+	return db.importRecords(db.defaultFamily, r, options)
+}
+
+// Import writes the keys exported by Export to the column family in batches,
+// the keys keep their expiration time, and the expired ones are skipped.
+//
+// The checksum of every frame is verified before its records are written,
+// ErrInvalidExport is returned if the stream is corrupted or truncated,
+// the records in the frames before the corrupted one may have been written then.
+func (cf *ColumnFamily) Import(r io.Reader, options ImportOptions) error {
+	return cf.db.importRecords(cf, r, options)
+}
+
+func (db *DB) importRecords(cf *ColumnFamily, r io.Reader, options ImportOptions) error {
+	br := bufio.NewReader(r)
+	readFull := func(buf []byte) error {
+		_, err := io.ReadFull(br, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrInvalidExport
+		}
+		return err
+	}
+	header := make([]byte, len(exportMagic)+1)
+	if err := readFull(header); err != nil {
+		return err
+	}
+	if string(header[:len(exportMagic)]) != exportMagic || header[len(exportMagic)] != exportVersion {
+		return ErrInvalidExport
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportOptions.BatchSize
+	}
+	var records []*LogRecord
+	var size int64
+	commit := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		batch := db.NewBatch(BatchOptions{WriteOptions: WriteOptions{
+			Sync:       options.Sync,
+			DisableWal: options.DisableWal,
+		}})
+		for _, record := range records {
+			if err := batch.write(record); err != nil {
+				batch.Discard()
+				return err
+			}
+		}
+		records, size = records[:0], 0
+		return batch.Commit()
+	}
+
+	// a frame holds exportFrameSize bytes of records and one more record at most,
+	// which can not be larger than a memtable, so a corrupted length is found before allocating.
+	maxFrameSize := uint64(exportFrameSize) + uint64(db.options.MemtableSize)
+	frameHeader := make([]byte, 8)
+	for {
+		if err := readFull(frameHeader); err != nil {
+			return err
+		}
+		length, checksum := binary.LittleEndian.Uint32(frameHeader[0:4]), binary.LittleEndian.Uint32(frameHeader[4:8])
+		if uint64(length) > maxFrameSize {
+			return ErrInvalidExport
+		}
+		payload := make([]byte, length)
+		if err := readFull(payload); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return ErrInvalidExport
+		}
+		// the empty frame ends the stream
+		if length == 0 {
+			break
+		}
+
+		now := time.Now().UnixNano()
+		for len(payload) > 0 {
+			var fields [3]uint64
+			for i := range fields {
+				field, n := binary.Uvarint(payload)
+				if n <= 0 {
+					return ErrInvalidExport
+				}
+				fields[i], payload = field, payload[n:]
+			}
+			keySize, valueSize, expire := fields[0], fields[1], fields[2]
+			if keySize == 0 || keySize > uint64(len(payload)) || valueSize > uint64(len(payload))-keySize {
+				return ErrInvalidExport
+			}
+			key, value := payload[:keySize], payload[keySize:keySize+valueSize]
+			payload = payload[keySize+valueSize:]
+			if err := checkKey(key); err != nil {
+				return err
+			}
+			if isExpired(expire, now) {
+				continue
+			}
+			records = append(records, &LogRecord{
+				Key:          key,
+				Value:        value,
+				Type:         LogRecordNormal,
+				Expire:       expire,
+				ColumnFamily: cf.id,
+			})
+			size += int64(len(key) + len(value))
+			if len(records) >= batchSize || size >= int64(db.options.MemtableSize)/4 {
+				if err := commit(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return commit()
+}
@@ -0,0 +1,118 @@
+package lotusdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBExport(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-export")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	key := func(prefix string, i int) []byte {
+		return []byte(fmt.Sprintf("%s %03d", prefix, i))
+	}
+	// the keys are in index and memtables
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put(key("a", i), key("value", i)))
+		require.NoError(t, db.Put(key("b", i), key("value", i)))
+	}
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.PutWithTTL(key("a", 0), []byte("ttl"), time.Hour))
+	require.NoError(t, db.PutWithTTL(key("a", 1), []byte("expired"), time.Millisecond))
+	require.NoError(t, db.Delete(key("a", 2)))
+	require.NoError(t, db.Merge(key("a", 3), []byte("-merged")))
+	time.Sleep(2 * time.Millisecond)
+
+	exported := new(bytes.Buffer)
+	require.NoError(t, db.Export(exported, ExportOptions{Prefix: []byte("a")}))
+	ranged := new(bytes.Buffer)
+	require.NoError(t, db.Export(ranged, ExportOptions{LowerBound: key("b", 10), UpperBound: key("b", 20)}))
+
+	// import to a database with different options
+	importOptions := DefaultOptions
+	importPath, err := os.MkdirTemp("", "db-test-import")
+	require.NoError(t, err)
+	importOptions.DirPath = importPath
+	importOptions.PartitionNum = 2
+	importOptions.IndexType = Hash
+	importOptions.KeyHashFunction = func(key []byte) uint64 {
+		return uint64(len(key)) + uint64(key[len(key)-1])
+	}
+	importDB, err := Open(importOptions)
+	require.NoError(t, err)
+	defer destroyDB(importDB)
+	family, err := importDB.CreateColumnFamily("ranged", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	require.NoError(t, importDB.Import(bytes.NewReader(exported.Bytes()), ImportOptions{BatchSize: 7}))
+	require.NoError(t, family.Import(bytes.NewReader(ranged.Bytes()), DefaultImportOptions))
+
+	itr, err := importDB.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var keys int
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		keys++
+		expire, errExpire := itr.expire()
+		require.NoError(t, errExpire)
+		if bytes.Equal(itr.Key(), key("a", 0)) {
+			assert.Positive(t, expire)
+			assert.Equal(t, []byte("ttl"), itr.Value())
+			continue
+		}
+		assert.Zero(t, expire)
+		if bytes.Equal(itr.Key(), key("a", 3)) {
+			assert.Equal(t, []byte("value 003,-merged"), itr.Value())
+			continue
+		}
+		assert.Equal(t, append([]byte("value"), itr.Key()[1:]...), itr.Value())
+	}
+	require.NoError(t, itr.Close())
+	assert.Equal(t, 98, keys)
+	for i := 0; i < 100; i++ {
+		_, err = family.Get(key("b", i))
+		if i >= 10 && i < 20 {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, ErrKeyNotFound)
+		}
+	}
+
+	// the corrupted and truncated streams
+	corrupted := bytes.Clone(exported.Bytes())
+	corrupted[len(corrupted)-20] ^= 0xff
+	require.ErrorIs(t, importDB.Import(bytes.NewReader(corrupted), DefaultImportOptions), ErrInvalidExport)
+	truncated := exported.Bytes()[:exported.Len()-8]
+	require.ErrorIs(t, importDB.Import(bytes.NewReader(truncated), DefaultImportOptions), ErrInvalidExport)
+	require.ErrorIs(t, importDB.Import(bytes.NewReader([]byte("lotusdb")), DefaultImportOptions), ErrInvalidExport)
+
+	// the frames with valid checksums but corrupted sizes
+	frame := func(length uint32, payload []byte) []byte {
+		buf := append([]byte(exportMagic), exportVersion)
+		buf = binary.LittleEndian.AppendUint32(buf, length)
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+		return append(buf, payload...)
+	}
+	payload := binary.AppendUvarint(nil, 1)
+	payload = binary.AppendUvarint(payload, math.MaxUint64)
+	payload = binary.AppendUvarint(payload, 0)
+	payload = append(payload, 'k')
+	stream := frame(uint32(len(payload)), payload)
+	require.ErrorIs(t, importDB.Import(bytes.NewReader(stream), DefaultImportOptions), ErrInvalidExport)
+	stream = frame(math.MaxUint32, nil)
+	require.ErrorIs(t, importDB.Import(bytes.NewReader(stream), DefaultImportOptions), ErrInvalidExport)
+}
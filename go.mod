@@ -7,16 +7,16 @@ require (
 	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/dgraph-io/badger/v4 v4.2.0
 	github.com/gofrs/flock v0.8.1
+	github.com/lotusdblabs/bbolt v1.3.9-0.20250108061345-78c23c59588d
 	github.com/rosedblabs/diskhash v0.0.0-20230910084041-289755737e2a
 	github.com/rosedblabs/wal v1.3.8
+	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/sync v0.5.0
 )
 
 require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/lotusdblabs/bbolt v1.3.9-0.20250108061345-78c23c59588d // indirect
-	github.com/shirou/gopsutil v3.21.11+incompatible // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
 )
 
@@ -27,7 +27,7 @@ require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/glog v1.2.0 // indirect
 	github.com/google/uuid v1.6.0
-	github.com/klauspost/compress v1.17.4 // indirect
+	github.com/klauspost/compress v1.17.4
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
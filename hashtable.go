@@ -4,8 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/rosedblabs/diskhash"
 	"github.com/rosedblabs/wal"
@@ -17,11 +24,18 @@ import (
 // This is the maximum length after wal.chunkPosition encoding.
 const slotValueLength = binary.MaxVarintLen32*3 + binary.MaxVarintLen64
 
+// hashMetaFileName is the meta file in the directory of a diskhash.
+const hashMetaFileName = "HASH.META"
+
 // HashTable is the diskhash index implementation.
 // see: https://github.com/rosedblabs/diskhash
 type HashTable struct {
 	options indexOptions
-	tables  []*diskhash.Table
+	// mu protects tables, the tables are reopened to store their metas, see reopen.
+	mu     sync.RWMutex
+	tables []*diskhash.Table
+	// err is the error to reopen a table, the index can not be used after that.
+	err error
 }
 
 // openHashIndex open a diskhash for each partition.
@@ -30,10 +44,7 @@ func openHashIndex(options indexOptions) (*HashTable, error) {
 	tables := make([]*diskhash.Table, options.partitionNum)
 
 	for i := 0; i < options.partitionNum; i++ {
-		dishHashOptions := diskhash.DefaultOptions
-		dishHashOptions.DirPath = filepath.Join(options.dirPath, fmt.Sprintf(indexFileExt, i))
-		dishHashOptions.SlotValueLength = slotValueLength
-		table, err := diskhash.Open(dishHashOptions)
+		table, err := openHashTable(options.dirPath, i)
 		if err != nil {
 			return nil, err
 		}
@@ -46,11 +57,94 @@ func openHashIndex(options indexOptions) (*HashTable, error) {
 	}, nil
 }
 
+// openHashTable opens the diskhash of the partition in dirPath.
+// In read only mode, dirPath is the copy of the index, see Open.
+func openHashTable(dirPath string, partition int) (*diskhash.Table, error) {
+	dishHashOptions := diskhash.DefaultOptions
+	dishHashOptions.DirPath = filepath.Join(dirPath, fmt.Sprintf(indexFileExt, partition))
+	dishHashOptions.SlotValueLength = slotValueLength
+	if err := compactHashMeta(filepath.Join(dishHashOptions.DirPath, hashMetaFileName)); err != nil {
+		return nil, err
+	}
+	return diskhash.Open(dishHashOptions)
+}
+
+// compactHashMeta keeps only the latest meta in the meta file of a diskhash.
+// The meta is appended to the file when the diskhash is closed, but only the first one is read when it is opened,
+// so the latest meta would be lost if it is reopened more than once, e.g. by DB.Checkpoint or Open after Close.
+func compactHashMeta(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var latest json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	for {
+		var meta json.RawMessage
+		if decoder.Decode(&meta) != nil {
+			break
+		}
+		latest = meta
+	}
+	if latest == nil || len(latest)+1 == len(buf) {
+		return nil
+	}
+	return writeMetaFile(path, append(latest, '\n'))
+}
+
+// copyTo copies the diskhash of all partitions to dirPath, see DB.Checkpoint.
+// The meta of a diskhash is only stored when it is closed, so the tables are reopened to store it
+// with the reads of the index paused for a moment, then the files are copied without any lock of the index.
+// It must be called with db.flushLock held, so the tables are not changed while copying.
+func (ht *HashTable) copyTo(dirPath string) error {
+	if err := ht.reopen(); err != nil {
+		return err
+	}
+	for i := range ht.tables {
+		name := fmt.Sprintf(indexFileExt, i)
+		if err := copyDir(filepath.Join(ht.options.dirPath, name), filepath.Join(dirPath, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reopen closes and reopens the tables, so their metas are stored.
+// If a table can not be reopened, the index is unusable, the error is returned by all the later operations.
+func (ht *HashTable) reopen() error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.err != nil {
+		return ht.err
+	}
+	for i, table := range ht.tables {
+		if err := table.Close(); err != nil {
+			// the table is still usable if the meta is not stored.
+			return err
+		}
+		reopened, err := openHashTable(ht.options.dirPath, i)
+		if err != nil {
+			ht.err = fmt.Errorf("reopen hash index of partition %d failed: %w", i, err)
+			return ht.err
+		}
+		ht.tables[i] = reopened
+	}
+	return nil
+}
+
 // PutBatch put batch records to index.
 func (ht *HashTable) PutBatch(positions []*KeyPosition, matchKeyFunc ...diskhash.MatchKeyFunc) ([]*KeyPosition, error) {
 	if len(positions) == 0 {
 		return nil, nil
 	}
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if ht.err != nil {
+		return nil, ht.err
+	}
 	partitionRecords := make([][]*KeyPosition, ht.options.partitionNum)
 	matchKeys := make([][]diskhash.MatchKeyFunc, ht.options.partitionNum)
 	for i, pos := range positions {
@@ -94,6 +188,11 @@ func (ht *HashTable) Get(key []byte, matchKeyFunc ...diskhash.MatchKeyFunc) (*Ke
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if ht.err != nil {
+		return nil, ht.err
+	}
 	p := ht.options.getKeyPartition(key)
 	table := ht.tables[p]
 	err := table.Get(key, matchKeyFunc[0])
@@ -109,6 +208,11 @@ func (ht *HashTable) DeleteBatch(keys [][]byte, matchKeyFunc ...diskhash.MatchKe
 	if len(keys) == 0 {
 		return nil, nil
 	}
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if ht.err != nil {
+		return nil, ht.err
+	}
 	partitionKeys := make([][][]byte, ht.options.partitionNum)
 	matchKeys := make([][]*diskhash.MatchKeyFunc, ht.options.partitionNum)
 	for i, key := range keys {
@@ -146,6 +250,11 @@ func (ht *HashTable) DeleteBatch(keys [][]byte, matchKeyFunc ...diskhash.MatchKe
 
 // Sync sync index data to disk.
 func (ht *HashTable) Sync() error {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if ht.err != nil {
+		return ht.err
+	}
 	for _, table := range ht.tables {
 		err := table.Sync()
 		if err != nil {
@@ -156,26 +265,106 @@ func (ht *HashTable) Sync() error {
 }
 
 // Close close index.
+// The meta of every diskhash is compacted after it is closed, so only the latest one is kept.
+// In read only mode, the tables are the copy of the index, which is removed after closing, see DB.Close.
 func (ht *HashTable) Close() error {
-	for _, table := range ht.tables {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.err != nil {
+		return ht.err
+	}
+	for i, table := range ht.tables {
 		err := table.Close()
 		if err != nil {
 			return err
 		}
+		metaPath := filepath.Join(ht.options.dirPath, fmt.Sprintf(indexFileExt, i), hashMetaFileName)
+		if err = compactHashMeta(metaPath); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// newIterator creates an iterator of the index entries in the partition.
+// The diskhash tables only store the hash of keys, so the keys are read from the value log,
+// a record in value log is an index entry if the table still points to it.
+// All the index entries in the bounds are loaded into memory and sorted,
+// so the iterator supports the same options as the btree index.
+//
+// The records are read from the view of the partition opened by valueLog.openReadView, without any lock held,
+// the index entries overwritten by flush meanwhile are skipped, they are kept by the snapshot of the iterator.
+// It must be called with db.scanLock held for reading, so the records are not moved by compaction while loading.
+func (ht *HashTable) newIterator(ctx context.Context, view *walView, vlog *valueLog, partition int,
+	options IteratorOptions) (*positionIterator, error) {
+	itr := &positionIterator{options: options}
+	lower, upper := iterateBounds(options)
+	reader := view.NewReader()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk, chunkPosition, err := reader.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		record, err := vlog.decodeRecord(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if !keyInRange(record.key, lower, upper) {
+			continue
+		}
+
+		// a position identifies a record, so the key must be the same if the position matches.
+		var current bool
+		// the table may be reopened by flush meanwhile, see DB.unlockIndex.
+		_, err = ht.Get(record.key, func(slot diskhash.Slot) (bool, error) {
+			position := wal.DecodeChunkPosition(slot.Value)
+			current = position.SegmentId == chunkPosition.SegmentId &&
+				position.BlockNumber == chunkPosition.BlockNumber &&
+				position.ChunkOffset == chunkPosition.ChunkOffset
+			return current, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !current {
+			continue
+		}
+		itr.keys = append(itr.keys, record.key)
+		itr.positions = append(itr.positions, &KeyPosition{
+			key:       record.key,
+			partition: uint32(partition),
+			uid:       record.uid,
+			expire:    record.expire,
+			position:  chunkPosition,
+		})
+	}
+	sort.Sort(itr)
+	return itr, nil
+}
+
 // MatchKeyFunc Set nil if do not need keyPos or value.
+// The value will not be set if the matched entry is expired.
 func MatchKeyFunc(db *DB, key []byte, keyPos **KeyPosition, value *[]byte) func(slot diskhash.Slot) (bool, error) {
+	return matchKeyFunc(db.vlog, key, keyPos, value)
+}
+
+// matchKeyFunc is like MatchKeyFunc, but reads the entries from the given value log,
+// which is the value log of a column family.
+func matchKeyFunc(vlog *valueLog, key []byte, keyPos **KeyPosition, value *[]byte) func(slot diskhash.Slot) (bool, error) {
 	return func(slot diskhash.Slot) (bool, error) {
 		chunkPosition := wal.DecodeChunkPosition(slot.Value)
 		checkKeyPos := &KeyPosition{
 			key:       key,
-			partition: uint32(db.vlog.getKeyPartition(key)),
+			partition: uint32(vlog.getKeyPartition(key)),
 			position:  chunkPosition,
 		}
-		valueLogRecord, err := db.vlog.read(checkKeyPos)
+		valueLogRecord, err := vlog.read(checkKeyPos)
 		if err != nil {
 			return false, err
 		}
@@ -185,10 +374,13 @@ func MatchKeyFunc(db *DB, key []byte, keyPos **KeyPosition, value *[]byte) func(
 		if !bytes.Equal(valueLogRecord.key, key) {
 			return false, nil
 		}
+		checkKeyPos.uid = valueLogRecord.uid
+		checkKeyPos.expire = valueLogRecord.expire
 		if keyPos != nil {
 			*keyPos = checkKeyPos
 		}
-		if value != nil {
+		// the expired value is invisible, but the slot still matches the key.
+		if value != nil && !isExpired(valueLogRecord.expire, time.Now().UnixNano()) {
 			*value = valueLogRecord.value
 		}
 		return true, nil
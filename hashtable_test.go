@@ -304,3 +304,23 @@ func testHashTableSync(t *testing.T, partitionNum int) {
 	err = ht.Sync()
 	assert.NoError(t, err)
 }
+
+func TestCompactHashMeta(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "hashtable-meta")
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	require.NoError(t, compactHashMeta(path))
+
+	// the meta appended when closed is kept.
+	require.NoError(t, os.WriteFile(path, []byte("{\"NumKeys\":1}\n{\"NumKeys\":2}\n"), 0644))
+	require.NoError(t, compactHashMeta(path))
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"NumKeys\":2}\n", string(buf))
+
+	require.NoError(t, compactHashMeta(path))
+	buf, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"NumKeys\":2}\n", string(buf))
+}
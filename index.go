@@ -64,6 +64,10 @@ type indexOptions struct {
 	partitionNum int // index partition nums for sharding
 
 	keyHashFunction func([]byte) uint64 // hash function for sharding
+
+	encryptor *encryptor // encrypt the values of bptree, nil if the encryption is disabled
+
+	readOnly bool // open the index in read only mode, see Options.ReadOnly
 }
 
 func (io *indexOptions) getKeyPartition(key []byte) int {
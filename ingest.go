@@ -0,0 +1,114 @@
+package lotusdb
+
+import (
+	"bytes"
+
+	"github.com/google/uuid"
+)
+
+// IngestIterator is the source of the key-value pairs to ingest, see DB.IngestSorted.
+// The keys must be in ascending order, e.g. an Iterator of another database.
+type IngestIterator interface {
+	// Valid returns whether the iterator is positioned at a key-value pair.
+	Valid() bool
+	// Next moves the iterator to the next pair.
+	Next()
+	// Key returns the current key.
+	Key() []byte
+	// Value returns the current value.
+	Value() []byte
+	// Err returns the error encountered by the iterator, which stops the ingestion.
+	Err() error
+}
+
+// IngestSorted writes the key-value pairs of the iterator to the default column family,
+// bypassing the wal and memtables, see ColumnFamily.IngestSorted.
+func (db *DB) IngestSorted(itr IngestIterator, options IngestOptions) error {
+	return db.ingestSorted(db.defaultFamily, itr, options)
+}
+
+// IngestSorted writes the key-value pairs of the iterator to the column family,
+// bypassing the wal and memtables, it is much faster than Put for the initial loads.
+// The iterator must be positioned at the first pair, and the keys must be in strictly ascending order,
+// or ErrIngestNotSorted is returned.
+//
+// The pairs are written in batches, the values are written to the value log directly,
+// and the index entries are written in a transaction per partition, like flushing a memtable.
+// The overwritten index entries are marked in the deprecated table, and kept for the open snapshots.
+// If the ingestion fails, the batches written before are not rolled back.
+//
+// The ingested values are older than the writes in memtables, which are not flushed yet,
+// so a key in memtables is still read from memtables, and it overwrites the ingested one when flushed.
+// The ingested keys are not in the wal, so they are invisible to the change consumers, see DB.Changes.
+// The active transactions which read or iterate the ingested keys fail to commit with ErrTxnConflict.
+func (cf *ColumnFamily) IngestSorted(itr IngestIterator, options IngestOptions) error {
+	return cf.db.ingestSorted(cf, itr, options)
+}
+
+func (db *DB) ingestSorted(cf *ColumnFamily, itr IngestIterator, options IngestOptions) error {
+	if db.options.ReadOnly {
+		return ErrDatabaseReadOnly
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultIngestOptions.BatchSize
+	}
+	expire := expireAt(options.TTL)
+
+	var records []*ValueLogRecord
+	var size int64
+	var prevKey []byte
+	for ; itr.Valid(); itr.Next() {
+		key := itr.Key()
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		if prevKey != nil && bytes.Compare(key, prevKey) <= 0 {
+			return ErrIngestNotSorted
+		}
+		// the iterator may reuse the buffers of key and value
+		key = bytes.Clone(key)
+		prevKey = key
+		records = append(records, &ValueLogRecord{key: key, value: bytes.Clone(itr.Value()),
+			uid: uuid.New(), expire: expire})
+		size += int64(len(key) + len(itr.Value()))
+		if len(records) >= batchSize || size >= int64(db.options.MemtableSize) {
+			if err := db.ingestBatch(cf, records); err != nil {
+				return err
+			}
+			records, size = nil, 0
+		}
+	}
+	if err := itr.Err(); err != nil {
+		return err
+	}
+	return db.ingestBatch(cf, records)
+}
+
+// ingestBatch writes the records to the value log and index of the column family.
+func (db *DB) ingestBatch(cf *ColumnFamily, records []*ValueLogRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	// the value log segments can not be removed while ingesting, and the flush and compaction are paused.
+	db.pinValueLogs()
+	defer db.unpinValueLogs()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return ErrDBClosed
+	}
+	db.lockIndex()
+	defer db.unlockIndex()
+
+	if err := db.flushFamily(&familyFlush{family: cf, logRecords: records}, nil); err != nil {
+		return err
+	}
+	// the ingested keys are not committed by batches, the active transactions are told here.
+	db.oracle.recordIngest(cf.id, records[0].key, records[len(records)-1].key)
+	db.sendThresholdState()
+	return nil
+}
@@ -0,0 +1,85 @@
+package lotusdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sliceIngestIterator iterates the key-value pairs in slices.
+type sliceIngestIterator struct {
+	keys, values [][]byte
+	index        int
+}
+
+func (it *sliceIngestIterator) Valid() bool   { return it.index < len(it.keys) }
+func (it *sliceIngestIterator) Next()         { it.index++ }
+func (it *sliceIngestIterator) Key() []byte   { return it.keys[it.index] }
+func (it *sliceIngestIterator) Value() []byte { return it.values[it.index] }
+func (it *sliceIngestIterator) Err() error    { return nil }
+
+func TestDBIngestSorted(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-ingest")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("key %04d", i))
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put(key(i), []byte("flushed")))
+			}
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Put(key(0), []byte("memtable")))
+			snapshot := db.NewSnapshot()
+			defer snapshot.Release()
+
+			itr := &sliceIngestIterator{}
+			for i := 0; i < 1000; i++ {
+				itr.keys = append(itr.keys, key(i))
+				itr.values = append(itr.values, []byte(fmt.Sprintf("ingested %d", i)))
+			}
+			require.NoError(t, db.IngestSorted(itr, IngestOptions{BatchSize: 64}))
+
+			// the keys in memtables are newer than the ingested ones
+			for i := 0; i < 1000; i++ {
+				expected := []byte(fmt.Sprintf("ingested %d", i))
+				if i == 0 {
+					expected = []byte("memtable")
+				}
+				v, errGet := db.Get(key(i))
+				require.NoError(t, errGet)
+				assert.Equal(t, expected, v)
+			}
+			v, err := db.GetWithOptions(key(1), ReadOptions{Snapshot: snapshot})
+			require.NoError(t, err)
+			assert.Equal(t, []byte("flushed"), v)
+			// the overwritten values are deprecated
+			assert.Equal(t, uint32(100), db.vlog.deprecatedNumber)
+
+			snapshot.Release()
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Compact())
+			report, err := db.Verify(context.Background(), VerifyOptions{CheckOrphans: true})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			assert.Equal(t, 1000, report.IndexEntries)
+
+			unsorted := &sliceIngestIterator{keys: [][]byte{key(2), key(1)}, values: [][]byte{nil, nil}}
+			require.ErrorIs(t, db.IngestSorted(unsorted, DefaultIngestOptions), ErrIngestNotSorted)
+			empty := &sliceIngestIterator{keys: [][]byte{nil}, values: [][]byte{nil}}
+			require.ErrorIs(t, db.IngestSorted(empty, DefaultIngestOptions), ErrKeyIsEmpty)
+		})
+	}
+}
@@ -3,9 +3,12 @@ package lotusdb
 import (
 	"bytes"
 	"container/heap"
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/v4/y"
-	"github.com/rosedblabs/wal"
 )
 
 // baseIterator.
@@ -27,16 +30,47 @@ type baseIterator interface {
 	Close() error
 }
 
+// iterateBounds returns the range [lower, upper) of the keys to iterate, a nil bound means no limit.
+// The prefix is converted to a range too, so the iterators can seek to the prefix directly.
+func iterateBounds(options IteratorOptions) ([]byte, []byte) {
+	lower, upper := options.LowerBound, options.UpperBound
+	if len(upper) == 0 {
+		upper = nil
+	}
+	if len(options.Prefix) > 0 {
+		if bytes.Compare(options.Prefix, lower) > 0 {
+			lower = options.Prefix
+		}
+		if end := prefixEnd(options.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+	return lower, upper
+}
+
 // Iterator holds a heap and a set of iterators that implement the baseIterator interface.
 type Iterator struct {
-	h       iterHeap
-	itrs    []*singleIter       // used for rebuilding heap
-	rankMap map[int]*singleIter // map rank->singleIter
-	db      *DB
+	h          iterHeap
+	itrs       []*singleIter       // used for rebuilding heap
+	rankMap    map[int]*singleIter // map rank->singleIter
+	tombstones []*rangeTombstone   // range tombstones visible to the iterator
+	db         *DB
+	family     *ColumnFamily // the column family to iterate
+	vlog       *valueLog     // the value log of the family, a secondary replaces it when catching up
+	snapshot   *Snapshot     // the snapshot created by the iterator, released when closing
+	err        error         // the first error encountered, see Err
+	keysOnly   bool          // whether the values are not read, see IteratorOptions.KeysOnly
+	partition  int           // the only partition to iterate, -1 means all partitions, see DB.Export
+	closed     bool
+	// dbClosed is set when the database is closed, the iterator is invalid then, see DB.invalidateIterators.
+	dbClosed atomic.Bool
 }
 
 // Rewind seek the first key in the iterator.
 func (mi *Iterator) Rewind() {
+	if mi.closed {
+		return
+	}
 	for _, v := range mi.itrs {
 		v.iter.Rewind()
 	}
@@ -48,6 +82,9 @@ func (mi *Iterator) Rewind() {
 // Seek move the iterator to the key which is
 // greater(less when reverse is true) than or equal to the specified key.
 func (mi *Iterator) Seek(key []byte) {
+	if mi.closed {
+		return
+	}
 	seekItrs := make([]*singleIter, 0)
 	for _, v := range mi.itrs {
 		v.iter.Seek(key)
@@ -65,11 +102,6 @@ func (mi *Iterator) Seek(key []byte) {
 // cleanKey Remove all unused keys from all iterators.
 // If the iterators become empty after clearing, remove them from the heap.
 func (mi *Iterator) cleanKey(oldKey []byte, rank int) {
-	defer func() {
-		if r := recover(); r != nil {
-			mi.db.mu.Unlock()
-		}
-	}()
 	for i := 0; i < len(mi.itrs); i++ {
 		if i == rank {
 			continue
@@ -81,7 +113,8 @@ func (mi *Iterator) cleanKey(oldKey []byte, rank int) {
 		for itr.iter.Valid() &&
 			bytes.Equal(itr.iter.Key(), oldKey) {
 			if itr.rank > rank {
-				panic("rank error")
+				mi.err = ErrIteratorOutOfOrder
+				return
 			}
 			itr.iter.Next()
 		}
@@ -95,13 +128,16 @@ func (mi *Iterator) cleanKey(oldKey []byte, rank int) {
 
 // Next moves the iterator to the next key.
 func (mi *Iterator) Next() {
-	if mi.h.Len() == 0 {
+	if mi.closed || mi.err != nil || mi.h.Len() == 0 {
 		return
 	}
 
 	// Get the top item from the heap
 	topIter := mi.h[0]
 	mi.cleanKey(topIter.iter.Key(), topIter.rank)
+	if mi.err != nil {
+		return
+	}
 
 	// Move to the next key and update the heap
 	topIter.iter.Next()
@@ -112,45 +148,252 @@ func (mi *Iterator) Next() {
 	}
 }
 
-// Key get the current key.
+// Key get the current key, nil is returned if the iterator is not valid.
 func (mi *Iterator) Key() []byte {
+	if mi.closed || mi.h.Len() == 0 {
+		return nil
+	}
 	return mi.h[0].iter.Key()
 }
 
 // Value get the current value.
+// A nil value is returned if the value can not be read, the error can be got by ValueErr or Err.
 func (mi *Iterator) Value() []byte {
-	defer func() {
-		if r := recover(); r != nil {
-			mi.db.mu.Unlock()
+	value, _ := mi.ValueErr()
+	return value
+}
+
+// ValueErr get the current value, and the error if the value can not be read,
+// such as the value log read failure or the corrupted index entry.
+// The error is also recorded in the iterator, and the iterator becomes invalid, see Err.
+func (mi *Iterator) ValueErr() ([]byte, error) {
+	if mi.err != nil {
+		return nil, mi.err
+	}
+	if mi.closed {
+		return nil, ErrIteratorClosed
+	}
+	if mi.keysOnly {
+		return nil, ErrIteratorKeysOnly
+	}
+	if mi.h.Len() == 0 {
+		return nil, nil
+	}
+	mi.db.mu.RLock()
+	closed := mi.db.closed
+	mi.db.mu.RUnlock()
+	if closed {
+		mi.err = ErrDBClosed
+		return nil, mi.err
+	}
+
+	var value []byte
+	var err error
+	topIter := mi.h[0]
+	switch topIter.iType {
+	case BptreeItr, SnapshotItr, HashItr:
+		value, err = mi.indexValue(topIter)
+	case MemItr:
+		valueStruct := topIter.iter.Value().(y.ValueStruct)
+		if valueStruct.Meta == LogRecordMerge {
+			value, err = mi.mergedValue(topIter)
+		} else {
+			value = valueStruct.Value
 		}
-	}()
+	default:
+		panic("iType not support")
+	}
+	if err != nil {
+		mi.err = err
+		return nil, err
+	}
+	return value, nil
+}
+
+// ValueSize get the size of the current value without reading the value log,
+// so it is available in the KeysOnly mode.
+// If the value is compressed in value log, the compressed size is returned, see Options.Compression.
+// The value of a merged key is folded to get its size, which may read the value log.
+func (mi *Iterator) ValueSize() (int, error) {
+	if mi.err != nil {
+		return 0, mi.err
+	}
+	if mi.closed {
+		return 0, ErrIteratorClosed
+	}
+	if mi.h.Len() == 0 {
+		return 0, nil
+	}
 	topIter := mi.h[0]
 	switch topIter.iType {
-	case BptreeItr:
-		keyPos := new(KeyPosition)
-		keyPos.key = topIter.iter.Key()
-		keyPos.partition = uint32(mi.db.vlog.getKeyPartition(topIter.iter.Key()))
-		keyPos.position = wal.DecodeChunkPosition(topIter.iter.Value().([]byte))
-		record, err := mi.db.vlog.read(keyPos)
+	case BptreeItr, SnapshotItr, HashItr:
+		keyPos, err := mi.indexPosition(topIter)
+		if err != nil {
+			mi.err = err
+			return 0, err
+		}
+		if keyPos == nil {
+			return 0, nil
+		}
+		return mi.vlog.valueSize(keyPos), nil
+	case MemItr:
+		valueStruct := topIter.iter.Value().(y.ValueStruct)
+		if valueStruct.Meta != LogRecordMerge {
+			return len(valueStruct.Value), nil
+		}
+		value, err := mi.mergedValue(topIter)
 		if err != nil {
-			panic(err)
+			mi.err = err
+			return 0, err
 		}
-		return record.value
+		return len(value), nil
+	default:
+		panic("iType not support")
+	}
+}
+
+// expire returns the expiration time of the current key, 0 means the key never expires.
+func (mi *Iterator) expire() (uint64, error) {
+	if mi.h.Len() == 0 {
+		return 0, nil
+	}
+	topIter := mi.h[0]
+	switch topIter.iType {
+	case BptreeItr, SnapshotItr, HashItr:
+		keyPos, err := mi.indexPosition(topIter)
+		if keyPos == nil || err != nil {
+			return 0, err
+		}
+		return keyPos.expire, nil
 	case MemItr:
-		return topIter.iter.Value().(y.ValueStruct).Value
+		// the value of a merged key expires with its latest operand.
+		return topIter.iter.Value().(y.ValueStruct).ExpiresAt, nil
 	default:
 		panic("iType not support")
 	}
 }
 
+// Err returns the first error encountered by the iterator, nil if there is no error.
+// The iterator is not valid after an error, it should be checked when Valid returns false.
+func (mi *Iterator) Err() error {
+	return mi.err
+}
+
+// indexValue reads the value of the current key of a bptree, snapshot or hash iterator from the value log.
+// A nil value is returned if the key is expired or not exist.
+func (mi *Iterator) indexValue(itr *singleIter) ([]byte, error) {
+	keyPos, err := mi.indexPosition(itr)
+	if keyPos == nil || err != nil {
+		return nil, err
+	}
+	record, err := mi.vlog.read(keyPos)
+	if err != nil {
+		return nil, err
+	}
+	return record.value, nil
+}
+
+// indexPosition returns the position of the current key of a bptree, snapshot or hash iterator.
+// A nil position is returned if the key is expired or not exist.
+func (mi *Iterator) indexPosition(itr *singleIter) (*KeyPosition, error) {
+	var keyPos *KeyPosition
+	switch itr.iType {
+	case BptreeItr:
+		bptreeItr, ok := itr.iter.(*bptreeIterator)
+		if !ok {
+			panic("iType not support")
+		}
+		position, expire, err := bptreeItr.position()
+		if err != nil {
+			return nil, err
+		}
+		keyPos = &KeyPosition{
+			key:       itr.iter.Key(),
+			partition: uint32(mi.vlog.getKeyPartition(itr.iter.Key())),
+			position:  position,
+			expire:    expire,
+		}
+	case SnapshotItr, HashItr:
+		keyPos = itr.iter.Value().(*KeyPosition)
+	default:
+		panic("iType not support")
+	}
+	if keyPos == nil || isExpired(keyPos.expire, time.Now().UnixNano()) {
+		return nil, nil
+	}
+	if keyPos.position == nil {
+		return nil, ErrChunkPositionCorrupted
+	}
+	return keyPos, nil
+}
+
+// mergedValue folds the merge operands of the current key of a memtable iterator,
+// the older values of the key are held by the lower ranked iterators at the same key.
+func (mi *Iterator) mergedValue(top *singleIter) ([]byte, error) {
+	key := top.iter.Key()
+	itrs := make([]*singleIter, 0, len(mi.h))
+	for _, itr := range mi.h {
+		if bytes.Equal(itr.iter.Key(), key) {
+			itrs = append(itrs, itr)
+		}
+	}
+	// from the newest to the oldest
+	sort.Slice(itrs, func(i, j int) bool {
+		return itrs[i].rank > itrs[j].rank
+	})
+
+	var operands [][]byte
+	for _, itr := range itrs {
+		// deleted by a range tombstone in the newer memtables
+		if mi.isRangeDeleted(itr) {
+			return mi.db.resolveValue(key, nil, operands)
+		}
+		if itr.iType != MemItr {
+			value, err := mi.indexValue(itr)
+			if err != nil {
+				return nil, err
+			}
+			return mi.db.resolveValue(key, value, operands)
+		}
+		memItr, ok := itr.iter.(*memtableIterator)
+		if !ok {
+			panic("iType not support")
+		}
+		deleted, value, tableOperands := memItr.table.lookup(familyKey(mi.family.id, key), memItr.readSeq)
+		operands = append(operands, tableOperands...)
+		if deleted || len(value) != 0 {
+			return mi.db.resolveValue(key, value, operands)
+		}
+	}
+	return mi.db.resolveValue(key, nil, operands)
+}
+
 // Valid returns whether the iterator is exhausted.
+// It returns false if the iterator is closed or an error is encountered, see Err.
 func (mi *Iterator) Valid() bool {
+	if mi.closed || mi.err != nil {
+		return false
+	}
+	if mi.dbClosed.Load() {
+		mi.err = ErrDBClosed
+		return false
+	}
+	// the bptree iterators are exhausted if they fail to read the index.
+	for _, itr := range mi.itrs {
+		if bptreeItr, ok := itr.iter.(*bptreeIterator); ok && bptreeItr.err != nil {
+			mi.err = bptreeItr.err
+			return false
+		}
+	}
 	if mi.h.Len() == 0 {
 		return false
 	}
 	topIter := mi.h[0]
-	if topIter.iType == MemItr && topIter.iter.Value().(y.ValueStruct).Meta == LogRecordDeleted {
+	if mi.isInvisible(topIter) {
 		mi.cleanKey(topIter.iter.Key(), topIter.rank)
+		if mi.err != nil {
+			return false
+		}
 		topIter.iter.Next()
 		if topIter.iter.Valid() {
 			heap.Fix(&mi.h, topIter.idx)
@@ -162,60 +405,255 @@ func (mi *Iterator) Valid() bool {
 	return true
 }
 
+// isInvisible checks whether the current key of the iterator is deleted or expired,
+// or in another partition if the iterator only iterates a partition.
+func (mi *Iterator) isInvisible(itr *singleIter) bool {
+	if mi.isRangeDeleted(itr) {
+		return true
+	}
+	if mi.partition >= 0 && mi.vlog.getKeyPartition(itr.iter.Key()) != mi.partition {
+		return true
+	}
+	now := time.Now().UnixNano()
+	switch itr.iType {
+	case BptreeItr:
+		bptreeItr, ok := itr.iter.(*bptreeIterator)
+		if !ok {
+			return false
+		}
+		// the corrupted entry is visible, the error is reported when reading the value.
+		_, expire, err := bptreeItr.position()
+		return err == nil && isExpired(expire, now)
+	case MemItr:
+		valueStruct := itr.iter.Value().(y.ValueStruct)
+		return valueStruct.Meta == LogRecordDeleted || isExpired(valueStruct.ExpiresAt, now)
+	case SnapshotItr, HashItr:
+		keyPos := itr.iter.Value().(*KeyPosition)
+		return keyPos == nil || isExpired(keyPos.expire, now)
+	default:
+		return false
+	}
+}
+
+// isRangeDeleted checks whether the current key of the iterator is deleted by a newer range tombstone,
+// the keys in index are older than all the range tombstones in memtables.
+func (mi *Iterator) isRangeDeleted(itr *singleIter) bool {
+	var seq uint64
+	if memItr, ok := itr.iter.(*memtableIterator); ok {
+		seq = memItr.seq()
+	}
+	return isRangeDeleted(mi.tombstones, familyKey(mi.family.id, itr.iter.Key()), seq)
+}
+
 // Close the iterator.
+// It is safe to call Close multiple times, after an error is encountered, and after the database is closed.
 func (mi *Iterator) Close() error {
-	defer mi.db.mu.Unlock()
+	if mi.closed {
+		return nil
+	}
+	mi.closed = true
+	defer func() {
+		if mi.snapshot != nil {
+			mi.snapshot.Release()
+		}
+		mi.db.iterLock.Lock()
+		delete(mi.db.iterators, mi)
+		mi.db.iterLock.Unlock()
+		mi.db.unpinValueLogs()
+	}()
+	// close all the iterators even if some of them fail, the first error is returned.
+	var err error
 	for _, itr := range mi.itrs {
-		err := itr.iter.Close()
-		if err != nil {
-			return err
+		if errClose := itr.iter.Close(); errClose != nil && err == nil {
+			err = errClose
 		}
 	}
-	return nil
+	return err
 }
 
 // NewIterator returns a new iterator.
-// The iterator will iterate all the keys in DB.
+// The iterator will iterate all the keys in the default column family,
+// or the keys visible to the snapshot if options.Snapshot is set.
+//
+// The iterator pins a consistent view of the database when it is created,
+// the writes committed after that are invisible to it, and the database is not locked while iterating,
+// so the reads and writes can run concurrently with the iterator.
+// The memtables and a snapshot of the index are held until the iterator is closed,
+// and the value log segments it reads are not removed by compaction until then.
+// The bptree index is read in short read transactions, and the index entries in the range of the iterator
+// overwritten by flush meanwhile are kept by the snapshot, so the flushes are a bit slower while iterating.
+// If the database is closed, the iterator is invalid and Err returns ErrDBClosed, but it should still be closed.
+//
+// If the index type is Hash, the keys in index are loaded from the value log
+// and sorted in memory when the iterator is created, which is much more expensive than BTree,
+// but the writes and flushes are not blocked while loading.
 // It's the caller's responsibility to call Close when iterator is no longer
 // used, otherwise resources will be leaked.
 // The iterator is not goroutine-safe, you should not use the same iterator
 // concurrently from multiple goroutines.
 func (db *DB) NewIterator(options IteratorOptions) (*Iterator, error) {
-	if db.options.IndexType == Hash {
-		return nil, ErrDBIteratorUnsupportedTypeHASH
+	return db.newIterator(context.Background(), db.defaultFamily, options, -1)
+}
+
+// NewIteratorCtx returns a new iterator like NewIterator, but gives up if ctx is done
+// before the iterator is created, e.g. while loading the hash index, the error of ctx is returned.
+// The ctx is not used after the iterator is created, because iterating is driven by the caller,
+// which can check ctx between the calls of Next.
+func (db *DB) NewIteratorCtx(ctx context.Context, options IteratorOptions) (*Iterator, error) {
+	return db.newIterator(ctx, db.defaultFamily, options, -1)
+}
+
+// newIterator returns a new iterator of the column family, see NewIteratorCtx.
+// If partition is not negative, only the keys in the partition are iterated, see DB.Export.
+//
+//nolint:funlen,gocognit
+func (db *DB) newIterator(ctx context.Context, cf *ColumnFamily, options IteratorOptions,
+	partition int) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	db.mu.Lock()
-	defer func() {
-		if r := recover(); r != nil {
-			db.mu.Unlock()
+	db.pinValueLogs()
+	itrs := make([]*singleIter, 0)
+	// the index iterators of the partitions, and the value log views to load the hash index.
+	indexItrs := make([]baseIterator, 0, cf.options.PartitionNum)
+	views := make(map[int]*walView)
+	// the snapshot keeps the index entries overwritten after the iterator is created, it is created by
+	// the iterator if options.Snapshot is not set, and released once the hash index is loaded, or the iterator is closed.
+	snapshot := options.Snapshot
+	var ownSnapshot *Snapshot
+	scanning := cf.options.IndexType == Hash
+	// the index and value log are replaced by a secondary when catching up, see DB.TryCatchUpWithPrimary.
+	var index Index
+	var vlog *valueLog
+	fail := func(err error) (*Iterator, error) {
+		for _, itr := range indexItrs {
+			_ = itr.Close()
 		}
-	}()
+		for _, itr := range itrs {
+			_ = itr.iter.Close()
+		}
+		for _, view := range views {
+			_ = view.Close()
+		}
+		if ownSnapshot != nil {
+			ownSnapshot.Release()
+		}
+		if scanning {
+			db.scanLock.RUnlock()
+		}
+		db.unpinValueLogs()
+		return nil, err
+	}
+	if scanning {
+		// the value log views are opened to load the hash index after the locks are released,
+		// no flush can happen meanwhile, so the views hold all the records in index.
+		// The records can not be moved by compaction until the hash index is loaded.
+		db.scanLock.RLock()
+		db.flushLock.Lock()
+	}
+	// the locks are only held to pin the view, no batch can be committed meanwhile.
+	db.mu.RLock()
+	unlock := func() {
+		db.mu.RUnlock()
+		if scanning {
+			db.flushLock.Unlock()
+		}
+	}
+	if db.closed {
+		unlock()
+		return fail(ErrDBClosed)
+	}
+	index, vlog = cf.index, cf.vlog
 
-	itrs := make([]*singleIter, 0, db.options.PartitionNum+len(db.immuMems)+1)
-	itrsM := make(map[int]*singleIter)
-	rank := 0
-	index, ok := db.index.(*BPTree)
-	if !ok {
-		panic("index type not support")
+	// memtables from the oldest to the newest
+	memtableList := make([]*memtable, len(db.immuMems)+1)
+	copy(memtableList, append(db.immuMems, db.activeMem))
+	readSeq := db.seq
+	if options.Snapshot != nil {
+		options.Snapshot.mu.RLock()
+		released := options.Snapshot.released()
+		memtableList = make([]*memtable, len(options.Snapshot.memtables))
+		for i, table := range options.Snapshot.memtables {
+			memtableList[len(memtableList)-1-i] = table
+		}
+		options.Snapshot.mu.RUnlock()
+		if released {
+			unlock()
+			return fail(ErrSnapshotReleased)
+		}
+		readSeq = options.Snapshot.seq
+	}
+
+	var tombstones []*rangeTombstone
+	for _, table := range memtableList {
+		tombstones = append(tombstones, table.rangeTombstones(readSeq)...)
+	}
+
+	if snapshot == nil {
+		lower, upper := iterateBounds(options)
+		ownSnapshot = db.newSnapshot(&snapshotScope{familyID: cf.id, lower: lower, upper: upper})
+		snapshot = ownSnapshot
+	}
+	for i := 0; i < cf.options.PartitionNum; i++ {
+		if partition >= 0 && i != partition {
+			continue
+		}
+		switch index := index.(type) {
+		case *BPTree:
+			override := snapshot.newSnapshotOverride(cf.id, i, index.options, options)
+			indexItrs = append(indexItrs, newBptreeIterator(index.trees[i], options, index.options.encryptor, override))
+		case *HashTable:
+			view, err := vlog.openReadView(i)
+			if err != nil {
+				unlock()
+				return fail(err)
+			}
+			views[i] = view
+		default:
+			panic("index type not support")
+		}
 	}
+	unlock()
 
-	for i := 0; i < db.options.PartitionNum; i++ {
-		tx, err := index.trees[i].Begin(false)
+	// the hash index is loaded from the value log views, the flushes are not blocked meanwhile.
+	for i := 0; i < cf.options.PartitionNum; i++ {
+		view, ok := views[i]
+		if !ok {
+			continue
+		}
+		hashItr, err := index.(*HashTable).newIterator(ctx, view, vlog, i, options)
+		delete(views, i)
+		if errClose := view.Close(); err == nil {
+			err = errClose
+		}
 		if err != nil {
-			return nil, err
+			return fail(err)
+		}
+		indexItrs = append(indexItrs, hashItr)
+	}
+	if scanning {
+		db.scanLock.RUnlock()
+		scanning = false
+	}
+
+	rank := 0
+	itrsM := make(map[int]*singleIter)
+	for _, itr := range indexItrs {
+		iType := BptreeItr
+		if _, ok := itr.(*positionIterator); ok {
+			iType = HashItr
 		}
-		itr := newBptreeIterator(
-			tx,
-			options,
-		)
 		itr.Rewind()
+		if bptreeItr, ok := itr.(*bptreeIterator); ok && bptreeItr.err != nil {
+			return fail(bptreeItr.err)
+		}
 		// is empty
 		if !itr.Valid() {
 			_ = itr.Close()
 			continue
 		}
 		itrs = append(itrs, &singleIter{
-			iType:   BptreeItr,
+			iType:   iType,
 			options: options,
 			rank:    rank,
 			idx:     rank,
@@ -224,10 +662,29 @@ func (db *DB) NewIterator(options IteratorOptions) (*Iterator, error) {
 		itrsM[rank] = itrs[len(itrs)-1]
 		rank++
 	}
-	memtableList := make([]*memtable, len(db.immuMems)+1)
-	copy(memtableList, append(db.immuMems, db.activeMem))
+	indexItrs = nil
+	// the index entries kept by the snapshot override the entries in the hash index,
+	// the bptree iterators override them when reading, see snapshotOverride.
+	if cf.options.IndexType == Hash {
+		itr := snapshot.newSnapshotIterator(cf.id, options)
+		if ownSnapshot != nil {
+			ownSnapshot.Release()
+			ownSnapshot = nil
+		}
+		if itr.Valid() {
+			itrs = append(itrs, &singleIter{
+				iType:   SnapshotItr,
+				options: options,
+				rank:    rank,
+				idx:     rank,
+				iter:    itr,
+			})
+			itrsM[rank] = itrs[len(itrs)-1]
+			rank++
+		}
+	}
 	for i := 0; i < len(memtableList); i++ {
-		itr := newMemtableIterator(options, memtableList[i])
+		itr := newFamilyMemtableIterator(cf.id, readSeq, options, memtableList[i])
 		itr.Rewind()
 		// is empty
 		if !itr.Valid() {
@@ -248,10 +705,72 @@ func (db *DB) NewIterator(options IteratorOptions) (*Iterator, error) {
 	h := iterHeap(itrs)
 	heap.Init(&h)
 
-	return &Iterator{
-		h:       h,
-		itrs:    itrs,
-		rankMap: itrsM,
-		db:      db,
-	}, nil
+	iterator := &Iterator{
+		h:          h,
+		itrs:       itrs,
+		rankMap:    itrsM,
+		tombstones: tombstones,
+		db:         db,
+		family:     cf,
+		vlog:       vlog,
+		snapshot:   ownSnapshot,
+		keysOnly:   options.KeysOnly,
+		partition:  partition,
+	}
+	db.iterLock.Lock()
+	// the database is being closed, the read transactions of the iterator would block closing the index.
+	if db.iterators == nil {
+		db.iterLock.Unlock()
+		_ = iterator.Close()
+		return nil, ErrDBClosed
+	}
+	db.iterators[iterator] = struct{}{}
+	db.iterLock.Unlock()
+	return iterator, nil
+}
+
+// pinValueLogs is called when an iterator is opened, the value log segments read by the iterator
+// are not removed until it is closed, even if they are compacted, see DB.removeObsoleteSegments.
+// It is also called when creating a checkpoint and ingesting, see DB.Checkpoint and DB.IngestSorted.
+func (db *DB) pinValueLogs() {
+	db.iterLock.Lock()
+	defer db.iterLock.Unlock()
+	db.openIterators++
+}
+
+// unpinValueLogs is called when an iterator is closed.
+func (db *DB) unpinValueLogs() {
+	db.iterLock.Lock()
+	defer db.iterLock.Unlock()
+	db.openIterators--
+}
+
+// removeObsoleteSegments removes the value log segments rewritten by compaction if no iterator pins them,
+// otherwise they are removed by the next flush or compaction after the iterators are closed.
+// It must be called with db.flushLock and db.mu held, because the value logs are reopened.
+func (db *DB) removeObsoleteSegments() error {
+	db.iterLock.Lock()
+	defer db.iterLock.Unlock()
+	if db.openIterators > 0 {
+		return nil
+	}
+	for _, cf := range db.getFamilies() {
+		if err := cf.vlog.removeObsoleteSegments(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateIterators marks the open iterators invalid when closing the database,
+// their Valid returns false and Err returns ErrDBClosed, but they are still closed by their owners,
+// because the iterators are not goroutine-safe. The iterators created after it are closed immediately,
+// see newIterator. The iterators do not block closing the index, they read it in short read transactions.
+func (db *DB) invalidateIterators() {
+	db.iterLock.Lock()
+	defer db.iterLock.Unlock()
+	for itr := range db.iterators {
+		itr.dbClosed.Store(true)
+	}
+	db.iterators = nil
 }
@@ -2,6 +2,7 @@ package lotusdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 
@@ -25,6 +27,10 @@ const (
 	initialTableID = 1
 )
 
+// syncWal syncs the wal of a memtable after writing a batch with WriteOptions.Sync,
+// it is replaced by the tests to see whether the batch is synced.
+var syncWal = func(w *wal.WAL) error { return w.Sync() }
+
 type (
 	// memtable is an in-memory data structure holding data before they are flushed into index and value log.
 	// Currently, the only supported data structure is skip list, see github.com/dgraph-io/badger/v4/skl.
@@ -38,19 +44,26 @@ type (
 	// A background goroutine will flush the content of memtable into index and vlog,
 	// after that the memtable can be deleted.
 	memtable struct {
-		mu      sync.RWMutex
-		wal     *wal.WAL           // write ahead log for the memtable
-		skl     *arenaskl.Skiplist // in-memory skip list
-		options memtableOptions
+		mu     sync.RWMutex
+		wal    *wal.WAL           // write ahead log for the memtable
+		skl    *arenaskl.Skiplist // in-memory skip list
+		maxSeq uint64             // the max commit sequence number of entries in the memtable
+		chunks int                // number of chunks written to the wal, see ChangeIterator
+		ranges []*rangeTombstone  // range tombstones written to the memtable, see DB.DeleteRange
+		// replayed is the position after the last batch read from the wal, nil if none, see replay.
+		replayed *wal.ChunkPosition
+		options  memtableOptions
 	}
 
 	// memtableOptions represents the configuration options for a memtable.
 	memtableOptions struct {
-		dirPath         string // where write ahead log wal file is stored
-		tableID         uint32 // unique id of the memtable, used to generate wal file name
-		memSize         uint32 // max size of the memtable
-		walBytesPerSync uint32 // flush wal file to disk throughput BytesPerSync parameter
-		walSync         bool   // WAL flush immediately after each writing
+		dirPath         string     // where write ahead log wal file is stored
+		tableID         uint32     // unique id of the memtable, used to generate wal file name
+		memSize         uint32     // max size of the memtable
+		walBytesPerSync uint32     // flush wal file to disk throughput BytesPerSync parameter
+		walSync         bool       // WAL flush immediately after each writing
+		encryptor       *encryptor // encrypt the wal, nil if the encryption is disabled
+		readOnly        bool       // the wal is only read to rebuild the memtable, see Options.ReadOnly
 	}
 )
 
@@ -58,30 +71,14 @@ type (
 // a wal is associated with a memtable, so the wal file name is generated by the memtable id
 // for example, the wal file name of memtable with id 1 is .SEG.1.
 func openAllMemtables(options Options) ([]*memtable, error) {
-	entries, err := os.ReadDir(options.DirPath)
+	tableIDs, err := memtableIDs(options.DirPath)
 	if err != nil {
 		return nil, err
 	}
-
-	// get all memtable ids
-	var tableIDs []int
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		var id int
-		var prefix int
-		_, err = fmt.Sscanf(entry.Name(), "%d"+walFileExt, &prefix, &id)
-		if err != nil {
-			continue
-		}
-		tableIDs = append(tableIDs, id)
-	}
-
 	if len(tableIDs) == 0 {
 		tableIDs = append(tableIDs, initialTableID)
 	}
-	sort.Ints(tableIDs)
+	encryptor := newEncryptor(options.KeyProvider)
 	tables := make([]*memtable, len(tableIDs))
 	for i, table := range tableIDs {
 		table, errOpenMemtable := openMemtable(memtableOptions{
@@ -90,6 +87,8 @@ func openAllMemtables(options Options) ([]*memtable, error) {
 			memSize:         options.MemtableSize,
 			walSync:         options.Sync,
 			walBytesPerSync: options.BytesPerSync,
+			encryptor:       encryptor,
+			readOnly:        options.ReadOnly,
 		})
 		if errOpenMemtable != nil {
 			return nil, errOpenMemtable
@@ -100,6 +99,29 @@ func openAllMemtables(options Options) ([]*memtable, error) {
 	return tables, nil
 }
 
+// memtableIDs returns the sorted ids of the memtables whose wal are in dirPath.
+func memtableIDs(dirPath string) ([]int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var tableIDs []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id int
+		var prefix int
+		_, err = fmt.Sscanf(entry.Name(), "%d"+walFileExt, &prefix, &id)
+		if err != nil {
+			continue
+		}
+		tableIDs = append(tableIDs, id)
+	}
+	sort.Ints(tableIDs)
+	return tableIDs, nil
+}
+
 // memtable holds a wal(write ahead log), so when opening a memtable,
 // actually it open the corresponding wal file.
 // and load all entries from wal to rebuild the content of the skip list.
@@ -109,101 +131,282 @@ func openMemtable(options memtableOptions) (*memtable, error) {
 	skl := arenaskl.NewSkiplist(int64(float64(options.memSize) * 1.5))
 	table := &memtable{options: options, skl: skl}
 
-	// open the Write Ahead Log file
-	walFile, err := wal.Open(wal.Options{
-		DirPath:        options.dirPath,
-		SegmentSize:    math.MaxInt, // no limit, guarantee that a wal file only contains one segment file
-		SegmentFileExt: fmt.Sprintf(walFileExt, options.tableID),
-		Sync:           options.walSync,
-		BytesPerSync:   options.walBytesPerSync,
-	})
-	if err != nil {
-		return nil, err
+	var reader chunkReader
+	if options.readOnly {
+		// the wal is only read in read only mode, the batch being written by the writable process is ignored.
+		view, err := openWalView(options.dirPath, fmt.Sprintf(walFileExt, options.tableID))
+		if err != nil {
+			return nil, err
+		}
+		defer view.Close()
+		reader = view.NewReader()
+	} else {
+		// open the Write Ahead Log file
+		walFile, err := wal.Open(wal.Options{
+			DirPath:        options.dirPath,
+			SegmentSize:    math.MaxInt, // no limit, guarantee that a wal file only contains one segment file
+			SegmentFileExt: fmt.Sprintf(walFileExt, options.tableID),
+			Sync:           options.walSync,
+			BytesPerSync:   options.walBytesPerSync,
+		})
+		if err != nil {
+			return nil, err
+		}
+		table.wal = walFile
+		reader = table.wal.NewReader()
 	}
-	table.wal = walFile
 
-	indexRecords := make(map[uint64][]*LogRecord)
 	// now we get the opened wal file, we need to load all entries
 	// from wal to rebuild the content of the skip list
-	reader := table.wal.NewReader()
+	if err := table.replay(reader, table.applyBatch); err != nil {
+		return nil, err
+	}
+
+	// open and read wal file successfully, return the memtable
+	return table, nil
+}
+
+// replay reads the batches in the wal by the reader, and calls apply for every finished batch
+// with its records and commit sequence number. The position after the last finished batch is recorded,
+// so a secondary reads the batches written after that when catching up, see DB.catchUpMemtables.
+func (mt *memtable) replay(reader chunkReader, apply func(records []*LogRecord, seq uint64)) error {
+	indexRecords := make(map[uint64][]*LogRecord)
+	// the chunks read after the last finished batch, in read only mode they are only counted
+	// once the batch is finished, because the unfinished batch is read again by the next catch-up.
+	var chunks int
 	for {
 		chunk, _, errNext := reader.Next()
 		if errNext != nil {
 			if errors.Is(errNext, io.EOF) {
-				break
+				if !mt.options.readOnly {
+					mt.chunks += chunks
+				}
+				return nil
 			}
-			return nil, errNext
+			return errNext
+		}
+		chunks++
+		chunk, err := mt.options.encryptor.decryptLogRecord(chunk)
+		if err != nil {
+			return err
 		}
 		record := decodeLogRecord(chunk)
 		if record.Type == LogRecordBatchFinished {
 			batchID, errParseBytes := snowflake.ParseBytes(record.Key)
 			if errParseBytes != nil {
-				return nil, errParseBytes
-			}
-			for _, idxRecord := range indexRecords[uint64(batchID)] {
-				table.skl.Put(y.KeyWithTs(idxRecord.Key, 0),
-					y.ValueStruct{Value: idxRecord.Value, Meta: idxRecord.Type})
+				return errParseBytes
 			}
+			// the commit sequence number of the batch is stored in the value of the batch finished record.
+			seq, _ := binary.Uvarint(record.Value)
+			apply(indexRecords[uint64(batchID)], seq)
 			delete(indexRecords, uint64(batchID))
+			mt.chunks += chunks
+			chunks = 0
+			mt.replayed = reader.CurrentChunkPosition()
 		} else {
 			indexRecords[record.BatchID] = append(indexRecords[record.BatchID], record)
 		}
 	}
+}
 
-	// open and read wal file successfully, return the memtable
-	return table, nil
+// catchUp reads the batches written to the wal by the writable process after the ones replayed,
+// and calls apply for every finished batch, in read only mode, see replay.
+func (mt *memtable) catchUp(apply func(records []*LogRecord, seq uint64)) error {
+	view, err := openWalView(mt.options.dirPath, fmt.Sprintf(walFileExt, mt.options.tableID))
+	if err != nil {
+		return err
+	}
+	defer view.Close()
+	return mt.replay(view.NewReaderAt(mt.replayed), apply)
 }
 
-// putBatch writes a batch of entries to memtable.
+// applyBatch puts the records of a batch read from the wal to the memtable, see replay.
+func (mt *memtable) applyBatch(records []*LogRecord, seq uint64) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	for _, record := range records {
+		if record.Type == LogRecordRangeDeleted {
+			mt.ranges = append(mt.ranges, newRangeTombstone(record, seq))
+			continue
+		}
+		mt.skl.Put(y.KeyWithTs(familyKey(record.ColumnFamily, record.Key), seq),
+			y.ValueStruct{Value: record.Value, Meta: record.Type, ExpiresAt: record.Expire})
+	}
+	if seq > mt.maxSeq {
+		mt.maxSeq = seq
+	}
+}
+
+// putBatch writes a batch of entries and range tombstones to memtable.
+// All entries in the batch share the same commit sequence number,
+// which is used as the version of the keys in the skip list.
+// The range tombstones only delete the versions older than the batch.
+// The keys in the skip list are the family keys of the records.
 func (mt *memtable) putBatch(pendingWrites map[string]*LogRecord,
-	batchID snowflake.ID, options WriteOptions) error {
+	batchID snowflake.ID, seq uint64, options WriteOptions, rangeDeletes ...*LogRecord) error {
 	// if wal is not disabled, write to wal first to ensure durability and atomicity
+	var chunks int
 	if !options.DisableWal {
-		// add record to wal.pendingWrites
+		// add record to wal.pendingWrites, the records are encrypted if the encryption is enabled
+		pendingWrite := func(record *LogRecord) error {
+			encRecord, err := mt.options.encryptor.encryptLogRecord(encodeLogRecord(record))
+			if err != nil {
+				mt.wal.ClearPendingWrites()
+				return err
+			}
+			mt.wal.PendingWrites(encRecord)
+			return nil
+		}
+		for _, record := range rangeDeletes {
+			record.BatchID = uint64(batchID)
+			if err := pendingWrite(record); err != nil {
+				return err
+			}
+		}
 		for _, record := range pendingWrites {
 			record.BatchID = uint64(batchID)
-			encRecord := encodeLogRecord(record)
-			mt.wal.PendingWrites(encRecord)
+			if err := pendingWrite(record); err != nil {
+				return err
+			}
 		}
 
 		// add a record to indicate the end of the batch
-		endRecord := encodeLogRecord(&LogRecord{
-			Key:  batchID.Bytes(),
-			Type: LogRecordBatchFinished,
-		})
-		mt.wal.PendingWrites(endRecord)
+		seqBuf := make([]byte, binary.MaxVarintLen64)
+		if err := pendingWrite(&LogRecord{
+			Key:   batchID.Bytes(),
+			Value: seqBuf[:binary.PutUvarint(seqBuf, seq)],
+			Type:  LogRecordBatchFinished,
+		}); err != nil {
+			return err
+		}
 
 		// write wal.pendingWrites
-		if _, err := mt.wal.WriteAll(); err != nil {
+		positions, err := mt.wal.WriteAll()
+		if err != nil {
 			return err
 		}
+		chunks = len(positions)
 		// flush wal if necessary
 		if options.Sync && !mt.options.walSync {
-			if err := mt.wal.Sync(); err != nil {
+			if err := syncWal(mt.wal); err != nil {
 				return err
 			}
 		}
 	}
 
 	mt.mu.Lock()
+	for _, record := range rangeDeletes {
+		mt.ranges = append(mt.ranges, newRangeTombstone(record, seq))
+	}
 	// write to in-memory skip list
-	for key, record := range pendingWrites {
-		mt.skl.Put(y.KeyWithTs([]byte(key), 0), y.ValueStruct{Value: record.Value, Meta: record.Type})
+	for _, record := range pendingWrites {
+		mt.skl.Put(y.KeyWithTs(familyKey(record.ColumnFamily, record.Key), seq),
+			y.ValueStruct{Value: record.Value, Meta: record.Type, ExpiresAt: record.Expire})
+	}
+	if seq > mt.maxSeq {
+		mt.maxSeq = seq
 	}
+	mt.chunks += chunks
 	mt.mu.Unlock()
 
 	return nil
 }
 
-// get value from memtable
-// if the specified key is marked as deleted, a true bool value is returned.
+// get the latest value from memtable
+// if the specified key is marked as deleted or expired, a true bool value is returned.
 func (mt *memtable) get(key []byte) (bool, []byte) {
+	return mt.getAt(key, math.MaxUint64)
+}
+
+// getAt get the newest value of the key in the default column family
+// whose sequence number is not greater than seq.
+// if the specified key is marked as deleted or expired, a true bool value is returned.
+func (mt *memtable) getAt(key []byte, seq uint64) (bool, []byte) {
+	deleted, value, _ := mt.lookup(familyKey(defaultColumnFamilyID, key), seq)
+	return deleted, value
+}
+
+// lookup get the newest value of the family key whose sequence number is not greater than seq,
+// and the merge operands written after the value, from the newest to the oldest.
+// if the specified key is marked as deleted or expired, a true bool value is returned.
+//
+// If neither a value nor a deletion is found, the operands should be
+// folded onto the value in the older memtables or index.
+func (mt *memtable) lookup(key []byte, seq uint64) (bool, []byte, [][]byte) {
+	deleted, value, operands, _ := mt.lookupExpire(key, seq)
+	return deleted, value, operands
+}
+
+// lookupExpire looks up the key like lookup, and returns the expiration time of the merged value too,
+// which is the earliest one of the value and the operands, see mergeExpire.
+func (mt *memtable) lookupExpire(key []byte, seq uint64) (bool, []byte, [][]byte, uint64) {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
 
-	valueStruct := mt.skl.Get(y.KeyWithTs(key, 0))
-	deleted := valueStruct.Meta == LogRecordDeleted
-	return deleted, valueStruct.Value
+	// the versions older than the range tombstone are deleted,
+	// as well as the versions in the older memtables and index.
+	rangeSeq := mt.rangeDeletedSeq(key, seq)
+	valueStruct := mt.skl.Get(y.KeyWithTs(key, seq))
+	if valueStruct.Version < rangeSeq {
+		return true, nil, nil, 0
+	}
+	if valueStruct.Meta != LogRecordMerge {
+		if isExpired(valueStruct.ExpiresAt, time.Now().UnixNano()) {
+			return true, nil, nil, 0
+		}
+		deleted := valueStruct.Meta == LogRecordDeleted
+		return deleted, valueStruct.Value, nil, valueStruct.ExpiresAt
+	}
+
+	// the newest version is a merge, collect the operands of the older versions until a value is found.
+	var operands [][]byte
+	var expire uint64
+	now := time.Now().UnixNano()
+	iter := mt.skl.NewIterator()
+	defer iter.Close()
+	for iter.Seek(y.KeyWithTs(key, seq)); iter.Valid(); iter.Next() {
+		if !bytes.Equal(y.ParseKey(iter.Key()), key) {
+			break
+		}
+		valueStruct = iter.Value()
+		// an expired operand expires the merged value, the same as an expired value.
+		if valueStruct.Meta == LogRecordDeleted || isExpired(valueStruct.ExpiresAt, now) ||
+			y.ParseTs(iter.Key()) < rangeSeq {
+			return true, nil, operands, expire
+		}
+		expire = mergeExpire(expire, valueStruct.ExpiresAt)
+		if valueStruct.Meta != LogRecordMerge {
+			return false, valueStruct.Value, operands, expire
+		}
+		operands = appendMergeOperands(operands, valueStruct.Value)
+	}
+	return rangeSeq > 0, nil, operands, expire
+}
+
+// rangeDeletedSeq returns the max sequence number of the range tombstones deleting the key,
+// only the tombstones whose sequence number is not greater than seq are visible.
+// must be called with mt.mu held.
+func (mt *memtable) rangeDeletedSeq(key []byte, seq uint64) uint64 {
+	var rangeSeq uint64
+	for _, tombstone := range mt.ranges {
+		if tombstone.seq <= seq && tombstone.seq > rangeSeq && tombstone.contains(key) {
+			rangeSeq = tombstone.seq
+		}
+	}
+	return rangeSeq
+}
+
+// rangeTombstones returns the range tombstones whose sequence number is not greater than seq.
+func (mt *memtable) rangeTombstones(seq uint64) []*rangeTombstone {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	var tombstones []*rangeTombstone
+	for _, tombstone := range mt.ranges {
+		if tombstone.seq <= seq {
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+	return tombstones
 }
 
 func (mt *memtable) isFull() bool {
@@ -232,58 +435,138 @@ func (mt *memtable) sync() error {
 }
 
 // memtableIterator implement baseIterator.
+// A key may have several versions in the skip list, the iterator
+// only returns the newest version which is visible to readSeq.
+// It only iterates the keys of one column family, the family prefix is stripped from the keys.
 type memtableIterator struct {
 	options IteratorOptions
-	iter    *arenaskl.UniIterator
+	readSeq uint64
+	table   *memtable
+	iter    *arenaskl.Iterator
+	family  uint32
+	lower   []byte // inclusive lower bound of the family keys
+	upper   []byte // exclusive upper bound of the family keys
 }
 
 func newMemtableIterator(options IteratorOptions, memtable *memtable) *memtableIterator {
-	return &memtableIterator{
+	readSeq := uint64(math.MaxUint64)
+	if options.Snapshot != nil {
+		readSeq = options.Snapshot.seq
+	}
+	return newFamilyMemtableIterator(defaultColumnFamilyID, readSeq, options, memtable)
+}
+
+// newFamilyMemtableIterator creates an iterator of the keys of the column family in memtable,
+// only the versions not newer than readSeq are visible.
+func newFamilyMemtableIterator(familyID uint32, readSeq uint64, options IteratorOptions,
+	memtable *memtable) *memtableIterator {
+	// the keys of the column family are in [familyKey(id, lower), familyKey(id+1, nil)).
+	lower, upper := iterateBounds(options)
+	itr := &memtableIterator{
 		options: options,
-		iter:    memtable.skl.NewUniIterator(options.Reverse),
+		readSeq: readSeq,
+		table:   memtable,
+		iter:    memtable.skl.NewIterator(),
+		family:  familyID,
+		lower:   familyKey(familyID, lower),
+		upper:   familyKey(familyID+1, nil),
+	}
+	if upper != nil {
+		itr.upper = familyKey(familyID, upper)
 	}
+	return itr
 }
 
 // Rewind seek the first key in the iterator.
 func (mi *memtableIterator) Rewind() {
-	mi.iter.Rewind()
-	if len(mi.options.Prefix) == 0 {
-		return
-	}
-	// prefix scan
-	for mi.iter.Valid() && !bytes.HasPrefix(mi.iter.Key(), mi.options.Prefix) {
-		mi.iter.Next()
+	if mi.options.Reverse {
+		// the versions of a key are sorted from the newest, the upper bound itself is skipped.
+		mi.iter.SeekForPrev(y.KeyWithTs(mi.upper, math.MaxUint64))
+	} else {
+		mi.iter.Seek(y.KeyWithTs(mi.lower, math.MaxUint64))
 	}
+	mi.settle()
 }
 
 // Seek move the iterator to the key which is
 // greater(less when reverse is true) than or equal to the specified key.
 func (mi *memtableIterator) Seek(key []byte) {
-	mi.iter.Seek(y.KeyWithTs(key, 0))
-	if len(mi.options.Prefix) == 0 {
-		return
-	}
-	// prefix scan
-	for mi.Valid() && !bytes.HasPrefix(mi.Key(), mi.options.Prefix) {
-		mi.Next()
+	fkey := familyKey(mi.family, key)
+	if mi.options.Reverse {
+		if bytes.Compare(fkey, mi.upper) >= 0 {
+			mi.iter.SeekForPrev(y.KeyWithTs(mi.upper, math.MaxUint64))
+		} else {
+			mi.iter.SeekForPrev(y.KeyWithTs(fkey, 0))
+		}
+	} else {
+		if bytes.Compare(fkey, mi.lower) < 0 {
+			fkey = mi.lower
+		}
+		mi.iter.Seek(y.KeyWithTs(fkey, math.MaxUint64))
 	}
+	mi.settle()
 }
 
 // Next moves the iterator to the next key.
 func (mi *memtableIterator) Next() {
-	mi.iter.Next()
-	if len(mi.options.Prefix) == 0 {
-		return
-	}
-	// prefix scan
-	for mi.iter.Valid() && !bytes.HasPrefix(mi.iter.Key(), mi.options.Prefix) {
+	mi.skipKey(y.ParseKey(mi.iter.Key()))
+	mi.settle()
+}
+
+// step moves the underlying iterator to the next entry in the iterating direction.
+func (mi *memtableIterator) step() {
+	if mi.options.Reverse {
+		mi.iter.Prev()
+	} else {
 		mi.iter.Next()
 	}
 }
 
+// skipKey skips all versions of the specified key.
+func (mi *memtableIterator) skipKey(key []byte) {
+	for mi.iter.Valid() && bytes.Equal(y.ParseKey(mi.iter.Key()), key) {
+		mi.step()
+	}
+}
+
+// settle moves the iterator to the newest visible version of a key.
+func (mi *memtableIterator) settle() {
+	for mi.Valid() {
+		key := y.ParseKey(mi.iter.Key())
+		if !mi.options.Reverse {
+			// versions of a key are sorted from the newest to the oldest.
+			if y.ParseTs(mi.iter.Key()) <= mi.readSeq {
+				return
+			}
+			mi.iter.Next()
+			continue
+		}
+
+		// in reverse mode, versions of a key are visited from the oldest,
+		// if the oldest one is invisible, all versions of the key are invisible.
+		if y.ParseTs(mi.iter.Key()) > mi.readSeq {
+			mi.skipKey(key)
+			continue
+		}
+		for cur := mi.iter.Key(); ; cur = mi.iter.Key() {
+			mi.iter.Prev()
+			if !mi.iter.Valid() || !bytes.Equal(y.ParseKey(mi.iter.Key()), key) ||
+				y.ParseTs(mi.iter.Key()) > mi.readSeq {
+				mi.iter.Seek(cur)
+				return
+			}
+		}
+	}
+}
+
 // Key get the current key.
 func (mi *memtableIterator) Key() []byte {
-	return y.ParseKey(mi.iter.Key())
+	return y.ParseKey(mi.iter.Key())[familyKeySize:]
+}
+
+// seq get the commit sequence number of the current key.
+func (mi *memtableIterator) seq() uint64 {
+	return y.ParseTs(mi.iter.Key())
 }
 
 // Value get the current value.
@@ -292,8 +575,9 @@ func (mi *memtableIterator) Value() any {
 }
 
 // Valid returns whether the iterator is exhausted.
+// The keys out of the bounds are beyond the last key in the iterating direction.
 func (mi *memtableIterator) Valid() bool {
-	return mi.iter.Valid()
+	return mi.iter.Valid() && keyInRange(y.ParseKey(mi.iter.Key()), mi.lower, mi.upper)
 }
 
 // Close the iterator.
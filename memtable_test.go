@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/dgraph-io/badger/v4/y"
@@ -125,7 +126,7 @@ func TestMemTablePutAllKindsEntries(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err = table.putBatch(tt.args.entry, node.Generate(), writeOpts)
+			err = table.putBatch(tt.args.entry, node.Generate(), 1, writeOpts)
 			assert.NoError(t, err)
 		})
 	}
@@ -167,7 +168,7 @@ func TestMemTablePutBatch(t *testing.T) {
 	}
 
 	t.Run("test memory table put batch", func(t *testing.T) {
-		err = table.putBatch(pendingWrites, node.Generate(), writeOpts)
+		err = table.putBatch(pendingWrites, node.Generate(), 1, writeOpts)
 		assert.NoError(t, err)
 	})
 
@@ -207,7 +208,7 @@ func TestMemTablePutBatchReopen(t *testing.T) {
 		pendingWrites[string(log.Key)] = log
 	}
 
-	err = table.putBatch(pendingWrites, node.Generate(), writeOpts)
+	err = table.putBatch(pendingWrites, node.Generate(), 1, writeOpts)
 	require.NoError(t, err)
 
 	t.Run("test memory table put batch after reopening", func(t *testing.T) {
@@ -215,7 +216,7 @@ func TestMemTablePutBatchReopen(t *testing.T) {
 		require.NoError(t, err)
 		table, err = openMemtable(opts)
 		require.NoError(t, err)
-		err = table.putBatch(pendingWrites, node.Generate(), writeOpts)
+		err = table.putBatch(pendingWrites, node.Generate(), 2, writeOpts)
 		require.NoError(t, err)
 	})
 
@@ -259,7 +260,7 @@ func TestMemTableGet(t *testing.T) {
 		"key 2": {Key: []byte("key 2"), Value: []byte(""), Type: LogRecordDeleted},
 	}
 
-	err = table.putBatch(writeLogs, node.Generate(), writeOpts)
+	err = table.putBatch(writeLogs, node.Generate(), 1, writeOpts)
 	require.NoError(t, err)
 	t.Run("get existing log", func(t *testing.T) {
 		for keyStr, log := range writeLogs {
@@ -269,7 +270,7 @@ func TestMemTableGet(t *testing.T) {
 		}
 	})
 
-	err = table.putBatch(deleteLogs, node.Generate(), writeOpts)
+	err = table.putBatch(deleteLogs, node.Generate(), 2, writeOpts)
 	require.NoError(t, err)
 	t.Run("get deleted log", func(t *testing.T) {
 		for keyStr, log := range deleteLogs {
@@ -283,6 +284,56 @@ func TestMemTableGet(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestMemTableGetExpired(t *testing.T) {
+	path, err := os.MkdirTemp("", "memtable-test-get-expired")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	opts := memtableOptions{
+		dirPath:         path,
+		tableID:         0,
+		memSize:         DefaultOptions.MemtableSize,
+		walBytesPerSync: DefaultOptions.BytesPerSync,
+		walSync:         DefaultBatchOptions.Sync,
+	}
+	table, err := openMemtable(opts)
+	require.NoError(t, err)
+
+	node, err := snowflake.NewNode(1)
+	require.NoError(t, err)
+
+	writeLogs := map[string]*LogRecord{
+		"key 0": {Key: []byte("key 0"), Value: []byte("value 0"), Type: LogRecordNormal,
+			Expire: uint64(time.Now().Add(-time.Second).UnixNano())},
+		"key 1": {Key: []byte("key 1"), Value: []byte("value 1"), Type: LogRecordNormal,
+			Expire: uint64(time.Now().Add(time.Hour).UnixNano())},
+	}
+	err = table.putBatch(writeLogs, node.Generate(), 1, DefaultWriteOptions)
+	require.NoError(t, err)
+
+	check := func(t *testing.T) {
+		del, value := table.get([]byte("key 0"))
+		assert.True(t, del)
+		assert.Nil(t, value)
+		del, value = table.get([]byte("key 1"))
+		assert.False(t, del)
+		assert.Equal(t, []byte("value 1"), value)
+	}
+	t.Run("get expired log", check)
+
+	err = table.close()
+	require.NoError(t, err)
+	table, err = openMemtable(opts)
+	require.NoError(t, err)
+	t.Run("get expired log reopen", check)
+
+	err = table.close()
+	assert.NoError(t, err)
+}
+
 func TestMemTableGetReopen(t *testing.T) {
 	path, err := os.MkdirTemp("", "memtable-test-get-reopen")
 	require.NoError(t, err)
@@ -314,7 +365,7 @@ func TestMemTableGetReopen(t *testing.T) {
 			"":      {Key: nil, Value: []byte("value 1"), Type: LogRecordNormal},
 			"key 2": {Key: []byte("key 2"), Value: []byte(""), Type: LogRecordNormal},
 		}
-		err = table.putBatch(writeLogs, node.Generate(), writeOpts)
+		err = table.putBatch(writeLogs, node.Generate(), 1, writeOpts)
 		require.NoError(t, err)
 		err = table.close()
 		require.NoError(t, err)
@@ -339,7 +390,7 @@ func TestMemTableGetReopen(t *testing.T) {
 			"":      {Key: nil, Value: []byte(""), Type: LogRecordDeleted},
 			"key 2": {Key: []byte("key 2"), Value: []byte(""), Type: LogRecordDeleted},
 		}
-		err = table.putBatch(deleteLogs, node.Generate(), writeOpts)
+		err = table.putBatch(deleteLogs, node.Generate(), 2, writeOpts)
 		require.NoError(t, err)
 
 		for keyStr, log := range deleteLogs {
@@ -427,7 +478,7 @@ func TestMemTableSync(t *testing.T) {
 		log := &LogRecord{Key: util.GetTestKey(int64(i)), Value: val}
 		pendingWrites[string(log.Key)] = log
 	}
-	err = table.putBatch(pendingWrites, node.Generate(), writeOpts)
+	err = table.putBatch(pendingWrites, node.Generate(), 1, writeOpts)
 	require.NoError(t, err)
 
 	t.Run("test memtable delete wal", func(t *testing.T) {
@@ -525,15 +576,15 @@ func Test_memtableIterator(t *testing.T) {
 	require.NoError(t, err)
 	writeLogs := map[string]*LogRecord{
 		"key 0": {Key: []byte("key 0"), Value: []byte("value 0"), Type: LogRecordNormal},
-		"key 1": {Key: nil, Value: []byte("value 1"), Type: LogRecordNormal},
+		"key 1": {Key: []byte("key 1"), Value: []byte("value 1"), Type: LogRecordNormal},
 		"key 2": {Key: []byte("key 2"), Value: []byte(""), Type: LogRecordNormal},
 	}
 	writeLogs2 := map[string]*LogRecord{
 		"abc 0": {Key: []byte("abc 0"), Value: []byte("value 0"), Type: LogRecordNormal},
-		"key 3": {Key: nil, Value: []byte("key 3"), Type: LogRecordNormal},
+		"key 3": {Key: []byte("key 3"), Value: []byte("key 3"), Type: LogRecordNormal},
 		"abc 1": {Key: []byte("abc 1"), Value: []byte(""), Type: LogRecordNormal},
 	}
-	err = table.putBatch(writeLogs, node.Generate(), writeOpts)
+	err = table.putBatch(writeLogs, node.Generate(), 1, writeOpts)
 	require.NoError(t, err)
 
 	iteratorOptions := IteratorOptions{
@@ -599,7 +650,7 @@ func Test_memtableIterator(t *testing.T) {
 	require.NoError(t, err)
 
 	// prefix
-	err = table.putBatch(writeLogs2, node.Generate(), writeOpts)
+	err = table.putBatch(writeLogs2, node.Generate(), 2, writeOpts)
 	require.NoError(t, err)
 
 	iteratorOptions.Reverse = false
@@ -624,3 +675,81 @@ func Test_memtableIterator(t *testing.T) {
 	err = itr.Close()
 	assert.NoError(t, err)
 }
+
+func Test_memtableIteratorVersions(t *testing.T) {
+	path, err := os.MkdirTemp("", "memtable-test-iterator-versions")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	opts := memtableOptions{
+		dirPath:         path,
+		tableID:         0,
+		memSize:         DefaultOptions.MemtableSize,
+		walBytesPerSync: DefaultOptions.BytesPerSync,
+		walSync:         DefaultBatchOptions.Sync,
+	}
+	table, err := openMemtable(opts)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, table.close())
+	}()
+
+	node, err := snowflake.NewNode(1)
+	require.NoError(t, err)
+
+	versions := []map[string]*LogRecord{
+		{
+			"key 0": {Key: []byte("key 0"), Value: []byte("value 0 v1"), Type: LogRecordNormal},
+			"key 1": {Key: []byte("key 1"), Value: []byte("value 1 v1"), Type: LogRecordNormal},
+		},
+		{
+			"key 1": {Key: []byte("key 1"), Value: []byte("value 1 v2"), Type: LogRecordNormal},
+			"key 2": {Key: []byte("key 2"), Value: []byte("value 2 v2"), Type: LogRecordNormal},
+		},
+		{
+			"key 0": {Key: []byte("key 0"), Value: []byte("value 0 v3"), Type: LogRecordNormal},
+			"key 1": {Key: []byte("key 1"), Value: []byte("value 1 v3"), Type: LogRecordNormal},
+		},
+	}
+	for i, writeLogs := range versions {
+		err = table.putBatch(writeLogs, node.Generate(), uint64(i+1), DefaultWriteOptions)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		seq    uint64
+		keys   []string
+		values []string
+	}{
+		{1, []string{"key 0", "key 1"}, []string{"value 0 v1", "value 1 v1"}},
+		{2, []string{"key 0", "key 1", "key 2"}, []string{"value 0 v1", "value 1 v2", "value 2 v2"}},
+		{3, []string{"key 0", "key 1", "key 2"}, []string{"value 0 v3", "value 1 v3", "value 2 v2"}},
+	}
+	for _, tt := range tests {
+		for _, reverse := range []bool{false, true} {
+			itr := newMemtableIterator(IteratorOptions{Reverse: reverse}, table)
+			itr.readSeq = tt.seq
+			var keys, values []string
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				keys = append(keys, string(itr.Key()))
+				values = append(values, string(itr.Value().(y.ValueStruct).Value))
+			}
+			require.NoError(t, itr.Close())
+			if reverse {
+				for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+					keys[i], keys[j] = keys[j], keys[i]
+					values[i], values[j] = values[j], values[i]
+				}
+			}
+			assert.Equal(t, tt.keys, keys)
+			assert.Equal(t, tt.values, values)
+
+			del, value := table.getAt([]byte("key 1"), tt.seq)
+			assert.False(t, del)
+			assert.Equal(t, tt.values[1], string(value))
+		}
+	}
+}
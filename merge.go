@@ -0,0 +1,175 @@
+package lotusdb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Merge merge with defaultWriteOptions.
+func (db *DB) Merge(key []byte, operand []byte) error {
+	return db.MergeWithOptions(key, operand, DefaultWriteOptions)
+}
+
+// MergeWithOptions adds a merge operand to the key of the default column family,
+// see ColumnFamily.MergeWithOptions.
+func (db *DB) MergeWithOptions(key []byte, operand []byte, options WriteOptions) error {
+	return db.defaultFamily.MergeWithOptions(key, operand, options)
+}
+
+// Merge merge with defaultWriteOptions.
+func (cf *ColumnFamily) Merge(key []byte, operand []byte) error {
+	return cf.MergeWithOptions(key, operand, DefaultWriteOptions)
+}
+
+// MergeWithOptions adds a merge operand to the key, the operands will be folded
+// onto the existing value of the key by the MergeOperator in options.
+// It's cheaper than reading the value and putting the new one, and it does not race with other writers.
+//
+// The operands are folded lazily when reading, and permanently when the memtable is flushed.
+// It will return ErrMergeOperatorNotSet if the MergeOperator is not set.
+//
+// The merged value expires with the earliest expiring part of it, the existing value or an operand,
+// so an operand without TTL keeps the TTL of the existing value, and an operand with TTL may shorten it.
+// A part which is already expired when the operands are folded is treated as deleted,
+// and the newer operands are folded onto nothing, so merging to an expired key starts from scratch.
+func (cf *ColumnFamily) MergeWithOptions(key []byte, operand []byte, options WriteOptions) error {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.options.WriteOptions = options
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, options.Sync, options.DisableWal, db).withPendingWrites()
+	if err := batch.MergeCF(cf, key, operand); err != nil {
+		batch.Discard()
+		return err
+	}
+	return batch.Commit()
+}
+
+// foldOperands folds the operands onto the existing value with the merge operator,
+// the operands are sorted from the newest to the oldest, as they are collected by reads.
+func (db *DB) foldOperands(key []byte, existingValue []byte, operands [][]byte) ([]byte, error) {
+	if db.options.MergeOperator == nil {
+		return nil, ErrMergeOperatorNotSet
+	}
+	ordered := make([][]byte, len(operands))
+	for i, operand := range operands {
+		ordered[len(operands)-1-i] = operand
+	}
+	return db.options.MergeOperator(key, existingValue, ordered), nil
+}
+
+// resolveValue returns the value of the key with the merge operands applied,
+// the operands are sorted from the newest to the oldest.
+// A nil value means the key does not exist, ErrKeyNotFound will be returned if there is no operand.
+func (db *DB) resolveValue(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+	if len(operands) == 0 {
+		if value == nil {
+			return nil, ErrKeyNotFound
+		}
+		return value, nil
+	}
+	return db.foldOperands(key, value, operands)
+}
+
+// combineMerge combines a merge record with the pending record of the same key in a batch,
+// so the batch still holds a single record for each key.
+func (db *DB) combineMerge(pending *LogRecord, record *LogRecord) (*LogRecord, error) {
+	switch pending.Type {
+	case LogRecordMerge:
+		value := make([]byte, 0, len(pending.Value)+len(record.Value))
+		value = append(value, pending.Value...)
+		value = append(value, record.Value...)
+		return &LogRecord{Key: record.Key, Value: value, Type: LogRecordMerge,
+			Expire: mergeExpire(pending.Expire, record.Expire), ColumnFamily: record.ColumnFamily}, nil
+	case LogRecordNormal:
+		var existingValue []byte
+		expire := record.Expire
+		if !isExpired(pending.Expire, time.Now().UnixNano()) {
+			existingValue = pending.Value
+			expire = mergeExpire(pending.Expire, expire)
+		}
+		value, err := db.foldOperands(record.Key, existingValue, decodeMergeOperands(record.Value))
+		if err != nil {
+			return nil, err
+		}
+		return &LogRecord{Key: record.Key, Value: value, Type: LogRecordNormal, Expire: expire,
+			ColumnFamily: record.ColumnFamily}, nil
+	default:
+		value, err := db.foldOperands(record.Key, nil, decodeMergeOperands(record.Value))
+		if err != nil {
+			return nil, err
+		}
+		return &LogRecord{Key: record.Key, Value: value, Type: LogRecordNormal, Expire: record.Expire,
+			ColumnFamily: record.ColumnFamily}, nil
+	}
+}
+
+// mergeExpire returns the expiration time of the value merged from two parts, which is the earlier one,
+// zero means the part never expires, see ColumnFamily.MergeWithOptions.
+func mergeExpire(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// MergeOperands returns the operands of a LogRecordMerge record, from the oldest to the newest.
+// It is used to read the merge records yielded by the change feed, see DB.Changes.
+func (lr *LogRecord) MergeOperands() [][]byte {
+	if lr.Type != LogRecordMerge {
+		return nil
+	}
+	return decodeMergeOperands(lr.Value)
+}
+
+// appendMergeOperands appends the operands encoded in buf to operands in reverse order,
+// so the operands are sorted from the newest to the oldest.
+func appendMergeOperands(operands [][]byte, buf []byte) [][]byte {
+	decoded := decodeMergeOperands(buf)
+	for i := len(decoded) - 1; i >= 0; i-- {
+		operands = append(operands, decoded[i])
+	}
+	return operands
+}
+
+// +-------------+-------------+-------------+-------------+-----
+// |  size of 1  |  operand 1  |  size of 2  |  operand 2  | ...
+// +-------------+-------------+-------------+-------------+-----
+//
+//	varint(max 10)   n bytes    varint(max 10)   n bytes
+//
+// The operands are sorted from the oldest to the newest,
+// so appending operands to an encoded buffer is the same as encoding all of them.
+func encodeMergeOperands(operands [][]byte) []byte {
+	size := 0
+	for _, operand := range operands {
+		size += binary.MaxVarintLen64 + len(operand)
+	}
+	buf := make([]byte, size)
+	index := 0
+	for _, operand := range operands {
+		index += binary.PutUvarint(buf[index:], uint64(len(operand)))
+		index += copy(buf[index:], operand)
+	}
+	return buf[:index]
+}
+
+// decodeMergeOperands decodes the merge operands from the given byte slice.
+func decodeMergeOperands(buf []byte) [][]byte {
+	var operands [][]byte
+	for index := 0; index < len(buf); {
+		size, n := binary.Uvarint(buf[index:])
+		index += n
+		operand := make([]byte, size)
+		copy(operand, buf[index:index+int(size)])
+		index += int(size)
+		operands = append(operands, operand)
+	}
+	return operands
+}
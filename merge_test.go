@@ -0,0 +1,234 @@
+package lotusdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appendOperator appends the operands to the existing value, separated by commas.
+func appendOperator(_, existingValue []byte, operands [][]byte) []byte {
+	values := make([][]byte, 0, len(operands)+1)
+	if existingValue != nil {
+		values = append(values, existingValue)
+	}
+	values = append(values, operands...)
+	return bytes.Join(values, []byte(","))
+}
+
+func TestDBMerge(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-merge")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// key 0 has a value in index, key 1 has no value, key 2 is deleted
+	require.NoError(t, db.Put([]byte("key 0"), []byte("a")))
+	require.NoError(t, db.Put([]byte("key 2"), []byte("a")))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Delete([]byte("key 2")))
+
+	for _, operand := range []string{"b", "c"} {
+		require.NoError(t, db.Merge([]byte("key 0"), []byte(operand)))
+		require.NoError(t, db.Merge([]byte("key 1"), []byte(operand)))
+		require.NoError(t, db.Merge([]byte("key 2"), []byte(operand)))
+	}
+
+	check := func(t *testing.T) {
+		expected := map[string][]byte{
+			"key 0": []byte("a,b,c"),
+			"key 1": []byte("b,c"),
+			"key 2": []byte("b,c"),
+		}
+		for key, value := range expected {
+			got, errGet := db.Get([]byte(key))
+			require.NoError(t, errGet)
+			assert.Equal(t, value, got)
+			exist, errExist := db.Exist([]byte(key))
+			require.NoError(t, errExist)
+			assert.True(t, exist)
+		}
+
+		iter, errIter := db.NewIterator(IteratorOptions{})
+		require.NoError(t, errIter)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, expected[string(iter.Key())], iter.Value())
+			count++
+		}
+		assert.Equal(t, len(expected), count)
+		require.NoError(t, iter.Close())
+	}
+
+	t.Run("fold in memtable", check)
+
+	require.NoError(t, db.Close())
+	db, err = Open(options)
+	require.NoError(t, err)
+	t.Run("fold after reopen", check)
+
+	db.flushMemtable(db.activeMem)
+	t.Run("fold after flush", check)
+
+	require.NoError(t, db.Compact())
+	t.Run("fold after compaction", check)
+
+	require.NoError(t, db.Merge([]byte("key 0"), []byte("d")))
+	value, err := db.Get([]byte("key 0"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c,d"), value)
+}
+
+func TestBatchMerge(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-batch-merge")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.Merge([]byte("key 0"), []byte("a")))
+	require.NoError(t, batch.Merge([]byte("key 0"), []byte("b")))
+	require.NoError(t, batch.Put([]byte("key 1"), []byte("a")))
+	require.NoError(t, batch.Merge([]byte("key 1"), []byte("b")))
+	require.NoError(t, batch.Delete([]byte("key 2")))
+	require.NoError(t, batch.Merge([]byte("key 2"), []byte("b")))
+
+	require.NoError(t, batch.SetSavepoint())
+	require.NoError(t, batch.Merge([]byte("key 0"), []byte("c")))
+	value, err := batch.Get([]byte("key 0"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c"), value)
+	require.NoError(t, batch.RollbackToSavepoint())
+	require.NoError(t, batch.Commit())
+
+	expected := map[string][]byte{
+		"key 0": []byte("a,b"),
+		"key 1": []byte("a,b"),
+		"key 2": []byte("b"),
+	}
+	for key, value := range expected {
+		got, errGet := db.Get([]byte(key))
+		require.NoError(t, errGet)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestDBMergeOperatorNotSet(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-merge-not-set")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.ErrorIs(t, db.Merge([]byte("key"), []byte("value")), ErrMergeOperatorNotSet)
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestMergeOperandsEncoding(t *testing.T) {
+	operands := [][]byte{[]byte("a"), {}, []byte("operand c")}
+	buf := encodeMergeOperands(operands[:1])
+	buf = append(buf, encodeMergeOperands(operands[1:])...)
+	assert.Equal(t, operands, decodeMergeOperands(buf))
+	assert.Equal(t, [][]byte{operands[2], operands[1], operands[0]}, appendMergeOperands(nil, buf))
+}
+
+func TestDBMergeTTL(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-merge-ttl")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	ttl := 500 * time.Millisecond
+	// the value in index expires, the operand without TTL keeps its TTL.
+	require.NoError(t, db.PutWithTTL([]byte("key 0"), []byte("a"), ttl))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Merge([]byte("key 0"), []byte("b")))
+	// the value in the same batch expires, the operand without TTL keeps its TTL.
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.PutWithTTL([]byte("key 1"), []byte("a"), ttl))
+	require.NoError(t, batch.Merge([]byte("key 1"), []byte("b")))
+	require.NoError(t, batch.Commit())
+	// the operand with TTL shortens the value without TTL.
+	require.NoError(t, db.Put([]byte("key 2"), []byte("a")))
+	require.NoError(t, db.MergeWithOptions([]byte("key 2"), []byte("b"), WriteOptions{TTL: ttl}))
+	require.NoError(t, db.Merge([]byte("key 3"), []byte("b")))
+
+	db.flushMemtable(db.activeMem)
+	for _, key := range []string{"key 0", "key 1", "key 2"} {
+		value, errGet := db.Get([]byte(key))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("a,b"), value)
+	}
+
+	time.Sleep(ttl)
+	for _, key := range []string{"key 0", "key 1", "key 2"} {
+		_, err = db.Get([]byte(key))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+	}
+	value, err := db.Get([]byte("key 3"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), value)
+
+	// merging to the expired key starts from scratch.
+	require.NoError(t, db.Merge([]byte("key 0"), []byte("c")))
+	db.flushMemtable(db.activeMem)
+	value, err = db.Get([]byte("key 0"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("c"), value)
+}
+
+func TestColumnFamilyMerge(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-merge-cf")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	require.NoError(t, err)
+	require.NoError(t, users.Put([]byte("key"), []byte("a")))
+	require.NoError(t, users.Merge([]byte("key"), []byte("b")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	require.NoError(t, batch.MergeCF(users, []byte("key"), []byte("c")))
+	require.NoError(t, batch.Merge([]byte("key"), []byte("x")))
+	require.NoError(t, batch.Commit())
+
+	check := func() {
+		value, errGet := users.Get([]byte("key"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("a,b,c"), value)
+		value, errGet = db.Get([]byte("key"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("x"), value)
+	}
+	check()
+	db.flushMemtable(db.activeMem)
+	check()
+}
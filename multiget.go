@@ -0,0 +1,200 @@
+package lotusdb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// multiGetEntry is a key to be read by MultiGet.
+type multiGetEntry struct {
+	index    int // index of the key in the keys of MultiGet
+	key      []byte
+	operands [][]byte // merge operands found in memtables, from the newest to the oldest
+	position *KeyPosition
+	value    []byte
+	err      error
+}
+
+// MultiGet multi get with defaultReadOptions.
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return db.MultiGetWithOptions(keys, DefaultReadOptions)
+}
+
+// MultiGetWithOptions gets the values of the keys from the database.
+// The value and error of a key are at the same index as the key,
+// the error is ErrKeyNotFound if the key does not exist.
+//
+// It is more efficient than calling Get for each key, the memtables are checked once
+// for all the keys, and the remaining keys are grouped by partition,
+// each partition is read concurrently within a single index transaction,
+// the values are read from the value log in the order of their positions.
+func (db *DB) MultiGetWithOptions(keys [][]byte, options ReadOptions) ([][]byte, []error) {
+	return db.defaultFamily.MultiGetWithOptions(keys, options)
+}
+
+// MultiGet multi get with defaultReadOptions.
+func (cf *ColumnFamily) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return cf.MultiGetWithOptions(keys, DefaultReadOptions)
+}
+
+// MultiGetWithOptions gets the values of the keys from the column family, see DB.MultiGetWithOptions.
+func (cf *ColumnFamily) MultiGetWithOptions(keys [][]byte, options ReadOptions) ([][]byte, []error) {
+	db := cf.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	batch.init(true, false, true, db)
+	batch.snapshot = options.Snapshot
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return batch.multiGet(cf, keys)
+}
+
+// multiGet gets the values of the keys in the column family from memtables, index and value log,
+// the pending writes are not read, so it is only used by the readonly batch of MultiGet.
+func (b *Batch) multiGet(cf *ColumnFamily, keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	fail := func(err error) ([][]byte, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+	if b.db.closed {
+		return fail(ErrDBClosed)
+	}
+	tables, readSeq, err := b.readView()
+	if err != nil {
+		return fail(err)
+	}
+
+	// resolve the keys found in memtables, the others are grouped by partition.
+	partitionEntries := make([][]*multiGetEntry, cf.options.PartitionNum)
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrKeyIsEmpty
+			continue
+		}
+		entry := &multiGetEntry{index: i, key: key}
+		fkey := familyKey(cf.id, key)
+		var found bool
+		for _, table := range tables {
+			deleted, value, tableOperands := table.lookup(fkey, readSeq)
+			entry.operands = append(entry.operands, tableOperands...)
+			if deleted {
+				value = nil
+			}
+			if deleted || len(value) != 0 {
+				values[i], errs[i] = b.db.resolveValue(key, value, entry.operands)
+				found = true
+				break
+			}
+		}
+		if !found {
+			partition := cf.vlog.getKeyPartition(key)
+			partitionEntries[partition] = append(partitionEntries[partition], entry)
+		}
+	}
+
+	// read the index and value log of every partition concurrently.
+	var wg sync.WaitGroup
+	for i := range partitionEntries {
+		partition, entries := i, partitionEntries[i]
+		if len(entries) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errGet := b.multiGetPartition(cf, partition, entries); errGet != nil {
+				for _, entry := range entries {
+					entry.err = errGet
+				}
+			}
+			for _, entry := range entries {
+				values[entry.index], errs[entry.index] = entry.value, entry.err
+			}
+		}()
+	}
+	wg.Wait()
+	return values, errs
+}
+
+// multiGetPartition reads the values of the entries in the partition from index and value log.
+func (b *Batch) multiGetPartition(cf *ColumnFamily, partition int, entries []*multiGetEntry) error {
+	positions := make([]*KeyPosition, len(entries))
+	if cf.options.IndexType == Hash {
+		// the hash index reads the value log to match the key, so the values are read along with the index.
+		for _, entry := range entries {
+			var value []byte
+			if _, err := cf.index.Get(entry.key, matchKeyFunc(cf.vlog, entry.key, nil, &value)); err != nil {
+				return err
+			}
+			entry.value = value
+		}
+	} else {
+		index, ok := cf.index.(*BPTree)
+		if !ok {
+			panic("index type not support")
+		}
+		keys := make([][]byte, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.key
+		}
+		var err error
+		if positions, err = index.getBatch(partition, keys); err != nil {
+			return err
+		}
+	}
+
+	// the index entry is overwritten after the snapshot is created, read the kept one.
+	now := time.Now().UnixNano()
+	reads := make([]*multiGetEntry, 0, len(entries))
+	for i, entry := range entries {
+		position := positions[i]
+		if b.snapshot != nil {
+			if keptPos, ok := b.snapshot.keptPosition(familyKey(cf.id, entry.key)); ok {
+				position = keptPos
+				entry.value = nil
+			}
+		}
+		if position == nil || isExpired(position.expire, now) {
+			continue
+		}
+		entry.position = position
+		reads = append(reads, entry)
+	}
+
+	// read the value log in the order of positions, to make the reads as sequential as possible.
+	sort.Slice(reads, func(i, j int) bool {
+		pi, pj := reads[i].position.position, reads[j].position.position
+		if pi.SegmentId != pj.SegmentId {
+			return pi.SegmentId < pj.SegmentId
+		}
+		if pi.BlockNumber != pj.BlockNumber {
+			return pi.BlockNumber < pj.BlockNumber
+		}
+		return pi.ChunkOffset < pj.ChunkOffset
+	})
+	for _, entry := range reads {
+		record, err := cf.vlog.read(entry.position)
+		if err != nil {
+			entry.err = err
+			continue
+		}
+		entry.value = record.value
+	}
+
+	for _, entry := range entries {
+		if entry.err == nil {
+			entry.value, entry.err = b.db.resolveValue(entry.key, entry.value, entry.operands)
+		}
+	}
+	return nil
+}
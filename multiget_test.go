@@ -0,0 +1,115 @@
+package lotusdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBMultiGet(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-multi-get")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = appendOperator
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// key 0 ~ key 49 are in index, key 50 ~ key 99 are in memtable
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			db.flushMemtable(db.activeMem)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	require.NoError(t, db.Delete([]byte("key 10")))
+	require.NoError(t, db.Delete([]byte("key 60")))
+	require.NoError(t, db.Put([]byte("key 20"), []byte("value 20 new")))
+	require.NoError(t, db.Merge([]byte("key 30"), []byte("merged")))
+
+	keys := make([][]byte, 0, 103)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key %d", i)))
+	}
+	keys = append(keys, []byte("not found"), nil, []byte("key 0"))
+
+	check := func(t *testing.T) {
+		values, errs := db.MultiGet(keys)
+		require.Len(t, values, len(keys))
+		require.Len(t, errs, len(keys))
+		for i, key := range keys[:100] {
+			switch string(key) {
+			case "key 10", "key 60":
+				require.ErrorIs(t, errs[i], ErrKeyNotFound)
+				assert.Nil(t, values[i])
+			case "key 20":
+				require.NoError(t, errs[i])
+				assert.Equal(t, []byte("value 20 new"), values[i])
+			case "key 30":
+				require.NoError(t, errs[i])
+				assert.Equal(t, []byte("value 30,merged"), values[i])
+			default:
+				require.NoError(t, errs[i])
+				assert.Equal(t, []byte(fmt.Sprintf("value %d", i)), values[i])
+			}
+		}
+		require.ErrorIs(t, errs[100], ErrKeyNotFound)
+		require.ErrorIs(t, errs[101], ErrKeyIsEmpty)
+		require.NoError(t, errs[102])
+		assert.Equal(t, []byte("value 0"), values[102])
+
+		// the snapshot is taken before the deletions and overwrites
+		values, errs = db.MultiGetWithOptions(keys[:100], ReadOptions{Snapshot: snapshot})
+		for i := range values {
+			require.NoError(t, errs[i])
+			assert.Equal(t, []byte(fmt.Sprintf("value %d", i)), values[i])
+		}
+	}
+
+	t.Run("read from memtable", check)
+	db.flushMemtable(db.activeMem)
+	t.Run("read after flush", check)
+}
+
+func TestDBMultiGetHash(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-multi-get-hash")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.IndexType = Hash
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	require.NoError(t, db.Delete([]byte("key 5")))
+	db.flushMemtable(db.activeMem)
+
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key %d", i))
+	}
+	values, errs := db.MultiGet(keys)
+	for i := range keys {
+		if i == 5 {
+			require.ErrorIs(t, errs[i], ErrKeyNotFound)
+			continue
+		}
+		require.NoError(t, errs[i])
+		assert.Equal(t, []byte(fmt.Sprintf("value %d", i)), values[i])
+	}
+
+	require.NoError(t, db.Close())
+	_, errs = db.MultiGet(keys)
+	require.ErrorIs(t, errs[0], ErrDBClosed)
+}
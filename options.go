@@ -80,6 +80,65 @@ type Options struct {
 	// If the timeout is exceeded, the write operation will fail, you can try again later.
 	// Default value is 100ms.
 	WaitMemSpaceTimeout time.Duration
+
+	// MergeOperator specifies how to fold the merge operands of a key, see DB.Merge.
+	// existingValue is nil if the key does not exist, and operands are sorted from the oldest to the newest.
+	// The operands are folded lazily when reading, and permanently when the memtable is flushed.
+	// Default value is nil, and Merge will return ErrMergeOperatorNotSet.
+	MergeOperator func(key, existingValue []byte, operands [][]byte) []byte
+
+	// Compression specifies the compression algorithm of the values in value log.
+	// The values are compressed when the memtable is flushed, and recompressed in compaction.
+	// The algorithm is recorded in every record, so it can be changed when reopening the database,
+	// the values compressed by the old algorithm are still readable.
+	// Default value is NoCompression.
+	Compression Compression
+
+	// CompressionMinSize specifies the minimum size in bytes of the values to be compressed,
+	// the smaller values are stored as is, because the compression can hardly save any space.
+	// Default value is 64.
+	CompressionMinSize int
+
+	// EncryptionKey specifies the key to encrypt the data at rest with AES-GCM,
+	// it must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+	// The wal, the keys and values in value log and the values in bptree index are encrypted,
+	// but the keys in bptree index are kept in plaintext to keep them ordered,
+	// use the hash index if the keys are sensitive, it only stores the hash of keys and the positions.
+	// It is a shorthand of KeyProvider with a single key of id 0, and ignored if KeyProvider is set.
+	// Default value is nil, the data is not encrypted.
+	EncryptionKey []byte
+
+	// KeyProvider specifies the keys to encrypt the data at rest, see EncryptionKey.
+	// The new data is encrypted by the current key of the provider,
+	// and the data encrypted by an old key is reencrypted by the current key in compaction,
+	// the wal is reencrypted when the memtable is flushed.
+	// The data written before the encryption is enabled is still readable, and encrypted in compaction.
+	// Default value is nil.
+	KeyProvider KeyProvider
+
+	// ReadOnly specifies whether to open the database in read only mode, see Open.
+	// The database can be read as usual, but all the writes return ErrDatabaseReadOnly,
+	// including creating column families, compaction, ingestion, backups, checkpoints and change feeds.
+	// Several processes can open the same directory in read only mode at the same time,
+	// together with the writable one, they read the database as it is when they are opened.
+	// Default value is false.
+	ReadOnly bool
+}
+
+// ColumnFamilyOptions specifies the options of a column family, see DB.CreateColumnFamily.
+// A column family has its own index and value log, the other options are shared with the database.
+type ColumnFamilyOptions struct {
+	// IndexType is the index type of the column family.
+	// Default value is bptree.
+	IndexType IndexType
+
+	// PartitionNum specifies the number of partitions to use for the index and value log.
+	// Default value is 3.
+	PartitionNum int
+
+	// ValueLogFileSize size of a single value log file.
+	// Default value is 1GB.
+	ValueLogFileSize int64
 }
 
 // BatchOptions specifies the options for creating a batch.
@@ -110,6 +169,21 @@ type WriteOptions struct {
 	// Setting true only if don`t care about the data loss.
 	// Default value is false.
 	DisableWal bool
+
+	// TTL specifies the time to live of the written keys.
+	// The key will be invisible after it expires, and be removed from the value log in compaction.
+	// The value of a merged key expires with its latest merge operand.
+	// It is ignored by delete operations.
+	// Default value is 0, means the key never expires.
+	TTL time.Duration
+}
+
+// ReadOptions set optional params for GetWithOptions and ExistWithOptions.
+// If you use Get and Exist (without options), that means to use the default values.
+type ReadOptions struct {
+	// Snapshot specifies the snapshot to read from, see DB.NewSnapshot.
+	// Default value is nil, means reading the latest data.
+	Snapshot *Snapshot
 }
 
 // IteratorOptions is the options for the iterator.
@@ -117,9 +191,25 @@ type IteratorOptions struct {
 	// Prefix filters the keys by prefix.
 	Prefix []byte
 
+	// LowerBound is the inclusive lower bound of the keys, nil means no lower bound.
+	// The iterators seek to it directly instead of skipping the smaller keys.
+	LowerBound []byte
+
+	// UpperBound is the exclusive upper bound of the keys, nil means no upper bound.
+	// The iteration stops as soon as the bound is reached, in both forward and reverse mode.
+	UpperBound []byte
+
 	// Reverse indicates whether the iterator is reversed.
 	// false is forward, true is backward.
 	Reverse bool
+
+	// KeysOnly specifies whether to iterate the keys only, the values in value log are not read.
+	// Iterator.ValueErr returns ErrIteratorKeysOnly, use Iterator.ValueSize to get the size of the values.
+	KeysOnly bool
+
+	// Snapshot specifies the snapshot to iterate, see DB.NewSnapshot.
+	// Default value is nil, means iterating the latest data.
+	Snapshot *Snapshot
 }
 
 const (
@@ -159,6 +249,65 @@ var DefaultOptions = Options{
 	AutoCompactSupport: false,
 	//nolint:gomnd // default
 	WaitMemSpaceTimeout: 100 * time.Millisecond,
+	Compression:         NoCompression,
+	//nolint:gomnd // default
+	CompressionMinSize: 64,
+}
+
+// VerifyOptions specifies the options of DB.Verify.
+type VerifyOptions struct {
+	// CheckOrphans specifies whether to find the records in value log which are referenced by
+	// neither the index nor a snapshot, all the value logs are scanned if it is set.
+	// The records overwritten or deleted are also orphaned until they are compacted,
+	// so there should be no orphaned records only right after compaction.
+	CheckOrphans bool
+
+	// MaxIssues specifies the max number of issues to report, the verification stops when it is reached.
+	// Default value is 0, which means no limit.
+	MaxIssues int
+}
+
+// ExportOptions specifies the options of DB.Export.
+type ExportOptions struct {
+	// Prefix filters the keys to export by prefix.
+	Prefix []byte
+
+	// LowerBound is the inclusive lower bound of the keys to export, nil means no lower bound.
+	LowerBound []byte
+
+	// UpperBound is the exclusive upper bound of the keys to export, nil means no upper bound.
+	UpperBound []byte
+}
+
+// ImportOptions specifies the options of DB.Import.
+type ImportOptions struct {
+	// BatchSize is the max number of records written in a batch,
+	// a batch is also committed if the size of its records reaches a quarter of the memtable size.
+	// Default value is 1000.
+	BatchSize int
+
+	// Sync and DisableWal are the same as the ones in WriteOptions, they are applied to every batch.
+	Sync       bool
+	DisableWal bool
+}
+
+// IngestOptions specifies the options of DB.IngestSorted.
+type IngestOptions struct {
+	// BatchSize is the max number of key-value pairs written in a batch,
+	// a batch is also written if the size of its pairs reaches the memtable size.
+	// Default value is 100000.
+	BatchSize int
+
+	// TTL specifies the time to live of the ingested keys, see WriteOptions.TTL.
+	// Default value is 0, means the keys never expire.
+	TTL time.Duration
+}
+
+var DefaultColumnFamilyOptions = ColumnFamilyOptions{
+	IndexType: BTree,
+	//nolint:gomnd // default
+	PartitionNum:     3,
+	ValueLogFileSize: 1 * GB,
 }
 
 var DefaultBatchOptions = BatchOptions{
@@ -169,6 +318,24 @@ var DefaultBatchOptions = BatchOptions{
 var DefaultWriteOptions = WriteOptions{
 	Sync:       false,
 	DisableWal: false,
+	TTL:        0,
+}
+
+var DefaultImportOptions = ImportOptions{
+	//nolint:gomnd // default
+	BatchSize:  1000,
+	Sync:       false,
+	DisableWal: false,
+}
+
+var DefaultIngestOptions = IngestOptions{
+	//nolint:gomnd // default
+	BatchSize: 100000,
+	TTL:       0,
+}
+
+var DefaultReadOptions = ReadOptions{
+	Snapshot: nil,
 }
 
 func tempDBDir() string {
@@ -0,0 +1,312 @@
+package lotusdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rosedblabs/wal"
+)
+
+// indexLockName is the file locked by the writable process while it changes the index and value logs,
+// and locked shared by the read only processes while they capture them, see Open.
+const indexLockName = "INDEX.LOCK"
+
+// indexGenerationName is the file storing the index generation, which is written by the writable process
+// while it holds the index lock file, see DB.unlockIndex.
+const indexGenerationName = "INDEX.GEN"
+
+// chunkReader reads the chunks of a wal in order, it is implemented by wal.Reader and walViewReader.
+type chunkReader interface {
+	Next() ([]byte, *wal.ChunkPosition, error)
+	SkipCurrentSegment()
+	CurrentSegmentId() wal.SegmentID //nolint:revive // the same as wal.Reader
+	CurrentChunkPosition() *wal.ChunkPosition
+}
+
+// walView reads the segments of a wal opened read only, up to their sizes when they are opened,
+// so it reads the same chunks even if the wal is written by another process meanwhile.
+// The segments removed after they are opened can still be read.
+type walView struct {
+	ext    string
+	ids    []wal.SegmentID
+	files  map[wal.SegmentID]*os.File
+	sizes  map[wal.SegmentID]int64
+	shared bool // the files are closed by the view sharing them, see share
+}
+
+// openWalView opens the segments of the wal with the extension in dirPath read only.
+func openWalView(dirPath, ext string) (*walView, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	view := &walView{ext: ext, files: make(map[wal.SegmentID]*os.File), sizes: make(map[wal.SegmentID]int64)}
+	for _, entry := range entries {
+		var id wal.SegmentID
+		if entry.IsDir() {
+			continue
+		}
+		if _, err = fmt.Sscanf(entry.Name(), "%d"+ext, &id); err != nil ||
+			entry.Name() != filepath.Base(wal.SegmentFileName("", ext, id)) {
+			continue
+		}
+		file, errOpen := os.Open(filepath.Join(dirPath, entry.Name()))
+		if errOpen != nil {
+			_ = view.Close()
+			return nil, errOpen
+		}
+		info, errStat := file.Stat()
+		if errStat != nil {
+			_ = file.Close()
+			_ = view.Close()
+			return nil, errStat
+		}
+		view.ids = append(view.ids, id)
+		view.files[id] = file
+		view.sizes[id] = info.Size()
+	}
+	sort.Slice(view.ids, func(i, j int) bool { return view.ids[i] < view.ids[j] })
+	return view, nil
+}
+
+// share returns a view of the same segments, which can be closed without closing them.
+func (v *walView) share() *walView {
+	return &walView{ext: v.ext, ids: v.ids, files: v.files, sizes: v.sizes, shared: true}
+}
+
+// Read reads the chunk at the position, see wal.WAL.Read.
+func (v *walView) Read(pos *wal.ChunkPosition) ([]byte, error) {
+	if _, ok := v.files[pos.SegmentId]; !ok {
+		return nil, fmt.Errorf("segment file %d%s not found", pos.SegmentId, v.ext)
+	}
+	data, _, err := v.readChunk(pos.SegmentId, pos.BlockNumber, pos.ChunkOffset)
+	return data, err
+}
+
+// readChunk reads the chunk at the block number and chunk offset of the segment, and returns the next position.
+// It returns io.EOF if the chunk is beyond the size of the segment, e.g. it is being written when the view is opened.
+func (v *walView) readChunk(id wal.SegmentID, blockNumber uint32, chunkOffset int64) ([]byte, *wal.ChunkPosition, error) {
+	file, size := v.files[id], v.sizes[id]
+	var data []byte
+	var header [walChunkHeaderSize]byte
+	for {
+		offset := int64(blockNumber)*walBlockSize + chunkOffset
+		if offset+walChunkHeaderSize > size {
+			return nil, nil, io.EOF
+		}
+		if _, err := file.ReadAt(header[:], offset); err != nil {
+			return nil, nil, err
+		}
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		if offset+walChunkHeaderSize+length > size {
+			return nil, nil, io.EOF
+		}
+		start := len(data)
+		data = append(data, make([]byte, length)...)
+		if _, err := file.ReadAt(data[start:], offset+walChunkHeaderSize); err != nil {
+			return nil, nil, err
+		}
+		checksum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data[start:])
+		if checksum != binary.LittleEndian.Uint32(header[:4]) {
+			return nil, nil, wal.ErrInvalidCRC
+		}
+
+		chunkOffset += walChunkHeaderSize + length
+		if header[6] == wal.ChunkTypeFull || header[6] == wal.ChunkTypeLast {
+			// the rest of the block is padding if it can not hold a chunk header
+			if chunkOffset+walChunkHeaderSize >= walBlockSize {
+				blockNumber, chunkOffset = blockNumber+1, 0
+			}
+			return data, &wal.ChunkPosition{SegmentId: id, BlockNumber: blockNumber, ChunkOffset: chunkOffset}, nil
+		}
+		blockNumber, chunkOffset = blockNumber+1, 0
+	}
+}
+
+// NewReader returns a reader of all the chunks in the view, see wal.WAL.NewReader.
+func (v *walView) NewReader() *walViewReader {
+	return &walViewReader{view: v}
+}
+
+// NewReaderAt returns a reader of the chunks in the view from the position, or all of them if it is nil.
+func (v *walView) NewReaderAt(pos *wal.ChunkPosition) *walViewReader {
+	reader := &walViewReader{view: v}
+	if pos == nil {
+		return reader
+	}
+	for reader.current < len(v.ids) && v.ids[reader.current] < pos.SegmentId {
+		reader.current++
+	}
+	if reader.current < len(v.ids) && v.ids[reader.current] == pos.SegmentId {
+		reader.blockNumber, reader.chunkOffset = pos.BlockNumber, pos.ChunkOffset
+	}
+	return reader
+}
+
+// Close closes the segments of the view.
+func (v *walView) Close() error {
+	if v.shared {
+		return nil
+	}
+	var err error
+	for _, file := range v.files {
+		if errClose := file.Close(); err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// walViewReader reads the chunks of a walView in order.
+type walViewReader struct {
+	view        *walView
+	current     int // the index of the current segment in the view
+	blockNumber uint32
+	chunkOffset int64
+}
+
+// Next returns the next chunk and its position, io.EOF is returned if there is no more chunk.
+func (r *walViewReader) Next() ([]byte, *wal.ChunkPosition, error) {
+	for r.current < len(r.view.ids) {
+		id := r.view.ids[r.current]
+		data, next, err := r.view.readChunk(id, r.blockNumber, r.chunkOffset)
+		if errors.Is(err, io.EOF) {
+			r.SkipCurrentSegment()
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		pos := &wal.ChunkPosition{SegmentId: id, BlockNumber: r.blockNumber, ChunkOffset: r.chunkOffset,
+			ChunkSize: next.BlockNumber*walBlockSize + uint32(next.ChunkOffset) -
+				(r.blockNumber*walBlockSize + uint32(r.chunkOffset))}
+		r.blockNumber, r.chunkOffset = next.BlockNumber, next.ChunkOffset
+		return data, pos, nil
+	}
+	return nil, nil, io.EOF
+}
+
+// SkipCurrentSegment skips the rest of the current segment.
+func (r *walViewReader) SkipCurrentSegment() {
+	r.current++
+	r.blockNumber, r.chunkOffset = 0, 0
+}
+
+// CurrentSegmentId returns the id of the current segment.
+func (r *walViewReader) CurrentSegmentId() wal.SegmentID { //nolint:revive // the same as wal.Reader
+	return r.view.ids[r.current]
+}
+
+// CurrentChunkPosition returns the position of the next chunk to be read.
+func (r *walViewReader) CurrentChunkPosition() *wal.ChunkPosition {
+	return &wal.ChunkPosition{SegmentId: r.CurrentSegmentId(), BlockNumber: r.blockNumber, ChunkOffset: r.chunkOffset}
+}
+
+// copyIndex copies the index of the partitions in srcDir to dstDir,
+// the bptree index is a file of every partition, and the hash index is a directory.
+func copyIndex(indexType IndexType, partitionNum int, srcDir, dstDir string) error {
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return err
+	}
+	for i := 0; i < partitionNum; i++ {
+		name := fmt.Sprintf(indexFileExt, i)
+		var err error
+		if indexType == Hash {
+			err = copyDir(filepath.Join(srcDir, name), filepath.Join(dstDir, name))
+		} else {
+			err = copyFile(filepath.Join(srcDir, name), filepath.Join(dstDir, name), -1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockIndex locks the index lock file, so the read only processes do not capture the index and value logs
+// while they are changed, see Open. It must be called with db.flushLock held.
+func (db *DB) lockIndex() {
+	if err := db.indexLock.Lock(); err != nil {
+		// the read only processes may read the index being changed, but the writes go on.
+		log.Println("lock the index lock file failed:", err)
+	}
+}
+
+// unlockIndex stores the meta of the hash indexes, which is only stored when a diskhash is closed,
+// so the read only processes read the latest meta, then unlocks the index lock file.
+// It must be called with db.flushLock held.
+func (db *DB) unlockIndex() {
+	for _, cf := range db.getFamilies() {
+		if index, ok := cf.index.(*HashTable); ok {
+			if err := index.reopen(); err != nil {
+				log.Println("store the meta of hash index failed:", err)
+			}
+		}
+	}
+	// the secondaries capture the index again once they find the generation changed, see TryCatchUpWithPrimary.
+	db.indexGeneration++
+	if err := storeIndexGeneration(db.options.DirPath, db.indexGeneration); err != nil {
+		log.Println("store the index generation failed:", err)
+	}
+	if err := db.indexLock.Unlock(); err != nil {
+		log.Println("unlock the index lock file failed:", err)
+	}
+}
+
+// loadIndexGeneration reads the index generation stored in dirPath, it is 0 if not stored.
+// It must be called with the index lock file locked.
+func loadIndexGeneration(dirPath string) (uint64, error) {
+	buf, err := os.ReadFile(filepath.Join(dirPath, indexGenerationName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, fmt.Errorf("invalid index generation file size %d", len(buf))
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// storeIndexGeneration stores the index generation in dirPath.
+// It must be called with the index lock file locked exclusively.
+func storeIndexGeneration(dirPath string, generation uint64) error {
+	return writeMetaFile(filepath.Join(dirPath, indexGenerationName), binary.LittleEndian.AppendUint64(nil, generation))
+}
+
+// removeFlushedMemtables removes the memtables flushed by the writable process after their wal are read,
+// their wal are deleted or archived by the flush, which is done with the index lock file locked.
+// The rest of the memtables are not flushed yet, and they are newer than the flushed ones,
+// because the memtables are flushed in order. An empty memtable is kept if all of them are flushed.
+// It must be called with the index lock file locked, in read only mode.
+func removeFlushedMemtables(tables []*memtable) ([]*memtable, error) {
+	var kept []*memtable
+	for _, table := range tables {
+		ext := fmt.Sprintf(walFileExt, table.options.tableID)
+		_, err := os.Stat(wal.SegmentFileName(table.options.dirPath, ext, 1))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, table)
+	}
+	if len(kept) > 0 {
+		return kept, nil
+	}
+	last := tables[len(tables)-1]
+	empty, err := openMemtable(last.options)
+	if err != nil {
+		return nil, err
+	}
+	return []*memtable{empty}, nil
+}
@@ -0,0 +1,172 @@
+package lotusdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readFiles reads all the files in the directory, keyed by their relative paths.
+func readFiles(t *testing.T, dir string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[rel] = buf
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestDBReadOnly(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-readonly")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("key %03d", i))
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put(key(i), []byte("flushed")))
+			}
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Put(key(0), []byte("memtable")))
+			require.NoError(t, db.Delete(key(1)))
+			family, err := db.CreateColumnFamily("family", ColumnFamilyOptions{IndexType: indexType})
+			require.NoError(t, err)
+			require.NoError(t, family.Put(key(0), []byte("family")))
+
+			// the readers are opened while the writer is running
+			readOnlyOptions := options
+			readOnlyOptions.ReadOnly = true
+			reader, err := Open(readOnlyOptions)
+			require.NoError(t, err)
+			_, err = Open(options)
+			require.ErrorIs(t, err, ErrDatabaseIsUsing)
+
+			// the writes after the reader is opened are not read by it, even if they are flushed and compacted
+			require.NoError(t, db.Put(key(0), []byte("written")))
+			require.NoError(t, db.Put(key(100), []byte("written")))
+			require.NoError(t, db.Delete(key(99)))
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Compact())
+			require.NoError(t, db.Put(key(2), []byte("written")))
+			another, err := Open(readOnlyOptions)
+			require.NoError(t, err)
+
+			checkReader := func(r *DB, written bool) {
+				expected := func(value string) []byte {
+					if written {
+						return []byte("written")
+					}
+					return []byte(value)
+				}
+				v, errGet := r.Get(key(0))
+				require.NoError(t, errGet)
+				assert.Equal(t, expected("memtable"), v)
+				_, errGet = r.Get(key(1))
+				require.ErrorIs(t, errGet, ErrKeyNotFound)
+				v, errGet = r.Get(key(2))
+				require.NoError(t, errGet)
+				assert.Equal(t, expected("flushed"), v)
+				v, errGet = r.Get(key(99))
+				if written {
+					require.ErrorIs(t, errGet, ErrKeyNotFound)
+				} else {
+					require.NoError(t, errGet)
+					assert.Equal(t, []byte("flushed"), v)
+				}
+				_, errGet = r.Get(key(100))
+				if written {
+					require.NoError(t, errGet)
+				} else {
+					require.ErrorIs(t, errGet, ErrKeyNotFound)
+				}
+				readFamily, errFamily := r.ColumnFamily("family")
+				require.NoError(t, errFamily)
+				v, errGet = readFamily.Get(key(0))
+				require.NoError(t, errGet)
+				assert.Equal(t, []byte("family"), v)
+
+				itr, errItr := r.NewIterator(IteratorOptions{})
+				require.NoError(t, errItr)
+				var keys int
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					keys++
+				}
+				require.NoError(t, itr.Close())
+				assert.Equal(t, 99, keys)
+				report, errVerify := r.Verify(context.Background(), VerifyOptions{})
+				require.NoError(t, errVerify)
+				assert.True(t, report.OK(), report.Issues)
+			}
+			checkReader(reader, false)
+			checkReader(another, true)
+
+			// all the writes are rejected
+			require.ErrorIs(t, reader.Put(key(0), []byte("value")), ErrDatabaseReadOnly)
+			require.ErrorIs(t, reader.Delete(key(0)), ErrDatabaseReadOnly)
+			txn := reader.BeginTxn()
+			require.NoError(t, txn.Put(key(0), []byte("value")))
+			require.ErrorIs(t, txn.Commit(), ErrDatabaseReadOnly)
+			_, err = reader.CreateColumnFamily("another", DefaultColumnFamilyOptions)
+			require.ErrorIs(t, err, ErrDatabaseReadOnly)
+			require.ErrorIs(t, reader.Compact(), ErrDatabaseReadOnly)
+			itr := &sliceIngestIterator{keys: [][]byte{key(0)}, values: [][]byte{nil}}
+			require.ErrorIs(t, reader.IngestSorted(itr, DefaultIngestOptions), ErrDatabaseReadOnly)
+			_, err = reader.Backup(new(bytes.Buffer), 0)
+			require.ErrorIs(t, err, ErrDatabaseReadOnly)
+			_, err = reader.RegisterChangeConsumer("consumer")
+			require.ErrorIs(t, err, ErrDatabaseReadOnly)
+			_, err = reader.Changes(0)
+			require.ErrorIs(t, err, ErrDatabaseReadOnly)
+			require.ErrorIs(t, reader.Checkpoint(filepath.Join(path, "checkpoint")), ErrDatabaseReadOnly)
+
+			require.NoError(t, reader.Close())
+			require.NoError(t, another.Close())
+			v, err := db.Get(key(0))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("written"), v)
+
+			// nothing is written by the readers
+			require.NoError(t, db.Close())
+			files := readFiles(t, path)
+			reader, err = Open(readOnlyOptions)
+			require.NoError(t, err)
+			checkReader(reader, true)
+			require.NoError(t, reader.Close())
+			assert.Equal(t, files, readFiles(t, path))
+
+			readOnlyOptions.DirPath = filepath.Join(path, "not-exist")
+			_, err = Open(readOnlyOptions)
+			require.ErrorIs(t, err, os.ErrNotExist)
+			_, err = os.Stat(readOnlyOptions.DirPath)
+			require.ErrorIs(t, err, os.ErrNotExist)
+			// the database can be opened for writing after the writer is closed
+			reopened, err := Open(options)
+			require.NoError(t, err)
+			require.NoError(t, reopened.Close())
+		})
+	}
+}
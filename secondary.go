@@ -0,0 +1,301 @@
+package lotusdb
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+)
+
+// secondaryCopyPattern is the pattern of the directories in the secondary directory,
+// which hold the copies of the indexes of the primary captured by the catch-ups.
+const secondaryCopyPattern = "COPY.*"
+
+// retiredView is the index and value logs of the column families replaced by a catch-up with the primary,
+// they are still read by the iterators created before the catch-up, see DB.closeRetired.
+type retiredView struct {
+	families []*ColumnFamily // the column families holding the replaced index and value logs
+	indexDir string          // the copy of the indexes opened by the replaced ones
+}
+
+// OpenAsSecondary opens the database in primaryDir as a secondary, which reads the database
+// while it is written by the primary, the primary is usually opened by another process.
+// The DirPath and ReadOnly in options are ignored, and the other options must be the same as the primary,
+// e.g. the PartitionNum, IndexType, KeyHashFunction and KeyProvider.
+//
+// The secondary reads the primary like a database opened in read only mode, see Open.
+// The memtables are rebuilt from the wal of the primary, the value logs of the primary are read directly,
+// and the indexes are copied to secondaryDir, which is created if it does not exist,
+// and it can not be used by another secondary at the same time.
+// The keys can be read as usual, but all the writes return ErrDatabaseReadOnly.
+// Call TryCatchUpWithPrimary periodically to read the batches committed after it is opened.
+func OpenAsSecondary(primaryDir, secondaryDir string, options Options) (*DB, error) {
+	if primaryDir == "" || secondaryDir == "" {
+		return nil, ErrDBDirectoryISEmpty
+	}
+	if err := os.MkdirAll(secondaryDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(secondaryDir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+
+	// the copies left by a secondary which is not closed properly
+	copies, err := filepath.Glob(filepath.Join(secondaryDir, secondaryCopyPattern))
+	if err == nil {
+		for _, dir := range copies {
+			if err = os.RemoveAll(dir); err != nil {
+				break
+			}
+		}
+	}
+	var indexDir string
+	if err == nil {
+		indexDir, err = os.MkdirTemp(secondaryDir, secondaryCopyPattern)
+	}
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+
+	options.DirPath = primaryDir
+	options.ReadOnly = true
+	db, err := open(options, indexDir)
+	if err != nil {
+		_ = os.RemoveAll(indexDir)
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	db.primaryDir = primaryDir
+	db.fileLock = fileLock
+	return db, nil
+}
+
+// TryCatchUpWithPrimary reads the batches committed by the primary since it is opened or the last catch-up,
+// including the new column families, the flushed batches written with DisableWal and the ingested keys.
+// It returns ErrNotSecondary if the database is not opened by OpenAsSecondary.
+//
+// If the primary only writes its memtables since the last catch-up, the catch-up only reads
+// the chunks appended to their wal, so it costs as much as the batches written meanwhile.
+// Once the primary changes its index, by flushing a memtable, compacting, ingesting or reopening,
+// or it creates a column family, the primary is captured again like opening it:
+// the memtables are rebuilt from its wal and its indexes are copied to the secondary directory,
+// which costs as much as the size of the index, so the primary should not flush too often.
+// The batches written with DisableWal are only read after they are flushed by the primary.
+//
+// When the primary is captured again, the iterators created before the catch-up still read the database as it was,
+// the replaced indexes and value logs are closed by the first catch-up after those iterators are closed.
+// The snapshots created before it are released, because they read the replaced indexes,
+// reading with them returns ErrSnapshotReleased. Otherwise the iterators and snapshots are kept,
+// they do not read the batches caught up.
+func (db *DB) TryCatchUpWithPrimary() error {
+	if db.primaryDir == "" {
+		return ErrNotSecondary
+	}
+	db.catchUpLock.Lock()
+	defer db.catchUpLock.Unlock()
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return ErrDBClosed
+	}
+
+	caught, err := db.catchUpMemtables()
+	if err != nil || caught {
+		return err
+	}
+	// the copies are created in the secondary directory, see OpenAsSecondary.
+	indexDir, err := os.MkdirTemp(filepath.Dir(db.indexDir), secondaryCopyPattern)
+	if err != nil {
+		return err
+	}
+	files, err := openDatabaseFiles(db.options, db.indexLock, indexDir)
+	if err != nil {
+		_ = os.RemoveAll(indexDir)
+		return err
+	}
+	return db.replaceView(files, indexDir)
+}
+
+// catchUpMemtables reads the batches appended to the wal of the memtables of the primary since the last catch-up,
+// and the memtables created meanwhile. It returns false without reading them if the index generation
+// or the column families of the primary have changed since the index is captured, see TryCatchUpWithPrimary.
+func (db *DB) catchUpMemtables() (bool, error) {
+	// the index lock file is locked shared, so the memtables are not flushed while their wal are read.
+	if _, err := os.Stat(db.indexLock.Path()); err == nil {
+		if err = db.indexLock.RLock(); err != nil {
+			return false, err
+		}
+		defer func() { _ = db.indexLock.Unlock() }()
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	generation, err := loadIndexGeneration(db.options.DirPath)
+	if err != nil || generation != db.indexGeneration {
+		return false, err
+	}
+	metas, err := loadColumnFamilyMeta(db.options.DirPath)
+	if err != nil || len(metas) != len(db.getFamilies())-1 {
+		return false, err
+	}
+
+	// the memtables are only changed by the catch-ups, which are serialized.
+	db.mu.RLock()
+	tables := append(db.immuMems[:len(db.immuMems):len(db.immuMems)], db.activeMem)
+	db.mu.RUnlock()
+	type caughtBatch struct {
+		table   *memtable
+		records []*LogRecord
+		seq     uint64
+	}
+	var batches []caughtBatch
+	for _, table := range tables {
+		errCatchUp := table.catchUp(func(records []*LogRecord, seq uint64) {
+			batches = append(batches, caughtBatch{table: table, records: records, seq: seq})
+		})
+		if errCatchUp != nil {
+			return false, errCatchUp
+		}
+	}
+	// the memtables created by the primary after the last one, which may be created by a flush,
+	// see removeFlushedMemtables.
+	tableIDs, err := memtableIDs(db.options.DirPath)
+	if err != nil {
+		return false, err
+	}
+	last := tables[len(tables)-1].options
+	var created []*memtable
+	for _, id := range tableIDs {
+		if uint32(id) <= last.tableID {
+			continue
+		}
+		options := last
+		options.tableID = uint32(id)
+		table, errOpen := openMemtable(options)
+		if errOpen != nil {
+			return false, errOpen
+		}
+		created = append(created, table)
+	}
+
+	// the batches are put with db.mu held, so they are read atomically, see DB.Get.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return false, ErrDBClosed
+	}
+	for _, batch := range batches {
+		batch.table.applyBatch(batch.records, batch.seq)
+	}
+	for _, table := range created {
+		db.immuMems = append(db.immuMems, db.activeMem)
+		db.activeMem = table
+	}
+	if seq := lastSeq(db.changes, append(tables, created...)); seq > db.seq {
+		db.seq = seq
+	}
+
+	db.iterLock.Lock()
+	pinned := db.openIterators > 0
+	db.iterLock.Unlock()
+	if pinned {
+		return true, nil
+	}
+	return true, db.closeRetired()
+}
+
+// replaceView replaces the memtables, the indexes and the value logs with the ones captured by a catch-up.
+// The column families are kept, their replaced index and value logs are retired, see closeRetired.
+func (db *DB) replaceView(files *databaseFiles, indexDir string) error {
+	// the hash iterators load the hash index after the other locks are released, see newIterator.
+	db.scanLock.Lock()
+	defer db.scanLock.Unlock()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+	for _, family := range files.families {
+		family.db = db
+	}
+	if db.closed {
+		for _, family := range files.families {
+			_ = family.close()
+		}
+		_ = os.RemoveAll(indexDir)
+		return ErrDBClosed
+	}
+
+	retired := retiredView{indexDir: db.indexDir}
+	for _, family := range files.families {
+		current, ok := db.families[family.name]
+		if !ok {
+			db.families[family.name] = family
+			continue
+		}
+		replaced := *current
+		retired.families = append(retired.families, &replaced)
+		current.index, current.vlog = family.index, family.vlog
+	}
+	db.retired = append(db.retired, retired)
+	db.index, db.vlog = db.defaultFamily.index, db.defaultFamily.vlog
+	memtables := files.memtables
+	db.activeMem, db.immuMems = memtables[len(memtables)-1], memtables[:len(memtables)-1]
+	db.changes = files.changes
+	db.seq = lastSeq(files.changes, memtables)
+	db.indexGeneration = files.generation
+	db.indexDir = indexDir
+	db.releaseSnapshots()
+
+	db.iterLock.Lock()
+	pinned := db.openIterators > 0
+	db.iterLock.Unlock()
+	if pinned {
+		return nil
+	}
+	return db.closeRetired()
+}
+
+// releaseSnapshots releases the snapshots created by the users, they can not be read after a catch-up.
+// The snapshots created by the iterators are released when the iterators are closed.
+// It must be called with db.flushLock held, see Snapshot.Release.
+func (db *DB) releaseSnapshots() {
+	for _, snapshot := range db.getSnapshots() {
+		if snapshot.scope != nil {
+			continue
+		}
+		db.snapshotLock.Lock()
+		delete(db.snapshots, snapshot)
+		db.snapshotLock.Unlock()
+		snapshot.mu.Lock()
+		snapshot.memtables = nil
+		snapshot.kept = nil
+		snapshot.keptUIDs = nil
+		snapshot.mu.Unlock()
+	}
+}
+
+// closeRetired closes the index and value logs replaced by the catch-ups, and removes their copies of the indexes.
+// It must be called with db.mu held, when no iterator reads them.
+func (db *DB) closeRetired() error {
+	for len(db.retired) > 0 {
+		retired := db.retired[0]
+		db.retired = db.retired[1:]
+		for _, family := range retired.families {
+			if err := family.close(); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(retired.indexDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package lotusdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBSecondary(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-secondary")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+			require.ErrorIs(t, db.TryCatchUpWithPrimary(), ErrNotSecondary)
+
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("key %03d", i))
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, db.Put(key(i), []byte("flushed")))
+			}
+			db.flushMemtable(db.activeMem)
+			require.NoError(t, db.Put(key(100), []byte("memtable")))
+
+			// the secondary is opened while the primary is running
+			dir := filepath.Join(os.TempDir(), "db-test-secondary-dir")
+			_ = os.RemoveAll(dir)
+			defer os.RemoveAll(dir)
+			secondary, err := OpenAsSecondary(path, dir, options)
+			require.NoError(t, err)
+			defer func() { _ = secondary.Close() }()
+			_, err = OpenAsSecondary(path, dir, options)
+			require.ErrorIs(t, err, ErrDatabaseIsUsing)
+			v, err := secondary.Get(key(0))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("flushed"), v)
+			v, err = secondary.Get(key(100))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("memtable"), v)
+			require.ErrorIs(t, secondary.Put(key(0), []byte("value")), ErrDatabaseReadOnly)
+			_, err = secondary.CreateColumnFamily("family", DefaultColumnFamilyOptions)
+			require.ErrorIs(t, err, ErrDatabaseReadOnly)
+
+			// the iterator and the snapshot created before the catch-up
+			itr, err := secondary.NewIterator(IteratorOptions{})
+			require.NoError(t, err)
+			snapshot := secondary.NewSnapshot()
+
+			// the batches written to the memtable of the primary are caught up without copying the index again
+			copies, err := filepath.Glob(filepath.Join(dir, secondaryCopyPattern))
+			require.NoError(t, err)
+			require.Len(t, copies, 1)
+			require.NoError(t, db.Put(key(102), []byte("caught up")))
+			require.NoError(t, db.Put(key(100), []byte("caught up")))
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			caught, err := filepath.Glob(filepath.Join(dir, secondaryCopyPattern))
+			require.NoError(t, err)
+			assert.Equal(t, copies, caught)
+			v, err = secondary.Get(key(102))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("caught up"), v)
+			v, err = secondary.GetWithOptions(key(100), ReadOptions{Snapshot: snapshot})
+			require.NoError(t, err)
+			assert.Equal(t, []byte("memtable"), v)
+			_, err = secondary.GetWithOptions(key(102), ReadOptions{Snapshot: snapshot})
+			require.ErrorIs(t, err, ErrKeyNotFound)
+
+			// the batches are flushed between the catch-ups, and their wal are deleted
+			require.NoError(t, db.Delete(key(0)))
+			family, err := db.CreateColumnFamily("family", ColumnFamilyOptions{IndexType: indexType})
+			require.NoError(t, err)
+			require.NoError(t, family.Put(key(0), []byte("family")))
+			require.NoError(t, db.PutWithOptions(key(1), []byte("disable wal"), WriteOptions{DisableWal: true}))
+			db.flushMemtable(db.activeMem)
+			ingest := &sliceIngestIterator{keys: [][]byte{key(2), key(101)}, values: [][]byte{[]byte("ingested"), []byte("ingested")}}
+			require.NoError(t, db.IngestSorted(ingest, DefaultIngestOptions))
+			require.NoError(t, db.Compact())
+			require.NoError(t, db.Put(key(3), []byte("memtable")))
+
+			_, err = secondary.ColumnFamily("family")
+			require.ErrorIs(t, err, ErrColumnFamilyNotFound)
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			_, err = secondary.Get(key(0))
+			require.ErrorIs(t, err, ErrKeyNotFound)
+			for i, value := range map[int]string{
+				1: "disable wal", 2: "ingested", 3: "memtable", 100: "caught up", 101: "ingested", 102: "caught up",
+			} {
+				v, err = secondary.Get(key(i))
+				require.NoError(t, err)
+				assert.Equal(t, []byte(value), v)
+			}
+			secondaryFamily, err := secondary.ColumnFamily("family")
+			require.NoError(t, err)
+			v, err = secondaryFamily.Get(key(0))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("family"), v)
+			_, err = secondary.GetWithOptions(key(0), ReadOptions{Snapshot: snapshot})
+			require.ErrorIs(t, err, ErrSnapshotReleased)
+			snapshot.Release()
+
+			// the iterator still reads the database as it was, the replaced index is kept until it is closed
+			var keys int
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				value := itr.Value()
+				if keys < 100 {
+					assert.Equal(t, []byte("flushed"), value)
+				}
+				keys++
+			}
+			require.NoError(t, itr.Err())
+			assert.Equal(t, 101, keys)
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			copies, err = filepath.Glob(filepath.Join(dir, secondaryCopyPattern))
+			require.NoError(t, err)
+			assert.Len(t, copies, 2)
+			require.NoError(t, itr.Close())
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			copies, err = filepath.Glob(filepath.Join(dir, secondaryCopyPattern))
+			require.NoError(t, err)
+			assert.Len(t, copies, 1)
+
+			itr, err = secondary.NewIterator(IteratorOptions{})
+			require.NoError(t, err)
+			keys = 0
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				keys++
+			}
+			require.NoError(t, itr.Close())
+			assert.Equal(t, 102, keys)
+			report, err := secondary.Verify(context.Background(), VerifyOptions{})
+			require.NoError(t, err)
+			assert.True(t, report.OK(), report.Issues)
+
+			// the copies are removed when closing, and the secondary directory can be used again
+			require.NoError(t, secondary.Close())
+			copies, err = filepath.Glob(filepath.Join(dir, secondaryCopyPattern))
+			require.NoError(t, err)
+			assert.Empty(t, copies)
+			secondary, err = OpenAsSecondary(path, dir, options)
+			require.NoError(t, err)
+			v, err = secondary.Get(key(101))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("ingested"), v)
+		})
+	}
+}
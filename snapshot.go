@@ -0,0 +1,401 @@
+package lotusdb
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/rosedblabs/diskhash"
+)
+
+// Snapshot is a consistent point-in-time view of the database.
+// Reading with a snapshot can see all the batches committed before the snapshot is created,
+// and none of the batches committed after it, see ReadOptions and IteratorOptions.
+//
+// A snapshot pins the memtables and the value log records visible to it,
+// so you must call Release when the snapshot is no longer used,
+// otherwise the memory and the value log space will be leaked.
+type Snapshot struct {
+	db        *DB
+	seq       uint64      // commit sequence number of the snapshot
+	memtables []*memtable // memtables visible to the snapshot, the newest is the first one
+	mu        sync.RWMutex
+	// kept holds the index entries which are overwritten after the snapshot is created,
+	// keyed by the family key, a nil position means the key did not exist in index.
+	kept map[string]*KeyPosition
+	// keptUIDs holds the uid of value log records referenced by kept, map uid -> key.
+	keptUIDs map[uuid.UUID]string
+	// scope limits the keys kept by the snapshot, nil means all the keys, see snapshotScope.
+	scope *snapshotScope
+}
+
+// snapshotScope is the range of keys of a column family read with a snapshot.
+// The snapshot created by an iterator only keeps the index entries of the keys it iterates,
+// so the flushes do not look up the index for the other keys, see DB.keepSnapshotVersions.
+type snapshotScope struct {
+	familyID uint32
+	lower    []byte // inclusive lower bound, nil means no limit
+	upper    []byte // exclusive upper bound, nil means no limit
+}
+
+// NewSnapshot creates a snapshot of the current state of the database.
+// It's the caller's responsibility to call Release when the snapshot is no longer used.
+func (db *DB) NewSnapshot() *Snapshot {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.newSnapshot(nil)
+}
+
+// newSnapshot creates a snapshot like NewSnapshot which keeps the keys in the scope,
+// a nil scope means all the keys. It must be called with db.mu held.
+func (db *DB) newSnapshot(scope *snapshotScope) *Snapshot {
+	snapshot := &Snapshot{
+		db:        db,
+		seq:       db.seq,
+		memtables: db.getMemTables(),
+		kept:      make(map[string]*KeyPosition),
+		keptUIDs:  make(map[uuid.UUID]string),
+		scope:     scope,
+	}
+	db.snapshotLock.Lock()
+	db.snapshots[snapshot] = struct{}{}
+	db.snapshotLock.Unlock()
+	return snapshot
+}
+
+// Seq returns the commit sequence number of the snapshot,
+// all the batches with sequence number not greater than it are visible to the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release releases the snapshot, the memtables and value log records
+// only visible to it will be freed.
+// It is safe to call Release multiple times.
+func (s *Snapshot) Release() {
+	db := s.db
+	db.snapshotLock.Lock()
+	if _, ok := db.snapshots[s]; !ok {
+		db.snapshotLock.Unlock()
+		return
+	}
+	delete(db.snapshots, s)
+	db.snapshotLock.Unlock()
+
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the kept records are overwritten, they can be compacted if no other snapshots need them.
+	// Most of them are marked deprecated when they are overwritten, and compaction marks the ones it rewrites
+	// again, see valueLog.restoreDeprecated, the rest are marked here, e.g. the keys deleted from the hash index.
+	// The kept records are still in the value log, because compaction keeps them until the snapshot is released.
+	records := db.snapshotRecords()
+	for uid, key := range s.keptUIDs {
+		if _, ok := records[uid]; ok {
+			continue
+		}
+		id, userKey := splitFamilyKey([]byte(key))
+		cf := db.familyByID(id)
+		if cf == nil {
+			continue
+		}
+		partition := cf.vlog.getKeyPartition(userKey)
+		if !cf.vlog.isDeprecated(partition, uid) {
+			cf.vlog.setDeprecated(uint32(partition), uid)
+		}
+	}
+	s.memtables = nil
+	s.kept = nil
+	s.keptUIDs = nil
+}
+
+// released checks whether the snapshot is released, must be called with s.mu held.
+func (s *Snapshot) released() bool {
+	return s.kept == nil
+}
+
+// keep records the index entry of the key before it is overwritten,
+// only the first one will be kept, which is the version visible to the snapshot.
+func (s *Snapshot) keep(key []byte, keyPos *KeyPosition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released() {
+		return
+	}
+	if _, ok := s.kept[string(key)]; ok {
+		return
+	}
+	s.kept[string(key)] = keyPos
+	if keyPos != nil {
+		s.keptUIDs[keyPos.uid] = string(key)
+	}
+}
+
+// covers checks whether the snapshot keeps the key of the column family.
+func (s *Snapshot) covers(familyID uint32, key []byte) bool {
+	return s.scope == nil || (s.scope.familyID == familyID && keyInRange(key, s.scope.lower, s.scope.upper))
+}
+
+// keptPosition returns the kept index entry of the key.
+// The bool value is false if the index entry of the key is not overwritten after the snapshot is created.
+func (s *Snapshot) keptPosition(key []byte) (*KeyPosition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyPos, ok := s.kept[string(key)]
+	return keyPos, ok
+}
+
+// getSnapshots returns all the open snapshots.
+func (db *DB) getSnapshots() []*Snapshot {
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
+	snapshots := make([]*Snapshot, 0, len(db.snapshots))
+	for snapshot := range db.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// keepSnapshotVersions keeps the index entries of the keys in the column family
+// which will be overwritten by flush, so the open snapshots can still read the versions visible to them.
+// The index is only read for the keys kept by any snapshot, see snapshotScope.
+// must be called with db.flushLock held.
+func (db *DB) keepSnapshotVersions(cf *ColumnFamily, keys [][]byte) error {
+	snapshots := db.getSnapshots()
+	if len(snapshots) == 0 {
+		return nil
+	}
+	keeping := make([]*Snapshot, 0, len(snapshots))
+	for _, key := range keys {
+		keeping = keeping[:0]
+		for _, snapshot := range snapshots {
+			if snapshot.covers(cf.id, key) {
+				keeping = append(keeping, snapshot)
+			}
+		}
+		if len(keeping) == 0 {
+			continue
+		}
+		var hashTableKeyPos *KeyPosition
+		var matchKey func(diskhash.Slot) (bool, error)
+		if cf.options.IndexType == Hash {
+			matchKey = matchKeyFunc(cf.vlog, key, &hashTableKeyPos, nil)
+		}
+		keyPos, err := cf.index.Get(key, matchKey)
+		if err != nil {
+			return err
+		}
+		if cf.options.IndexType == Hash {
+			keyPos = hashTableKeyPos
+		}
+		fkey := familyKey(cf.id, key)
+		for _, snapshot := range keeping {
+			snapshot.keep(fkey, keyPos)
+		}
+	}
+	return nil
+}
+
+// snapshotRecords returns the uids of the value log records kept by the open snapshots.
+// It is built once for a compaction or verification run, instead of looking up all the snapshots
+// for every record, the kept records do not change while db.flushLock is held, see Snapshot.keep.
+func (db *DB) snapshotRecords() map[uuid.UUID]struct{} {
+	records := make(map[uuid.UUID]struct{})
+	for _, snapshot := range db.getSnapshots() {
+		snapshot.mu.RLock()
+		for uid := range snapshot.keptUIDs {
+			records[uid] = struct{}{}
+		}
+		snapshot.mu.RUnlock()
+	}
+	return records
+}
+
+// updateSnapshotPosition updates the position of the value log record kept by snapshots after compaction.
+// The bool value is true if the record is kept by any snapshot.
+func (db *DB) updateSnapshotPosition(keyPos *KeyPosition) bool {
+	var found bool
+	for _, snapshot := range db.getSnapshots() {
+		snapshot.mu.Lock()
+		if key, ok := snapshot.keptUIDs[keyPos.uid]; ok {
+			snapshot.kept[key] = keyPos
+			found = true
+		}
+		snapshot.mu.Unlock()
+	}
+	return found
+}
+
+// newSnapshotIterator creates an iterator of the index entries of the column family kept by the snapshot.
+func (s *Snapshot) newSnapshotIterator(familyID uint32, options IteratorOptions) *positionIterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	itr := &positionIterator{options: options}
+	lower, upper := iterateBounds(options)
+	for fkey, keyPos := range s.kept {
+		id, key := splitFamilyKey([]byte(fkey))
+		if id != familyID || !keyInRange(key, lower, upper) {
+			continue
+		}
+		itr.keys = append(itr.keys, key)
+		itr.positions = append(itr.positions, keyPos)
+	}
+	sort.Sort(itr)
+	return itr
+}
+
+// snapshotOverride overrides the index entries read by a bptree iterator with the ones kept by the snapshot.
+// The entries kept by the snapshot are reloaded when more entries are kept,
+// because the bptree iterator reads the index in new read transactions, see bptreeIterator.
+type snapshotOverride struct {
+	snapshot  *Snapshot
+	familyID  uint32
+	partition int
+	options   indexOptions
+	iterOpts  IteratorOptions
+	kept      *positionIterator // the kept entries of the partition
+	keptNum   int               // the number of the entries kept by the snapshot when kept is loaded
+}
+
+// newSnapshotOverride creates an override of the index entries of the partition by the snapshot.
+func (s *Snapshot) newSnapshotOverride(familyID uint32, partition int, options indexOptions,
+	iterOpts IteratorOptions) *snapshotOverride {
+	return &snapshotOverride{
+		snapshot:  s,
+		familyID:  familyID,
+		partition: partition,
+		options:   options,
+		iterOpts:  iterOpts,
+	}
+}
+
+// refresh reloads the kept entries if more entries are kept since they are loaded.
+// It must be called after the read transaction of the index is begun, the entries overwritten
+// before the transaction are kept before that, see DB.keepSnapshotVersions.
+// The loaded entries are used if the snapshot is released.
+func (o *snapshotOverride) refresh() {
+	o.snapshot.mu.RLock()
+	keptNum, released := len(o.snapshot.kept), o.snapshot.released()
+	o.snapshot.mu.RUnlock()
+	if released || (o.kept != nil && keptNum == o.keptNum) {
+		return
+	}
+	itr := o.snapshot.newSnapshotIterator(o.familyID, o.iterOpts)
+	kept := &positionIterator{options: o.iterOpts}
+	for i, key := range itr.keys {
+		if o.options.getKeyPartition(key) == o.partition {
+			kept.keys = append(kept.keys, key)
+			kept.positions = append(kept.positions, itr.positions[i])
+		}
+	}
+	o.kept, o.keptNum = kept, keptNum
+}
+
+// merge overrides the page of entries read from index by the kept entries in the range of the page,
+// which is from the start key to the end key in the iterating direction, a nil end means the last key.
+// The kept entry with a nil position means the key does not exist, so it is removed from the page.
+func (o *snapshotOverride) merge(page []bptreeEntry, start []byte, inclusive bool, end []byte,
+	compare func(a, b []byte) int) []bptreeEntry {
+	o.refresh()
+	keys, positions := o.kept.keys, o.kept.positions
+	i := 0
+	if start != nil {
+		i = sort.Search(len(keys), func(i int) bool {
+			c := compare(keys[i], start)
+			return c > 0 || (inclusive && c == 0)
+		})
+	}
+	if i == len(keys) || (end != nil && compare(keys[i], end) > 0) {
+		return page
+	}
+
+	merged := make([]bptreeEntry, 0, len(page))
+	j := 0
+	for ; i < len(keys) && (end == nil || compare(keys[i], end) <= 0); i++ {
+		for j < len(page) && compare(page[j].key, keys[i]) < 0 {
+			merged = append(merged, page[j])
+			j++
+		}
+		if j < len(page) && compare(page[j].key, keys[i]) == 0 {
+			j++
+		}
+		if positions[i] != nil {
+			merged = append(merged, bptreeEntry{key: keys[i], keyPos: positions[i]})
+		}
+	}
+	return append(merged, page[j:]...)
+}
+
+// positionIterator implement baseIterator.
+// It iterates the index entries held in memory, sorted in the iterating direction.
+// It is used for the index entries kept by a snapshot, which override the entries in index,
+// and the index entries of the hash index, which can not be iterated in order.
+type positionIterator struct {
+	options   IteratorOptions
+	keys      [][]byte
+	positions []*KeyPosition
+	cur       int
+}
+
+// Len is the number of entries.
+func (pi *positionIterator) Len() int {
+	return len(pi.keys)
+}
+
+// Less sorts the entries in the iterating direction.
+func (pi *positionIterator) Less(i, j int) bool {
+	if pi.options.Reverse {
+		return bytes.Compare(pi.keys[i], pi.keys[j]) > 0
+	}
+	return bytes.Compare(pi.keys[i], pi.keys[j]) < 0
+}
+
+// Swap swaps the entries with indexes i and j.
+func (pi *positionIterator) Swap(i, j int) {
+	pi.keys[i], pi.keys[j] = pi.keys[j], pi.keys[i]
+	pi.positions[i], pi.positions[j] = pi.positions[j], pi.positions[i]
+}
+
+// Rewind seek the first key in the iterator.
+func (pi *positionIterator) Rewind() {
+	pi.cur = 0
+}
+
+// Seek move the iterator to the key which is
+// greater(less when reverse is true) than or equal to the specified key.
+func (pi *positionIterator) Seek(key []byte) {
+	pi.cur = sort.Search(len(pi.keys), func(i int) bool {
+		if pi.options.Reverse {
+			return bytes.Compare(pi.keys[i], key) <= 0
+		}
+		return bytes.Compare(pi.keys[i], key) >= 0
+	})
+}
+
+// Next moves the iterator to the next key.
+func (pi *positionIterator) Next() {
+	pi.cur++
+}
+
+// Key get the current key.
+func (pi *positionIterator) Key() []byte {
+	return pi.keys[pi.cur]
+}
+
+// Value get the current value, it is the *KeyPosition of the current key.
+func (pi *positionIterator) Value() any {
+	return pi.positions[pi.cur]
+}
+
+// Valid returns whether the iterator is exhausted.
+func (pi *positionIterator) Valid() bool {
+	return pi.cur < len(pi.keys)
+}
+
+// Close the iterator.
+func (pi *positionIterator) Close() error {
+	return nil
+}
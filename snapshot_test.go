@@ -0,0 +1,250 @@
+package lotusdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBSnapshotGet(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-snapshot-get")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	// key 0 is in index, key 1 and key 2 are in memtable when taking the snapshot
+	require.NoError(t, db.Put([]byte("key 0"), []byte("value 0")))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1")))
+	require.NoError(t, db.Put([]byte("key 2"), []byte("value 2")))
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	assert.Equal(t, db.seq, snapshot.Seq())
+
+	require.NoError(t, db.Put([]byte("key 0"), []byte("value 0 new")))
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1 new")))
+	require.NoError(t, db.Delete([]byte("key 2")))
+	require.NoError(t, db.Put([]byte("key 3"), []byte("value 3")))
+
+	readOpts := ReadOptions{Snapshot: snapshot}
+	check := func(t *testing.T) {
+		expected := map[string][]byte{
+			"key 0": []byte("value 0"),
+			"key 1": []byte("value 1"),
+			"key 2": []byte("value 2"),
+			"key 3": nil,
+		}
+		for key, value := range expected {
+			got, errGet := db.GetWithOptions([]byte(key), readOpts)
+			exist, errExist := db.ExistWithOptions([]byte(key), readOpts)
+			require.NoError(t, errExist)
+			if value == nil {
+				require.ErrorIs(t, errGet, ErrKeyNotFound)
+				assert.False(t, exist)
+				continue
+			}
+			require.NoError(t, errGet)
+			assert.Equal(t, value, got)
+			assert.True(t, exist)
+		}
+
+		latest, errGet := db.Get([]byte("key 0"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("value 0 new"), latest)
+		_, errGet = db.Get([]byte("key 2"))
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	}
+
+	t.Run("read from memtable", check)
+
+	db.flushMemtable(db.activeMem)
+	t.Run("read after flush", check)
+
+	require.NoError(t, db.Compact())
+	t.Run("read after compaction", check)
+
+	require.NoError(t, db.CompactWithDeprecatedtable())
+	t.Run("read after compaction with deprecatedtable", check)
+
+	t.Run("read after release", func(t *testing.T) {
+		snapshot.Release()
+		_, errGet := db.GetWithOptions([]byte("key 0"), readOpts)
+		require.ErrorIs(t, errGet, ErrSnapshotReleased)
+		_, errIter := db.NewIterator(IteratorOptions{Snapshot: snapshot})
+		require.ErrorIs(t, errIter, ErrSnapshotReleased)
+		assert.Empty(t, db.getSnapshots())
+	})
+}
+
+func TestDBSnapshotIterator(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-snapshot-iterator")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("k1"), []byte("v1")))
+	require.NoError(t, db.Put([]byte("k2"), []byte("v2")))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Put([]byte("k3"), []byte("v3")))
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	require.NoError(t, db.Delete([]byte("k1")))
+	require.NoError(t, db.Put([]byte("k2"), []byte("v2 new")))
+	require.NoError(t, db.Put([]byte("k3"), []byte("v3 new")))
+	require.NoError(t, db.Put([]byte("k4"), []byte("v4")))
+	db.flushMemtable(db.activeMem)
+	require.NoError(t, db.Put([]byte("k2"), []byte("v2 newer")))
+
+	expectedKeys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}
+	expectedValues := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}
+	for _, reverse := range []bool{false, true} {
+		iter, errIter := db.NewIterator(IteratorOptions{Reverse: reverse, Snapshot: snapshot})
+		require.NoError(t, errIter)
+		var keys, values [][]byte
+		for iter.Valid() {
+			keys = append(keys, iter.Key())
+			values = append(values, iter.Value())
+			iter.Next()
+		}
+		require.NoError(t, iter.Close())
+		if reverse {
+			for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+				keys[i], keys[j] = keys[j], keys[i]
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+		assert.Equal(t, expectedKeys, keys)
+		assert.Equal(t, expectedValues, values)
+	}
+
+	iter, err := db.NewIterator(IteratorOptions{})
+	require.NoError(t, err)
+	var values [][]byte
+	for iter.Valid() {
+		values = append(values, iter.Value())
+		iter.Next()
+	}
+	require.NoError(t, iter.Close())
+	assert.Equal(t, [][]byte{[]byte("v2 newer"), []byte("v3 new"), []byte("v4")}, values)
+}
+
+func TestDBSnapshotSeqReopen(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-snapshot-seq-reopen")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	}
+	seq := db.seq
+	assert.Equal(t, uint64(10), seq)
+	require.NoError(t, db.Close())
+
+	db, err = Open(options)
+	require.NoError(t, err)
+	assert.Equal(t, seq, db.seq)
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	require.NoError(t, db.Put([]byte("key"), []byte("value new")))
+	value, err := db.GetWithOptions([]byte("key"), ReadOptions{Snapshot: snapshot})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestDBSnapshotReleaseAfterCompact(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		options := DefaultOptions
+		path, err := os.MkdirTemp("", "db-test-snapshot-compact")
+		require.NoError(t, err)
+		options.DirPath = path
+		options.IndexType = indexType
+		options.PartitionNum = 1
+		db, err := Open(options)
+		require.NoError(t, err)
+
+		require.NoError(t, db.Put([]byte("key 0"), []byte("value 0")))
+		db.flushMemtable(db.activeMem)
+		snapshot := db.NewSnapshot()
+		require.NoError(t, db.Put([]byte("key 0"), []byte("value 0 new")))
+		db.flushMemtable(db.activeMem)
+		vlog := db.defaultFamily.vlog
+		assert.Equal(t, uint32(1), vlog.deprecatedNumber)
+		assert.Equal(t, uint32(2), vlog.totalNumber)
+
+		// the record kept by the snapshot is rewritten, and it is still deprecated.
+		require.NoError(t, db.Compact())
+		assert.Equal(t, uint32(1), vlog.deprecatedNumber)
+		assert.Equal(t, uint32(2), vlog.totalNumber)
+		value, err := db.GetWithOptions([]byte("key 0"), ReadOptions{Snapshot: snapshot})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("value 0"), value)
+
+		// it is not counted twice after releasing the snapshot.
+		snapshot.Release()
+		assert.Equal(t, uint32(1), vlog.deprecatedNumber)
+		require.NoError(t, db.Compact())
+		assert.Equal(t, uint32(0), vlog.deprecatedNumber)
+		assert.Equal(t, uint32(1), vlog.totalNumber)
+		destroyDB(db)
+	}
+}
+
+func TestDBIteratorSnapshotScope(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-snapshot-scope")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	for _, key := range []string{"a 0", "a 1", "b 0", "b 1"} {
+		require.NoError(t, db.Put([]byte(key), []byte("value")))
+	}
+	db.flushMemtable(db.activeMem)
+
+	iter, err := db.NewIterator(IteratorOptions{Prefix: []byte("a ")})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, iter.Close())
+	}()
+
+	// only the keys iterated by the iterator are kept by its snapshot.
+	for _, key := range []string{"a 0", "a 1", "b 0", "b 1"} {
+		require.NoError(t, db.Put([]byte(key), []byte("new value")))
+	}
+	db.flushMemtable(db.activeMem)
+	iter.snapshot.mu.RLock()
+	assert.Len(t, iter.snapshot.kept, 2)
+	for key := range iter.snapshot.kept {
+		_, userKey := splitFamilyKey([]byte(key))
+		assert.Equal(t, []byte("a "), userKey[:2])
+	}
+	iter.snapshot.mu.RUnlock()
+
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, []byte("value"), iter.Value())
+		count++
+	}
+	assert.Equal(t, 2, count)
+}
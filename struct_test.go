@@ -2,9 +2,13 @@ package lotusdb
 
 import (
 	"bytes"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEncodeDecodeValueLogRecord(t *testing.T) {
@@ -14,16 +18,20 @@ func TestEncodeDecodeValueLogRecord(t *testing.T) {
 	uuidVal := uuid.New()
 
 	record := &ValueLogRecord{
-		key:   key,
-		value: value,
-		uid:   uuidVal,
+		key:    key,
+		value:  value,
+		uid:    uuidVal,
+		expire: 1024,
 	}
 
 	// Encode the record
-	encoded := encodeValueLogRecord(record)
+	encoded := encodeValueLogRecord(record, NoCompression)
 
 	// Decode the encoded record
-	decoded := decodeValueLogRecord(encoded)
+	decoded, err := decodeValueLogRecord(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Compare original and decoded records
 	if !bytes.Equal(record.key, decoded.key) {
@@ -37,4 +45,80 @@ func TestEncodeDecodeValueLogRecord(t *testing.T) {
 	if record.uid != decoded.uid {
 		t.Errorf("Expected UUID %v, got %v", record.uid, decoded.uid)
 	}
+
+	if record.expire != decoded.expire {
+		t.Errorf("Expected expire %v, got %v", record.expire, decoded.expire)
+	}
+}
+
+func TestEncodeDecodeLogRecord(t *testing.T) {
+	record := &LogRecord{
+		Key:     []byte("mykey"),
+		Value:   []byte("myvalue"),
+		Type:    LogRecordNormal,
+		BatchID: 100,
+		Expire:  1024,
+	}
+
+	decoded := decodeLogRecord(encodeLogRecord(record))
+
+	if !bytes.Equal(record.Key, decoded.Key) {
+		t.Errorf("Expected key %v, got %v", record.Key, decoded.Key)
+	}
+
+	if !bytes.Equal(record.Value, decoded.Value) {
+		t.Errorf("Expected value %v, got %v", record.Value, decoded.Value)
+	}
+
+	if record.BatchID != decoded.BatchID {
+		t.Errorf("Expected batch id %v, got %v", record.BatchID, decoded.BatchID)
+	}
+
+	if record.Expire != decoded.Expire {
+		t.Errorf("Expected expire %v, got %v", record.Expire, decoded.Expire)
+	}
+}
+
+func TestValueLogRecordMaxKeySize(t *testing.T) {
+	// the key size at the limit of the encoding does not overwrite the compression and the expire flag
+	record := &ValueLogRecord{
+		key:    bytes.Repeat([]byte("k"), valueLogRecordKeySizeMask),
+		value:  bytes.Repeat([]byte("v"), 1024),
+		uid:    uuid.New(),
+		expire: 1024,
+	}
+	decoded, err := decodeValueLogRecord(encodeValueLogRecord(record, Snappy))
+	require.NoError(t, err)
+	assert.Equal(t, record.key, decoded.key)
+	assert.Equal(t, record.value, decoded.value)
+	assert.Equal(t, record.expire, decoded.expire)
+
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-max-key-size")
+	require.NoError(t, err)
+	options.DirPath = path
+	options.MergeOperator = func(_, existingValue []byte, operands [][]byte) []byte {
+		return append(existingValue, bytes.Join(operands, nil)...)
+	}
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	tooLarge := bytes.Repeat([]byte("k"), MaxKeySize+1)
+	require.ErrorIs(t, db.Put(tooLarge, []byte("value")), ErrKeyTooLarge)
+	require.ErrorIs(t, db.Delete(tooLarge), ErrKeyTooLarge)
+	require.ErrorIs(t, db.Merge(tooLarge, []byte("value")), ErrKeyTooLarge)
+	txn := db.BeginTxn()
+	require.ErrorIs(t, txn.Put(tooLarge, []byte("value")), ErrKeyTooLarge)
+	txn.Discard()
+	itr := &sliceIngestIterator{keys: [][]byte{tooLarge}, values: [][]byte{[]byte("value")}}
+	require.ErrorIs(t, db.IngestSorted(itr, DefaultIngestOptions), ErrKeyTooLarge)
+
+	// the key at the limit is read from the index and value log after flush
+	key := tooLarge[:MaxKeySize]
+	require.NoError(t, db.PutWithTTL(key, record.value, time.Hour))
+	db.flushMemtable(db.activeMem)
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, record.value, value)
 }
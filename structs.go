@@ -2,8 +2,10 @@ package lotusdb
 
 import (
 	"encoding/binary"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lotusdblabs/bbolt"
 	"github.com/rosedblabs/wal"
 )
 
@@ -17,36 +19,83 @@ const (
 	LogRecordDeleted
 	// LogRecordBatchFinished is the batch finished log record type.
 	LogRecordBatchFinished
+	// LogRecordMerge is the merge log record type, its value holds the merge operands.
+	LogRecordMerge
+	// LogRecordRangeDeleted is the range tombstone log record type,
+	// its key is the start of the range and its value is the end of the range.
+	LogRecordRangeDeleted
 )
 
-// type batchId keySize valueSize
+const (
+	// logRecordColumnFamilyFlag is set in the type of an encoded log record
+	// if the record belongs to a column family other than the default one.
+	logRecordColumnFamilyFlag = 0x80
+	// logRecordExpireFlag is set in the type of an encoded log record if the record has an expiration time,
+	// so the records written before ttl is supported are read as never expire.
+	logRecordExpireFlag = 0x20
+)
+
+// type columnFamily batchId expire keySize valueSize
 //
-//	1  +  10  +   5   +   5 = 21
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 1
+//	1  +     5      +  10  +  10  +   5   +   5 = 36
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64*2 + 1
 
 // LogRecord is the log record of the key/value pair.
-// It contains the key, the value, the record type and the batch id
+// It contains the key, the value, the record type, the batch id,
+// the expiration time(unix nano, 0 means never expire)
+// and the id of the column family(0 means the default column family).
 // It will be encoded to byte slice and written to the wal.
 type LogRecord struct {
-	Key     []byte
-	Value   []byte
-	Type    LogRecordType
-	BatchID uint64
+	Key          []byte
+	Value        []byte
+	Type         LogRecordType
+	BatchID      uint64
+	Expire       uint64
+	ColumnFamily uint32
+}
+
+// isExpired reports whether the expiration time has passed,
+// an expire of 0 means the entry never expires.
+func isExpired(expire uint64, now int64) bool {
+	return expire > 0 && expire <= uint64(now)
 }
 
-// +-------------+-------------+-------------+--------------+-------------+--------------+
-// |    type     |  batch id   |   key size  |   value size |      key    |      value   |
-// +-------------+-------------+-------------+--------------+-------------+--------------+
+// expireAt returns the expiration time of an entry written now with the given ttl.
+func expireAt(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).UnixNano())
+}
+
+// +-------------+---------------+-------------+-------------+-------------+--------------+-------------+--------------+
+// |    type     | column family |  batch id   |    expire   |   key size  |   value size |      key    |      value   |
+// +-------------+---------------+-------------+-------------+-------------+--------------+-------------+--------------+
 //
-//	1 byte	      varint(max 10) varint(max 5)  varint(max 5)     varint		varint
+//	1 byte	      varint(max 5)  varint(max 10) varint(max 10) varint(max 5)  varint(max 5)     varint		varint
+//
+// The column family is only encoded if the record does not belong to the default column family,
+// which is marked by logRecordColumnFamilyFlag in the type.
+// The expire is only encoded if it is not 0, which is marked by logRecordExpireFlag in the type.
 func encodeLogRecord(logRecord *LogRecord) []byte {
 	header := make([]byte, maxLogRecordHeaderSize)
 
 	header[0] = logRecord.Type
 	var index = 1
 
+	// column family
+	if logRecord.ColumnFamily != defaultColumnFamilyID {
+		header[0] |= logRecordColumnFamilyFlag
+		index += binary.PutUvarint(header[index:], uint64(logRecord.ColumnFamily))
+	}
+
 	// batch id
 	index += binary.PutUvarint(header[index:], logRecord.BatchID)
+	// expire
+	if logRecord.Expire != 0 {
+		header[0] |= logRecordExpireFlag
+		index += binary.PutUvarint(header[index:], logRecord.Expire)
+	}
 	// key size
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	// value size
@@ -70,10 +119,27 @@ func decodeLogRecord(buf []byte) *LogRecord {
 	recordType := buf[0]
 
 	var index uint32 = 1
+	// column family
+	var columnFamily uint64
+	if recordType&logRecordColumnFamilyFlag != 0 {
+		recordType &^= logRecordColumnFamilyFlag
+		var n int
+		columnFamily, n = binary.Uvarint(buf[index:])
+		index += uint32(n)
+	}
+
 	// batch id
 	batchID, n := binary.Uvarint(buf[index:])
 	index += uint32(n)
 
+	// expire
+	var expire uint64
+	if recordType&logRecordExpireFlag != 0 {
+		recordType &^= logRecordExpireFlag
+		expire, n = binary.Uvarint(buf[index:])
+		index += uint32(n)
+	}
+
 	// key size
 	keySize, n := binary.Varint(buf[index:])
 	index += uint32(n)
@@ -91,8 +157,8 @@ func decodeLogRecord(buf []byte) *LogRecord {
 	value := make([]byte, valueSize)
 	copy(value, buf[index:index+uint32(valueSize)])
 
-	return &LogRecord{Key: key, Value: value,
-		BatchID: batchID, Type: recordType}
+	return &LogRecord{Key: key, Value: value, BatchID: batchID,
+		Type: recordType, Expire: expire, ColumnFamily: uint32(columnFamily)}
 }
 
 // KeyPosition is the position of the key in the value log.
@@ -100,55 +166,134 @@ type KeyPosition struct {
 	key       []byte
 	partition uint32
 	uid       uuid.UUID
+	expire    uint64
 	position  *wal.ChunkPosition
 }
 
 // ValueLogRecord is the record of the key/value pair in the value log.
 type ValueLogRecord struct {
-	uid   uuid.UUID
-	key   []byte
-	value []byte
+	uid    uuid.UUID
+	key    []byte
+	value  []byte
+	expire uint64
 }
 
-func encodeValueLogRecord(record *ValueLogRecord) []byte {
+// valueLogRecordCompressionShift is the bit offset of the compression algorithm in the key size,
+// the high byte of the key size holds the compression algorithm of the value and the flags of the record,
+// so the records written before compression is supported are read as uncompressed.
+const (
+	valueLogRecordCompressionShift = 24
+	valueLogRecordCompressionMask  = 1<<6 - 1
+	valueLogRecordKeySizeMask      = 1<<valueLogRecordCompressionShift - 1
+
+	// valueLogRecordExpireFlag is set in the key size if the record has an expiration time,
+	// so the records written before ttl is supported are read as never expire.
+	valueLogRecordExpireFlag = 1 << 30
+)
+
+// MaxKeySize is the max size of a key, ErrKeyTooLarge is returned if a larger key is written.
+// It is the max key size of the bptree index, the key sizes in the memtables and the value log records
+// are limited by their encoding as well, see valueLogRecordKeySizeMask, which are larger than it.
+const MaxKeySize = bbolt.MaxKeySize
+
+// checkKey checks whether the key can be written, it returns ErrKeyIsEmpty or ErrKeyTooLarge if not.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// valueLogRecordHeaderSize returns the size of the header(uid, key size and expire) of the encoded
+// value log record, the expire is only encoded if valueLogRecordExpireFlag is set in the key size.
+// The buf must hold the uid and key size at least.
+func valueLogRecordHeaderSize(buf []byte) int {
+	size := 16 + 4
+	if binary.LittleEndian.Uint32(buf[16:])&valueLogRecordExpireFlag != 0 {
+		size += 8
+	}
+	return size
+}
+
+// +-------------+-------------+-------------+-------------+--------------+
+// |     uid     |   key size  |    expire   |      key    |      value   |
+// +-------------+-------------+-------------+-------------+--------------+
+//
+//	16 bytes      4 bytes       8 bytes        varint		varint
+//
+// The value is compressed by the compression algorithm, which is recorded in the high byte of key size.
+// The expire is only encoded if it is not 0, which is marked by valueLogRecordExpireFlag in the key size.
+func encodeValueLogRecord(record *ValueLogRecord, compression Compression) []byte {
 	keySize := 4
+	expireSize := 0
 	index := 0
+	value, compression := compressValue(record.value, compression)
 	uidBytes, _ := record.uid.MarshalBinary()
-	buf := make([]byte, len(uidBytes)+4+len(record.key)+len(record.value))
+	keySizeValue := uint32(compression)<<valueLogRecordCompressionShift | uint32(len(record.key))
+	if record.expire != 0 {
+		keySizeValue |= valueLogRecordExpireFlag
+		expireSize = 8
+	}
+	buf := make([]byte, len(uidBytes)+keySize+expireSize+len(record.key)+len(value))
 
 	copy(buf[index:], uidBytes)
 	index += len(uidBytes)
 
-	binary.LittleEndian.PutUint32(buf[index:index+keySize], uint32(len(record.key)))
+	binary.LittleEndian.PutUint32(buf[index:index+keySize], keySizeValue)
 	index += keySize
 
+	if expireSize > 0 {
+		binary.LittleEndian.PutUint64(buf[index:index+expireSize], record.expire)
+		index += expireSize
+	}
+
 	copy(buf[index:index+len(record.key)], record.key)
 	index += len(record.key)
 
-	copy(buf[index:], record.value)
+	copy(buf[index:], value)
 	return buf
 }
 
-func decodeValueLogRecord(buf []byte) *ValueLogRecord {
+func decodeValueLogRecord(buf []byte) (*ValueLogRecord, error) {
 	keySize := 4
 	index := 0
 	var uid uuid.UUID
 	uidBytes := buf[:len(uid)]
 	err := uid.UnmarshalBinary(uidBytes)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	index += len(uid)
 
-	keyLen := (int)(binary.LittleEndian.Uint32(buf[index : index+keySize]))
+	keySizeValue := binary.LittleEndian.Uint32(buf[index : index+keySize])
+	// the encrypted record must be decrypted first, see valueLog.decodeRecord.
+	if keySizeValue&valueLogRecordEncryptedFlag != 0 {
+		return nil, ErrEncryptionKeyRequired
+	}
+	keyLen := int(keySizeValue & valueLogRecordKeySizeMask)
+	compression := Compression(keySizeValue >> valueLogRecordCompressionShift & valueLogRecordCompressionMask)
 	index += keySize
 
+	var expire uint64
+	if keySizeValue&valueLogRecordExpireFlag != 0 {
+		expire = binary.LittleEndian.Uint64(buf[index:])
+		index += 8
+	}
+
 	key := make([]byte, keyLen)
 	copy(key, buf[index:index+keyLen])
 	index += keyLen
 
-	value := make([]byte, len(buf)-len(uid)-keyLen-keySize)
-	copy(value, buf[index:])
+	var value []byte
+	if compression == NoCompression {
+		value = make([]byte, len(buf)-index)
+		copy(value, buf[index:])
+	} else if value, err = decompressValue(buf[index:], compression); err != nil {
+		return nil, err
+	}
 
-	return &ValueLogRecord{uid: uid, key: key, value: value}
+	return &ValueLogRecord{uid: uid, key: key, value: value, expire: expire}, nil
 }
@@ -0,0 +1,370 @@
+package lotusdb
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"time"
+)
+
+// Txn is an optimistic transaction of the database.
+//
+// All reads in the transaction are served from a snapshot taken when the transaction begins,
+// and the writes are buffered in the transaction until Commit.
+// Commit will fail with ErrTxnConflict if any key read by the transaction
+// was modified by another commit since the transaction began,
+// or any key in the ranges iterated by the transaction, see Txn.NewIterator.
+// Then you can retry the whole transaction.
+//
+// The writes of a transaction are committed as a batch, so it guarantees atomicity,
+// consistency, isolation(snapshot isolation) and durability(if the Sync options is true).
+//
+// You must call Commit or Discard method to finish the transaction,
+// otherwise the snapshot held by the transaction will not be released.
+type Txn struct {
+	db            *DB
+	snapshot      *Snapshot
+	pendingWrites map[string]*LogRecord // keyed by the family key, the same as Batch
+	reads         map[string]struct{}   // family keys read by the transaction
+	readRanges    []keyRange            // ranges of family keys iterated by the transaction
+	ingested      []keyRange            // ranges ingested while the transaction is active, protected by oracle.mu
+	options       WriteOptions
+	mu            sync.Mutex
+	finished      bool
+}
+
+// txnOracle tracks the commit sequence number of keys written
+// while there are active transactions, for conflict detection.
+type txnOracle struct {
+	mu              sync.Mutex
+	activeTxns      map[*Txn]struct{}
+	committedKeys   map[string]uint64 // key -> commit sequence number of its last write
+	committedRanges []*rangeTombstone // range tombstones committed while there are active transactions
+}
+
+// keyRange is the range [start, end) of family keys, see familyKey.
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// contains checks whether the key is in the range.
+func (r keyRange) contains(key []byte) bool {
+	return keyInRange(key, r.start, r.end)
+}
+
+// overlaps checks whether the range overlaps [start, end).
+func (r keyRange) overlaps(start, end []byte) bool {
+	return bytes.Compare(r.start, end) < 0 && bytes.Compare(start, r.end) < 0
+}
+
+func newTxnOracle() *txnOracle {
+	return &txnOracle{
+		activeTxns:    make(map[*Txn]struct{}),
+		committedKeys: make(map[string]uint64),
+	}
+}
+
+// BeginTxn begin a transaction with defaultWriteOptions.
+func (db *DB) BeginTxn() *Txn {
+	return db.BeginTxnWithOptions(DefaultWriteOptions)
+}
+
+// BeginTxnWithOptions begin a transaction, the options will be used when committing.
+func (db *DB) BeginTxnWithOptions(options WriteOptions) *Txn {
+	txn := &Txn{
+		db:            db,
+		pendingWrites: make(map[string]*LogRecord),
+		reads:         make(map[string]struct{}),
+		options:       options,
+	}
+	// register the transaction before taking the snapshot,
+	// so no commit after the snapshot will be missed.
+	db.oracle.mu.Lock()
+	db.oracle.activeTxns[txn] = struct{}{}
+	db.oracle.mu.Unlock()
+	snapshot := db.NewSnapshot()
+	db.oracle.mu.Lock()
+	txn.snapshot = snapshot
+	db.oracle.mu.Unlock()
+	return txn
+}
+
+// Put adds a key-value pair to the transaction for writing.
+func (txn *Txn) Put(key []byte, value []byte) error {
+	return txn.PutWithTTL(key, value, txn.options.TTL)
+}
+
+// PutWithTTL adds a key-value pair with the specified ttl to the transaction for writing.
+func (txn *Txn) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return txn.write(&LogRecord{
+		Key:    key,
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expireAt(ttl),
+	})
+}
+
+// Delete marks a key for deletion in the transaction.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.write(&LogRecord{
+		Key:  key,
+		Type: LogRecordDeleted,
+	})
+}
+
+func (txn *Txn) write(record *LogRecord) error {
+	if err := checkKey(record.Key); err != nil {
+		return err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.pendingWrites[string(familyKey(record.ColumnFamily, record.Key))] = record
+	return nil
+}
+
+// Get retrieves the value of the key from the transaction,
+// the key will be tracked for conflict detection.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	// get from pendingWrites
+	fkey := string(familyKey(defaultColumnFamilyID, key))
+	if record := txn.pendingWrites[fkey]; record != nil {
+		if record.Type == LogRecordDeleted || isExpired(record.Expire, time.Now().UnixNano()) {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	txn.reads[fkey] = struct{}{}
+	return txn.db.GetWithOptions(key, ReadOptions{Snapshot: txn.snapshot})
+}
+
+// Exist checks if the key exists in the transaction,
+// the key will be tracked for conflict detection.
+func (txn *Txn) Exist(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return false, ErrTxnFinished
+	}
+
+	// check if the key exists in pendingWrites
+	fkey := string(familyKey(defaultColumnFamilyID, key))
+	if record := txn.pendingWrites[fkey]; record != nil {
+		return record.Type != LogRecordDeleted && !isExpired(record.Expire, time.Now().UnixNano()), nil
+	}
+
+	txn.reads[fkey] = struct{}{}
+	return txn.db.ExistWithOptions(key, ReadOptions{Snapshot: txn.snapshot})
+}
+
+// NewIterator returns an iterator of the default column family, which reads the snapshot of the transaction,
+// options.Snapshot is ignored. The pending writes of the transaction are invisible to the iterator.
+//
+// The whole range of the iterator is tracked for conflict detection, no matter how many keys are read,
+// so Commit fails if any key in the range is written by another commit since the transaction began,
+// including the keys which did not exist when iterating.
+// The iterator must be closed before the transaction is finished.
+func (txn *Txn) NewIterator(options IteratorOptions) (*Iterator, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	lower, upper := iterateBounds(options)
+	readRange := keyRange{start: familyKey(defaultColumnFamilyID, lower)}
+	if upper != nil {
+		readRange.end = familyKey(defaultColumnFamilyID, upper)
+	} else {
+		readRange.end = familyKey(defaultColumnFamilyID+1, nil)
+	}
+	txn.readRanges = append(txn.readRanges, readRange)
+	options.Snapshot = txn.snapshot
+	return txn.db.NewIterator(options)
+}
+
+// Commit commits the transaction.
+// It will return ErrTxnConflict if any key read by the transaction
+// was modified by another commit since the transaction began,
+// and nothing will be written in this case.
+// A transaction without any writes has nothing to commit, so it never conflicts.
+//
+// The transaction is finished after Commit, whether it succeeds or not.
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	defer txn.finish()
+
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+
+	db := txn.db
+	batch, ok := db.batchPool.Get().(*Batch)
+	if !ok {
+		panic("batchPoll.Get failed")
+	}
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// the db lock is held until the batch is committed,
+	// so no other commits can happen between the conflict detection and our commit.
+	batch.init(false, false, false, db)
+	batch.options.WriteOptions = txn.options
+	if txn.hasConflict() {
+		batch.Discard()
+		return ErrTxnConflict
+	}
+	batch.pendingWrites = txn.pendingWrites
+	return batch.Commit()
+}
+
+// Discard discards the transaction, all the pending writes will be dropped.
+// It is safe to call Discard after Commit.
+func (txn *Txn) Discard() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if !txn.finished {
+		txn.finish()
+	}
+}
+
+// hasConflict checks whether any key read by the transaction, or in the ranges iterated by it,
+// was committed or ingested after the snapshot of the transaction.
+func (txn *Txn) hasConflict() bool {
+	oracle := txn.db.oracle
+	oracle.mu.Lock()
+	defer oracle.mu.Unlock()
+	for key := range txn.reads {
+		if seq, ok := oracle.committedKeys[key]; ok && seq > txn.snapshot.seq {
+			return true
+		}
+		for _, tombstone := range oracle.committedRanges {
+			if tombstone.seq > txn.snapshot.seq && tombstone.contains([]byte(key)) {
+				return true
+			}
+		}
+		for _, ingested := range txn.ingested {
+			if ingested.contains([]byte(key)) {
+				return true
+			}
+		}
+	}
+
+	for _, readRange := range txn.readRanges {
+		for key, seq := range oracle.committedKeys {
+			if seq > txn.snapshot.seq && readRange.contains([]byte(key)) {
+				return true
+			}
+		}
+		for _, tombstone := range oracle.committedRanges {
+			if tombstone.seq > txn.snapshot.seq && readRange.overlaps(tombstone.start, tombstone.end) {
+				return true
+			}
+		}
+		for _, ingested := range txn.ingested {
+			if readRange.overlaps(ingested.start, ingested.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// finish releases the snapshot and unregisters the transaction, must be called with txn.mu held.
+func (txn *Txn) finish() {
+	txn.finished = true
+	txn.snapshot.Release()
+	txn.db.oracle.done(txn)
+	txn.pendingWrites = nil
+	txn.reads = nil
+	txn.readRanges = nil
+}
+
+// done unregisters the finished transaction, and removes the committed keys
+// which are older than all the active transactions.
+func (o *txnOracle) done(txn *Txn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.activeTxns, txn)
+	if len(o.activeTxns) == 0 {
+		o.committedKeys = make(map[string]uint64)
+		o.committedRanges = nil
+		return
+	}
+	// the transactions without snapshot yet will read at a sequence number
+	// not less than any recorded one, so they can be ignored.
+	minSeq := uint64(math.MaxUint64)
+	for active := range o.activeTxns {
+		if active.snapshot != nil && active.snapshot.seq < minSeq {
+			minSeq = active.snapshot.seq
+		}
+	}
+	for key, seq := range o.committedKeys {
+		if seq <= minSeq {
+			delete(o.committedKeys, key)
+		}
+	}
+	ranges := o.committedRanges[:0]
+	for _, tombstone := range o.committedRanges {
+		if tombstone.seq > minSeq {
+			ranges = append(ranges, tombstone)
+		}
+	}
+	o.committedRanges = ranges
+}
+
+// recordCommit records the keys and ranges written by a committed batch, if there are active transactions.
+func (o *txnOracle) recordCommit(pendingWrites map[string]*LogRecord, rangeDeletes []*LogRecord, seq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.activeTxns) == 0 {
+		return
+	}
+	for key := range pendingWrites {
+		o.committedKeys[key] = seq
+	}
+	for _, record := range rangeDeletes {
+		o.committedRanges = append(o.committedRanges, newRangeTombstone(record, seq))
+	}
+}
+
+// recordIngest records the range of the keys ingested to the column family for the active transactions,
+// the keys from first to last are ingested without a commit sequence number, see DB.IngestSorted.
+// The transactions are conflicted with the whole range, which may cause a few needless conflicts,
+// but the ingested keys are not held in memory.
+func (o *txnOracle) recordIngest(familyID uint32, first, last []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.activeTxns) == 0 {
+		return
+	}
+	ingested := keyRange{
+		start: familyKey(familyID, first),
+		// the smallest key greater than last
+		end: familyKey(familyID, append(bytes.Clone(last), 0)),
+	}
+	for txn := range o.activeTxns {
+		txn.ingested = append(txn.ingested, ingested)
+	}
+}
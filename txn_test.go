@@ -0,0 +1,248 @@
+package lotusdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnCommit(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-txn-commit")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1")))
+	require.NoError(t, db.Put([]byte("key 2"), []byte("value 2")))
+
+	txn := db.BeginTxn()
+	value, err := txn.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1"), value)
+	require.NoError(t, txn.Put([]byte("key 1"), []byte("value 1 new")))
+	require.NoError(t, txn.Delete([]byte("key 2")))
+	require.NoError(t, txn.Put([]byte("key 3"), []byte("value 3")))
+
+	// read your own writes
+	value, err = txn.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1 new"), value)
+	exist, err := txn.Exist([]byte("key 2"))
+	require.NoError(t, err)
+	assert.False(t, exist)
+
+	// the writes are invisible before commit
+	value, err = db.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1"), value)
+	_, err = db.Get([]byte("key 3"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, txn.Commit())
+	value, err = db.Get([]byte("key 1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 1 new"), value)
+	_, err = db.Get([]byte("key 2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	value, err = db.Get([]byte("key 3"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value 3"), value)
+
+	// the transaction is finished
+	require.ErrorIs(t, txn.Commit(), ErrTxnFinished)
+	require.ErrorIs(t, txn.Put([]byte("key 4"), []byte("value 4")), ErrTxnFinished)
+	_, err = txn.Get([]byte("key 1"))
+	require.ErrorIs(t, err, ErrTxnFinished)
+	txn.Discard()
+	assert.Empty(t, db.getSnapshots())
+	assert.Empty(t, db.oracle.activeTxns)
+}
+
+func TestTxnConflict(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-txn-conflict")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("counter"), []byte("0")))
+
+	t.Run("read key modified by db", func(t *testing.T) {
+		txn := db.BeginTxn()
+		_, errGet := txn.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		require.NoError(t, db.Put([]byte("counter"), []byte("1")))
+
+		// the transaction still reads from its snapshot
+		value, errGet := txn.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("0"), value)
+
+		require.NoError(t, txn.Put([]byte("counter"), []byte("2")))
+		require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+		value, errGet = db.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("1"), value)
+	})
+
+	t.Run("read key modified by another txn", func(t *testing.T) {
+		txn1 := db.BeginTxn()
+		txn2 := db.BeginTxn()
+		exist, errExist := txn1.Exist([]byte("missing"))
+		require.NoError(t, errExist)
+		assert.False(t, exist)
+		require.NoError(t, txn1.Put([]byte("result"), []byte("txn1")))
+		require.NoError(t, txn2.Put([]byte("missing"), []byte("txn2")))
+
+		require.NoError(t, txn2.Commit())
+		require.ErrorIs(t, txn1.Commit(), ErrTxnConflict)
+		_, errGet := db.Get([]byte("result"))
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	})
+
+	t.Run("modified after flush", func(t *testing.T) {
+		txn := db.BeginTxn()
+		_, errGet := txn.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		require.NoError(t, txn.Put([]byte("result"), []byte("3")))
+		require.NoError(t, db.Put([]byte("counter"), []byte("3")))
+		db.flushMemtable(db.activeMem)
+		require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+	})
+
+	t.Run("read key deleted by range", func(t *testing.T) {
+		txn := db.BeginTxn()
+		_, errGet := txn.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		require.NoError(t, txn.Put([]byte("result"), []byte("4")))
+		require.NoError(t, db.DropPrefix([]byte("count")))
+		require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+	})
+
+	t.Run("blind writes do not conflict", func(t *testing.T) {
+		txn := db.BeginTxn()
+		require.NoError(t, txn.Put([]byte("counter"), []byte("4")))
+		require.NoError(t, db.Put([]byte("counter"), []byte("5")))
+		require.NoError(t, txn.Commit())
+		value, errGet := db.Get([]byte("counter"))
+		require.NoError(t, errGet)
+		assert.Equal(t, []byte("4"), value)
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		txn := db.BeginTxn()
+		require.NoError(t, txn.Put([]byte("discarded"), []byte("value")))
+		txn.Discard()
+		require.ErrorIs(t, txn.Commit(), ErrTxnFinished)
+		_, errGet := db.Get([]byte("discarded"))
+		require.ErrorIs(t, errGet, ErrKeyNotFound)
+	})
+
+	assert.Empty(t, db.getSnapshots())
+	assert.Empty(t, db.oracle.activeTxns)
+	assert.Empty(t, db.oracle.committedKeys)
+	assert.Empty(t, db.oracle.committedRanges)
+}
+
+func TestTxnIteratorConflict(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-txn-iterator")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("a 1"), []byte("value")))
+	require.NoError(t, db.Put([]byte("b 1"), []byte("value")))
+
+	scan := func(txn *Txn, prefix string) int {
+		iter, errIter := txn.NewIterator(IteratorOptions{Prefix: []byte(prefix)})
+		require.NoError(t, errIter)
+		defer func() { require.NoError(t, iter.Close()) }()
+		count := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			count++
+		}
+		return count
+	}
+
+	// a key inserted into the iterated range conflicts, even if it did not exist when iterating.
+	txn := db.BeginTxn()
+	assert.Equal(t, 1, scan(txn, "a"))
+	require.NoError(t, txn.Put([]byte("count"), []byte("1")))
+	require.NoError(t, db.Put([]byte("a 2"), []byte("value")))
+	// the iterator reads the snapshot of the transaction.
+	assert.Equal(t, 1, scan(txn, "a"))
+	require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+
+	// the writes out of the range do not conflict.
+	txn = db.BeginTxn()
+	assert.Equal(t, 1, scan(txn, "b"))
+	require.NoError(t, txn.Put([]byte("count"), []byte("1")))
+	require.NoError(t, db.Put([]byte("a 3"), []byte("value")))
+	require.NoError(t, txn.Commit())
+
+	// a range deletion overlapping the range conflicts.
+	txn = db.BeginTxn()
+	assert.Equal(t, 1, scan(txn, "b"))
+	require.NoError(t, txn.Put([]byte("count"), []byte("1")))
+	require.NoError(t, db.DeleteRange([]byte("a"), []byte("b 0")))
+	require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+}
+
+func TestTxnIngestConflict(t *testing.T) {
+	options := DefaultOptions
+	path, err := os.MkdirTemp("", "db-test-txn-ingest")
+	require.NoError(t, err)
+	options.DirPath = path
+
+	db, err := Open(options)
+	require.NoError(t, err)
+	defer destroyDB(db)
+
+	require.NoError(t, db.Put([]byte("key 1"), []byte("value 1")))
+	ingest := func(keys ...string) {
+		itr := &sliceIngestIterator{}
+		for _, key := range keys {
+			itr.keys = append(itr.keys, []byte(key))
+			itr.values = append(itr.values, []byte("ingested"))
+		}
+		require.NoError(t, db.IngestSorted(itr, DefaultIngestOptions))
+	}
+
+	txn := db.BeginTxn()
+	_, err = txn.Get([]byte("key 1"))
+	require.NoError(t, err)
+	require.NoError(t, txn.Put([]byte("key 2"), []byte("value 2")))
+	ingest("key 0", "key 1")
+	require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+
+	txn = db.BeginTxn()
+	_, err = txn.Get([]byte("key 1"))
+	require.NoError(t, err)
+	require.NoError(t, txn.Put([]byte("key 2"), []byte("value 2")))
+	ingest("key 3", "key 4")
+	require.NoError(t, txn.Commit())
+
+	// the keys imported are committed by batches, they conflict like the other commits.
+	export := new(bytes.Buffer)
+	require.NoError(t, db.Export(export, ExportOptions{}))
+	txn = db.BeginTxn()
+	_, err = txn.Get([]byte("key 1"))
+	require.NoError(t, err)
+	require.NoError(t, txn.Put([]byte("key 5"), []byte("value 5")))
+	require.NoError(t, db.Import(export, DefaultImportOptions))
+	require.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+}
@@ -0,0 +1,330 @@
+package lotusdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/lotusdblabs/bbolt"
+	"github.com/rosedblabs/diskhash"
+	"github.com/rosedblabs/wal"
+)
+
+// VerifyIssueKind is the kind of an issue found by DB.Verify.
+type VerifyIssueKind uint8
+
+const (
+	// VerifyCorruptedIndexEntry means the value of an index entry can not be decoded.
+	VerifyCorruptedIndexEntry VerifyIssueKind = iota
+	// VerifyDanglingPosition means an index entry points to a chunk which can not be read from the value log,
+	// e.g. the chunk is beyond the value log file, or its crc is mismatched.
+	VerifyDanglingPosition
+	// VerifyKeyMismatch means an index entry points to a record of another key or another version.
+	VerifyKeyMismatch
+	// VerifyCorruptedRecord means a chunk in the value log is read, but can not be decoded to a record,
+	// or a chunk can not be read when scanning the value log.
+	VerifyCorruptedRecord
+	// VerifyOrphanedRecord means a record in the value log is referenced by neither the index nor a snapshot.
+	VerifyOrphanedRecord
+)
+
+// String returns the name of the issue kind.
+func (k VerifyIssueKind) String() string {
+	switch k {
+	case VerifyCorruptedIndexEntry:
+		return "corrupted index entry"
+	case VerifyDanglingPosition:
+		return "dangling position"
+	case VerifyKeyMismatch:
+		return "key mismatch"
+	case VerifyCorruptedRecord:
+		return "corrupted record"
+	case VerifyOrphanedRecord:
+		return "orphaned record"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyIssue is an issue found by DB.Verify.
+type VerifyIssue struct {
+	Kind VerifyIssueKind
+	// ColumnFamily is the name of the column family of the issue.
+	ColumnFamily string
+	// Partition is the partition of the index and value log of the issue.
+	Partition int
+	// Key is the key of the index entry or the record, it is nil if the key is unknown,
+	// e.g. a dangling position in the hash index, which only stores the hash of keys.
+	Key []byte
+	// Position is the position of the chunk in the value log, nil for VerifyCorruptedIndexEntry.
+	Position *wal.ChunkPosition
+	// Err is the error of reading or decoding, nil for VerifyKeyMismatch and VerifyOrphanedRecord.
+	Err error
+}
+
+// VerifyReport is the result of DB.Verify.
+type VerifyReport struct {
+	// IndexEntries is the number of the index entries verified.
+	IndexEntries int
+	// ValueLogRecords is the number of the records read when scanning the value logs.
+	ValueLogRecords int
+	// Issues are the issues found, sorted by column family and partition.
+	Issues []VerifyIssue
+	// Truncated is true if the verification is stopped after VerifyOptions.MaxIssues issues are found.
+	Truncated bool
+}
+
+// OK reports whether no issue is found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Verify checks the integrity of the index and value log of all column families.
+//
+// Every entry of the bptree index is checked: its value is decoded, the chunk it points to
+// is read from the value log, which checks the crc of the chunk,
+// and the key and version of the record must be the same as the entry.
+// If VerifyOptions.CheckOrphans is set, the value logs are scanned to find the records
+// referenced by neither the index nor a snapshot.
+//
+// The hash index only stores the hash of keys, so it can not be walked,
+// the value logs are always scanned, and the index entries are verified through the keys in them.
+//
+// The issues are reported in the VerifyReport, the error is only returned if
+// the verification can not go on, e.g. the database is closed or the context is done.
+// The writes can go on while verifying, but the memtables are not flushed until it is finished,
+// so the writes may wait for memtable space if the verification takes too long.
+func (db *DB) Verify(ctx context.Context, options VerifyOptions) (*VerifyReport, error) {
+	// the flush lock keeps the index and value logs from changing, the compaction also waits for it.
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return nil, ErrDBClosed
+	}
+
+	v := &verifier{db: db, ctx: ctx, options: options, report: &VerifyReport{}, kept: db.snapshotRecords()}
+	for _, cf := range db.getFamilies() {
+		var err error
+		switch index := cf.index.(type) {
+		case *BPTree:
+			err = v.verifyBPTree(cf, index)
+		case *HashTable:
+			err = v.verifyHashTable(cf, index)
+		default:
+			panic("index type not support")
+		}
+		if errors.Is(err, errVerifyTruncated) {
+			v.report.Truncated = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v.report, nil
+}
+
+// errVerifyTruncated stops the verification after VerifyOptions.MaxIssues issues are found.
+var errVerifyTruncated = errors.New("too many issues")
+
+// chunkID identifies the chunk at the position, the chunk size is excluded,
+// because the one returned by the wal reader is estimated, which may include the padding of the block.
+func chunkID(pos *wal.ChunkPosition) wal.ChunkPosition {
+	return wal.ChunkPosition{SegmentId: pos.SegmentId, BlockNumber: pos.BlockNumber, ChunkOffset: pos.ChunkOffset}
+}
+
+// verifier holds the state of DB.Verify.
+type verifier struct {
+	db      *DB
+	ctx     context.Context
+	options VerifyOptions
+	report  *VerifyReport
+	kept    map[uuid.UUID]struct{} // the value log records kept by the open snapshots
+}
+
+// addIssue adds the issue to the report, errVerifyTruncated is returned if there are too many issues.
+func (v *verifier) addIssue(issue VerifyIssue) error {
+	v.report.Issues = append(v.report.Issues, issue)
+	if v.options.MaxIssues > 0 && len(v.report.Issues) >= v.options.MaxIssues {
+		return errVerifyTruncated
+	}
+	return nil
+}
+
+// verifyBPTree walks all the entries of the bptree index,
+// and scans the value logs for the orphaned records if needed.
+func (v *verifier) verifyBPTree(cf *ColumnFamily, index *BPTree) error {
+	for part, tree := range index.trees {
+		// the positions referenced by the index, to find the orphaned records.
+		referenced := make(map[wal.ChunkPosition]struct{})
+		err := tree.View(func(tx *bbolt.Tx) error {
+			cursor := tx.Bucket(indexBucketName).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				if err := v.ctx.Err(); err != nil {
+					return err
+				}
+				v.report.IndexEntries++
+				// the key and value are only valid in the transaction
+				key = bytes.Clone(key)
+				keyPos, err := index.decodeValue(key, uint32(part), value)
+				if err == nil && keyPos.position == nil {
+					err = ErrChunkPositionCorrupted
+				}
+				if err != nil {
+					err = v.addIssue(VerifyIssue{Kind: VerifyCorruptedIndexEntry, ColumnFamily: cf.name,
+						Partition: part, Key: key, Err: err})
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				referenced[chunkID(keyPos.position)] = struct{}{}
+				if err = v.verifyPosition(cf, keyPos); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !v.options.CheckOrphans {
+			continue
+		}
+		err = v.scanValueLog(cf, part, func(_ *ValueLogRecord, pos *wal.ChunkPosition) (bool, error) {
+			_, ok := referenced[chunkID(pos)]
+			return ok, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyPosition reads the record at the position of the index entry, and checks its key and version.
+func (v *verifier) verifyPosition(cf *ColumnFamily, keyPos *KeyPosition) error {
+	issue := VerifyIssue{ColumnFamily: cf.name, Partition: int(keyPos.partition),
+		Key: keyPos.key, Position: keyPos.position}
+	buf, err := cf.vlog.readChunk(int(keyPos.partition), keyPos.position)
+	if err != nil {
+		issue.Kind, issue.Err = VerifyDanglingPosition, err
+		return v.addIssue(issue)
+	}
+	record, err := cf.vlog.decodeRecord(buf)
+	if err != nil {
+		issue.Kind, issue.Err = VerifyCorruptedRecord, err
+		return v.addIssue(issue)
+	}
+	if !bytes.Equal(record.key, keyPos.key) || record.uid != keyPos.uid {
+		issue.Kind = VerifyKeyMismatch
+		return v.addIssue(issue)
+	}
+	return nil
+}
+
+// verifyHashTable scans the value logs, and verifies the index entries through the keys in them.
+// A record is referenced by the index if a slot of its key points to it,
+// and all the slots with the same hash as the key are read to find the dangling positions.
+func (v *verifier) verifyHashTable(cf *ColumnFamily, index *HashTable) error {
+	for part, table := range index.tables {
+		// the checked slots, a slot is shared by all the keys with the same hash.
+		checked := make(map[wal.ChunkPosition]struct{})
+		err := v.scanValueLog(cf, part, func(record *ValueLogRecord, pos *wal.ChunkPosition) (bool, error) {
+			var current bool
+			var issues []VerifyIssue
+			err := table.Get(record.key, func(slot diskhash.Slot) (bool, error) {
+				position := wal.DecodeChunkPosition(slot.Value)
+				if chunkID(position) == chunkID(pos) {
+					current = true
+				}
+				if _, ok := checked[chunkID(position)]; ok {
+					return false, nil
+				}
+				checked[chunkID(position)] = struct{}{}
+				if _, errRead := cf.vlog.readChunk(part, position); errRead != nil {
+					issues = append(issues, VerifyIssue{Kind: VerifyDanglingPosition, ColumnFamily: cf.name,
+						Partition: part, Position: position, Err: errRead})
+				}
+				// go on to check the other slots with the same hash
+				return false, nil
+			})
+			if err != nil {
+				return false, err
+			}
+			if current {
+				v.report.IndexEntries++
+			}
+			for _, issue := range issues {
+				if err = v.addIssue(issue); err != nil {
+					return current, err
+				}
+			}
+			return current, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanValueLog reads all the records in the value log of the partition, and reports the corrupted records
+// and the orphaned ones if VerifyOptions.CheckOrphans is set, which are not referenced by the index nor a snapshot.
+// The rest of a segment is skipped if a chunk in it can not be read, because the next chunk is unknown.
+func (v *verifier) scanValueLog(cf *ColumnFamily, part int,
+	referenced func(record *ValueLogRecord, pos *wal.ChunkPosition) (bool, error)) error {
+	reader := cf.vlog.newReader(part)
+	// the segments rewritten by compaction are removed once no iterator reads them, their records are stale.
+	for obsolete := cf.vlog.obsolete[part]; obsolete > 0 && reader.CurrentSegmentId() <= obsolete; {
+		reader.SkipCurrentSegment()
+	}
+	for {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		chunk, pos, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			position := reader.CurrentChunkPosition()
+			if errIssue := v.addIssue(VerifyIssue{Kind: VerifyCorruptedRecord, ColumnFamily: cf.name,
+				Partition: part, Position: position, Err: err}); errIssue != nil {
+				return errIssue
+			}
+			reader.SkipCurrentSegment()
+			continue
+		}
+		v.report.ValueLogRecords++
+
+		record, err := cf.vlog.decodeRecord(chunk)
+		if err != nil {
+			if err = v.addIssue(VerifyIssue{Kind: VerifyCorruptedRecord, ColumnFamily: cf.name,
+				Partition: part, Position: pos, Err: err}); err != nil {
+				return err
+			}
+			continue
+		}
+		ok, err := referenced(record, pos)
+		if err != nil {
+			return err
+		}
+		if ok || !v.options.CheckOrphans {
+			continue
+		}
+		if _, kept := v.kept[record.uid]; kept {
+			continue
+		}
+		if err = v.addIssue(VerifyIssue{Kind: VerifyOrphanedRecord, ColumnFamily: cf.name,
+			Partition: part, Key: record.key, Position: pos}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package lotusdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/lotusdblabs/bbolt"
+	"github.com/rosedblabs/diskhash"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueKinds returns the kinds of the issues in the report.
+func issueKinds(report *VerifyReport) []VerifyIssueKind {
+	kinds := make([]VerifyIssueKind, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func TestDBVerify(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, Hash} {
+		t.Run(fmt.Sprintf("index type %d", indexType), func(t *testing.T) {
+			options := DefaultOptions
+			path, err := os.MkdirTemp("", "db-test-verify")
+			require.NoError(t, err)
+			options.DirPath = path
+			options.IndexType = indexType
+			options.PartitionNum = 1
+			db, err := Open(options)
+			require.NoError(t, err)
+			defer destroyDB(db)
+
+			ctx := context.Background()
+			put := func(keys ...int) {
+				for _, i := range keys {
+					require.NoError(t, db.Put([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i))))
+				}
+				db.flushMemtable(db.activeMem)
+			}
+			getPosition := func(key []byte) *KeyPosition {
+				var keyPos *KeyPosition
+				var matchKeys []diskhash.MatchKeyFunc
+				if indexType == Hash {
+					matchKeys = append(matchKeys, matchKeyFunc(db.vlog, key, &keyPos, nil))
+				}
+				pos, errGet := db.index.Get(key, matchKeys...)
+				require.NoError(t, errGet)
+				if pos != nil {
+					return pos
+				}
+				require.NotNil(t, keyPos)
+				return keyPos
+			}
+
+			put(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+			report, err := db.Verify(ctx, VerifyOptions{CheckOrphans: true})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			assert.Equal(t, 10, report.IndexEntries)
+			assert.Equal(t, 10, report.ValueLogRecords)
+
+			// the overwritten record is orphaned until it is compacted
+			put(0)
+			report, err = db.Verify(ctx, VerifyOptions{CheckOrphans: true})
+			require.NoError(t, err)
+			assert.Equal(t, []VerifyIssueKind{VerifyOrphanedRecord}, issueKinds(report))
+			assert.Equal(t, []byte("key 0"), report.Issues[0].Key)
+			assert.Equal(t, 11, report.ValueLogRecords)
+			report, err = db.Verify(ctx, VerifyOptions{})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			require.NoError(t, db.Compact())
+			report, err = db.Verify(ctx, VerifyOptions{CheckOrphans: true})
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+
+			// the record of key 9 is the last one in value log, corrupt its crc
+			put(9)
+			pos9 := getPosition([]byte("key 9")).position
+			file, err := os.OpenFile(wal.SegmentFileName(path, fmt.Sprintf(valueLogFileExt, 0), pos9.SegmentId),
+				os.O_RDWR, 0)
+			require.NoError(t, err)
+			offset := int64(pos9.BlockNumber)*walBlockSize + pos9.ChunkOffset + walChunkHeaderSize + 30
+			_, err = file.WriteAt([]byte{0xff}, offset)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+
+			pos2, pos3 := getPosition([]byte("key 2")), getPosition([]byte("key 3"))
+			var expected []VerifyIssueKind
+			switch index := db.index.(type) {
+			case *BPTree:
+				putIndex := func(key, value []byte) {
+					require.NoError(t, index.trees[0].Update(func(tx *bbolt.Tx) error {
+						errPut, _ := tx.Bucket(indexBucketName).Put(key, value)
+						return errPut
+					}))
+				}
+				putIndex([]byte("key 1"), []byte("corrupted"))
+				putIndex([]byte("key 2"), encodeIndexValue(&KeyPosition{uid: pos2.uid, position: pos3.position}))
+				expected = []VerifyIssueKind{VerifyCorruptedIndexEntry, VerifyKeyMismatch, VerifyDanglingPosition}
+			case *HashTable:
+				// the hash index only stores the positions, the slot of key 1 points to nowhere.
+				_, err = index.PutBatch([]*KeyPosition{{
+					key:      []byte("key 1"),
+					position: &wal.ChunkPosition{SegmentId: 100, ChunkSize: 10},
+				}}, matchKeyFunc(db.vlog, []byte("key 1"), nil, nil))
+				require.NoError(t, err)
+				// the slot of key 9 is found dangling through its overwritten record.
+				expected = []VerifyIssueKind{VerifyDanglingPosition, VerifyDanglingPosition, VerifyCorruptedRecord}
+			}
+
+			report, err = db.Verify(ctx, VerifyOptions{})
+			require.NoError(t, err)
+			assert.False(t, report.OK())
+			assert.Equal(t, expected, issueKinds(report))
+			for _, issue := range report.Issues {
+				assert.Equal(t, DefaultColumnFamilyName, issue.ColumnFamily)
+				if issue.Kind == VerifyDanglingPosition || issue.Kind == VerifyCorruptedRecord {
+					require.Error(t, issue.Err)
+				}
+			}
+			if indexType == BTree {
+				assert.Equal(t, []byte("key 2"), report.Issues[1].Key)
+			}
+			require.ErrorIs(t, report.Issues[2].Err, wal.ErrInvalidCRC)
+
+			report, err = db.Verify(ctx, VerifyOptions{MaxIssues: 1})
+			require.NoError(t, err)
+			assert.True(t, report.Truncated)
+			assert.Len(t, report.Issues, 1)
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err = db.Verify(canceled, VerifyOptions{})
+			require.ErrorIs(t, err, context.Canceled)
+
+			require.NoError(t, db.Close())
+			_, err = db.Verify(ctx, VerifyOptions{})
+			require.ErrorIs(t, err, ErrDBClosed)
+		})
+	}
+}
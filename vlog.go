@@ -3,6 +3,8 @@ package lotusdb
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/google/uuid"
 	"github.com/rosedblabs/wal"
@@ -10,18 +12,29 @@ import (
 )
 
 const (
-	valueLogFileExt     = ".VLOG.%d"
-	tempValueLogFileExt = ".VLOG.%d.temp"
+	valueLogFileExt = ".VLOG.%d"
+
+	// the chunk layout of the wal files, a chunk is split into several blocks
+	// with a header in every block if it crosses the block boundary.
+	walChunkHeaderSize = 7
+	walBlockSize       = 32 * KB
 )
 
 // valueLog value log is named after the concept in Wisckey paper
 // https://www.usenix.org/system/files/conference/fast16/fast16-papers-lu.pdf
 type valueLog struct {
 	walFiles         []*wal.WAL
+	views            []*walView // the partitions are opened as views in read only mode, walFiles is nil
 	dpTables         []*deprecatedtable
 	deprecatedNumber uint32
 	totalNumber      uint32
 	options          valueLogOptions
+	// the segments up to obsolete of every partition are rewritten by compaction,
+	// they are removed once no iterator reads them, see DB.removeObsoleteSegments.
+	obsolete []wal.SegmentID
+	// the segments up to interrupted of every partition are read by a stopped compaction, some records in them
+	// are rewritten to the newer segments, but not deprecated, so they are dropped by checking the index.
+	interrupted []wal.SegmentID
 }
 
 type valueLogOptions struct {
@@ -45,6 +58,18 @@ type valueLogOptions struct {
 
 	// total number
 	totalNumber uint32
+
+	// compression algorithm of the values, see Options.Compression.
+	compression Compression
+
+	// the values smaller than it are not compressed.
+	compressionMinSize int
+
+	// encrypt the keys and values, nil if the encryption is disabled.
+	encryptor *encryptor
+
+	// open the partitions as views, so their files are only read, see Options.ReadOnly.
+	readOnly bool
 }
 
 // open wal files for value log, it will open several wal files for concurrent writing and reading
@@ -52,19 +77,22 @@ type valueLogOptions struct {
 // init deprecatedtable for every wal, we should build dpTable aftering compacting vlog.
 func openValueLog(options valueLogOptions) (*valueLog, error) {
 	var walFiles []*wal.WAL
+	var views []*walView
 	var dpTables []*deprecatedtable
 	for i := 0; i < int(options.partitionNum); i++ {
-		vLogWal, err := wal.Open(wal.Options{
-			DirPath:        options.dirPath,
-			SegmentSize:    options.segmentSize,
-			SegmentFileExt: fmt.Sprintf(valueLogFileExt, i),
-			Sync:           false, // we will sync manually
-			BytesPerSync:   0,     // the same as Sync
-		})
-		if err != nil {
-			return nil, err
+		if options.readOnly {
+			view, err := openWalView(options.dirPath, fmt.Sprintf(valueLogFileExt, i))
+			if err != nil {
+				return nil, err
+			}
+			views = append(views, view)
+		} else {
+			vLogWal, err := openValueLogPartition(options, i)
+			if err != nil {
+				return nil, err
+			}
+			walFiles = append(walFiles, vLogWal)
 		}
-		walFiles = append(walFiles, vLogWal)
 		// init dpTable
 		dpTable := newDeprecatedTable(i)
 		dpTables = append(dpTables, dpTable)
@@ -72,20 +100,170 @@ func openValueLog(options valueLogOptions) (*valueLog, error) {
 
 	return &valueLog{
 		walFiles:         walFiles,
+		views:            views,
 		dpTables:         dpTables,
+		obsolete:         make([]wal.SegmentID, options.partitionNum),
+		interrupted:      make([]wal.SegmentID, options.partitionNum),
 		deprecatedNumber: options.deprecatedtableNumber,
 		totalNumber:      options.totalNumber,
 		options:          options}, nil
 }
 
+// openValueLogPartition opens the wal of the value log partition.
+func openValueLogPartition(options valueLogOptions, partition int) (*wal.WAL, error) {
+	return wal.Open(wal.Options{
+		DirPath:        options.dirPath,
+		SegmentSize:    options.segmentSize,
+		SegmentFileExt: fmt.Sprintf(valueLogFileExt, partition),
+		Sync:           false, // we will sync manually
+		BytesPerSync:   0,     // the same as Sync
+	})
+}
+
 // read the value log record from the specified position.
 func (vlog *valueLog) read(pos *KeyPosition) (*ValueLogRecord, error) {
-	buf, err := vlog.walFiles[pos.partition].Read(pos.position)
+	buf, err := vlog.readChunk(int(pos.partition), pos.position)
 	if err != nil {
 		return nil, err
 	}
-	log := decodeValueLogRecord(buf)
-	return log, nil
+	return vlog.decodeRecord(buf)
+}
+
+// readChunk reads the chunk at the position of the partition.
+func (vlog *valueLog) readChunk(partition int, pos *wal.ChunkPosition) ([]byte, error) {
+	if vlog.options.readOnly {
+		return vlog.views[partition].Read(pos)
+	}
+	return vlog.walFiles[partition].Read(pos)
+}
+
+// newReader returns a reader of all the records in the partition.
+func (vlog *valueLog) newReader(partition int) chunkReader {
+	if vlog.options.readOnly {
+		return vlog.views[partition].NewReader()
+	}
+	return vlog.walFiles[partition].NewReader()
+}
+
+// openReadView opens a view of the partition, which only reads the records written before it is opened,
+// so it can be read while the value log is being written. In read only mode, the view is shared.
+// It must be opened with db.flushLock held, and closed after reading, see HashTable.newIterator.
+func (vlog *valueLog) openReadView(partition int) (*walView, error) {
+	if vlog.options.readOnly {
+		return vlog.views[partition].share(), nil
+	}
+	return openWalView(vlog.options.dirPath, fmt.Sprintf(valueLogFileExt, partition))
+}
+
+// compactionReader starts a new segment of the partition, the valid records are rewritten to it by compaction.
+// It returns the last segment to be compacted and a reader of the records in the segments to be compacted,
+// the obsolete segments are skipped, their valid records are rewritten by the last compaction.
+func (vlog *valueLog) compactionReader(partition int) (*wal.Reader, wal.SegmentID, error) {
+	walFile := vlog.walFiles[partition]
+	if err := walFile.OpenNewActiveSegment(); err != nil {
+		return nil, 0, err
+	}
+	last := walFile.ActiveSegmentID() - 1
+	reader := walFile.NewReaderWithMax(last)
+	if last > vlog.obsolete[partition] {
+		for reader.CurrentSegmentId() <= vlog.obsolete[partition] {
+			reader.SkipCurrentSegment()
+		}
+	}
+	return reader, last, nil
+}
+
+// complete marks the segments of the partition up to last rewritten by compaction.
+func (vlog *valueLog) complete(partition int, last wal.SegmentID) {
+	vlog.obsolete[partition] = last
+	vlog.interrupted[partition] = 0
+}
+
+// interrupt marks the segments of the partition up to last read by a stopped compaction,
+// they are compacted again by the next compaction.
+func (vlog *valueLog) interrupt(partition int, last wal.SegmentID) {
+	vlog.interrupted[partition] = last
+}
+
+// removeObsoleteSegments removes the segments rewritten by compaction,
+// the wal of the partition is reopened, so no one can read it meanwhile.
+func (vlog *valueLog) removeObsoleteSegments() error {
+	for part, obsolete := range vlog.obsolete {
+		if obsolete == 0 {
+			continue
+		}
+		if err := vlog.walFiles[part].Close(); err != nil {
+			return err
+		}
+		if err := removeSegments(vlog.options.dirPath, fmt.Sprintf(valueLogFileExt, part), obsolete); err != nil {
+			return err
+		}
+		walFile, err := openValueLogPartition(vlog.options, part)
+		if err != nil {
+			return err
+		}
+		vlog.walFiles[part] = walFile
+		vlog.obsolete[part] = 0
+	}
+	return nil
+}
+
+// removeSegments removes the wal segments in dirPath with the ext whose ids are not greater than maxID.
+func removeSegments(dirPath, ext string, maxID wal.SegmentID) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var id wal.SegmentID
+		if _, err = fmt.Sscanf(entry.Name(), "%d"+ext, &id); err != nil || id > maxID ||
+			entry.Name() != filepath.Base(wal.SegmentFileName(dirPath, ext, id)) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeRecord encodes the value log record, the value is compressed if it is not smaller than compressionMinSize,
+// and the record is encrypted if the encryption is enabled.
+func (vlog *valueLog) encodeRecord(record *ValueLogRecord) ([]byte, error) {
+	compression := vlog.options.compression
+	if len(record.value) < vlog.options.compressionMinSize {
+		compression = NoCompression
+	}
+	return vlog.options.encryptor.encryptValueLogRecord(encodeValueLogRecord(record, compression))
+}
+
+// decodeRecord decrypts the value log record if it is encrypted, and decodes it.
+func (vlog *valueLog) decodeRecord(buf []byte) (*ValueLogRecord, error) {
+	buf, err := vlog.options.encryptor.decryptValueLogRecord(buf)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValueLogRecord(buf)
+}
+
+// valueSize returns the size of the value of the record at the position without reading it,
+// it is calculated from the size of the chunk, excluding the chunk headers and the record header.
+// The compressed size is returned if the value is compressed.
+// The encryption overhead is excluded if the encryption is enabled,
+// so the size of a record written before enabling it is underestimated until it is compacted.
+func (vlog *valueLog) valueSize(pos *KeyPosition) int {
+	chunk := pos.position
+	blocks := (chunk.ChunkOffset + int64(chunk.ChunkSize) + walBlockSize - 1) / walBlockSize
+	// uid + key size, and the expire if it is set, see encodeValueLogRecord.
+	headerSize := 16 + 4
+	if pos.expire != 0 {
+		headerSize += 8
+	}
+	size := int(chunk.ChunkSize) - int(blocks)*walChunkHeaderSize - headerSize - len(pos.key)
+	if vlog.options.encryptor != nil {
+		size -= encryptionOverhead
+	}
+	return max(size, 0)
 }
 
 // write the value log record to the value log, it will be separated to several partitions
@@ -124,7 +302,11 @@ func (vlog *valueLog) writeBatch(records []*ValueLogRecord) ([]*KeyPosition, err
 					err = ctx.Err()
 					return err
 				default:
-					vlog.walFiles[part].PendingWrites(encodeValueLogRecord(record))
+					var buf []byte
+					if buf, err = vlog.encodeRecord(record); err != nil {
+						return err
+					}
+					vlog.walFiles[part].PendingWrites(buf)
 				}
 			}
 			positions, err := vlog.walFiles[part].WriteAll()
@@ -136,6 +318,7 @@ func (vlog *valueLog) writeBatch(records []*ValueLogRecord) ([]*KeyPosition, err
 					key:       partitionRecords[part][writeIdx+i].key,
 					partition: uint32(part),
 					uid:       partitionRecords[part][writeIdx+i].uid,
+					expire:    partitionRecords[part][writeIdx+i].expire,
 					position:  pos,
 				})
 			}
@@ -170,12 +353,27 @@ func (vlog *valueLog) sync() error {
 }
 
 // close the value log.
+// close closes the wal files of the value log, and removes the segments rewritten by compaction.
 func (vlog *valueLog) close() error {
 	for _, walFile := range vlog.walFiles {
 		if err := walFile.Close(); err != nil {
 			return err
 		}
 	}
+	for _, view := range vlog.views {
+		if err := view.Close(); err != nil {
+			return err
+		}
+	}
+	for part, obsolete := range vlog.obsolete {
+		if obsolete == 0 {
+			continue
+		}
+		if err := removeSegments(vlog.options.dirPath, fmt.Sprintf(valueLogFileExt, part), obsolete); err != nil {
+			return err
+		}
+		vlog.obsolete[part] = 0
+	}
 	return nil
 }
 
@@ -193,6 +391,27 @@ func (vlog *valueLog) isDeprecated(partition int, id uuid.UUID) bool {
 	return vlog.dpTables[partition].existEntry(id)
 }
 
+// removeExpiredNumber removes the expired entries dropped by compaction from the total number.
+func (vlog *valueLog) removeExpiredNumber(expiredNumber uint32) {
+	if expiredNumber > vlog.totalNumber {
+		expiredNumber = vlog.totalNumber
+	}
+	vlog.totalNumber -= expiredNumber
+}
+
+// restoreDeprecated marks the records rewritten by compaction for the open snapshots deprecated again
+// after the deprecated table is cleaned, they are overwritten in index but still in the value log.
+// The deprecatedNumber of them were deprecated before compaction, they are added back to the total number,
+// because cleanDeprecatedTable removes them from it.
+func (vlog *valueLog) restoreDeprecated(uids [][]uuid.UUID, deprecatedNumber uint32) {
+	for part, partUIDs := range uids {
+		for _, uid := range partUIDs {
+			vlog.setDeprecated(uint32(part), uid)
+		}
+	}
+	vlog.totalNumber += deprecatedNumber
+}
+
 func (vlog *valueLog) cleanDeprecatedTable() {
 	for i := 0; i < int(vlog.options.partitionNum); i++ {
 		vlog.dpTables[i].clean()